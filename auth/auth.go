@@ -4,8 +4,11 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 )
 
@@ -14,55 +17,200 @@ type Authentication interface {
 	// Authenticate.
 	Authenticate(key, hostname string) (Permissions, error)
 
-	// Add a key.
+	// Add a key. Each allowed IP may be an exact IP, a CIDR block such as
+	// 10.0.0.0/8, or "*" to allow any IP.
 	AddKey(key string, allowedIPs []string, permissions Permissions)
+
+	// Add a key stored as its hash, as returned by HashKey, so the key
+	// itself doesn't need to be kept.
+	AddHashedKey(hash string, allowedIPs []string, permissions Permissions)
+
+	// Enable guest access: requests with a key that matches no other key are
+	// given the guest permissions, if they come from one of the allowed IPs.
+	// An empty list of IPs allows any IP.
+	SetGuest(allowedIPs []string, permissions Permissions)
+
+	// Disable guest access, rejecting unknown keys.
+	DisableGuest()
+
+	// Get the secret requests with a key must be signed with. Nil if the
+	// key has no secret.
+	HMACSecret(key string) []byte
+
+	// Set the secret requests with a key must be signed with. Nil removes
+	// the secret. Keys added as hashes are given by their hash.
+	SetHMACSecret(key string, secret []byte)
 }
 
 // Authentication implementation.
 type authentication struct {
 	keys map[string]authKey
+
+	// The keys stored as hashes, by hash.
+	hashedKeys map[string]authKey
+
+	// The guest permissions, if guest access is enabled.
+	guest *authKey
+
+	// The secrets requests must be signed with, by key.
+	hmacSecrets map[string][]byte
 }
 
 // An individual authentication key entry.
 type authKey struct {
 	allowedIPs  map[string]struct{}
+	allowedNets []*net.IPNet
+	allowAll    bool
 	permissions Permissions
 }
 
 // Create a new authentication manager.
 func NewAuthentication() Authentication {
-	return &authentication{keys: map[string]authKey{}}
+	return &authentication{keys: map[string]authKey{}, hashedKeys: map[string]authKey{}, hmacSecrets: map[string][]byte{}}
+}
+
+// Hash a key for storing in place of the key. The hash is the hex-encoded
+// SHA-256 of the key.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check if a string is a valid key hash.
+func IsKeyHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Look up the entry of a key, matching plain keys first, then hashed keys.
+// Returns the key the entry is stored under.
+func (a *authentication) lookup(key string) (authKey, string, bool) {
+	if auth, ok := a.keys[key]; ok {
+		return auth, key, true
+	}
+	hash := HashKey(key)
+	if auth, ok := a.hashedKeys[hash]; ok {
+		return auth, hash, true
+	}
+	return authKey{}, "", false
 }
 
 // Authenticate.
 func (a *authentication) Authenticate(key, hostname string) (Permissions, error) {
-	auth, ok := a.keys[key]
+	auth, _, ok := a.lookup(key)
 	if !ok {
+		// Fall back to guest access.
+		if a.guest != nil && a.hostAllowed(a.guest, hostname) {
+			return a.guest.permissions, nil
+		}
 		return Permissions{}, errors.New(fmt.Sprintf("invalid authentication key: %s", key))
 	}
 
 	// Match the hostname.
-	hostname = strings.ToLower(hostname)
-	if _, ok := auth.allowedIPs[hostname]; !ok {
+	if !a.hostAllowed(&auth, hostname) {
 		return Permissions{}, errors.New(fmt.Sprintf("invalid authentication key: %s", key))
 	}
 
 	return auth.permissions, nil
 }
 
+// Check if a key may be used from a hostname.
+func (a *authentication) hostAllowed(auth *authKey, hostname string) bool {
+	if auth.allowAll {
+		return true
+	}
+	if _, ok := auth.allowedIPs[strings.ToLower(hostname)]; ok {
+		return true
+	}
+
+	// Match the IP against the allowed IPs and ranges.
+	ip := net.ParseIP(hostname)
+	if ip == nil {
+		return false
+	}
+	if _, ok := auth.allowedIPs[ip.String()]; ok {
+		return true
+	}
+	for _, ipNet := range auth.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Add a key.
 func (a *authentication) AddKey(key string, allowedIPs []string, permissions Permissions) {
-	// Create the allowed hosts map.
+	a.keys[key] = newAuthKey(allowedIPs, permissions)
+}
+
+// Add a key stored as its hash.
+func (a *authentication) AddHashedKey(hash string, allowedIPs []string, permissions Permissions) {
+	a.hashedKeys[strings.ToLower(hash)] = newAuthKey(allowedIPs, permissions)
+}
+
+// Enable guest access, giving requests with unknown keys the guest
+// permissions.
+func (a *authentication) SetGuest(allowedIPs []string, permissions Permissions) {
+	guest := newAuthKey(allowedIPs, permissions)
+	if len(allowedIPs) == 0 {
+		// An empty list allows any IP.
+		guest.allowAll = true
+	}
+	a.guest = &guest
+}
+
+// Disable guest access.
+func (a *authentication) DisableGuest() {
+	a.guest = nil
+}
+
+// Get the secret requests with a key must be signed with.
+func (a *authentication) HMACSecret(key string) []byte {
+	if _, stored, ok := a.lookup(key); ok {
+		return a.hmacSecrets[stored]
+	}
+	return nil
+}
+
+// Set the secret requests with a key must be signed with.
+func (a *authentication) SetHMACSecret(key string, secret []byte) {
+	if _, ok := a.hashedKeys[strings.ToLower(key)]; ok {
+		key = strings.ToLower(key)
+	}
+	if secret == nil {
+		delete(a.hmacSecrets, key)
+		return
+	}
+	a.hmacSecrets[key] = secret
+}
+
+// Create an authentication key entry. Entries which are CIDR blocks are
+// parsed as ranges, and IPs are stored in their canonical form, so they match
+// however the connecting IP is written.
+func newAuthKey(allowedIPs []string, permissions Permissions) authKey {
+	// Create the allowed hosts map and ranges.
 	hostsMap := map[string]struct{}{}
+	nets := []*net.IPNet{}
+	allowAll := false
 	for i := range allowedIPs {
-		hostsMap[strings.ToLower(allowedIPs[i])] = struct{}{}
+		entry := strings.ToLower(strings.TrimSpace(allowedIPs[i]))
+		if entry == "*" {
+			allowAll = true
+		} else if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			hostsMap[ip.String()] = struct{}{}
+		} else {
+			hostsMap[entry] = struct{}{}
+		}
 	}
 
 	// Create the auth key struct.
-	auth := authKey{
+	return authKey{
 		allowedIPs:  hostsMap,
+		allowedNets: nets,
+		allowAll:    allowAll,
 		permissions: permissions,
 	}
-
-	a.keys[key] = auth
 }
@@ -0,0 +1,136 @@
+// auth/auth_test.go
+// Tests for authentication.
+
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGuestAllowedIPs(t *testing.T) {
+	perms := Permissions{AllowedDrives: []string{"public"}}
+	tests := []struct {
+		name       string
+		allowedIPs []string
+		hostname   string
+		allowed    bool
+	}{
+		{"empty list allows any IP", nil, "203.0.113.9", true},
+		{"wildcard allows any IP", []string{"*"}, "203.0.113.9", true},
+		{"exact IP", []string{"10.1.2.3"}, "10.1.2.3", true},
+		{"other IP", []string{"10.1.2.3"}, "10.1.2.4", false},
+		{"inside CIDR range", []string{"10.0.0.0/8"}, "10.20.30.40", true},
+		{"outside CIDR range", []string{"10.0.0.0/8"}, "203.0.113.9", false},
+		{"outside CIDR range, not an IP", []string{"10.0.0.0/8"}, "example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAuthentication()
+			a.SetGuest(test.allowedIPs, perms)
+			got, err := a.Authenticate("nobody", test.hostname)
+			if test.allowed {
+				if err != nil {
+					t.Fatalf("guest rejected: %v", err)
+				}
+				if !got.DriveAllowed("public") {
+					t.Fatalf("guest given the wrong permissions: %+v", got)
+				}
+			} else if err == nil {
+				t.Fatalf("guest admitted from %s", test.hostname)
+			}
+		})
+	}
+}
+
+func TestGuestDoesNotOverrideKeys(t *testing.T) {
+	a := NewAuthentication()
+	a.AddKey("key", []string{"10.0.0.0/8"}, Permissions{IsAdmin: true})
+	a.SetGuest(nil, Permissions{})
+
+	// A known key from a disallowed IP is rejected, not given guest access.
+	if _, err := a.Authenticate("key", "203.0.113.9"); err == nil {
+		t.Fatal("key admitted from a disallowed IP")
+	}
+	perms, err := a.Authenticate("key", "10.0.0.1")
+	if err != nil || !perms.IsAdmin {
+		t.Fatalf("key rejected from an allowed IP: %v", err)
+	}
+
+	a.DisableGuest()
+	if _, err := a.Authenticate("nobody", "10.0.0.1"); err == nil {
+		t.Fatal("unknown key admitted with guest access disabled")
+	}
+}
+
+func TestKeyAllowedIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedIPs []string
+		hostname   string
+		allowed    bool
+	}{
+		{"exact IP", []string{"127.0.0.1"}, "127.0.0.1", true},
+		{"IPv4 CIDR range", []string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{"outside IPv4 CIDR range", []string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{"IPv4 in IPv6 form", []string{"10.0.0.0/8"}, "::ffff:10.1.2.3", true},
+		{"one of several", []string{"192.0.2.1", "10.0.0.0/8"}, "10.9.9.9", true},
+		{"surrounding spaces", []string{" 10.1.2.3 "}, "10.1.2.3", true},
+		{"IPv6 in another form", []string{"::1"}, "0:0:0:0:0:0:0:1", true},
+		{"IPv6 CIDR range", []string{"2001:db8::/32"}, "2001:db8::5", true},
+		{"outside IPv6 CIDR range", []string{"2001:db8::/32"}, "2001:db9::5", false},
+		{"wildcard", []string{"*"}, "192.0.2.1", true},
+		{"hostname", []string{"LocalHost"}, "localhost", true},
+		{"empty list", nil, "127.0.0.1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAuthentication()
+			a.AddKey("key", test.allowedIPs, Permissions{})
+			_, err := a.Authenticate("key", test.hostname)
+			if test.allowed && err != nil {
+				t.Fatalf("key rejected: %v", err)
+			} else if !test.allowed && err == nil {
+				t.Fatal("key admitted")
+			}
+		})
+	}
+}
+
+func TestHashedKey(t *testing.T) {
+	a := NewAuthentication()
+	a.AddHashedKey(HashKey("secret"), []string{"*"}, Permissions{IsAdmin: true})
+	perms, err := a.Authenticate("secret", "127.0.0.1")
+	if err != nil || !perms.IsAdmin {
+		t.Fatalf("hashed key rejected: %v", err)
+	}
+	if _, err := a.Authenticate(HashKey("secret"), "127.0.0.1"); err == nil {
+		t.Fatal("hash of a key accepted as the key")
+	}
+	if !IsKeyHash(HashKey("secret")) || IsKeyHash("secret") {
+		t.Fatal("IsKeyHash misidentified a hash")
+	}
+}
+
+func TestHashedKeySecret(t *testing.T) {
+	a := NewAuthentication()
+	hash := HashKey("secret")
+	a.AddHashedKey(strings.ToUpper(hash), []string{"*"}, Permissions{})
+
+	// Hashes are matched whatever their case, and secrets set by the hash
+	// apply to the key.
+	if _, err := a.Authenticate("secret", "127.0.0.1"); err != nil {
+		t.Fatalf("hashed key rejected: %v", err)
+	}
+	a.SetHMACSecret(strings.ToUpper(hash), []byte("signing"))
+	if secret := a.HMACSecret("secret"); string(secret) != "signing" {
+		t.Fatalf("secret %q", secret)
+	}
+	if secret := a.HMACSecret("other"); secret != nil {
+		t.Fatalf("secret %q for an unknown key", secret)
+	}
+	a.SetHMACSecret(hash, nil)
+	if secret := a.HMACSecret("secret"); secret != nil {
+		t.Fatalf("secret %q after removing it", secret)
+	}
+}
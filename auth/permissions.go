@@ -3,13 +3,39 @@
 
 package auth
 
+import "sort"
+
 // Permissions struct.
 type Permissions struct {
 	AllowedDrives []string
-	CanWrite      bool
+
+	// If the key may write to drives. This is the default for drives not
+	// listed in Drives.
+	CanWrite bool
+
+	// The permissions of individual drives, overriding AllowedDrives and
+	// CanWrite.
+	Drives map[string]DrivePermissions
+
+	// If the key may use administrative commands.
+	IsAdmin bool
+
+	// The maximum number of bytes the files stored by the key may use across
+	// every drive. Zero is unlimited.
+	QuotaBytes int64
 }
 
+// The permissions of a key on a drive.
+type DrivePermissions struct {
+	Read  bool
+	Write bool
+}
+
+// Check if the key may access a drive at all, to read or write it.
 func (p *Permissions) DriveAllowed(drive string) bool {
+	if perms, ok := p.Drives[drive]; ok {
+		return perms.Read || perms.Write
+	}
 	for _, a := range p.AllowedDrives {
 		if a == drive {
 			return true
@@ -17,3 +43,40 @@ func (p *Permissions) DriveAllowed(drive string) bool {
 	}
 	return false
 }
+
+// Check if the key may read a drive.
+func (p *Permissions) CanReadDrive(drive string) bool {
+	if perms, ok := p.Drives[drive]; ok {
+		return perms.Read
+	}
+	return p.DriveAllowed(drive)
+}
+
+// Check if the key may write to a drive.
+func (p *Permissions) CanWriteDrive(drive string) bool {
+	if perms, ok := p.Drives[drive]; ok {
+		return perms.Write
+	}
+	return p.CanWrite
+}
+
+// Get the drives the key may access: those in AllowedDrives, in order,
+// followed by those only listed in Drives, sorted.
+func (p *Permissions) Accessible() []string {
+	drives := []string{}
+	seen := map[string]bool{}
+	for _, a := range p.AllowedDrives {
+		if !seen[a] && p.DriveAllowed(a) {
+			drives = append(drives, a)
+		}
+		seen[a] = true
+	}
+	extra := []string{}
+	for name := range p.Drives {
+		if !seen[name] && p.DriveAllowed(name) {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	return append(drives, extra...)
+}
@@ -0,0 +1,64 @@
+// auth/permissions_test.go
+// Tests for permissions.
+
+package auth
+
+import "testing"
+
+func TestDrivePermissions(t *testing.T) {
+	p := Permissions{
+		AllowedDrives: []string{"shared"},
+		Drives: map[string]DrivePermissions{
+			"readonly":  {Read: true},
+			"writeonly": {Write: true},
+			"none":      {},
+		},
+	}
+	tests := []struct {
+		drive                  string
+		allowed, read, written bool
+	}{
+		{"shared", true, true, false},
+		{"readonly", true, true, false},
+		{"writeonly", true, false, false},
+		{"none", false, false, false},
+		{"unknown", false, false, false},
+	}
+	for _, test := range tests {
+		if got := p.DriveAllowed(test.drive); got != test.allowed {
+			t.Errorf("DriveAllowed(%q) = %v, want %v", test.drive, got, test.allowed)
+		}
+		if got := p.CanReadDrive(test.drive); got != test.read {
+			t.Errorf("CanReadDrive(%q) = %v, want %v", test.drive, got, test.read)
+		}
+	}
+	if !p.CanWriteDrive("writeonly") || p.CanWriteDrive("readonly") || p.CanWriteDrive("shared") {
+		t.Error("CanWriteDrive ignored the permissions of the drives")
+	}
+
+	got := p.Accessible()
+	want := []string{"shared", "readonly", "writeonly"}
+	if len(got) != len(want) {
+		t.Fatalf("Accessible() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Accessible() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDrivePermissionsOverrideCanWrite(t *testing.T) {
+	// CanWrite is the default for drives which aren't listed.
+	p := Permissions{
+		AllowedDrives: []string{"scratch", "archive"},
+		CanWrite:      true,
+		Drives:        map[string]DrivePermissions{"archive": {Read: true}},
+	}
+	if !p.CanWriteDrive("scratch") || p.CanWriteDrive("archive") {
+		t.Fatal("CanWriteDrive ignored the permissions of the drives")
+	}
+	if !p.CanReadDrive("scratch") || !p.CanReadDrive("archive") {
+		t.Fatal("CanReadDrive denied an allowed drive")
+	}
+}
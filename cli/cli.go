@@ -5,13 +5,21 @@ package cli
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cubeflix/deepwell/client"
 	"github.com/google/shlex"
+	"golang.org/x/term"
 )
 
 // The CLI struct.
@@ -20,18 +28,101 @@ type CLI struct {
 	Addr, Key        string
 	SkipVerification bool
 
-	c     client.Client
-	drive string
+	// The pinned fingerprint of the server certificate, and the known hosts
+	// file to trust it on first use with.
+	Pin        string
+	KnownHosts string
+
+	// The secret to sign connections with, if any.
+	HMACSecret string
+
+	// If the data of reads and writes is compressed.
+	Compression bool
+
+	// The bandwidth limit of each connection in bytes per second. Zero is
+	// unlimited.
+	Bandwidth int64
+
+	c      client.Client
+	drive  string
+	reader *bufio.Reader
+
+	// If the connection was lost during the current command, and if the
+	// command is being retried after reconnecting.
+	dropped  bool
+	retrying bool
 }
 
 // Connect.
 func (c *CLI) connect() error {
+	c.newClient()
+
+	// Ping the server.
+	err := c.c.Ping()
+	warnCertificateChanged(err)
+	return err
+}
+
+// Create the client.
+func (c *CLI) newClient() {
 	c.c = client.NewClient(time.Second * 5)
 	c.c.Connect(c.Addr, c.Key)
 	c.c.SetInsecureSkipVerify(c.SkipVerification)
+	if c.Pin != "" {
+		c.c.PinCertificate(c.Pin)
+	}
+	if c.KnownHosts != "" {
+		c.c.SetKnownHostsFile(c.KnownHosts)
+	}
+	if c.HMACSecret != "" {
+		c.c.SetHMACSecret([]byte(c.HMACSecret))
+	}
+	c.c.SetCompression(c.Compression)
+	c.c.SetBandwidthLimit(c.Bandwidth)
+}
 
-	// Ping the server.
-	return c.c.Ping()
+// Warn loudly if an error is due to the certificate of the server changing,
+// since the connection may have been intercepted.
+func warnCertificateChanged(err error) {
+	var changed *client.CertificateChangedError
+	if !errors.As(err, &changed) {
+		return
+	}
+	fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Println("@    WARNING: SERVER CERTIFICATE HAS CHANGED!             @")
+	fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Println("Someone could be intercepting your connection, or the server's certificate")
+	fmt.Println("may have been replaced.")
+	fmt.Println("The fingerprint of the certificate sent by", changed.Addr, "is:")
+	fmt.Println(changed.Actual)
+	fmt.Println("The expected fingerprint is:")
+	fmt.Println(changed.Expected)
+	fmt.Println("If the change is expected, remove the server from your known hosts file or")
+	fmt.Println("update the pinned fingerprint.")
+}
+
+// Serve a drive over WebDAV on an address until the server fails. Each WebDAV
+// request must supply its own key as its basic auth password, unless fallback
+// is set, in which case requests without one use the CLI's key.
+func (c *CLI) ServeWebDAV(drive, addr string, fallback bool) error {
+	if fallback && c.Key == "" {
+		return errors.New("a key is required to fall back to")
+	}
+	if c.Key != "" {
+		fmt.Println("Connecting to", c.Addr)
+		if err := c.connect(); err != nil {
+			return err
+		}
+	} else {
+		c.newClient()
+	}
+	defer c.c.Close()
+
+	fmt.Println("Serving", drive, "over WebDAV on", addr)
+	if fallback {
+		return http.ListenAndServe(addr, c.c.WebDAVHandlerWithFallback(drive))
+	}
+	return http.ListenAndServe(addr, c.c.WebDAVHandler(drive))
 }
 
 // Run the CLI interface.
@@ -41,12 +132,12 @@ func (c *CLI) Run() error {
 	if err != nil {
 		return err
 	}
-	reader := bufio.NewReader(os.Stdin)
+	c.reader = bufio.NewReader(os.Stdin)
 
 	for {
 		// Get the command.
 		fmt.Printf("%s:%s> ", c.Hostname, c.drive)
-		cmd, err := reader.ReadString('\n')
+		cmd, err := c.reader.ReadString('\n')
 		if err != nil {
 			return err
 		}
@@ -54,7 +145,23 @@ func (c *CLI) Run() error {
 	}
 }
 
-// Perform a command.
+// Ask the user a yes or no question. Fails if the CLI is not interactive.
+func (c *CLI) confirm(question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("cannot confirm in a non-interactive session")
+	}
+
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := c.reader.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// Perform a command. If the connection to the server was lost, reconnect and
+// retry the command once.
 func (c *CLI) command(cmd string) {
 	args, err := shlex.Split(cmd)
 	if err != nil {
@@ -64,10 +171,63 @@ func (c *CLI) command(cmd string) {
 	if len(args) == 0 {
 		return
 	}
+
+	c.execute(args)
+	if !c.dropped {
+		return
+	}
+
+	// Reconnect, keeping the selected drive, and retry.
+	c.dropped = false
+	c.c.Close()
+	if err := c.connect(); err != nil {
+		fmt.Println("Lost connection to", c.Addr+", failed to reconnect:", err)
+		return
+	}
+	fmt.Println("Reconnected to", c.Addr)
+	c.retrying = true
+	c.execute(args)
+	c.retrying = false
+}
+
+// Check if an error is caused by a lost or failed connection.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// Print an error from a command. Connection errors are not printed, but
+// recorded so the command can be retried once reconnected.
+func (c *CLI) printError(err error) {
+	if isConnectionError(err) && !c.retrying {
+		c.dropped = true
+		return
+	}
+	warnCertificateChanged(err)
+	fmt.Println(err)
+}
+
+// Format a size in bytes for display, in binary units.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Execute a command.
+func (c *CLI) execute(args []string) {
 	name := args[0]
 
 	if name == "quit" || name == "exit" {
 		// Quit.
+		c.c.Close()
 		os.Exit(0)
 	} else if name == "drive" {
 		// Select the drive.
@@ -76,22 +236,148 @@ func (c *CLI) command(cmd string) {
 			return
 		}
 		c.drive = args[1]
+	} else if name == "drives" && len(args) == 2 && args[1] == "-l" {
+		// Get a detailed list of drives.
+		drives, err := c.c.DrivesInfo()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for i := range drives {
+			access := "read-only"
+			if drives[i].Writable {
+				access = "read-write"
+			}
+			quota := "unlimited"
+			if drives[i].Quota != 0 {
+				quota = strconv.FormatInt(drives[i].Quota, 10) + " bytes"
+			}
+			if !drives[i].Available {
+				fmt.Printf("%s\t%s\t%s\tquota: %s\tunavailable\n", drives[i].Name, drives[i].Type, access, quota)
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\tquota: %s\tusage: %d bytes\n", drives[i].Name, drives[i].Type, access, quota, drives[i].Usage)
+		}
 	} else if name == "drives" {
 		// Get a list of drives.
 		drives, err := c.c.Drives()
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			return
 		}
 		fmt.Println(strings.Join(drives, "\n"))
+	} else if name == "load" {
+		// Display the load of the server.
+		load, err := c.c.Load()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Queued:", load.Queued, "of", load.QueueSize)
+		fmt.Println("Busy workers:", load.Busy, "of", load.Workers)
+		fmt.Printf("Request rate: %.2f/s\n", load.RequestRate)
+		if load.Backoff > 0 {
+			fmt.Println("Suggested backoff:", load.Backoff)
+		}
+	} else if name == "status" {
+		// Display the status of the server.
+		status, err := c.c.Status()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Uptime:", status.Uptime.Round(time.Second))
+		fmt.Println("Busy workers:", status.Busy, "of", status.Workers)
+		fmt.Println("Queued:", status.Queued)
+		fmt.Println("Drives:", status.Drives, "("+strconv.Itoa(status.UnhealthyDrives), "unhealthy)")
+	} else if name == "keyquota" {
+		// Display the usage and quota of the key.
+		used, quota, err := c.c.KeyQuota()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		if quota == 0 {
+			fmt.Println("Used:", used, "bytes (unlimited)")
+		} else {
+			fmt.Println("Used:", used, "of", quota, "bytes")
+		}
+	} else if name == "setdrivereadonly" {
+		// Make a drive read-only or writable.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for setdrivereadonly command. Please provide a drive and true or false.")
+			return
+		}
+		readOnly, err := strconv.ParseBool(args[2])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		err = c.c.SetDriveReadOnly(args[1], readOnly)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "dropcache" {
+		// Drop the caches of a drive.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for dropcache command. Please provide a drive.")
+			return
+		}
+		err := c.c.DropCache(args[1])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "sessions" {
+		// List the active sessions.
+		sessions, err := c.c.Sessions()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for i := range sessions {
+			fmt.Printf("%d\t%s\tkey: %s\t%s\tread: %d bytes\twritten: %d bytes\t%s\n", sessions[i].ID, sessions[i].IP, sessions[i].Key, sessions[i].Command, sessions[i].BytesRead, sessions[i].BytesWritten, sessions[i].Duration)
+		}
+	} else if name == "kill" {
+		// Close a session.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for kill command. Please provide a session ID.")
+			return
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid session ID:", args[1])
+			return
+		}
+		err = c.c.Kill(id)
+		if err != nil {
+			c.printError(err)
+			return
+		}
 	} else if name == "ping" {
 		// Ping the server.
 		err := c.c.Ping()
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			return
 		}
 		fmt.Println("PONG")
+	} else if name == "time" {
+		// Get the time of the server.
+		serverTime, err := c.c.ServerTime()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		skew, err := c.c.ClockSkew()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Server time:", serverTime.Format(time.RFC3339))
+		fmt.Println("UTC:", serverTime.UTC().Format(time.RFC3339))
+		fmt.Println("Clock skew:", skew.Round(time.Millisecond))
 	} else if name == "create" {
 		// Create a file.
 		if len(args) != 2 {
@@ -104,12 +390,73 @@ func (c *CLI) command(cmd string) {
 		}
 		err := c.c.Create(c.drive, args[1])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
+			return
+		}
+	} else if name == "createsized" {
+		// Create a file of a given size.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for createsized command. Please provide a path to create and a size.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		size, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		err = c.c.CreateSized(c.drive, args[1], size)
+		if err != nil {
+			c.printError(err)
 			return
 		}
+	} else if name == "createtemp" {
+		// Create a uniquely named file.
+		if len(args) != 2 && len(args) != 3 {
+			fmt.Println("Invalid arguments for createtemp command. Please provide a directory and optionally a pattern.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		pattern := ""
+		if len(args) == 3 {
+			pattern = args[2]
+		}
+		path, err := c.c.CreateTemp(c.drive, args[1], pattern)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println(path)
+	} else if name == "cas" {
+		// Replace the contents of a file if they equal the expected contents.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for cas command. Please provide a file, the expected contents, and the new contents.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		swapped, err := c.c.CompareAndSwap(c.drive, args[1], []byte(args[2]), []byte(args[3]))
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		if swapped {
+			fmt.Println("Swapped.")
+		} else {
+			fmt.Println("Not swapped, the contents did not match.")
+		}
 	} else if name == "mkdir" {
 		// Create a directory.
-		if len(args) != 2 {
+		existOK := len(args) == 3 && args[1] == "--exist-ok"
+		if len(args) != 2 && !existOK {
 			fmt.Println("Invalid arguments for mkdir command. Please provide a path to create.")
 			return
 		}
@@ -117,9 +464,9 @@ func (c *CLI) command(cmd string) {
 			fmt.Println("No drive selected. Use the drive command to select a drive.")
 			return
 		}
-		err := c.c.Mkdir(c.drive, args[1])
+		err := c.c.Mkdir(c.drive, args[len(args)-1], existOK)
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			return
 		}
 	} else if name == "download" {
@@ -135,22 +482,93 @@ func (c *CLI) command(cmd string) {
 		// Open the file for writing.
 		f, err := os.Create(args[2])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			f.Close()
 			return
 		}
 		n, err := c.c.Read(c.drive, args[1], f)
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			f.Close()
 			return
 		}
 		f.Close()
 		fmt.Println("Successfully wrote", n, "bytes to", args[2])
+	} else if name == "lines" {
+		// Display a range of lines from a file.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for lines command. Please provide a file, a start line, and a number of lines.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		start, err := strconv.Atoi(args[2])
+		if err != nil || start < 1 {
+			fmt.Println("Invalid start line. Lines are numbered from 1.")
+			return
+		}
+		count, err := strconv.Atoi(args[3])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		lines, err := c.c.ReadLines(c.drive, args[1], start-1, count)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for i := range lines {
+			fmt.Printf("%d\t%s\n", start+i, lines[i])
+		}
+	} else if name == "appendrecord" {
+		// Append a record to a file.
+		if len(args) < 3 {
+			fmt.Println("Invalid arguments for appendrecord command. Please provide a file and a record.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.AppendRecord(c.drive, args[1], []byte(strings.Join(args[2:], " ")))
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "records" {
+		// Display a range of records from a file.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for records command. Please provide a file, a start record, and a number of records.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		start, err := strconv.Atoi(args[2])
+		if err != nil || start < 1 {
+			fmt.Println("Invalid start record. Records are numbered from 1.")
+			return
+		}
+		count, err := strconv.Atoi(args[3])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		records, err := c.c.ReadRecords(c.drive, args[1], start-1, count)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for i := range records {
+			fmt.Printf("%d\t%q\n", start+i, records[i])
+		}
 	} else if name == "ls" || name == "list" || name == "dir" {
 		// List a directory.
-		if len(args) != 1 && len(args) != 2 {
-			fmt.Println("Invalid arguments for list command. Please provide a path to list.")
+		if len(args) > 3 {
+			fmt.Println("Invalid arguments for list command. Please provide a path to list and optionally a pattern.")
 			return
 		}
 		if c.drive == "" {
@@ -158,12 +576,16 @@ func (c *CLI) command(cmd string) {
 			return
 		}
 		path := ""
-		if len(args) == 2 {
+		if len(args) >= 2 {
 			path = args[1]
 		}
-		list, err := c.c.List(c.drive, path)
+		pattern := ""
+		if len(args) == 3 {
+			pattern = args[2]
+		}
+		list, err := c.c.List(c.drive, path, pattern)
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			return
 		}
 		for i := range list {
@@ -185,20 +607,46 @@ func (c *CLI) command(cmd string) {
 		}
 		stat, err := c.c.Stat(c.drive, args[1])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			return
 		}
 		if stat.IsDir {
 			fmt.Println(args[1])
 			fmt.Println("Type: Directory")
+			size, count, err := c.c.DirSize(c.drive, args[1])
+			if err != nil {
+				c.printError(err)
+				return
+			}
+			fmt.Println("Size:", size, "bytes")
+			fmt.Println("Files:", count)
 		} else {
 			fmt.Println(args[1])
 			fmt.Println("Type: File")
 			fmt.Println("Size:", stat.Size, "bytes")
 		}
+		if !stat.ModTime.IsZero() {
+			fmt.Println("Modified:", stat.ModTime.Format(time.RFC3339))
+		}
+		if stat.UID >= 0 {
+			fmt.Println("Owner:", stat.UID, stat.GID)
+		}
 	} else if name == "upload" {
 		// Upload a file.
-		if len(args) != 3 {
+		policy := ""
+		paths := []string{}
+		for _, arg := range args[1:] {
+			if arg == "--no-clobber" || arg == "--force" || arg == "--resume" {
+				if policy != "" && policy != arg {
+					fmt.Println("Invalid arguments for upload command. Please provide only one of --no-clobber, --force, and --resume.")
+					return
+				}
+				policy = arg
+			} else {
+				paths = append(paths, arg)
+			}
+		}
+		if len(paths) != 2 {
 			fmt.Println("Invalid arguments for upload command. Please provide a path to upload and a path to upload to.")
 			return
 		}
@@ -206,10 +654,29 @@ func (c *CLI) command(cmd string) {
 			fmt.Println("No drive selected. Use the drive command to select a drive.")
 			return
 		}
+
+		// Check if the remote file already exists.
+		if policy != "--force" && policy != "--resume" {
+			if _, err := c.c.Stat(c.drive, paths[1]); err == nil {
+				if policy == "--no-clobber" {
+					fmt.Println("Skipping", paths[1]+": file already exists.")
+					return
+				}
+				overwrite, err := c.confirm(fmt.Sprintf("%s already exists. Overwrite?", paths[1]))
+				if err != nil {
+					fmt.Println(paths[1], "already exists:", err)
+					return
+				}
+				if !overwrite {
+					return
+				}
+			}
+		}
+
 		// Open the file for reading.
-		f, err := os.Open(args[1])
+		f, err := os.Open(paths[0])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			f.Close()
 			return
 		}
@@ -219,22 +686,69 @@ func (c *CLI) command(cmd string) {
 			return
 		}
 
+		// Resume a partial upload.
+		if policy == "--resume" {
+			_, err = c.c.ResumeWrite(c.drive, paths[1], stat.Size(), f)
+			f.Close()
+			if err != nil {
+				c.printError(err)
+				return
+			}
+			fmt.Println("Successfully wrote", stat.Size(), "bytes to", paths[1])
+			return
+		}
+
 		// Create the file.
-		err = c.c.Create(c.drive, args[2])
+		err = c.c.Create(c.drive, paths[1])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			f.Close()
 			return
 		}
 
-		err = c.c.Write(c.drive, args[2], stat.Size(), f)
+		_, err = c.c.Write(c.drive, paths[1], stat.Size(), f)
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
 			f.Close()
 			return
 		}
 		f.Close()
-		fmt.Println("Successfully wrote", stat.Size(), "bytes to", args[2])
+		fmt.Println("Successfully wrote", stat.Size(), "bytes to", paths[1])
+	} else if name == "writeat" {
+		// Write a local file into a remote file at an offset.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for writeat command. Please provide a path to upload, a path to write to, and an offset.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		offset, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || offset < 0 {
+			fmt.Println("Invalid offset:", args[3])
+			return
+		}
+
+		// Open the file for reading.
+		f, err := os.Open(args[1])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			c.printError(err)
+			return
+		}
+
+		err = c.c.WriteAt(c.drive, args[2], offset, stat.Size(), f)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Successfully wrote", stat.Size(), "bytes to", args[2], "at offset", offset)
 	} else if name == "remove" {
 		// Remove a path.
 		if len(args) != 2 {
@@ -247,7 +761,46 @@ func (c *CLI) command(cmd string) {
 		}
 		err := c.c.Remove(c.drive, args[1])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
+			return
+		}
+	} else if name == "deploy" {
+		// Deploy a local directory.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for deploy command. Please provide a local directory and a path to deploy it to.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.Deploy(args[1], c.drive, args[2])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Deployed", args[1], "to", args[2])
+	} else if name == "removetree" {
+		// Recursively remove a directory.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for removetree command. Please provide a directory to remove.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.RemoveTree(c.drive, args[1], func(count int) bool {
+			ok, err := c.confirm(fmt.Sprintf("Remove %s and %d paths under it?", args[1], count-1))
+			if err != nil {
+				fmt.Println(err)
+			}
+			return ok
+		}, func(removed int) {
+			fmt.Println("Removed", removed, "paths")
+		})
+		if err != nil {
+			c.printError(err)
 			return
 		}
 	} else if name == "move" {
@@ -262,22 +815,338 @@ func (c *CLI) command(cmd string) {
 		}
 		err := c.c.Move(c.drive, args[1], args[2])
 		if err != nil {
-			fmt.Println(err)
+			c.printError(err)
+			return
+		}
+	} else if name == "movedrive" {
+		// Move a file to another drive.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for movedrive command. Please provide a file to move, a destination drive, and a destination path.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.MoveCrossDrive(c.drive, args[1], args[2], args[3])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "cp" {
+		// Copy a file.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for cp command. Please provide a file to copy and a destination path.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.Copy(c.drive, args[1], args[2])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "chown" {
+		// Change the owner of a path.
+		if len(args) != 4 {
+			fmt.Println("Invalid arguments for chown command. Please provide a path, a user ID, and a group ID.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		uid, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println("Invalid user ID.")
+			return
+		}
+		gid, err := strconv.Atoi(args[3])
+		if err != nil {
+			fmt.Println("Invalid group ID.")
+			return
+		}
+		err = c.c.Chown(c.drive, args[1], uid, gid)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "checksum" {
+		// Display the checksum of a file.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for checksum command. Please provide a file.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		checksum, err := c.c.Checksum(c.drive, args[1])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println(checksum)
+	} else if name == "versions" {
+		// List the previous versions of a file.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for versions command. Please provide a file.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		versions, err := c.c.ListVersions(c.drive, args[1])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for _, version := range versions {
+			fmt.Println(version.ID, version.Time.Format(time.RFC3339), version.Size, "bytes")
+		}
+	} else if name == "restore" {
+		// Restore a previous version of a file.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for restore command. Please provide a file and a version.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
 			return
 		}
+		err := c.c.RestoreVersion(c.drive, args[1], args[2])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "sync" {
+		// Sync a path.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for sync command. Please provide a path to sync.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		err := c.c.Sync(c.drive, args[1])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+	} else if name == "compare" {
+		// Compare two files.
+		if len(args) != 3 {
+			fmt.Println("Invalid arguments for compare command. Please provide two paths to compare.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		equal, err := c.c.Compare(c.drive, args[1], args[2])
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		if equal {
+			fmt.Println("The files are identical.")
+		} else {
+			fmt.Println("The files differ.")
+		}
+	} else if name == "quota" {
+		// Display the quota of the drive.
+		if len(args) != 1 {
+			fmt.Println("Invalid arguments for quota command.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		info, err := c.c.QuotaInfo(c.drive)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Usage:", info.Usage, "bytes")
+		if info.Limited {
+			fmt.Println("Quota:", info.Quota, "bytes")
+			fmt.Println("Remaining:", info.Headroom, "bytes")
+		} else {
+			fmt.Println("Quota: None")
+		}
+	} else if name == "usage" {
+		// Display the total size of the files under a path.
+		if len(args) != 1 && len(args) != 2 {
+			fmt.Println("Invalid arguments for usage command. Please provide a path.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		usage, err := c.c.Usage(c.drive, path)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Usage:", formatSize(usage), "("+strconv.FormatInt(usage, 10), "bytes)")
+		info, err := c.c.QuotaInfo(c.drive)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		if info.Limited {
+			fmt.Println("Drive quota:", formatSize(info.Quota), "("+strconv.FormatInt(info.Headroom, 10), "bytes remaining)")
+		}
+	} else if name == "count" {
+		// Count the files and directories under a directory.
+		if len(args) != 1 && len(args) != 2 {
+			fmt.Println("Invalid arguments for count command. Please provide a directory.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		files, dirs, bytes, err := c.c.CountTree(c.drive, path)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		fmt.Println("Files:", files)
+		fmt.Println("Directories:", dirs)
+		fmt.Println("Size:", bytes, "bytes")
+	} else if name == "manifest" {
+		// Get the checksums of all files in a directory.
+		if len(args) != 1 && len(args) != 2 {
+			fmt.Println("Invalid arguments for manifest command. Please provide a directory.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		path := ""
+		if len(args) == 2 {
+			path = args[1]
+		}
+		manifest, err := c.c.Manifest(c.drive, path)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		names := make([]string, 0, len(manifest))
+		for name := range manifest {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(manifest[name].Checksum, manifest[name].Size, name)
+		}
+	} else if name == "verify" {
+		// Verify the drive against a local manifest, in the format output by
+		// the manifest command.
+		if len(args) != 2 {
+			fmt.Println("Invalid arguments for verify command. Please provide a manifest file.")
+			return
+		}
+		if c.drive == "" {
+			fmt.Println("No drive selected. Use the drive command to select a drive.")
+			return
+		}
+		file, err := os.Open(args[1])
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer file.Close()
+		manifest := map[string]string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), " ", 3)
+			if len(fields) != 3 {
+				fmt.Println("Invalid manifest line:", scanner.Text())
+				return
+			}
+			manifest[fields[2]] = fields[0]
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		report, err := c.c.Verify(c.drive, manifest)
+		if err != nil {
+			c.printError(err)
+			return
+		}
+		for _, path := range report.Missing {
+			fmt.Println("missing", path)
+		}
+		for _, path := range report.Changed {
+			fmt.Println("changed", path)
+		}
+		for _, path := range report.Extra {
+			fmt.Println("extra", path)
+		}
+		if len(report.Missing)+len(report.Changed)+len(report.Extra) == 0 {
+			fmt.Println("All files match.")
+		}
 	} else if name == "help" {
 		fmt.Println("DEEPWELL is a file server developed by cubeflix at https://github.com/cubeflix/deepwell. deepwell-cli is the command line client program.")
 		fmt.Println("drive <name>: Select the drive <name>.")
-		fmt.Println("drives: List the available drives on the server.")
+		fmt.Println("drives [-l]: List the available drives on the server. With -l, also list their types, access, quotas, and usage.")
 		fmt.Println("ping: Ping the server.")
+		fmt.Println("time: Display the time of the server and the skew of its clock.")
 		fmt.Println("create <file>: Create an empty file <file>.")
-		fmt.Println("mkdir <path>: Create an empty directory <path>.")
+		fmt.Println("createsized <file> <size>: Create a file <file> of <size> bytes without uploading its contents.")
+		fmt.Println("createtemp <dir> [pattern]: Create a uniquely named file in <dir>, with the last \"*\" in [pattern] replaced by a random string, and display its path.")
+		fmt.Println("cas <file> <expected> <new>: Replace the contents of <file> with <new> if they equal <expected>.")
+		fmt.Println("mkdir [--exist-ok] <path>: Create an empty directory <path>. With --exist-ok, succeed if <path> is already a directory.")
+		fmt.Println("lines <file> <start> <count>: Display <count> lines of the file <file>, starting at line <start> (from 1).")
+		fmt.Println("appendrecord <file> <record>: Append the text <record> to the record file <file>, creating it if it doesn't exist.")
+		fmt.Println("records <file> <start> <count>: Display <count> records of the record file <file>, starting at record <start> (from 1).")
 		fmt.Println("download <path> <save>: Download the file <path> on the server and save it to the local path <save>.")
-		fmt.Println("ls, dir, list <path>: List the contents of the directory <path>. If <path> is not provided, it will list the root of the drive.")
-		fmt.Println("stat <path>: Display the type and size of the path <path>.")
-		fmt.Println("upload <file> <path>: Upload the local file <file> to the path <path>.")
+		fmt.Println("setdrivereadonly <drive> <true|false>: Make the drive <drive> read-only, or writable again. Requires an admin key.")
+		fmt.Println("dropcache <drive>: Drop the caches of the drive <drive>, so it reflects changes made to its files outside the server. Requires an admin key.")
+		fmt.Println("sessions: List the active sessions on the server. Requires an admin key.")
+		fmt.Println("kill <id>: Close the connection of the session <id>. Requires an admin key.")
+		fmt.Println("load: Display the load of the server.")
+		fmt.Println("status: Display the uptime, workers, queued requests, and drives of the server.")
+		fmt.Println("keyquota: Display the bytes used by the files written with your key, and its quota.")
+		fmt.Println("ls, dir, list <path> [pattern]: List the contents of the directory <path>, optionally only the entries matching the glob [pattern]. If <path> is not provided, it will list the root of the drive.")
+		fmt.Println("stat <path>: Display the type, size, modification time, and owner of the path <path>.")
+		fmt.Println("upload [--no-clobber | --force | --resume] <file> <path>: Upload the local file <file> to the path <path>. If <path> exists, --no-clobber skips the upload, --force overwrites it, --resume continues a partial upload of it, and otherwise you are asked to confirm.")
+		fmt.Println("writeat <file> <path> <offset>: Write the local file <file> into the existing file <path> at byte <offset>, without truncating the rest of it.")
 		fmt.Println("remove <path>: Remove the path <path>. If it is a directory, it must be empty.")
+		fmt.Println("deploy <dir> <path>: Upload the local directory <dir>, verify it, and atomically move it into place at <path>. The previous contents of <path> are kept at <path>.previous.")
+		fmt.Println("removetree <path>: Remove the directory <path> and everything under it, after confirming.")
 		fmt.Println("move <src> <dest>: Move the path <src> to <dest>.")
+		fmt.Println("movedrive <src> <drive> <dest>: Move the file <src> to <dest> on the drive <drive>.")
+		fmt.Println("cp <src> <dest>: Copy the file <src> to <dest>, which must not exist.")
+		fmt.Println("chown <path> <uid> <gid>: Change the owner of <path>. An ID of -1 leaves it unchanged. Requires admin permissions.")
+		fmt.Println("checksum <file>: Display the SHA-256 checksum of the file <file>, computed on the server.")
+		fmt.Println("versions <file>: List the previous versions of the file <file> on a versioned drive, newest first.")
+		fmt.Println("restore <file> <version>: Restore the version <version> of the file <file>, keeping its current contents as a version.")
+		fmt.Println("sync <path>: Flush the path <path> to stable storage on the server.")
+		fmt.Println("compare <a> <b>: Compare the contents of the files <a> and <b> on the server.")
+		fmt.Println("quota: Display the quota, usage, and remaining space of the drive.")
+		fmt.Println("usage [path]: Display the total size of the files under [path], or the whole drive, and the quota of the drive.")
+		fmt.Println("count <path>: Display the number of files and directories under the directory <path>, and the total size of the files.")
+		fmt.Println("manifest <path>: Display the SHA-256 checksum and size of every file under the directory <path>.")
+		fmt.Println("verify <manifest>: Compare the drive against the local file <manifest>, as output by the manifest command, and display the missing, changed, and extra files.")
 		fmt.Println("help: Display this message.")
 		fmt.Println("exit, quit: Exit the CLI.")
 	} else {
@@ -0,0 +1,744 @@
+// cli/cli_test.go
+// Tests for the command-line interface.
+
+package cli
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// The key of test servers.
+const testKey = "key"
+
+// Start a server on a free port with a drive, d1, in a temporary directory.
+// Returns the server and the directory of the drive. The server is stopped
+// when the test finishes.
+func startTestServer(t *testing.T) (server.Server, string) {
+	t.Helper()
+	return startTestServerDrive(t, drive.NewDrive)
+}
+
+// Start a test server whose drive d1 is created by a function from its
+// directory.
+func startTestServerDrive(t *testing.T, newDrive func(dir string) drive.Drive) (server.Server, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	s := server.NewServer()
+	s.SetAddress("127.0.0.1:0")
+	s.SetHTTPAddress("")
+	s.SetTimeout(5 * time.Second)
+	s.SetHandshakeTimeout(5 * time.Second)
+	s.SetBacklogSize(10)
+	s.SetNumWorkers(5)
+	s.SetIdempotencyLimits(0, 0)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	s.SetDrives(map[string]drive.Drive{"d1": newDrive(dir)})
+	s.SetHealthCheckInterval(-1)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	a := auth.NewAuthentication()
+	a.AddKey(testKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true, IsAdmin: true})
+	s.SetAuthentication(a)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActualAddress() == "" {
+		select {
+		case err := <-served:
+			t.Fatalf("failed to serve: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(s.Stop)
+	return s, dir
+}
+
+// Create a CLI connected to a test server, with d1 selected and input read
+// from a string.
+func newTestCLI(t *testing.T, s server.Server, input string) *CLI {
+	t.Helper()
+	c := &CLI{Addr: s.ActualAddress(), Key: testKey, SkipVerification: true}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.c.Close() })
+	c.drive = "d1"
+	c.reader = bufio.NewReader(strings.NewReader(input))
+	return c
+}
+
+// Run a command, returning what it printed.
+func runCommand(t *testing.T, c *CLI, cmd string) string {
+	t.Helper()
+	return captureOutput(t, func() { c.command(cmd) })
+}
+
+// Run a function, returning what it printed.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestUploadOverwritePolicies(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	local := filepath.Join(t.TempDir(), "local")
+	if err := os.WriteFile(local, []byte("new"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(dir, "remote")
+	check := func(want string) {
+		t.Helper()
+		if data, err := os.ReadFile(remote); err != nil || string(data) != want {
+			t.Fatalf("remote file is %q, %v, want %q", data, err, want)
+		}
+	}
+
+	// New files are uploaded without asking.
+	if out := runCommand(t, c, "upload "+local+" remote"); !strings.Contains(out, "Successfully wrote 3 bytes") {
+		t.Fatalf("upload printed %q", out)
+	}
+	check("new")
+	if err := os.WriteFile(remote, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cmd    string
+		output string
+		want   string
+	}{
+		{"no clobber", "upload --no-clobber " + local + " remote", "Skipping remote: file already exists.", "old"},
+		{"both policies", "upload --no-clobber --force " + local + " remote", "Please provide only one of --no-clobber, --force", "old"},
+		{"not interactive", "upload " + local + " remote", "cannot confirm in a non-interactive session", "old"},
+		{"force", "upload " + local + " remote --force", "Successfully wrote 3 bytes", "new"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if out := runCommand(t, c, test.cmd); !strings.Contains(out, test.output) {
+				t.Fatalf("printed %q, want %q", out, test.output)
+			}
+			check(test.want)
+		})
+	}
+
+	// Partial uploads are resumed.
+	if err := os.WriteFile(remote, []byte("ne"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out := runCommand(t, c, "upload --resume "+local+" remote"); !strings.Contains(out, "Successfully wrote 3 bytes") {
+		t.Fatalf("upload printed %q", out)
+	}
+	check("new")
+}
+
+func TestRemoveTreeConfirmation(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.MkdirAll(filepath.Join(dir, "tree", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removals can't be confirmed without a terminal.
+	out := runCommand(t, c, "removetree tree")
+	if !strings.Contains(out, "cannot confirm in a non-interactive session") || !strings.Contains(out, "removal cancelled") {
+		t.Fatalf("printed %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tree", "sub")); err != nil {
+		t.Fatalf("unconfirmed removal removed the tree: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Save the output of the manifest command.
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	if err := os.WriteFile(manifest, []byte(runCommand(t, c, "manifest .")), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out := runCommand(t, c, "verify "+manifest); !strings.Contains(out, "All files match.") {
+		t.Fatalf("printed %q", out)
+	}
+
+	// Differences are listed.
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, want := runCommand(t, c, "verify "+manifest), "missing b\nchanged a\nextra c\n"; out != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+
+	// Malformed manifests are rejected.
+	if err := os.WriteFile(manifest, []byte("bad\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out := runCommand(t, c, "verify "+manifest); !strings.Contains(out, "Invalid manifest line: bad") {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestCertificateChangedWarning(t *testing.T) {
+	s, _ := startTestServer(t)
+	c := &CLI{Addr: s.ActualAddress(), Key: testKey, Pin: strings.Repeat("00", 32)}
+	var err error
+	out := captureOutput(t, func() { err = c.connect() })
+	c.c.Close()
+	if err == nil {
+		t.Fatal("connected to a server with a changed certificate")
+	}
+	if !strings.Contains(out, "WARNING: SERVER CERTIFICATE HAS CHANGED!") || !strings.Contains(out, strings.Repeat("00", 32)) {
+		t.Fatalf("printed %q", out)
+	}
+
+	// Other errors aren't warned about.
+	if out := captureOutput(t, func() { warnCertificateChanged(errors.New("failed")) }); out != "" {
+		t.Fatalf("printed %q", out)
+	}
+}
+
+// A proxy to a server which can drop connections as they are accepted.
+type dropProxy struct {
+	listener net.Listener
+	drop     atomic.Int32
+}
+
+// Start a proxy to an address. The proxy is closed when the test finishes.
+func startDropProxy(t *testing.T, addr string) *dropProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &dropProxy{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if p.drop.Add(-1) >= 0 {
+				conn.Close()
+				continue
+			}
+			p.drop.Store(0)
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(target, conn)
+				target.Close()
+			}()
+			go func() {
+				io.Copy(conn, target)
+				conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+func TestReconnect(t *testing.T) {
+	s, dir := startTestServer(t)
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p := startDropProxy(t, s.ActualAddress())
+	c := &CLI{Addr: p.listener.Addr().String(), Key: testKey, SkipVerification: true}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.c.Close()
+	runCommand(t, c, "drive d1")
+
+	// A dropped connection is reconnected and the command retried once,
+	// keeping the selected drive.
+	p.drop.Store(1)
+	out := runCommand(t, c, "ls")
+	if !strings.Contains(out, "Reconnected to") || !strings.Contains(out, "F a") {
+		t.Fatalf("printed %q", out)
+	}
+	if c.drive != "d1" {
+		t.Fatalf("selected drive %q after reconnecting", c.drive)
+	}
+
+	// Failing to reconnect is reported.
+	p.drop.Store(2)
+	out = runCommand(t, c, "ls")
+	if !strings.Contains(out, "failed to reconnect") || strings.Contains(out, "F a") {
+		t.Fatalf("printed %q", out)
+	}
+
+	// The connection is usable again once reconnected.
+	p.drop.Store(1)
+	if out := runCommand(t, c, "ping"); !strings.Contains(out, "PONG") {
+		t.Fatalf("printed %q", out)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{io.EOF, true},
+		{fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true},
+		{syscall.ECONNRESET, true},
+		{&net.OpError{Op: "read", Err: syscall.EPIPE}, true},
+		{os.ErrDeadlineExceeded, true},
+		{errors.New("file does not exist"), false},
+	}
+	for _, test := range tests {
+		if got := isConnectionError(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	s, _ := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	for _, record := range []string{"first record", "second", "third"} {
+		if out := runCommand(t, c, "appendrecord log "+record); out != "" {
+			t.Fatalf("printed %q", out)
+		}
+	}
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"records log 1 2", "1\t\"first record\"\n2\t\"second\"\n"},
+		{"records log 3 10", "3\t\"third\"\n"},
+		{"records log 0 1", "Invalid start record. Records are numbered from 1.\n"},
+		{"records log", "Invalid arguments for records command. Please provide a file, a start record, and a number of records.\n"},
+		{"appendrecord log", "Invalid arguments for appendrecord command. Please provide a file and a record.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	writeFile := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("src", "data")
+	writeFile("existing", "old")
+
+	if out := runCommand(t, c, "cp src dest"); out != "" {
+		t.Fatalf("printed %q", out)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "dest")); err != nil || string(data) != "data" {
+		t.Fatalf("copied %q: %v", data, err)
+	}
+	if out := runCommand(t, c, "cp src existing"); !strings.Contains(out, "path already exists") {
+		t.Errorf("printed %q", out)
+	}
+	if out := runCommand(t, c, "cp src"); out != "Invalid arguments for cp command. Please provide a file to copy and a destination path.\n" {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if out := runCommand(t, c, "mkdir dir"); out != "" {
+		t.Fatalf("printed %q", out)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "dir")); err != nil || !info.IsDir() {
+		t.Fatalf("directory not created: %v", err)
+	}
+
+	// Existing directories are only created again with --exist-ok.
+	if out := runCommand(t, c, "mkdir dir"); out == "" {
+		t.Error("created an existing directory")
+	}
+	if out := runCommand(t, c, "mkdir --exist-ok dir"); out != "" {
+		t.Errorf("printed %q", out)
+	}
+	if out := runCommand(t, c, "mkdir --force dir"); out != "Invalid arguments for mkdir command. Please provide a path to create.\n" {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	s, dir := startTestServerDrive(t, func(dir string) drive.Drive {
+		return drive.NewVersionedDrive(drive.NewDrive(dir), 0, 0)
+	})
+	c := newTestCLI(t, s, "")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("one"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new"), []byte("two"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out := runCommand(t, c, "upload --force "+filepath.Join(dir, "new")+" file"); strings.Contains(out, "rror") {
+		t.Fatalf("printed %q", out)
+	}
+
+	// Each version is listed with its time and size, newest first. Uploading
+	// over a file creates it before writing it, which keeps the empty file.
+	out := runCommand(t, c, "versions file")
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " 0 bytes") {
+		t.Fatalf("printed %q", out)
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 4 || fields[2] != "3" || fields[3] != "bytes" {
+		t.Fatalf("printed %q", out)
+	}
+	if _, err := time.Parse(time.RFC3339, fields[1]); err != nil {
+		t.Fatalf("printed %q: %v", out, err)
+	}
+
+	if out := runCommand(t, c, "restore file "+fields[0]); out != "" {
+		t.Fatalf("printed %q", out)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "one" {
+		t.Fatalf("restored %q: %v", data, err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"versions", "Invalid arguments for versions command. Please provide a file.\n"},
+		{"restore file", "Invalid arguments for restore command. Please provide a file and a version.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+	if out := runCommand(t, c, "restore file latest"); !strings.Contains(out, "invalid version") {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestDropCache(t *testing.T) {
+	s, _ := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"dropcache d1", ""},
+		{"dropcache", "Invalid arguments for dropcache command. Please provide a drive.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+	if out := runCommand(t, c, "dropcache missing"); !strings.Contains(out, "unknown drive") {
+		t.Errorf("printed %q", out)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"checksum file", "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7\n"},
+		{"checksum", "Invalid arguments for checksum command. Please provide a file.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+	if out := runCommand(t, c, "checksum missing"); out == "" {
+		t.Error("printed no error for a missing file")
+	}
+}
+
+func TestKeyQuota(t *testing.T) {
+	s, _ := startTestServer(t)
+	c := newTestCLI(t, s, "")
+
+	// Keys without quotas are unlimited.
+	if out, want := runCommand(t, c, "keyquota"), "Used: 0 bytes (unlimited)\n"; out != want {
+		t.Fatalf("printed %q, want %q", out, want)
+	}
+}
+
+func TestCount(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.MkdirAll(filepath.Join(dir, "dir", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dir", "sub", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"count dir", "Files: 1\nDirectories: 1\nSize: 4 bytes\n"},
+		{"count", "Files: 1\nDirectories: 2\nSize: 4 bytes\n"},
+		{"count a b", "Invalid arguments for count command. Please provide a directory.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "index"), []byte("v1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"deploy " + local + " site", "Deployed " + local + " to site\n"},
+		{"deploy " + local, "Invalid arguments for deploy command. Please provide a local directory and a path to deploy it to.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "site", "index")); err != nil || string(data) != "v1" {
+		t.Fatalf("deployed %q: %v", data, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dir", "file"), make([]byte, 1536), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"usage", "Usage: 1.5 KiB (1536 bytes)\n"},
+		{"usage dir", "Usage: 1.5 KiB (1536 bytes)\n"},
+		{"usage a b", "Invalid arguments for usage command. Please provide a path.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+
+	// The quota of the drive is shown, if it has one.
+	s, dir = startTestServerDrive(t, func(dir string) drive.Drive {
+		return drive.NewDriveWithOptions(dir, drive.Options{Quota: 4096})
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), make([]byte, 1024), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := "Usage: 1.0 KiB (1024 bytes)\nDrive quota: 4.0 KiB (3072 bytes remaining)\n"
+	if out := runCommand(t, newTestCLI(t, s, ""), "usage"); out != want {
+		t.Fatalf("printed %q, want %q", out, want)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{1 << 62, "4.0 EiB"},
+	}
+	for _, test := range tests {
+		if got := formatSize(test.size); got != test.want {
+			t.Errorf("formatted %d as %q, want %q", test.size, got, test.want)
+		}
+	}
+}
+
+func TestMoveDrive(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"movedrive file d1 moved", ""},
+		{"movedrive file d1", "Invalid arguments for movedrive command. Please provide a file to move, a destination drive, and a destination path.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "moved")); err != nil || string(data) != "data" {
+		t.Fatalf("moved %q: %v", data, err)
+	}
+	if out := runCommand(t, c, "movedrive moved d2 file"); out == "" {
+		t.Error("printed no error for an unknown drive")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, _ := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	out := runCommand(t, c, "status")
+	if !regexp.MustCompile(`^Uptime: \d+s\nBusy workers: \d+ of 5\nQueued: 0\nDrives: 1 \(0 unhealthy\)\n$`).MatchString(out) {
+		t.Fatalf("printed %q", out)
+	}
+}
+
+func TestStat(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "file"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// The modification time is shown after the size.
+	out := runCommand(t, c, "stat file")
+	want := "file\nType: File\nSize: 4 bytes\nModified: " + mtime.Local().Format(time.RFC3339) + "\n"
+	if !strings.HasPrefix(out, want) {
+		t.Fatalf("printed %q, want it to start with %q", out, want)
+	}
+}
+
+func TestChown(t *testing.T) {
+	s, dir := startTestServer(t)
+	c := newTestCLI(t, s, "")
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"chown file", "Invalid arguments for chown command. Please provide a path, a user ID, and a group ID.\n"},
+		{"chown file root 0", "Invalid user ID.\n"},
+		{"chown file 0 wheel", "Invalid group ID.\n"},
+	}
+	for _, test := range tests {
+		if out := runCommand(t, c, test.cmd); out != test.want {
+			t.Errorf("%s: printed %q, want %q", test.cmd, out, test.want)
+		}
+	}
+
+	// The owner is shown by stat.
+	if out, want := runCommand(t, c, "stat file"), fmt.Sprintf("Owner: %d %d\n", os.Getuid(), os.Getgid()); !strings.HasSuffix(out, want) {
+		t.Fatalf("printed %q, want it to end with %q", out, want)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	if out := runCommand(t, c, "chown file 1234 -1"); out != "" {
+		t.Fatalf("printed %q", out)
+	}
+	if out := runCommand(t, c, "stat file"); !strings.HasSuffix(out, fmt.Sprintf("Owner: 1234 %d\n", os.Getgid())) {
+		t.Fatalf("printed %q", out)
+	}
+}
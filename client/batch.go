@@ -0,0 +1,88 @@
+// client/batch.go
+// Batches of simple operations in a single request.
+
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+// An operation of a batch.
+type Operation struct {
+	// The kind of operation: "create", "mkdir", "remove", or "move".
+	Kind string
+
+	Drive string
+	Path  string
+
+	// The destination of a move.
+	Dest string
+}
+
+// The result of an operation of a batch. Err is nil if the operation
+// succeeded.
+type OpResult struct {
+	Err error
+}
+
+// Apply a list of create, mkdir, remove, and move operations on the server in
+// a single request, in order. Failed operations don't abort the batch; the
+// result of each operation is returned in the same order.
+func (c *client) Batch(ops []Operation) ([]OpResult, error) {
+	if len(ops) == 0 {
+		return []OpResult{}, nil
+	}
+
+	// Encode the operations.
+	var args strings.Builder
+	for _, op := range ops {
+		for _, arg := range []string{op.Kind, op.Drive, op.Path, op.Dest} {
+			if strings.Contains(arg, "\n") {
+				return nil, errors.New("invalid operation: arguments can't contain newlines")
+			}
+			args.WriteString(arg + "\n")
+		}
+	}
+
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("batch", c.key, args.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the result of each operation.
+	results := make([]OpResult, len(ops))
+	for i := range results {
+		line, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "error ") {
+			results[i].Err = errors.New(strings.TrimPrefix(line, "error "))
+		} else if line != "ok" {
+			return nil, errors.New("invalid server response")
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,241 @@
+// client/cache.go
+// Local on-disk caching of reads.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The prefix of files being fetched into the cache.
+const cacheTempPrefix = ".tmp-"
+
+// A local on-disk cache of files read from the server. Cached files are
+// validated against the checksum of the file on the server before use, so
+// changed files are fetched again, and corrupted cache files are replaced.
+// The least recently used files are evicted once the cache is full.
+type readCache struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*cacheEntry
+}
+
+// A cached file.
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// Set a local directory to cache files read from the server in, holding up to
+// maxSize bytes. Reads check the checksum of the file on the server and use
+// the cached copy if it matches, otherwise they fetch the file and cache it.
+// The least recently used files are evicted once the cache is full. An empty
+// directory disables the cache.
+func (c *client) SetCache(dir string, maxSize int64) error {
+	if dir == "" {
+		c.cache = nil
+		return nil
+	}
+	if maxSize <= 0 {
+		return errors.New("invalid cache size")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Load the files already in the cache, removing any partial fetches.
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	cache := &readCache{dir: dir, maxSize: maxSize, entries: map[string]*cacheEntry{}}
+	for i := range items {
+		path := filepath.Join(dir, items[i].Name())
+		if strings.HasPrefix(items[i].Name(), cacheTempPrefix) {
+			os.Remove(path)
+			continue
+		}
+		info, err := items[i].Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		cache.entries[items[i].Name()] = &cacheEntry{size: info.Size(), used: info.ModTime()}
+		cache.size += info.Size()
+	}
+	cache.lock.Lock()
+	cache.evict()
+	cache.lock.Unlock()
+
+	c.cache = cache
+	return nil
+}
+
+// Read a file on the server into a stream through the cache.
+func (c *client) cachedRead(ctx context.Context, drive, path string, stream io.Writer) (int64, error) {
+	checksum, err := c.Checksum(drive, path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Use the cached copy if it is up to date.
+	name := cacheName(c.addr, drive, path)
+	if n, ok, err := c.cache.get(name, checksum, stream); ok || err != nil {
+		return n, err
+	}
+
+	// Fetch the file, caching it if it matches the checksum. Failing to
+	// cache the file doesn't fail the read.
+	tmp, err := os.CreateTemp(c.cache.dir, cacheTempPrefix+"*")
+	if err != nil {
+		return c.read(ctx, drive+"\n"+path+"\n", stream)
+	}
+	hash := sha256.New()
+	cw := &cacheWriter{file: tmp}
+	n, err := c.read(ctx, drive+"\n"+path+"\n", io.MultiWriter(stream, hash, cw))
+	closeErr := tmp.Close()
+	if err != nil || cw.err != nil || closeErr != nil || hex.EncodeToString(hash.Sum(nil)) != checksum {
+		os.Remove(tmp.Name())
+		return n, err
+	}
+	c.cache.put(name, tmp.Name(), n)
+	return n, nil
+}
+
+// Get the name of the cache file of a file on a server.
+func cacheName(addr, drive, path string) string {
+	sum := sha256.Sum256([]byte(addr + "\x00" + drive + "\x00" + path))
+	return hex.EncodeToString(sum[:])
+}
+
+// A writer to a cache file, which records the first error instead of
+// returning it, so the read it is fetched with doesn't fail.
+type cacheWriter struct {
+	file *os.File
+	err  error
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// Copy a cached file into a stream if its checksum matches. Returns false if
+// the file isn't cached or is stale or corrupted, in which case it is
+// removed. Errors are only returned if writing to the stream fails.
+func (cache *readCache) get(name, checksum string, stream io.Writer) (int64, bool, error) {
+	cache.lock.Lock()
+	_, ok := cache.entries[name]
+	cache.lock.Unlock()
+	if !ok {
+		return 0, false, nil
+	}
+
+	// Verify the cached file.
+	path := filepath.Join(cache.dir, name)
+	if !verifyCacheFile(path, checksum) {
+		cache.remove(name)
+		return 0, false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		cache.remove(name)
+		return 0, false, nil
+	}
+	defer file.Close()
+
+	// Mark the file as used, both in memory and on disk, so the order is
+	// kept across clients.
+	now := time.Now()
+	cache.lock.Lock()
+	if entry, ok := cache.entries[name]; ok {
+		entry.used = now
+	}
+	cache.lock.Unlock()
+	os.Chtimes(path, now, now)
+
+	n, err := io.Copy(stream, file)
+	return n, true, err
+}
+
+// Check if a cache file matches a checksum.
+func verifyCacheFile(path, checksum string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == checksum
+}
+
+// Add a fetched file to the cache, evicting the least recently used files if
+// the cache is full. Files larger than the cache aren't kept.
+func (cache *readCache) put(name, tmpPath string, size int64) {
+	if size > cache.maxSize {
+		os.Remove(tmpPath)
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if err := os.Rename(tmpPath, filepath.Join(cache.dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if entry, ok := cache.entries[name]; ok {
+		cache.size -= entry.size
+	}
+	cache.entries[name] = &cacheEntry{size: size, used: time.Now()}
+	cache.size += size
+	cache.evict()
+}
+
+// Remove a file from the cache.
+func (cache *readCache) remove(name string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if entry, ok := cache.entries[name]; ok {
+		cache.size -= entry.size
+		delete(cache.entries, name)
+	}
+	os.Remove(filepath.Join(cache.dir, name))
+}
+
+// Evict the least recently used files until the cache fits its size. The
+// lock must be held.
+func (cache *readCache) evict() {
+	if cache.size <= cache.maxSize {
+		return
+	}
+	names := make([]string, 0, len(cache.entries))
+	for name := range cache.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return cache.entries[names[i]].used.Before(cache.entries[names[j]].used)
+	})
+	for _, name := range names {
+		if cache.size <= cache.maxSize {
+			return
+		}
+		cache.size -= cache.entries[name].size
+		delete(cache.entries, name)
+		os.Remove(filepath.Join(cache.dir, name))
+	}
+}
@@ -0,0 +1,209 @@
+// client/cache_test.go
+// Tests for the local read cache.
+
+package client_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// A drive which counts the files read from it.
+type readCountingDrive struct {
+	drive.Drive
+	reads atomic.Int64
+}
+
+func (d *readCountingDrive) Read(path string, stream io.Writer) error {
+	d.reads.Add(1)
+	return d.Drive.Read(path, stream)
+}
+
+func (d *readCountingDrive) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	d.reads.Add(1)
+	return d.Drive.ReadRange(path, stream, offset, length)
+}
+
+// Start a test server whose drive d1 counts the files read from it.
+func startCountingServer(t *testing.T) (server.Server, string, *readCountingDrive) {
+	t.Helper()
+	var counting *readCountingDrive
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		drives := s.Drives()
+		counting = &readCountingDrive{Drive: drives["d1"]}
+		drives["d1"] = counting
+		s.SetDrives(drives)
+	})
+	return s, dir, counting
+}
+
+// Read a file through a client, checking its contents.
+func readThrough(t *testing.T, c client.Client, path, want string) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	n, err := c.Read("d1", path, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want || n != int64(len(want)) {
+		t.Fatalf("read %d bytes %q, want %q", n, buf.String(), want)
+	}
+}
+
+// List the files in a cache directory.
+func cacheFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Name())
+	}
+	return names
+}
+
+func TestCacheHit(t *testing.T) {
+	s, dir, counting := startCountingServer(t)
+	writeFiles(t, dir, map[string]string{"file": "cached data"})
+	cacheDir := t.TempDir()
+	c := newTestClient(t, s)
+	if err := c.SetCache(cacheDir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read fetches the file, and later reads use the cache.
+	for i := 0; i < 3; i++ {
+		readThrough(t, c, "file", "cached data")
+	}
+	if reads := counting.reads.Load(); reads != 1 {
+		t.Fatalf("read the file from the server %d times, want 1", reads)
+	}
+
+	// The cache is kept across clients.
+	other := newTestClient(t, s)
+	if err := other.SetCache(cacheDir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	readThrough(t, other, "file", "cached data")
+	if reads := counting.reads.Load(); reads != 1 {
+		t.Fatalf("read the file from the server %d times, want 1", reads)
+	}
+
+	// Disabling the cache reads from the server again.
+	if err := c.SetCache("", 0); err != nil {
+		t.Fatal(err)
+	}
+	readThrough(t, c, "file", "cached data")
+	if reads := counting.reads.Load(); reads != 2 {
+		t.Fatalf("read the file from the server %d times, want 2", reads)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	s, dir, counting := startCountingServer(t)
+	writeFiles(t, dir, map[string]string{"file": "old"})
+	cacheDir := t.TempDir()
+	c := newTestClient(t, s)
+	if err := c.SetCache(cacheDir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	readThrough(t, c, "file", "old")
+
+	// Changed files are fetched again.
+	writeFiles(t, dir, map[string]string{"file": "new"})
+	readThrough(t, c, "file", "new")
+	readThrough(t, c, "file", "new")
+	if reads := counting.reads.Load(); reads != 2 {
+		t.Fatalf("read the file from the server %d times, want 2", reads)
+	}
+
+	// Corrupted cache files are replaced.
+	files := cacheFiles(t, cacheDir)
+	if len(files) != 1 {
+		t.Fatalf("cache holds %v", files)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, files[0]), []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	readThrough(t, c, "file", "new")
+	readThrough(t, c, "file", "new")
+	if reads := counting.reads.Load(); reads != 3 {
+		t.Fatalf("read the file from the server %d times, want 3", reads)
+	}
+
+	// Removed files can't be read from the cache.
+	if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read("d1", "file", io.Discard); err == nil {
+		t.Fatal("read a removed file")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	s, dir, counting := startCountingServer(t)
+	writeFiles(t, dir, map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc", "large": strings.Repeat("l", 20)})
+	cacheDir := t.TempDir()
+	c := newTestClient(t, s)
+	if err := c.SetCache(cacheDir, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Using a keeps it, so caching c evicts b, the least recently used.
+	readThrough(t, c, "a", "aaaa")
+	readThrough(t, c, "b", "bbbb")
+	readThrough(t, c, "a", "aaaa")
+	readThrough(t, c, "c", "cccc")
+	if files := cacheFiles(t, cacheDir); len(files) != 2 {
+		t.Fatalf("cache holds %v", files)
+	}
+	before := counting.reads.Load()
+	readThrough(t, c, "a", "aaaa")
+	readThrough(t, c, "c", "cccc")
+	if reads := counting.reads.Load() - before; reads != 0 {
+		t.Fatalf("read cached files from the server %d times", reads)
+	}
+	readThrough(t, c, "b", "bbbb")
+	if reads := counting.reads.Load() - before; reads != 1 {
+		t.Fatalf("read the evicted file from the server %d times, want 1", reads)
+	}
+
+	// Files larger than the cache aren't kept.
+	before = counting.reads.Load()
+	readThrough(t, c, "large", strings.Repeat("l", 20))
+	readThrough(t, c, "large", strings.Repeat("l", 20))
+	if reads := counting.reads.Load() - before; reads != 2 {
+		t.Fatalf("read the large file from the server %d times, want 2", reads)
+	}
+}
+
+func TestSetCache(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := c.SetCache(t.TempDir(), 0); err == nil || !strings.Contains(err.Error(), "invalid cache size") {
+		t.Fatalf("got %v, want an invalid cache size error", err)
+	}
+
+	// Partial fetches are removed, and caches over their size are evicted
+	// down to it.
+	cacheDir := t.TempDir()
+	writeFiles(t, cacheDir, map[string]string{".tmp-partial": "partial", "a": "aaaa", "b": "bbbb"})
+	if err := c.SetCache(cacheDir, 5); err != nil {
+		t.Fatal(err)
+	}
+	if files := cacheFiles(t, cacheDir); len(files) != 1 || files[0] == ".tmp-partial" {
+		t.Fatalf("cache holds %v", files)
+	}
+}
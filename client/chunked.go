@@ -0,0 +1,111 @@
+// client/chunked.go
+// Chunked, pull-based reads.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// A reader for a file on the server, which requests each chunk of the file
+// only once the previous chunk has been consumed. This gives the reader
+// control over the rate at which the server sends data. Pauses between chunks
+// must be shorter than the connection timeout.
+type ChunkedReader struct {
+	r    *request
+	size int64
+	n    int64
+	eof  bool
+}
+
+// Read a file on the server one chunk at a time. Each chunk is only requested
+// once the previous one has been consumed, so a slow reader paces the server.
+// The reader must be closed.
+func (c *client) ReadChunked(drive, path string) (*ChunkedReader, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the request.
+	err = r.sendSimpleRequest("readchunks", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		r.conn.Close()
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		r.conn.Close()
+		return nil, err
+	}
+
+	// Get the size of the file.
+	sizeStr, err := r.getString()
+	if err != nil {
+		r.conn.Close()
+		return nil, err
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		r.conn.Close()
+		return nil, err
+	}
+
+	return &ChunkedReader{r: r, size: size}, nil
+}
+
+// Get the size of the file.
+func (c *ChunkedReader) Size() int64 {
+	return c.size
+}
+
+// Read from the file, requesting the next chunk if the current one has been
+// consumed.
+func (c *ChunkedReader) Read(p []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+
+	// Request the next chunk.
+	if c.n == 0 {
+		if err := c.r.sendString("NEXT"); err != nil {
+			return 0, err
+		}
+		lenStr, err := c.r.getString()
+		if err != nil {
+			return 0, err
+		}
+		c.n, err = strconv.ParseInt(lenStr, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if c.n < 0 {
+			return 0, errors.New("invalid server response")
+		}
+		if c.n == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+	}
+
+	// Read from the current chunk.
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.reader.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+// Close the reader, stopping the transfer.
+func (c *ChunkedReader) Close() error {
+	if !c.eof {
+		c.r.sendString("DONE")
+	}
+	return c.r.conn.Close()
+}
@@ -0,0 +1,62 @@
+// client/chunked_test.go
+// Tests for chunked, pull-based reads.
+
+package client_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+func TestReadChunked(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	data := make([]byte, 2*protocol.ChunkSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for name, contents := range map[string][]byte{"file": data, "empty": nil} {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string][]byte{"file": data, "empty": nil} {
+		reader, err := c.ReadChunked("d1", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.Size() != int64(len(want)) {
+			t.Errorf("%s has size %d, want %d", name, reader.Size(), len(want))
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("read %d bytes of %s: %v", len(got), name, err)
+		}
+	}
+
+	// Closing the reader part way through stops the transfer.
+	reader, err := c.ReadChunked("d1", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatalf("server failed after a closed transfer: %v", err)
+	}
+
+	if _, err := c.ReadChunked("d1", "missing"); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
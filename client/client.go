@@ -5,17 +5,51 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"io"
+	"net/http"
+	"sync"
 	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+	"github.com/hashicorp/yamux"
 )
 
+// A progress event of a long-running command.
+type Progress = protocol.Progress
+
 // The client interface.
 type Client interface {
-	// Set the address and key of the server to connect to.
-	Connect(addr, key string)
+	// Set the address and key of the server to connect to, and optionally the
+	// server name to verify the server's certificate against. The server name
+	// is needed when dialing an IP address for a certificate issued to a
+	// hostname.
+	Connect(addr, key string, serverName ...string)
+
+	// Close the client, releasing any persistent connections.
+	Close() error
+
+	// Get a client which sends flags with each request, as key=value options
+	// commands may interpret. Servers ignore flags they don't support. The
+	// client shares its connections with this client.
+	WithFlags(flags map[string]string) Client
+
+	// Get a client which asks for progress events from long-running
+	// commands which support them (removetree, manifest, and copy), calling
+	// the progress function with each event.
+	WithProgress(progress func(Progress)) Client
+
+	// Get a client which sends an idempotency key with each request, such as
+	// one from NewIdempotencyKey. Mutating requests with the same key are
+	// only executed once by the server, and retries are sent the outcome of
+	// the first, so a request can be safely retried if its response is lost.
+	// Use a new key for each operation.
+	WithIdempotencyKey(key string) Client
 
 	// Insecure skip verify.
 	InsecureSkipVerify() bool
@@ -32,36 +66,342 @@ type Client interface {
 	// Add a root CA.
 	AddRootCA(cert []byte) error
 
+	// Pin the certificate of the server to a SHA-256 fingerprint, as a hex
+	// string (colons are ignored). The certificate is verified against the
+	// fingerprint in place of the root CAs.
+	PinCertificate(fingerprint string)
+
+	// Set a known hosts file to trust the certificate of the server on first
+	// use. The fingerprint of the certificate is recorded on the first
+	// connection, and later connections fail with a CertificateChangedError
+	// if the certificate changes. The certificate is verified against the
+	// fingerprint in place of the root CAs.
+	SetKnownHostsFile(path string)
+
+	// If requests are multiplexed over a single connection.
+	Multiplexing() bool
+
+	// Set if requests are multiplexed over a single connection.
+	SetMultiplexing(v bool)
+
+	// Set the maximum number of idle connections kept to reuse for later
+	// requests, instead of dialing a new connection for each request. Zero
+	// disables pooling, which is the default. Connections are only reused
+	// once their response has been read completely.
+	SetMaxIdleConns(n int)
+
+	// Set the secret to sign connections with. Signed connections carry
+	// each message in frames signed with an HMAC, so tampering is detected
+	// even without end-to-end TLS. The server must have the same secret for
+	// the key. Nil disables signing.
+	SetHMACSecret(secret []byte)
+
+	// Get the bandwidth limit of each connection in bytes per second. Zero
+	// means unlimited.
+	BandwidthLimit() int64
+
+	// Set the bandwidth limit of each connection in bytes per second, in
+	// each direction. Reads and writes sleep as needed to honor the limit.
+	// Zero means unlimited.
+	SetBandwidthLimit(bps int64)
+
+	// If the data of reads and writes is compressed.
+	Compression() bool
+
+	// Set if the data of reads and writes is compressed with gzip. Reads ask
+	// the server to compress their data, and writes are compressed if the
+	// server supports it. Small files are sent as is.
+	SetCompression(v bool)
+
+	// Set a local directory to cache files read from the server in, holding
+	// up to maxSize bytes. Reads check the checksum of the file on the
+	// server and use the cached copy if it matches, otherwise they fetch the
+	// file and cache it. The least recently used files are evicted once the
+	// cache is full. An empty directory disables the cache.
+	SetCache(dir string, maxSize int64) error
+
+	// Get the interval followed files are polled on.
+	FollowInterval() time.Duration
+
+	// Set the interval followed files are polled on.
+	SetFollowInterval(interval time.Duration)
+
 	// Ping the server.
 	Ping() error
 
+	// Get the current time of the server, in its local time zone.
+	ServerTime() (time.Time, error)
+
+	// Estimate the skew of the server's clock relative to the client's,
+	// using the round-trip time of the request. Positive skew means the
+	// server's clock is ahead.
+	ClockSkew() (time.Duration, error)
+
+	// Get the load of the server, including the backoff it suggests before
+	// further requests.
+	Load() (LoadInfo, error)
+
+	// Get the status of the server: its uptime, workers, queued requests,
+	// and drives. The status needs no valid key, so it can be used as a
+	// health check.
+	Status() (ServerStatus, error)
+
+	// Get the bytes used by the files written with the client's key, and
+	// its quota. A zero quota is unlimited.
+	KeyQuota() (used, quota int64, err error)
+
 	// Get the drives on the server.
 	Drives() ([]string, error)
 
+	// Make a drive on the server read-only, or writable again. Requires an
+	// admin key.
+	SetDriveReadOnly(drive string, readOnly bool) error
+
+	// Drop the caches of a drive on the server, so it reflects changes made
+	// to its files outside the server. Requires an admin key.
+	DropCache(drive string) error
+
+	// Get the active sessions on the server. Requires an admin key.
+	Sessions() ([]SessionInfo, error)
+
+	// Forcibly close the connection of an active session on the server.
+	// Requires an admin key.
+	Kill(id uint64) error
+
+	// Get the drives on the server, along with their types, capabilities,
+	// quotas, usage, and availability.
+	DrivesInfo() ([]DriveInfo, error)
+
 	// Create a file on the server.
 	Create(drive, path string) error
 
-	// Create a directory on the server.
-	Mkdir(drive, path string) error
+	// Create a file of a given size on the server, without sending its
+	// contents.
+	CreateSized(drive, path string, size int64) error
+
+	// Create a uniquely named file in a directory on the server, like
+	// os.CreateTemp. The name is generated from the pattern, with the last
+	// "*" replaced by a random string. Returns the path of the file.
+	CreateTemp(drive, dir, pattern string) (string, error)
+
+	// Create a directory on the server. If existOK is true, creating a
+	// directory which already exists succeeds, but creating over a file still
+	// fails.
+	Mkdir(drive, path string, existOK bool) error
 
 	// Read a file on the server into a stream.
 	Read(drive, path string, stream io.Writer) (int64, error)
 
-	// List a directory on the server.
-	List(drive, path string) ([]DirItem, error)
+	// Read a file on the server into a stream. The context's deadline
+	// applies to the whole read, and cancelling the context aborts it,
+	// closing the connection and returning the context's error.
+	ReadContext(ctx context.Context, drive, path string, stream io.Writer) (int64, error)
+
+	// Read a text file on the server into a stream, transcoded from UTF-8 to
+	// an encoding (e.g. "utf-16le" or "shift_jis").
+	ReadEncoded(drive, path, encoding string, stream io.Writer) (int64, error)
+
+	// Read a file on the server one chunk at a time. Each chunk is only
+	// requested once the previous one has been consumed, so a slow reader
+	// paces the server. The reader must be closed.
+	ReadChunked(drive, path string) (*ChunkedReader, error)
+
+	// Read a byte range of a file on the server into a stream. Reading past
+	// the end of the file only reads the available data.
+	ReadRange(drive, path string, offset, length int64, stream io.Writer) (int64, error)
+
+	// Read many small files on the server in one request, returning their
+	// contents keyed by path. Files larger than ReadManyMaxSize aren't read.
+	// If some of the files can't be read, the rest are still returned, along
+	// with a *ReadManyError holding the error of each file which failed.
+	ReadMany(drive string, paths []string) (map[string][]byte, error)
+
+	// Read a range of lines from a file on the server, starting at the line
+	// at index start (from zero). Lines past the end of the file are not
+	// returned. The lines don't include their trailing newlines.
+	ReadLines(drive, path string, start, count int) ([]string, error)
+
+	// Append a record to a file on the server, framed by its length,
+	// creating the file if it doesn't exist. Concurrent appends never
+	// interleave.
+	AppendRecord(drive, path string, record []byte) error
+
+	// Read a range of records from a record file on the server, starting at
+	// the record at index start. At most count records are returned, fewer
+	// if the end of the file is reached or the records are too large to
+	// return at once.
+	ReadRecords(drive, path string, start, count int) ([][]byte, error)
+
+	// Read a file on the server in parallel byte ranges, writing each range
+	// to its offset in the writer.
+	ParallelRead(drive, path string, w io.WriterAt, parts int) (int64, error)
+
+	// Follow a file on the server, like tail -f, writing the data appended
+	// to it to a stream. The file is polled every follow interval, and is
+	// followed from the start again if it shrinks. Runs until the file can't
+	// be read or writing to the stream fails.
+	Follow(drive, path string, stream io.Writer) error
+
+	// List a directory on the server, optionally only the entries whose names
+	// match a glob pattern (e.g. "*.txt").
+	List(drive, path string, pattern ...string) ([]DirItem, error)
+
+	// List a directory on the server with the size and modification time of
+	// each entry, optionally only the entries whose names match a glob
+	// pattern. The entries are sent as JSON, so their names may contain any
+	// character.
+	ListJSON(drive, path string, pattern ...string) ([]DirEntry, error)
 
 	// Stat a path on the server.
 	Stat(drive, path string) (PathInfo, error)
 
 	// Write a file on the server from a stream. Stops writing once the stream
-	// encounters an EOF.
-	Write(drive, path string, size int64, stream io.Reader) error
+	// encounters an EOF. Returns the SHA-256 checksum of the data the server
+	// received, as a hex string, and fails if it doesn't match the data sent.
+	Write(drive, path string, size int64, stream io.Reader) (string, error)
+
+	// Write a file on the server from a stream. The context's deadline
+	// applies to the whole write, and cancelling the context aborts it,
+	// closing the connection and returning the context's error.
+	WriteContext(ctx context.Context, drive, path string, size int64, stream io.Reader) (string, error)
+
+	// Write a text file on the server from a stream in an encoding (e.g.
+	// "utf-16le" or "shift_jis"), transcoded to UTF-8. The size is the size
+	// of the encoded data. Returns the SHA-256 checksum of the stored UTF-8
+	// data, as a hex string.
+	WriteEncoded(drive, path, encoding string, size int64, stream io.Reader) (string, error)
+
+	// Write size bytes from a stream into an existing file on the server at
+	// an offset, without truncating the rest of the file. Writing past the
+	// end of the file extends it. Fails if the data the server received
+	// doesn't match the data sent.
+	WriteAt(drive, path string, offset int64, size int64, stream io.Reader) error
+
+	// Append size bytes from a stream to the end of a file on the server,
+	// creating the file if it doesn't exist. Fails if the data the server
+	// received doesn't match the data sent.
+	Append(drive, path string, size int64, stream io.Reader) error
+
+	// Replace the contents of a file on the server with new contents if its
+	// current contents equal the expected contents. The comparison and the
+	// write are atomic. Returns if the contents were swapped.
+	CompareAndSwap(drive, path string, expected, new []byte) (bool, error)
 
 	// Remove a file from the server.
 	Remove(drive, path string) error
 
-	// Move a file on the server.
+	// Recursively remove a directory on the server. The confirm function is
+	// called with the number of paths to remove, and the removal only
+	// proceeds if it returns true. The progress function, if not nil, is
+	// called with the number of paths removed so far after each batch.
+	RemoveTree(drive, path string, confirm func(count int) bool, progress func(removed int)) error
+
+	// Move a file or directory on the server.
 	Move(drive, src, dest string) error
+
+	// Move a file from one drive to another on the server. The file is
+	// copied to a temporary file next to the destination, verified, and
+	// renamed into place, then the source is removed. Moves within a drive
+	// are regular moves.
+	MoveCrossDrive(srcDrive, src, destDrive, dest string) error
+
+	// Copy a file on the server, failing if the destination already exists. An
+	// interrupted copy of an unchanged source resumes where it left off when
+	// retried.
+	Copy(drive, src, dest string) error
+
+	// Flush a file or directory on the server to stable storage.
+	Sync(drive, path string) error
+
+	// Change the user and group IDs of the owner of a file or directory on
+	// the server. A negative ID leaves it unchanged. Requires an admin key,
+	// and the server to have the privileges to change ownership.
+	Chown(drive, path string, uid, gid int) error
+
+	// Compute the SHA-256 checksum of a file on the server, as a hex string.
+	Checksum(drive, path string) (string, error)
+
+	// Compare the contents of two files on a drive on the server, without
+	// transferring them. Returns if the files are equal.
+	Compare(drive, pathA, pathB string) (bool, error)
+
+	// Get the quota, usage, and remaining headroom of a drive on the server.
+	QuotaInfo(drive string) (QuotaInfo, error)
+
+	// Get the total size in bytes of the files under a path on the server.
+	Usage(drive, path string) (int64, error)
+
+	// Upload a file to the server, resuming a previous partial upload of it.
+	// The size of the file on the server is taken as the amount already
+	// uploaded, and only the rest of the stream is written. The whole file is
+	// then verified against the stream. Returns the checksum of the file.
+	ResumeWrite(drive, path string, size int64, stream io.ReadSeeker) (string, error)
+
+	// Move a file on the server by copying it, verifying the checksum of the
+	// copy, and then removing the source. If verification fails, the copy is
+	// removed and the source is left intact.
+	SafeMove(drive, src, dest string) error
+
+	// Move a file between drives on the server by copying it, verifying the
+	// checksum of the copy, and then removing the source. If verification
+	// fails, the copy is removed and the source is left intact.
+	SafeMoveCrossDrive(srcDrive, src, destDrive, dest string) error
+
+	// Get the total size in bytes and the number of files under a directory
+	// on the server.
+	DirSize(drive, path string) (size int64, count int, err error)
+
+	// Count the files and directories under a directory on the server, and
+	// the total size of the files in bytes, without listing them. The
+	// directory itself isn't counted.
+	CountTree(drive, path string) (files, dirs int, bytes int64, err error)
+
+	// Get the checksums of every file under a directory on the server, keyed
+	// by path relative to the directory.
+	Manifest(drive, path string) (map[string]FileDigest, error)
+
+	// Verify the files on a drive against a manifest of SHA-256 checksums,
+	// keyed by path. The comparison is done on the server, so no file
+	// contents are transferred.
+	Verify(drive string, manifest map[string]string) (VerifyReport, error)
+
+	// Deploy a local directory to a path on the server. The directory is
+	// uploaded to a staging directory and verified, then renamed into place,
+	// with the previous contents of the path kept at <path>.previous for
+	// rollback. If the upload or verification fails, the current deployment
+	// is left untouched.
+	Deploy(localDir, drive, remotePath string) error
+
+	// Apply a list of create, mkdir, remove, and move operations on the
+	// server in a single request, in order. Failed operations don't abort the
+	// batch; the result of each operation is returned in the same order.
+	Batch(ops []Operation) ([]OpResult, error)
+
+	// Begin a transaction on a drive on the server. Operations staged in the
+	// transaction are only applied once it is committed, and are undone if
+	// any fails. Uncommitted transactions are discarded after an hour.
+	Begin(drive string) (*Transaction, error)
+
+	// List the previous versions of a file on a versioned drive, newest
+	// first.
+	ListVersions(drive, path string) ([]Version, error)
+
+	// Read a previous version of a file on a versioned drive into a stream.
+	ReadVersion(drive, path, version string, stream io.Writer) (int64, error)
+
+	// Restore a previous version of a file on a versioned drive. The current
+	// contents of the file are kept as a version, so the restore can be
+	// undone.
+	RestoreVersion(drive, path, version string) error
+
+	// Get an HTTP handler which exposes a drive on the server over WebDAV.
+	// The password of each request's basic auth is used as its key, and
+	// requests without one are unauthorized.
+	WebDAVHandler(drive string) http.Handler
+
+	// Get an HTTP handler which exposes a drive on the server over WebDAV,
+	// serving requests without basic auth with the client's key.
+	WebDAVHandlerWithFallback(drive string) http.Handler
 }
 
 // The client implementation.
@@ -69,12 +409,62 @@ type client struct {
 	addr      string
 	key       string
 	tlsConfig *tls.Config
+	hasRootCA bool
 	timeout   time.Duration
+
+	// The pinned fingerprint of the server certificate, and the known hosts
+	// file to trust it on first use with.
+	pinned     string
+	knownHosts string
+
+	// The interval followed files are polled on.
+	followInterval time.Duration
+
+	// The flags sent with each request.
+	flags map[string]string
+
+	// The function called with progress events.
+	progress func(Progress)
+
+	// The multiplexed session, shared with clients derived with WithFlags.
+	multiplex bool
+	mux       *muxSession
+
+	// The pool of idle connections, shared with clients derived with
+	// WithFlags.
+	pool *connPool
+
+	// The local cache of files read from the server, if enabled.
+	cache *readCache
+
+	// The secret to sign connections with, if signing is enabled.
+	hmacSecret []byte
+
+	// The bandwidth limit of each connection in bytes per second.
+	bandwidth int64
+
+	// If the data of reads and writes is compressed, and if the server
+	// supports it, shared with clients derived with WithFlags.
+	compression bool
+	support     *compressionSupport
 }
 
-// Create a new client.
+// A multiplexed session.
+type muxSession struct {
+	session *yamux.Session
+	lock    sync.Mutex
+}
+
+// Create a new client. Callers should defer Close to release any persistent
+// connections.
 func NewClient(timeout time.Duration) Client {
-	return &client{tlsConfig: &tls.Config{RootCAs: x509.NewCertPool()}, timeout: timeout}
+	return &client{tlsConfig: &tls.Config{
+		RootCAs: x509.NewCertPool(),
+
+		// Cache sessions so later connections resume them, skipping the
+		// full handshake.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}, timeout: timeout, mux: &muxSession{}, pool: &connPool{}, support: &compressionSupport{}}
 }
 
 // Insecure skip verify.
@@ -103,11 +493,99 @@ func (c *client) AddRootCA(cert []byte) error {
 	if !ok {
 		return errors.New("failed to append certificate")
 	}
+	c.hasRootCA = true
 	return nil
 }
 
-// Set the address and key of the server to connect to.
-func (c *client) Connect(addr, key string) {
+// If requests are multiplexed over a single connection.
+func (c *client) Multiplexing() bool {
+	return c.multiplex
+}
+
+// Set if requests are multiplexed over a single connection.
+func (c *client) SetMultiplexing(v bool) {
+	c.multiplex = v
+}
+
+// Set the secret to sign connections with. Nil disables signing.
+func (c *client) SetHMACSecret(secret []byte) {
+	c.hmacSecret = secret
+}
+
+// Get the bandwidth limit of each connection.
+func (c *client) BandwidthLimit() int64 {
+	return c.bandwidth
+}
+
+// Set the bandwidth limit of each connection.
+func (c *client) SetBandwidthLimit(bps int64) {
+	c.bandwidth = bps
+}
+
+// Get a client which sends flags with each request, as key=value options
+// commands may interpret. Servers ignore flags they don't support. The client
+// shares its connections with this client. The flags replace any set by
+// WithProgress, so its progress function isn't kept.
+func (c *client) WithFlags(flags map[string]string) Client {
+	derived := *c
+	derived.flags = flags
+	derived.progress = nil
+	return &derived
+}
+
+// Get a client which sends an additional flag with each request.
+func (c *client) withFlag(key, value string) *client {
+	flags := map[string]string{}
+	for k, v := range c.flags {
+		flags[k] = v
+	}
+	flags[key] = value
+	derived := *c
+	derived.flags = flags
+	return &derived
+}
+
+// Get a client which sends an idempotency key with each request.
+func (c *client) WithIdempotencyKey(key string) Client {
+	return c.withFlag("idempotency", key)
+}
+
+// Get a client which asks for progress events from long-running commands.
+func (c *client) WithProgress(progress func(Progress)) Client {
+	derived := c.withFlag(protocol.ProgressFlag, "true")
+	derived.progress = progress
+	return derived
+}
+
+// Generate a new random idempotency key.
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Set the address and key of the server to connect to, and optionally the
+// server name to verify the server's certificate against.
+func (c *client) Connect(addr, key string, serverName ...string) {
 	c.addr = addr
 	c.key = key
+	if len(serverName) > 0 {
+		c.tlsConfig.ServerName = serverName[0]
+	}
+}
+
+// Close the client, releasing any persistent connections.
+func (c *client) Close() error {
+	c.pool.close()
+
+	c.mux.lock.Lock()
+	defer c.mux.lock.Unlock()
+
+	// Close the multiplexed session.
+	if c.mux.session == nil {
+		return nil
+	}
+	err := c.mux.session.Close()
+	c.mux.session = nil
+	return err
 }
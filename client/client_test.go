@@ -0,0 +1,199 @@
+// client/client_test.go
+// Tests for the client.
+
+package client_test
+
+import (
+	"crypto/tls"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// Wait for a client to be served, retrying until the timeout.
+func waitServed(t *testing.T, c client.Client, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.Ping()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client not served: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Wait for the number of goroutines to fall to at most n, failing with their
+// stacks if it doesn't within the timeout.
+func waitGoroutines(t *testing.T, n int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines left, want at most %d:\n%s", runtime.NumGoroutine(), n, buf)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCloseReleasesConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c client.Client)
+	}{
+		{"multiplexed session", func(c client.Client) { c.SetMultiplexing(true) }},
+		{"idle pool", func(c client.Client) { c.SetMaxIdleConns(4) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The server allows a single connection, so others are only
+			// served once the client's persistent connection is closed.
+			s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+				s.SetConnectionLimit(1, 0)
+			})
+			before := runtime.NumGoroutine()
+			c := newTestClient(t, s)
+			test.setup(c)
+			if err := c.Ping(); err != nil {
+				t.Fatal(err)
+			}
+			if runtime.NumGoroutine() <= before && test.name == "multiplexed session" {
+				t.Fatal("no goroutines started for the session")
+			}
+			other := newTestClient(t, s)
+			if err := other.Ping(); err == nil {
+				t.Fatal("persistent connection not kept open")
+			}
+
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatalf("failed to close twice: %v", err)
+			}
+			waitServed(t, other, 2*time.Second)
+
+			// The goroutines of the connection, on both ends, exit.
+			waitGoroutines(t, before, 2*time.Second)
+		})
+	}
+}
+
+func TestCertificateVerification(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+	_, otherPEM := testCertificate(t)
+	s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	})
+	_, port, _ := net.SplitHostPort(s.ActualAddress())
+	tests := []struct {
+		name       string
+		addr       string
+		serverName []string
+		rootCA     []byte
+		err        string
+	}{
+		{"no root CA", s.ActualAddress(), nil, nil, "no root CAs added"},
+		{"IP address", s.ActualAddress(), nil, certPEM, "not valid for server name 127.0.0.1"},
+		{"wrong server name", s.ActualAddress(), []string{"example.com"}, certPEM, "not valid for server name example.com"},
+		{"unknown CA", s.ActualAddress(), []string{"localhost"}, otherPEM, "not signed by an added root CA"},
+		{"server name", s.ActualAddress(), []string{"localhost"}, certPEM, ""},
+		{"hostname", net.JoinHostPort("localhost", port), nil, certPEM, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := client.NewClient(5 * time.Second)
+			c.Connect(test.addr, testKey, test.serverName...)
+			defer c.Close()
+			if test.rootCA != nil {
+				if err := c.AddRootCA(test.rootCA); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := c.Ping()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestWithFlags(t *testing.T) {
+	received := make(chan map[string]string, 10)
+	s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		s.RegisterCommand("ping", func(r *server.Request) error {
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			received <- r.Flags()
+			return r.SendSuccess("PONG\n")
+		})
+	})
+	c := newTestClient(t, s)
+	flagged := c.WithFlags(map[string]string{"color": "blue", "size": "a b"})
+
+	// The flags are only sent by the derived client.
+	if err := flagged.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if flags := <-received; flags["color"] != "blue" || flags["size"] != "a b" {
+		t.Fatalf("server received flags %v", flags)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if flags := <-received; flags["color"] != "" {
+		t.Fatalf("flags sent by the original client: %v", flags)
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		s.SetBandwidthLimit(100000)
+	})
+	data := strings.Repeat("x", 150000)
+	writeFiles(t, dir, map[string]string{"file": ""})
+
+	// Payloads are throttled by the client's limit when writing, and by the
+	// server's when reading, after a second of data.
+	c := newTestClient(t, s)
+	c.SetBandwidthLimit(100000)
+	if c.BandwidthLimit() != 100000 {
+		t.Fatalf("limit %d, want 100000", c.BandwidthLimit())
+	}
+	start := time.Now()
+	if _, err := c.Write("d1", "file", int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("write took %v, want at least 400ms", elapsed)
+	}
+
+	c.SetBandwidthLimit(0)
+	buf := &strings.Builder{}
+	start = time.Now()
+	if _, err := c.Read("d1", "file", buf); err != nil || buf.String() != data {
+		t.Fatalf("read %d bytes: %v", buf.Len(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("read took %v, want at least 400ms", elapsed)
+	}
+}
@@ -4,9 +4,19 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cubeflix/deepwell/protocol"
 )
@@ -47,6 +57,75 @@ func (c *client) Ping() error {
 	return nil
 }
 
+// Get the current time of the server, in its local time zone.
+func (c *client) ServerTime() (time.Time, error) {
+	serverTime, _, err := c.serverTime()
+	return serverTime, err
+}
+
+// Estimate the skew of the server's clock relative to the client's, as the
+// difference between the server's time and the client's time halfway
+// through the request. Positive skew means the server's clock is ahead.
+func (c *client) ClockSkew() (time.Duration, error) {
+	serverTime, midpoint, err := c.serverTime()
+	if err != nil {
+		return 0, err
+	}
+	return serverTime.Sub(midpoint), nil
+}
+
+// Get the current time of the server, and the client's time halfway through
+// the request.
+func (c *client) serverTime() (time.Time, time.Time, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	sent := time.Now()
+	err = r.sendSimpleRequest("time", c.key, "")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	received := time.Now()
+
+	// Receive the time in UTC, then in the local time zone of the server.
+	if _, err := r.getString(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	localStr, err := r.getString()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	zone, err := r.getString()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	serverTime, err := time.Parse(time.RFC3339Nano, localStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	_, offset := serverTime.Zone()
+	serverTime = serverTime.In(time.FixedZone(zone, offset))
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return serverTime, sent.Add(received.Sub(sent) / 2), nil
+}
+
 // Get the drives on the server.
 func (c *client) Drives() ([]string, error) {
 	// Create a connection.
@@ -96,108 +175,213 @@ func (c *client) Drives() ([]string, error) {
 	return drives, nil
 }
 
-// Create a file on the server.
-func (c *client) Create(drive, path string) error {
+// Server load information.
+type LoadInfo struct {
+	// The number of requests waiting for a worker, and the maximum number
+	// that can wait.
+	Queued    int
+	QueueSize int
+
+	// The number of busy workers, and the total number of workers.
+	Busy    int
+	Workers int
+
+	// The average number of requests per second over the last minute.
+	RequestRate float64
+
+	// The backoff the server suggests before further requests. Zero if the
+	// server isn't overloaded.
+	Backoff time.Duration
+}
+
+// Get the load of the server, including the backoff it suggests before
+// further requests.
+func (c *client) Load() (LoadInfo, error) {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
-		return err
+		return LoadInfo{}, err
 	}
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("create", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("load", c.key, "")
 	if err != nil {
-		return err
+		return LoadInfo{}, err
 	}
 
 	// Receive the header.
 	err = r.receiveHeader()
 	if err != nil {
-		return err
+		return LoadInfo{}, err
 	}
 
+	// Receive the load.
+	lines := make([]string, 6)
+	for i := range lines {
+		lines[i], err = r.getString()
+		if err != nil {
+			return LoadInfo{}, err
+		}
+	}
+	info := LoadInfo{}
+	ints := []*int{&info.Queued, &info.QueueSize, &info.Busy, &info.Workers}
+	for i := range ints {
+		*ints[i], err = strconv.Atoi(lines[i])
+		if err != nil {
+			return LoadInfo{}, err
+		}
+	}
+	info.RequestRate, err = strconv.ParseFloat(lines[4], 64)
+	if err != nil {
+		return LoadInfo{}, err
+	}
+	backoff, err := strconv.ParseInt(lines[5], 10, 64)
+	if err != nil {
+		return LoadInfo{}, err
+	}
+	info.Backoff = time.Duration(backoff) * time.Millisecond
+
 	// Consume.
 	err = r.consume()
 	if err != nil {
-		return err
+		return LoadInfo{}, err
 	}
 
-	return nil
+	return info, nil
+}
+
+// Server status information.
+type ServerStatus struct {
+	// How long the server has been serving for.
+	Uptime time.Duration
+
+	// The number of workers, and the number of them which are busy.
+	Workers int
+	Busy    int
+
+	// The number of requests waiting for a worker.
+	Queued int
+
+	// The number of drives, and the number of them which are unhealthy.
+	Drives          int
+	UnhealthyDrives int
 }
 
-// Create a directory on the server.
-func (c *client) Mkdir(drive, path string) error {
+// Get the status of the server. The status needs no valid key.
+func (c *client) Status() (ServerStatus, error) {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
-		return err
+		return ServerStatus{}, err
 	}
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("mkdir", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("status", c.key, "")
 	if err != nil {
-		return err
+		return ServerStatus{}, err
 	}
 
 	// Receive the header.
 	err = r.receiveHeader()
 	if err != nil {
-		return err
+		return ServerStatus{}, err
+	}
+
+	// Receive the status.
+	lines := make([]string, 6)
+	for i := range lines {
+		lines[i], err = r.getString()
+		if err != nil {
+			return ServerStatus{}, err
+		}
+	}
+	status := ServerStatus{}
+	uptime, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil {
+		return ServerStatus{}, err
+	}
+	status.Uptime = time.Duration(uptime) * time.Millisecond
+	ints := []*int{&status.Workers, &status.Busy, &status.Queued, &status.Drives, &status.UnhealthyDrives}
+	for i := range ints {
+		*ints[i], err = strconv.Atoi(lines[i+1])
+		if err != nil {
+			return ServerStatus{}, err
+		}
 	}
 
 	// Consume.
 	err = r.consume()
 	if err != nil {
-		return err
+		return ServerStatus{}, err
 	}
 
-	return nil
+	return status, nil
 }
 
-// Read a file on the server into a stream.
-func (c *client) Read(drive, path string, stream io.Writer) (int64, error) {
+// Get the bytes used by the files written with the client's key, and its
+// quota.
+func (c *client) KeyQuota() (int64, int64, error) {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("read", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("keyquota", c.key, "")
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	// Receive the header.
 	err = r.receiveHeader()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	// Get the length of the data.
-	lenStr, err := r.getString()
-	if err != nil {
-		return 0, err
+	// Receive the usage and the quota.
+	values := make([]int64, 2)
+	for i := range values {
+		str, err := r.getString()
+		if err != nil {
+			return 0, 0, err
+		}
+		values[i], err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
-	_, err = strconv.ParseInt(lenStr, 10, 64)
+
+	// Consume.
+	err = r.consume()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return io.Copy(stream, r.reader)
+	return values[0], values[1], nil
 }
 
-// A directory list item.
-type DirItem struct {
-	Name  string
-	IsDir bool
+// Drive information.
+type DriveInfo struct {
+	Name     string
+	Type     string
+	Writable bool
+
+	// The storage quota in bytes. Zero means the drive is unlimited.
+	Quota int64
+	Usage int64
+
+	// If the backing store of the drive is available. The usage of an
+	// unavailable drive is reported as zero.
+	Available bool
 }
 
-// List a directory on the server.
-func (c *client) List(drive, path string) ([]DirItem, error) {
+// Get the drives on the server, along with their types, capabilities, quotas,
+// usage, and availability.
+func (c *client) DrivesInfo() ([]DriveInfo, error) {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
@@ -206,7 +390,7 @@ func (c *client) List(drive, path string) ([]DirItem, error) {
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("list", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("drivesinfo", c.key, "")
 	if err != nil {
 		return nil, err
 	}
@@ -217,29 +401,43 @@ func (c *client) List(drive, path string) ([]DirItem, error) {
 		return nil, err
 	}
 
-	// Receive the number of items.
-	numItemsStr, err := r.getString()
+	// Receive the number of drives.
+	numDrivesStr, err := r.getString()
 	if err != nil {
 		return nil, err
 	}
-	numItems, err := strconv.Atoi(numItemsStr)
+	numDrives, err := strconv.Atoi(numDrivesStr)
 	if err != nil {
 		return nil, err
 	}
 
-	items := make([]DirItem, numItems)
-	for i := range items {
-		line, err := r.getString()
+	drives := make([]DriveInfo, numDrives)
+	for i := range drives {
+		lines := make([]string, 6)
+		for j := range lines {
+			lines[j], err = r.getString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		drives[i].Name = lines[0]
+		drives[i].Type = lines[1]
+		drives[i].Writable, err = strconv.ParseBool(lines[2])
 		if err != nil {
 			return nil, err
 		}
-		if len(line) < 2 {
-			return nil, errors.New("invalid server response")
+		drives[i].Quota, err = strconv.ParseInt(lines[3], 10, 64)
+		if err != nil {
+			return nil, err
 		}
-		if line[0] == 'd' {
-			items[i].IsDir = true
+		drives[i].Usage, err = strconv.ParseInt(lines[4], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		drives[i].Available, err = strconv.ParseBool(lines[5])
+		if err != nil {
+			return nil, err
 		}
-		items[i].Name = line[2:]
 	}
 
 	// Consume.
@@ -248,70 +446,42 @@ func (c *client) List(drive, path string) ([]DirItem, error) {
 		return nil, err
 	}
 
-	return items, nil
-}
-
-// Path information.
-type PathInfo struct {
-	IsDir bool
-	Size  int64
+	return drives, nil
 }
 
-// Stat a path on the server.
-func (c *client) Stat(drive, path string) (PathInfo, error) {
+// Make a drive on the server read-only, or writable again. Requires an admin
+// key.
+func (c *client) SetDriveReadOnly(drive string, readOnly bool) error {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
-		return PathInfo{}, err
+		return err
 	}
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("stat", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("setdrivereadonly", c.key, drive+"\n"+strconv.FormatBool(readOnly)+"\n")
 	if err != nil {
-		return PathInfo{}, err
+		return err
 	}
 
 	// Receive the header.
 	err = r.receiveHeader()
 	if err != nil {
-		return PathInfo{}, err
-	}
-
-	// Receive the number of items.
-	line, err := r.getString()
-	if err != nil {
-		return PathInfo{}, err
-	}
-
-	info := PathInfo{}
-
-	if line[0] == 'd' {
-		info.IsDir = true
-	} else {
-		if len(line) < 2 {
-			return PathInfo{}, errors.New("invalid server response")
-		}
-		sizeStr := line[2:]
-		size, err := strconv.ParseInt(sizeStr, 10, 64)
-		if err != nil {
-			return PathInfo{}, err
-		}
-		info.Size = size
+		return err
 	}
 
 	// Consume.
 	err = r.consume()
 	if err != nil {
-		return PathInfo{}, err
+		return err
 	}
 
-	return info, nil
+	return nil
 }
 
-// Write a file on the server from a stream. Stops writing once the stream
-// encounters an EOF.
-func (c *client) Write(drive, path string, size int64, stream io.Reader) error {
+// Drop the caches of a drive on the server. Requires an admin key.
+func (c *client) DropCache(drive string) error {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
@@ -319,44 +489,129 @@ func (c *client) Write(drive, path string, size int64, stream io.Reader) error {
 	}
 	defer r.conn.Close()
 
-	// Send the header.
-	err = r.sendString(protocol.Header)
+	// Send the request.
+	err = r.sendSimpleRequest("dropcache", c.key, drive+"\n")
 	if err != nil {
 		return err
 	}
 
-	// Send the key and command.
-	err = r.sendString(c.key)
+	// Receive the header.
+	err = r.receiveHeader()
 	if err != nil {
 		return err
 	}
-	err = r.sendString("write")
+
+	// Consume.
+	err = r.consume()
 	if err != nil {
 		return err
 	}
 
-	data := drive + "\n" + path + "\n"
+	return nil
+}
+
+// Session information.
+type SessionInfo struct {
+	ID uint64
 
-	// Send the length of the data.
-	err = r.sendString(strconv.Itoa(len(data)))
+	// The IP address of the client, and a hash of its key.
+	IP  string
+	Key string
+
+	// The command being handled.
+	Command string
+
+	// The bytes read from and written to the connection.
+	BytesRead    int64
+	BytesWritten int64
+
+	// How long the session has been active.
+	Duration time.Duration
+}
+
+// Get the active sessions on the server. Requires an admin key.
+func (c *client) Sessions() ([]SessionInfo, error) {
+	// Create a connection.
+	r, err := c.newRequest()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer r.conn.Close()
 
-	// Send the data.
-	_, err = r.writer.Write([]byte(data))
+	// Send the request.
+	err = r.sendSimpleRequest("sessions", c.key, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Send the length of the data.
-	err = r.sendString(strconv.FormatInt(size, 10))
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of sessions.
+	numSessionsStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	numSessions, err := strconv.Atoi(numSessionsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]SessionInfo, numSessions)
+	for i := range sessions {
+		lines := make([]string, 7)
+		for j := range lines {
+			lines[j], err = r.getString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		sessions[i].ID, err = strconv.ParseUint(lines[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i].IP = lines[1]
+		sessions[i].Key = lines[2]
+		sessions[i].Command = lines[3]
+		sessions[i].BytesRead, err = strconv.ParseInt(lines[4], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i].BytesWritten, err = strconv.ParseInt(lines[5], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := strconv.ParseInt(lines[6], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i].Duration = time.Duration(duration) * time.Millisecond
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Forcibly close the connection of an active session on the server. Requires
+// an admin key.
+func (c *client) Kill(id uint64) error {
+	// Create a connection.
+	r, err := c.newRequest()
 	if err != nil {
 		return err
 	}
+	defer r.conn.Close()
 
-	// Send the data.
-	_, err = io.Copy(r.writer, stream)
+	// Send the request.
+	err = r.sendSimpleRequest("kill", c.key, strconv.FormatUint(id, 10)+"\n")
 	if err != nil {
 		return err
 	}
@@ -376,8 +631,8 @@ func (c *client) Write(drive, path string, size int64, stream io.Reader) error {
 	return nil
 }
 
-// Remove a file from the server.
-func (c *client) Remove(drive, path string) error {
+// Create a file on the server.
+func (c *client) Create(drive, path string) error {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
@@ -386,7 +641,7 @@ func (c *client) Remove(drive, path string) error {
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("remove", c.key, drive+"\n"+path+"\n")
+	err = r.sendSimpleRequest("create", c.key, drive+"\n"+path+"\n")
 	if err != nil {
 		return err
 	}
@@ -406,8 +661,9 @@ func (c *client) Remove(drive, path string) error {
 	return nil
 }
 
-// Move a file on the server.
-func (c *client) Move(drive, src, dest string) error {
+// Create a file of a given size on the server, without sending its
+// contents.
+func (c *client) CreateSized(drive, path string, size int64) error {
 	// Create a connection.
 	r, err := c.newRequest()
 	if err != nil {
@@ -416,7 +672,7 @@ func (c *client) Move(drive, src, dest string) error {
 	defer r.conn.Close()
 
 	// Send the request.
-	err = r.sendSimpleRequest("move", c.key, drive+"\n"+src+"\n"+dest+"\n")
+	err = r.sendSimpleRequest("createsized", c.key, drive+"\n"+path+"\n"+strconv.FormatInt(size, 10)+"\n")
 	if err != nil {
 		return err
 	}
@@ -435,3 +691,1529 @@ func (c *client) Move(drive, src, dest string) error {
 
 	return nil
 }
+
+// Create a uniquely named file in a directory on the server, like
+// os.CreateTemp. The name is generated from the pattern, with the last "*"
+// replaced by a random string. Returns the path of the file.
+func (c *client) CreateTemp(drive, dir, pattern string) (string, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return "", err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("createtemp", c.key, drive+"\n"+dir+"\n"+pattern+"\n")
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the path.
+	path, err := r.getString()
+	if err != nil {
+		return "", err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Create a directory on the server. If existOK is true, creating a directory
+// which already exists succeeds, but creating over a file still fails.
+func (c *client) Mkdir(drive, path string, existOK bool) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("mkdir", c.key, drive+"\n"+path+"\n"+strconv.FormatBool(existOK)+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read a file on the server into a stream.
+func (c *client) Read(drive, path string, stream io.Writer) (int64, error) {
+	return c.ReadContext(context.Background(), drive, path, stream)
+}
+
+// Read a text file on the server into a stream, transcoded from UTF-8 to an
+// encoding (e.g. "utf-16le" or "shift_jis").
+func (c *client) ReadEncoded(drive, path, encoding string, stream io.Writer) (int64, error) {
+	return c.read(context.Background(), drive+"\n"+path+"\n"+encoding+"\n", stream)
+}
+
+// Send a read request with arguments, reading the file into a stream. The
+// request is aborted if the context is cancelled.
+func (c *client) read(ctx context.Context, args string, stream io.Writer) (n int64, err error) {
+	// Create a connection, asking for the data to be compressed if
+	// compression is enabled.
+	sender := c
+	if c.compression {
+		sender = c.withFlag(protocol.CompressionFlag, protocol.Gzip)
+	}
+	r, err := sender.newRequest()
+	if err != nil {
+		return 0, err
+	}
+	defer r.conn.Close()
+	stop := r.watch(ctx)
+	defer func() { err = stop(err) }()
+
+	// Send the request.
+	err = r.sendSimpleRequest("read", c.key, args)
+	if err != nil {
+		return 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the length of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return 0, err
+	}
+	length, _, compressed, err := protocol.ParseLength(lenStr)
+	if err != nil {
+		return 0, err
+	}
+
+	// Decompress the data.
+	if compressed {
+		reader, err := gzip.NewReader(io.LimitReader(r.reader, length))
+		if err != nil {
+			return 0, err
+		}
+		n, err = io.Copy(stream, reader)
+	} else {
+		n, err = io.CopyN(stream, r.reader, length)
+	}
+
+	// The data is the end of the response, so the connection can be reused.
+	if err == nil {
+		r.complete = true
+	}
+	return n, err
+}
+
+// Read a byte range of a file on the server into a stream. Reading past the
+// end of the file only reads the available data.
+func (c *client) ReadRange(drive, path string, offset, length int64, stream io.Writer) (int64, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return 0, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("read", c.key, drive+"\n"+path+"\n"+strconv.FormatInt(offset, 10)+"\n"+strconv.FormatInt(length, 10)+"\n")
+	if err != nil {
+		return 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the length of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return 0, err
+	}
+	len, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.CopyN(stream, r.reader, len)
+}
+
+// The maximum size of each file read by ReadMany.
+const ReadManyMaxSize = 1 << 20
+
+// The errors reading some of the files of a ReadMany call, keyed by path.
+type ReadManyError struct {
+	Errors map[string]error
+}
+
+func (e *ReadManyError) Error() string {
+	paths := make([]string, 0, len(e.Errors))
+	for path := range e.Errors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = path + ": " + e.Errors[path].Error()
+	}
+	return "failed to read " + strconv.Itoa(len(paths)) + " files: " + strings.Join(msgs, "; ")
+}
+
+// Read many small files on the server in one request, returning their
+// contents keyed by path. Files larger than ReadManyMaxSize aren't read. If
+// some of the files can't be read, the rest are still returned, along with a
+// *ReadManyError holding the error of each file which failed.
+func (c *client) ReadMany(drive string, paths []string) (map[string][]byte, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("readmany", c.key, drive+"\n"+strconv.Itoa(ReadManyMaxSize)+"\n"+strings.Join(paths, "\n")+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive each file, framed with its path and either its length or the
+	// error reading it.
+	files := map[string][]byte{}
+	failed := map[string]error{}
+	for range paths {
+		path, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		status, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(status, "error ") {
+			failed[path] = errors.New(strings.TrimPrefix(status, "error "))
+			continue
+		}
+		if !strings.HasPrefix(status, "ok ") {
+			return nil, errors.New("invalid server response")
+		}
+		len, err := strconv.ParseInt(strings.TrimPrefix(status, "ok "), 10, 64)
+		if err != nil || len < 0 || len > ReadManyMaxSize {
+			return nil, errors.New("invalid server response")
+		}
+		data := make([]byte, len)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		files[path] = data
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(failed) > 0 {
+		return files, &ReadManyError{Errors: failed}
+	}
+	return files, nil
+}
+
+// Read a range of lines from a file on the server, starting at the line at
+// index start (from zero). Lines past the end of the file are not returned.
+// The lines don't include their trailing newlines.
+func (c *client) ReadLines(drive, path string, start, count int) ([]string, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("readlines", c.key, drive+"\n"+path+"\n"+strconv.Itoa(start)+"\n"+strconv.Itoa(count)+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of lines.
+	numLinesStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	numLines, err := strconv.Atoi(numLinesStr)
+	if err != nil {
+		return nil, err
+	}
+	if numLines < 0 || numLines > count {
+		return nil, errors.New("invalid server response")
+	}
+
+	lines := make([]string, numLines)
+	for i := range lines {
+		lines[i], err = r.getString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// Append a record to a file on the server, framed by its length, creating the
+// file if it doesn't exist. Concurrent appends never interleave.
+func (c *client) AppendRecord(drive, path string, record []byte) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request, with the record as the data.
+	err = r.sendDataRequest("appendrecord", c.key, drive+"\n"+path+"\n", record)
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read a range of records from a record file on the server, starting at the
+// record at index start. At most count records are returned, fewer if the end
+// of the file is reached or the records are too large to return at once.
+func (c *client) ReadRecords(drive, path string, start, count int) ([][]byte, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("readrecords", c.key, drive+"\n"+path+"\n"+strconv.Itoa(start)+"\n"+strconv.Itoa(count)+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of records.
+	numRecordsStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	numRecords, err := strconv.Atoi(numRecordsStr)
+	if err != nil {
+		return nil, err
+	}
+	if numRecords < 0 || numRecords > count {
+		return nil, errors.New("invalid server response")
+	}
+
+	// Receive the size of each record, followed by the record.
+	records := make([][]byte, numRecords)
+	for i := range records {
+		sizeStr, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size < 0 {
+			return nil, errors.New("invalid server response")
+		}
+		records[i] = make([]byte, size)
+		if _, err := io.ReadFull(r.reader, records[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// A directory list item.
+type DirItem struct {
+	Name  string
+	IsDir bool
+}
+
+// List a directory on the server, optionally only the entries whose names
+// match a glob pattern (e.g. "*.txt").
+func (c *client) List(drive, path string, pattern ...string) ([]DirItem, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	args := drive + "\n" + path + "\n"
+	if len(pattern) > 0 && pattern[0] != "" {
+		args += pattern[0] + "\n"
+	}
+	err = r.sendSimpleRequest("list", c.key, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of items.
+	numItemsStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	numItems, err := strconv.Atoi(numItemsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]DirItem, numItems)
+	for i := range items {
+		line, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 2 {
+			return nil, errors.New("invalid server response")
+		}
+		if line[0] == 'd' {
+			items[i].IsDir = true
+		}
+		items[i].Name = line[2:]
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// A directory entry, with its size and modification time. The size of a
+// directory is zero.
+type DirEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// If the entry is a directory.
+func (e DirEntry) IsDir() bool {
+	return e.Type == "dir"
+}
+
+// List a directory on the server with the size and modification time of each
+// entry, optionally only the entries whose names match a glob pattern. The
+// entries are sent as JSON, so their names may contain any character.
+func (c *client) ListJSON(drive, path string, pattern ...string) ([]DirEntry, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	args := drive + "\n" + path + "\n"
+	if len(pattern) > 0 && pattern[0] != "" {
+		args += pattern[0] + "\n"
+	}
+	err = r.sendSimpleRequest("listjson", c.key, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of entries.
+	numEntriesStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	numEntries, err := strconv.Atoi(numEntriesStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode each entry from its line.
+	entries := make([]DirEntry, numEntries)
+	for i := range entries {
+		line, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Path information. The UID and GID of the owner are -1 if the server
+// doesn't report ownership.
+type PathInfo struct {
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	UID     int
+	GID     int
+}
+
+// Stat a path on the server.
+func (c *client) Stat(drive, path string) (PathInfo, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return PathInfo{}, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("stat", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	// Receive the number of items.
+	line, err := r.getString()
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	info := PathInfo{UID: -1, GID: -1}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return PathInfo{}, errors.New("invalid server response")
+	}
+	if fields[0] == "d" {
+		info.IsDir = true
+		fields = fields[1:]
+	} else {
+		if len(fields) < 2 {
+			return PathInfo{}, errors.New("invalid server response")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return PathInfo{}, err
+		}
+		info.Size = size
+		fields = fields[2:]
+	}
+
+	// Get the modification time, if the server reported it.
+	if len(fields) == 1 || len(fields) == 3 {
+		mtime, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return PathInfo{}, err
+		}
+		info.ModTime = time.Unix(mtime, 0)
+		fields = fields[1:]
+	}
+
+	// Get the owner, if the server reported it.
+	if len(fields) == 2 {
+		if info.UID, err = strconv.Atoi(fields[0]); err != nil {
+			return PathInfo{}, err
+		}
+		if info.GID, err = strconv.Atoi(fields[1]); err != nil {
+			return PathInfo{}, err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	return info, nil
+}
+
+// Write a file on the server from a stream. Stops writing once the stream
+// encounters an EOF. Returns the SHA-256 checksum of the data the server
+// received, as a hex string, and fails if it doesn't match the data sent.
+func (c *client) Write(drive, path string, size int64, stream io.Reader) (string, error) {
+	return c.WriteContext(context.Background(), drive, path, size, stream)
+}
+
+// Write a text file on the server from a stream in an encoding (e.g.
+// "utf-16le" or "shift_jis"), transcoded to UTF-8. The size is the size of
+// the encoded data. Returns the SHA-256 checksum of the stored UTF-8 data, as
+// a hex string.
+func (c *client) WriteEncoded(drive, path, encoding string, size int64, stream io.Reader) (string, error) {
+	return c.write(context.Background(), "write", drive+"\n"+path+"\n"+encoding+"\n", size, stream)
+}
+
+// Write size bytes from a stream into an existing file on the server at an
+// offset, without truncating the rest of the file. Writing past the end of
+// the file extends it. Fails if the data the server received doesn't match
+// the data sent.
+func (c *client) WriteAt(drive, path string, offset int64, size int64, stream io.Reader) error {
+	if offset < 0 {
+		return errors.New(fmt.Sprintf("invalid offset: %d", offset))
+	}
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	// Hash the data as it is sent.
+	hash := sha256.New()
+	checksum, err := c.write(context.Background(), "writeat", drive+"\n"+path+"\n"+strconv.FormatInt(offset, 10)+"\n", size, io.TeeReader(io.LimitReader(stream, size), hash))
+	if err != nil {
+		return err
+	}
+	if sent := hex.EncodeToString(hash.Sum(nil)); checksum != sent {
+		return errors.New(fmt.Sprintf("checksum mismatch: sent %s, server received %s", sent, checksum))
+	}
+	return nil
+}
+
+// Append size bytes from a stream to the end of a file on the server, creating
+// the file if it doesn't exist. Fails if the data the server received doesn't
+// match the data sent.
+func (c *client) Append(drive, path string, size int64, stream io.Reader) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	// Hash the data as it is sent.
+	hash := sha256.New()
+	checksum, err := c.write(context.Background(), "append", drive+"\n"+path+"\n", size, io.TeeReader(io.LimitReader(stream, size), hash))
+	if err != nil {
+		return err
+	}
+	if sent := hex.EncodeToString(hash.Sum(nil)); checksum != sent {
+		return errors.New(fmt.Sprintf("checksum mismatch: sent %s, server received %s", sent, checksum))
+	}
+	return nil
+}
+
+// Send a write command with arguments, writing the file from a stream.
+// Returns the checksum of the data reported by the server. The request is
+// aborted if the context is cancelled.
+func (c *client) write(ctx context.Context, cmd, data string, size int64, stream io.Reader) (checksum string, err error) {
+	// Compress the data of writes.
+	lengthLine := strconv.FormatInt(size, 10)
+	if cmd == "write" {
+		lengthLine, stream, err = c.compressWrite(size, stream)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return "", err
+	}
+	defer r.conn.Close()
+	stop := r.watch(ctx)
+	defer func() { err = stop(err) }()
+
+	// Send the header.
+	err = r.sendString(protocol.Header)
+	if err != nil {
+		return "", err
+	}
+
+	// Send the key and command.
+	err = r.sendString(c.key)
+	if err != nil {
+		return "", err
+	}
+	err = r.sendString(cmd + protocol.EncodeFlags(r.flags))
+	if err != nil {
+		return "", err
+	}
+
+	// Send the length of the data.
+	err = r.sendString(strconv.Itoa(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	// Send the data.
+	_, err = r.writer.Write([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	// Send the length of the data.
+	err = r.sendString(lengthLine)
+	if err != nil {
+		return "", err
+	}
+
+	// Send the data.
+	_, err = io.Copy(r.writer, stream)
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the checksum.
+	line, err := r.getString()
+	if err != nil {
+		return "", err
+	}
+	algorithm, checksum, ok := strings.Cut(line, " ")
+	if !ok || algorithm != "sha256" {
+		return "", errors.New("invalid server response")
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return "", err
+	}
+
+	return checksum, nil
+}
+
+// Replace the contents of a file on the server with new contents if its
+// current contents equal the expected contents. The comparison and the write
+// are atomic. Returns if the contents were swapped.
+func (c *client) CompareAndSwap(drive, path string, expected, new []byte) (bool, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return false, err
+	}
+	defer r.conn.Close()
+
+	// Send the request, with the expected and new contents as the data.
+	data := make([]byte, 0, len(expected)+len(new))
+	data = append(append(data, expected...), new...)
+	err = r.sendDataRequest("cas", c.key, drive+"\n"+path+"\n"+strconv.Itoa(len(expected))+"\n", data)
+	if err != nil {
+		return false, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return false, err
+	}
+
+	// Receive if the contents were swapped.
+	swappedStr, err := r.getString()
+	if err != nil {
+		return false, err
+	}
+	swapped, err := strconv.ParseBool(swappedStr)
+	if err != nil {
+		return false, err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return false, err
+	}
+
+	return swapped, nil
+}
+
+// Remove a file from the server.
+func (c *client) Remove(drive, path string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("remove", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Recursively remove a directory on the server. The confirm function is called
+// with the number of paths to remove, and the removal only proceeds if it
+// returns true. The progress function, if not nil, is called with the number
+// of paths removed so far after each batch.
+func (c *client) RemoveTree(drive, path string, confirm func(count int) bool, progress func(removed int)) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("removetree", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Get the number of paths and the confirmation token.
+	countStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return err
+	}
+	token, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Confirm the removal.
+	if !confirm(count) {
+		if err := r.sendString("CANCEL"); err != nil {
+			return err
+		}
+		return errors.New("removal cancelled")
+	}
+	if err := r.sendString(token); err != nil {
+		return err
+	}
+
+	// Receive the progress.
+	err = r.receiveProgress(func(p Progress) {
+		if progress != nil {
+			progress(int(p.Done))
+		}
+		if c.progress != nil {
+			c.progress(p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Move a file or directory on the server.
+func (c *client) Move(drive, src, dest string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("move", c.key, drive+"\n"+src+"\n"+dest+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Move a file from one drive to another on the server.
+func (c *client) MoveCrossDrive(srcDrive, src, destDrive, dest string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("movecrossdrive", c.key, srcDrive+"\n"+src+"\n"+destDrive+"\n"+dest+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Copy a file on the server, failing if the destination already exists. An
+// interrupted copy of an unchanged source resumes where it left off when
+// retried.
+func (c *client) Copy(drive, src, dest string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("copy", c.key, drive+"\n"+src+"\n"+dest+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Receive the progress events, if they were asked for.
+	if c.progress != nil {
+		if err := r.receiveProgress(c.progress); err != nil {
+			return err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flush a file or directory on the server to stable storage.
+func (c *client) Sync(drive, path string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("fsync", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Change the user and group IDs of the owner of a file or directory on the
+// server. A negative ID leaves it unchanged. Requires an admin key, and the
+// server to have the privileges to change ownership.
+func (c *client) Chown(drive, path string, uid, gid int) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("chown", c.key, drive+"\n"+path+"\n"+strconv.Itoa(uid)+"\n"+strconv.Itoa(gid)+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Compute the SHA-256 checksum of a file on the server, as a hex string.
+func (c *client) Checksum(drive, path string) (string, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return "", err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("checksum", c.key, drive+"\n"+path+"\nsha256\n")
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return "", err
+	}
+
+	// Receive the algorithm and checksum.
+	line, err := r.getString()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", errors.New("invalid server response")
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return "", err
+	}
+
+	return fields[1], nil
+}
+
+// Compare the contents of two files on a drive on the server, without
+// transferring them. Returns if the files are equal.
+func (c *client) Compare(drive, pathA, pathB string) (bool, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return false, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("compare", c.key, drive+"\n"+pathA+"\n"+pathB+"\n")
+	if err != nil {
+		return false, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return false, err
+	}
+
+	// Receive the result.
+	line, err := r.getString()
+	if err != nil {
+		return false, err
+	}
+	equal, err := strconv.ParseBool(line)
+	if err != nil {
+		return false, errors.New("invalid server response")
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return false, err
+	}
+
+	return equal, nil
+}
+
+// Drive quota information. If the drive is unlimited, Limited is false and
+// only Usage is set.
+type QuotaInfo struct {
+	Limited  bool
+	Quota    int64
+	Usage    int64
+	Headroom int64
+}
+
+// Get the total size in bytes of the files under a path on the server.
+func (c *client) Usage(drive, path string) (int64, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return 0, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("usage", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	// Receive the usage.
+	usageString, err := r.getString()
+	if err != nil {
+		return 0, err
+	}
+	usage, err := strconv.ParseInt(usageString, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+// Get the quota, usage, and remaining headroom of a drive on the server.
+func (c *client) QuotaInfo(drive string) (QuotaInfo, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("quotacheck", c.key, drive+"\n")
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+
+	// Receive the quota, usage, and headroom.
+	lines := make([]string, 3)
+	for i := range lines {
+		lines[i], err = r.getString()
+		if err != nil {
+			return QuotaInfo{}, err
+		}
+	}
+	info := QuotaInfo{}
+	info.Usage, err = strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+	if lines[0] != "none" {
+		info.Limited = true
+		info.Quota, err = strconv.ParseInt(lines[0], 10, 64)
+		if err != nil {
+			return QuotaInfo{}, err
+		}
+		info.Headroom, err = strconv.ParseInt(lines[2], 10, 64)
+		if err != nil {
+			return QuotaInfo{}, err
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+
+	return info, nil
+}
+
+// A file checksum and size.
+type FileDigest struct {
+	Checksum string
+	Size     int64
+}
+
+// Get the checksums of every file under a directory on the server, keyed by
+// path relative to the directory.
+func (c *client) Manifest(drive, path string) (map[string]FileDigest, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("manifest", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the progress events, if they were asked for.
+	if c.progress != nil {
+		if err := r.receiveProgress(c.progress); err != nil {
+			return nil, err
+		}
+	}
+
+	// Receive the entries until we reach an empty line.
+	manifest := map[string]FileDigest{}
+	for {
+		line, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		// Parse the line from the right, since the path may contain spaces.
+		sizeIndex := strings.LastIndex(line, " ")
+		if sizeIndex == -1 {
+			return nil, errors.New("invalid server response")
+		}
+		checksumIndex := strings.LastIndex(line[:sizeIndex], " ")
+		if checksumIndex == -1 {
+			return nil, errors.New("invalid server response")
+		}
+		size, err := strconv.ParseInt(line[sizeIndex+1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		manifest[line[:checksumIndex]] = FileDigest{
+			Checksum: line[checksumIndex+1 : sizeIndex],
+			Size:     size,
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// The differences between a manifest and the files on a drive.
+type VerifyReport struct {
+	// The files in the manifest which aren't on the drive.
+	Missing []string
+
+	// The files whose checksums don't match the manifest.
+	Changed []string
+
+	// The files on the drive which aren't in the manifest.
+	Extra []string
+}
+
+// Verify the files on a drive against a manifest of SHA-256 checksums, keyed
+// by path. The comparison is done on the server, so no file contents are
+// transferred.
+func (c *client) Verify(drive string, manifest map[string]string) (VerifyReport, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer r.conn.Close()
+
+	// Send the request, with the manifest as the data.
+	var data bytes.Buffer
+	for path, checksum := range manifest {
+		if strings.Contains(path, "\n") {
+			return VerifyReport{}, errors.New(fmt.Sprintf("invalid path in manifest: %s", path))
+		}
+		data.WriteString(checksum + " " + path + "\n")
+	}
+	err = r.sendDataRequest("verify", c.key, drive+"\n\n", data.Bytes())
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	// Receive the differences until we reach an empty line.
+	report := VerifyReport{}
+	for {
+		line, err := r.getString()
+		if err != nil {
+			return VerifyReport{}, err
+		}
+		if line == "" {
+			break
+		}
+
+		kind, path, ok := strings.Cut(line, " ")
+		if !ok {
+			return VerifyReport{}, errors.New("invalid server response")
+		}
+		switch kind {
+		case "missing":
+			report.Missing = append(report.Missing, path)
+		case "changed":
+			report.Changed = append(report.Changed, path)
+		case "extra":
+			report.Extra = append(report.Extra, path)
+		default:
+			return VerifyReport{}, errors.New("invalid server response")
+		}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	return report, nil
+}
+
+// Get the total size in bytes and the number of files under a directory on
+// the server.
+func (c *client) DirSize(drive, path string) (int64, int, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("dirsize", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Receive the size and the number of files.
+	sizeString, err := r.getString()
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := strconv.ParseInt(sizeString, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	countString, err := r.getString()
+	if err != nil {
+		return 0, 0, err
+	}
+	count, err := strconv.Atoi(countString)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return size, count, nil
+}
+
+// Count the files and directories under a directory on the server, and the
+// total size of the files in bytes.
+func (c *client) CountTree(drive, path string) (int, int, int64, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("count", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Receive the number of files and directories, and the size.
+	filesString, err := r.getString()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	files, err := strconv.Atoi(filesString)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	dirsString, err := r.getString()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	dirs, err := strconv.Atoi(dirsString)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bytesString, err := r.getString()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bytes, err := strconv.ParseInt(bytesString, 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return files, dirs, bytes, nil
+}
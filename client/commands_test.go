@@ -0,0 +1,893 @@
+// client/commands_test.go
+// Tests for client commands.
+
+package client_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+func TestQuotaInfo(t *testing.T) {
+	quotaDir := t.TempDir()
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		drives := s.Drives()
+		drives["limited"] = drive.NewDriveWithOptions(quotaDir, drive.Options{Quota: 100})
+		s.SetDrives(drives)
+		a.AddKey(testKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "d2", "limited"}, CanWrite: true, IsAdmin: true})
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "file"), make([]byte, 30), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(quotaDir, "file"), make([]byte, 40), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.QuotaInfo("d1")
+	if err != nil || info.Limited || info.Usage != 30 {
+		t.Fatalf("unlimited drive reported %+v: %v", info, err)
+	}
+	info, err = c.QuotaInfo("limited")
+	if err != nil || !info.Limited || info.Quota != 100 || info.Usage != 40 || info.Headroom != 60 {
+		t.Fatalf("limited drive reported %+v: %v", info, err)
+	}
+
+	// The headroom doesn't go below zero when the drive is over its quota.
+	if err := os.WriteFile(filepath.Join(quotaDir, "big"), make([]byte, 100), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err = c.QuotaInfo("limited")
+	if err != nil || info.Usage != 140 || info.Headroom != 0 {
+		t.Fatalf("drive over its quota reported %+v: %v", info, err)
+	}
+
+	// Keys without write access may check their drives, but no others.
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if info, err := reader.QuotaInfo("d1"); err != nil || info.Usage != 30 {
+		t.Fatalf("read-only key reported %+v: %v", info, err)
+	}
+	if _, err := reader.QuotaInfo("limited"); err == nil || !strings.Contains(err.Error(), "drive not allowed") {
+		t.Fatalf("checked a drive the key may not use: %v", err)
+	}
+}
+
+func TestCreateSized(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+	if err := c.CreateSized("d1", "file", 5000); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "file")); err != nil || stat.Size() != 5000 {
+		t.Fatalf("file not created: %v", err)
+	}
+	if err := c.CreateSized("d1", "negative", -1); err == nil {
+		t.Error("created a file with a negative size")
+	}
+	if err := c.CreateSized("d1", "missing/file", 1); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if err := reader.CreateSized("d1", "denied", 1); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("created a file without write permissions: %v", err)
+	}
+}
+
+func TestDrivesInfo(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		drives := s.Drives()
+		drives["overlay"] = drive.NewOverlayDrive(drive.NewDriveWithOptions(t.TempDir(), drive.Options{Quota: 1000}), drive.NewDrive(t.TempDir()))
+		s.SetDrives(drives)
+		a.AddKey(testKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "overlay"}, CanWrite: true})
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), make([]byte, 30), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestClient(t, s)
+	drives, err := c.DrivesInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]client.DriveInfo{
+		"d1":      {Name: "d1", Type: "local", Writable: true, Usage: 30},
+		"overlay": {Name: "overlay", Type: "overlay", Writable: true, Quota: 1000},
+	}
+	if len(drives) != len(want) {
+		t.Fatalf("got %d drives, want %d: %+v", len(drives), len(want), drives)
+	}
+	for _, info := range drives {
+		if expected := want[info.Name]; info.Name != expected.Name || info.Type != expected.Type || info.Writable != expected.Writable || info.Quota != expected.Quota || info.Usage != expected.Usage {
+			t.Errorf("got %+v, want %+v", info, expected)
+		}
+	}
+
+	// Keys only see the drives they may use, and if they may write to them.
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	drives, err = reader.DrivesInfo()
+	if err != nil || len(drives) != 1 || drives[0].Name != "d1" || drives[0].Writable {
+		t.Fatalf("read-only key got %+v: %v", drives, err)
+	}
+}
+
+func TestRemoveTree(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		s.SetRemoveTreeLimits(3, 20)
+	})
+	c := newTestClient(t, s)
+	if err := os.MkdirAll(filepath.Join(dir, "tree", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "tree", "sub", strconv.Itoa(i)), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cancelling removes nothing.
+	count := 0
+	err := c.RemoveTree("d1", "tree", func(n int) bool {
+		count = n
+		return false
+	}, nil)
+	if err == nil || err.Error() != "removal cancelled" || count != 10 {
+		t.Fatalf("cancelled removal of %d paths: %v", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tree", "sub", "0")); err != nil {
+		t.Fatalf("cancelled removal removed files: %v", err)
+	}
+
+	// Progress is reported after each batch, paced by the rate.
+	progress := []int{}
+	start := time.Now()
+	err = c.RemoveTree("d1", "tree", func(n int) bool { return true }, func(removed int) {
+		progress = append(progress, removed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[3 6 9 10]" {
+		t.Errorf("progress %v", progress)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("removed 10 paths at 20 per second in %v", elapsed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tree")); !os.IsNotExist(err) {
+		t.Fatalf("tree not removed: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	confirm := func(n int) bool {
+		t.Fatal("asked to confirm an invalid removal")
+		return false
+	}
+	if err := c.RemoveTree("d1", "file", confirm, nil); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("removed a file: %v", err)
+	}
+	if err := c.RemoveTree("d1", "missing", confirm, nil); err == nil {
+		t.Error("removed a missing directory")
+	}
+}
+
+func TestListPattern(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	for _, name := range []string{"a.txt", "b.txt", "c.log", "sub.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.txt"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern []string
+		want    string
+	}{
+		{nil, "a.txt,b.txt,c.log,dir.txt,sub.txt"},
+		{[]string{""}, "a.txt,b.txt,c.log,dir.txt,sub.txt"},
+		{[]string{"*.txt"}, "a.txt,b.txt,dir.txt,sub.txt"},
+		{[]string{"?.*"}, "a.txt,b.txt,c.log"},
+		{[]string{"*.md"}, ""},
+	}
+	for _, test := range tests {
+		items, err := c.List("d1", "", test.pattern...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, item := range items {
+			names = append(names, item.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%q: listed %s, want %s", test.pattern, got, test.want)
+		}
+	}
+
+	if _, err := c.List("d1", "", "[a-"); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("listed with an invalid pattern: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "c", "dir/b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unchanged drive matches its own manifest.
+	digests, err := c.Manifest("d1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := map[string]string{}
+	for path, digest := range digests {
+		manifest[path] = digest.Checksum
+	}
+	report, err := c.Verify("d1", manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing)+len(report.Changed)+len(report.Extra) != 0 {
+		t.Fatalf("got %+v, want no differences", report)
+	}
+
+	// Change, remove, and add a file.
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dir", "d"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	report, err = c.Verify("d1", manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(report.Missing, report.Changed, report.Extra)
+	if want := "[c] [a] [dir/d]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Paths containing newlines can't be sent.
+	if _, err := c.Verify("d1", map[string]string{"a\nb": ""}); err == nil {
+		t.Error("verified a path containing a newline")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+	path := filepath.Join(dir, "lock")
+	if err := os.WriteFile(path, []byte("free"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if swapped, err := c.CompareAndSwap("d1", "lock", []byte("held"), []byte("free")); err != nil || swapped {
+		t.Fatalf("swapped mismatched contents: %v", err)
+	}
+
+	// Only one of the contenders swaps the contents.
+	results := make(chan bool, 8)
+	for i := 0; i < cap(results); i++ {
+		go func(c client.Client, i int) {
+			swapped, err := c.CompareAndSwap("d1", "lock", []byte("free"), []byte("held by "+strconv.Itoa(i)))
+			if err != nil {
+				t.Error(err)
+			}
+			results <- swapped
+		}(newTestClient(t, s), i)
+	}
+	won := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			won++
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d contenders swapped, want 1", won)
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.HasPrefix(string(data), "held by ") {
+		t.Fatalf("read %q: %v", data, err)
+	}
+
+	if _, err := c.CompareAndSwap("d1", "lock", nil, make([]byte, 2<<20)); err == nil || !strings.Contains(err.Error(), "contents too large") {
+		t.Errorf("swapped too large contents: %v", err)
+	}
+	if _, err := c.CompareAndSwap("d1", "missing", nil, nil); err == nil {
+		t.Error("swapped a missing file")
+	}
+
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if _, err := reader.CompareAndSwap("d1", "lock", nil, nil); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("swapped without write permissions: %v", err)
+	}
+}
+
+func TestCreateTemp(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent clients get unique names matching the pattern.
+	paths := make(chan string, 8)
+	for i := 0; i < cap(paths); i++ {
+		go func(c client.Client) {
+			path, err := c.CreateTemp("d1", "tmp", "upload-*.part")
+			if err != nil {
+				t.Error(err)
+			}
+			paths <- path
+		}(newTestClient(t, s))
+	}
+	seen := map[string]bool{}
+	for i := 0; i < cap(paths); i++ {
+		path := <-paths
+		if seen[path] {
+			t.Errorf("created %s twice", path)
+		}
+		seen[path] = true
+		if name := filepath.Base(path); filepath.Dir(path) != "tmp" || !strings.HasPrefix(name, "upload-") || !strings.HasSuffix(name, ".part") {
+			t.Errorf("created %q, which doesn't match the pattern", path)
+		}
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	c := newTestClient(t, s)
+	if _, err := c.CreateTemp("d1", "../..", "*"); err == nil {
+		t.Error("created a file outside the drive")
+	}
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if _, err := reader.CreateTemp("d1", "tmp", "*"); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("created a file without write permissions: %v", err)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "log"), []byte("zero\none\ntwo\nthree"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start int
+		count int
+		want  string
+		err   string
+	}{
+		{0, 2, "zero,one", ""},
+		{2, 10, "two,three", ""},
+		{4, 1, "", ""},
+		{-1, 1, "", "invalid start"},
+		{0, -1, "", "invalid count"},
+		{0, 1 << 20, "", "invalid count"},
+	}
+	for _, test := range tests {
+		lines, err := c.ReadLines("d1", "log", test.start, test.count)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%d %d: got %v, want %s", test.start, test.count, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(lines, ","); got != test.want {
+			t.Errorf("%d %d: read %q, want %q", test.start, test.count, got, test.want)
+		}
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s)
+
+	// The server shares the client's clock and time zone.
+	before := time.Now()
+	serverTime, err := c.ServerTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverTime.Before(before.Add(-time.Second)) || serverTime.After(time.Now().Add(time.Second)) {
+		t.Fatalf("server time %v, want about %v", serverTime, before)
+	}
+	wantZone, wantOffset := before.Zone()
+	if zone, offset := serverTime.Zone(); zone != wantZone || offset != wantOffset {
+		t.Errorf("server time zone %s %d, want %s %d", zone, offset, wantZone, wantOffset)
+	}
+
+	skew, err := c.ClockSkew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew < -time.Second || skew > time.Second {
+		t.Errorf("clock skew %v, want about zero", skew)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("0123456789"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Patch the middle of the file, then extend it.
+	if err := c.WriteAt("d1", "file", 4, 2, strings.NewReader("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteAt("d1", "file", 9, 3, strings.NewReader("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "0123ab678xyz" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+
+	if err := c.WriteAt("d1", "file", -1, 1, strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "invalid offset") {
+		t.Errorf("wrote at a negative offset: %v", err)
+	}
+	if err := c.WriteAt("d1", "missing", 0, 1, strings.NewReader("x")); err == nil {
+		t.Error("wrote into a missing file")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteAt("d1", "dir", 0, 1, strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "cannot be written") {
+		t.Errorf("wrote into a directory: %v", err)
+	}
+
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if err := reader.WriteAt("d1", "file", 0, 1, strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("wrote without write permissions: %v", err)
+	}
+
+	// Rejected writes leave the file untouched.
+	if data, err := os.ReadFile(path); err != nil || string(data) != "0123ab678xyz" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	files := map[string]string{"a": "same contents", "b": "same contents", "c": "diff contents", "d": "shorter"}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		a, b  string
+		equal bool
+		err   string
+	}{
+		{"a", "b", true, ""},
+		{"a", "a", true, ""},
+		{"a", "c", false, ""},
+		{"a", "d", false, ""},
+		{"a", "missing", false, "no such file"},
+		{"dir", "a", false, "cannot be read"},
+		{"a", "../../outside", false, "path is invalid"},
+	}
+	for _, test := range tests {
+		equal, err := c.Compare("d1", test.a, test.b)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %s: got %v, want %s", test.a, test.b, err, test.err)
+			}
+			continue
+		}
+		if err != nil || equal != test.equal {
+			t.Errorf("%s %s: got %t, %v, want %t", test.a, test.b, equal, err, test.equal)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+
+	// Many clients append records concurrently.
+	appenders, count := 8, 10
+	errs := make(chan error, appenders)
+	for i := 0; i < appenders; i++ {
+		go func(i int) {
+			c := client.NewClient(5 * time.Second)
+			c.Connect(s.ActualAddress(), testKey)
+			c.SetInsecureSkipVerify(true)
+			defer c.Close()
+			for j := 0; j < count; j++ {
+				if err := c.AppendRecord("d1", "log", []byte(fmt.Sprintf("%d:%d:%s", i, j, strings.Repeat("\n", i+j)))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < appenders; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every record is intact and complete, and each client's records are in
+	// order.
+	c := newTestClient(t, s)
+	records, err := c.ReadRecords("d1", "log", 0, appenders*count+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != appenders*count {
+		t.Fatalf("read %d records, want %d", len(records), appenders*count)
+	}
+	next := make([]int, appenders)
+	for _, record := range records {
+		parts := strings.SplitN(string(record), ":", 3)
+		if len(parts) != 3 {
+			t.Fatalf("corrupt record %q", record)
+		}
+		i, err1 := strconv.Atoi(parts[0])
+		j, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil || i < 0 || i >= appenders || j != next[i] || parts[2] != strings.Repeat("\n", i+j) {
+			t.Fatalf("record %q out of order or corrupt", record)
+		}
+		next[i]++
+	}
+
+	// Ranges of records can be read.
+	if page, err := c.ReadRecords("d1", "log", 5, 3); err != nil || len(page) != 3 || string(page[0]) != string(records[5]) {
+		t.Fatalf("read %d records: %v", len(page), err)
+	}
+	if _, err := c.ReadRecords("d1", "log", -1, 1); err == nil || !strings.Contains(err.Error(), "invalid start") {
+		t.Errorf("got %v, want an invalid start error", err)
+	}
+	if _, err := c.ReadRecords("d1", "missing", 0, 1); err == nil {
+		t.Error("read records from a missing file")
+	}
+
+	// Keys without write access may read records, but not append them.
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if _, err := reader.ReadRecords("d1", "log", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.AppendRecord("d1", "log", []byte("record")); err == nil {
+		t.Error("appended a record with a read-only key")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+	data := strings.Repeat("0123456789", 200000)
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "existing"), []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Copy("d1", "src", "dest"); err != nil {
+		t.Fatal(err)
+	}
+	if copied, err := os.ReadFile(filepath.Join(dir, "dest")); err != nil || string(copied) != data {
+		t.Fatalf("copied %d bytes: %v", len(copied), err)
+	}
+
+	// Existing paths are never overwritten.
+	if err := c.Copy("d1", "src", "existing"); err == nil || !strings.Contains(err.Error(), "path already exists") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+	if old, err := os.ReadFile(filepath.Join(dir, "existing")); err != nil || string(old) != "old" {
+		t.Fatalf("existing file changed to %.20q: %v", old, err)
+	}
+
+	// Keys without write access can't copy.
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if err := reader.Copy("d1", "src", "other"); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Fatalf("got %v, want a no write permissions error", err)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("writer", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner is reported by stat on platforms with ownership.
+	info, err := c.Stat("d1", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && (info.UID != os.Getuid() || info.GID != os.Getgid()) {
+		t.Fatalf("owner %d:%d, want %d:%d", info.UID, info.GID, os.Getuid(), os.Getgid())
+	}
+	if info.Size != 4 || info.IsDir {
+		t.Fatalf("stat %+v", info)
+	}
+
+	// Only admin keys may change owners.
+	writer := client.NewClient(5 * time.Second)
+	writer.Connect(s.ActualAddress(), "writer")
+	writer.SetInsecureSkipVerify(true)
+	defer writer.Close()
+	if err := writer.Chown("d1", "file", 1234, 5678); err == nil || !strings.Contains(err.Error(), "no admin permissions") {
+		t.Fatalf("got %v, want a no admin permissions error", err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	if err := c.Chown("d1", "file", 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.Stat("d1", "file"); err != nil || info.UID != 1234 || info.GID != 5678 {
+		t.Fatalf("owner %d:%d: %v", info.UID, info.GID, err)
+	}
+	if err := c.Chown("d1", "missing", 1234, 5678); err == nil {
+		t.Error("changed the owner of a missing file")
+	}
+}
+
+func TestReadMany(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("other", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d2"}})
+	})
+	c := newTestClient(t, s)
+	writeFiles(t, dir, map[string]string{"a": "a data", "dir/b": "b data", "empty": "", "large": strings.Repeat("l", client.ReadManyMaxSize+1)})
+
+	// Files which can be read are returned, and the rest are reported
+	// without failing the batch.
+	files, err := c.ReadMany("d1", []string{"a", "missing", "dir/b", "dir", "empty", "large"})
+	var readErr *client.ReadManyError
+	if !errors.As(err, &readErr) {
+		t.Fatalf("got %v, want a ReadManyError", err)
+	}
+	if len(files) != 3 || string(files["a"]) != "a data" || string(files["dir/b"]) != "b data" || files["empty"] == nil || len(files["empty"]) != 0 {
+		t.Fatalf("read %q", files)
+	}
+	if len(readErr.Errors) != 3 {
+		t.Fatalf("errors %v", readErr.Errors)
+	}
+	for path, want := range map[string]string{"missing": "", "dir": "cannot be read", "large": "too large"} {
+		if err := readErr.Errors[path]; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error containing %q", path, err, want)
+		}
+	}
+
+	// Without failures, no error is returned.
+	if files, err := c.ReadMany("d1", []string{"a", "dir/b"}); err != nil || len(files) != 2 {
+		t.Fatalf("read %q: %v", files, err)
+	}
+
+	// Keys without access to the drive can't read any files.
+	other := client.NewClient(5 * time.Second)
+	other.Connect(s.ActualAddress(), "other")
+	other.SetInsecureSkipVerify(true)
+	defer other.Close()
+	if _, err := other.ReadMany("d1", []string{"a"}); err == nil || !strings.Contains(err.Error(), "drive not allowed") {
+		t.Fatalf("got %v, want a drive not allowed error", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	c := newTestClient(t, s)
+
+	// Appending creates the file, then adds to its end.
+	for _, data := range []string{"first\n", "second\n"} {
+		if err := c.Append("d1", "log", int64(len(data)), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "log")); err != nil || string(data) != "first\nsecond\n" {
+		t.Fatalf("appended %q: %v", data, err)
+	}
+	if err := c.Append("d1", "log", -1, strings.NewReader("")); err == nil {
+		t.Error("appended a negative size")
+	}
+
+	// Appending requires write permissions, like writing.
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+	if err := reader.Append("d1", "log", 1, strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Fatalf("got %v, want a no write permissions error", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "log")); err != nil || string(data) != "first\nsecond\n" {
+		t.Fatalf("log changed to %q: %v", data, err)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		existOK bool
+		valid   bool
+	}{
+		{"new", "dir", false, true},
+		{"existing", "dir", false, false},
+		{"existing with exist ok", "dir", true, true},
+		{"new with exist ok", "other", true, true},
+		{"file with exist ok", "file", true, false},
+		{"missing parent with exist ok", "missing/dir", true, false},
+	}
+	for _, test := range tests {
+		if err := c.Mkdir("d1", test.path, test.existOK); (err == nil) != test.valid {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "data" {
+		t.Errorf("file changed to %q: %v", data, err)
+	}
+}
+
+func TestStatModTime(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modification times are reported to the second for files and
+	// directories.
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, path := range []string{"file", "dir"} {
+		if err := os.Chtimes(filepath.Join(dir, path), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.Stat("d1", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime.Equal(mtime) {
+			t.Errorf("%s: modified at %v, want %v", path, info.ModTime, mtime)
+		}
+		if info.IsDir != (path == "dir") {
+			t.Errorf("%s: stat %+v", path, info)
+		}
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	names := []string{"plain", "with space", "new\nline", `quote"d`, `back\slash`, "tab\there", "ünïcødé", "d emoji 🎉"}
+	for i, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("x", i)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "plain"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.ListJSON("d1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]client.DirEntry{}
+	for _, entry := range entries {
+		byName[entry.Name] = entry
+	}
+	if len(entries) != len(names)+1 || len(byName) != len(entries) {
+		t.Fatalf("listed %d entries: %v", len(entries), entries)
+	}
+	for i, name := range names {
+		entry, ok := byName[name]
+		if !ok || entry.IsDir() || entry.Type != "file" || entry.Size != int64(i) {
+			t.Errorf("%q listed as %+v", name, entry)
+		}
+	}
+	if entry := byName["sub dir"]; !entry.IsDir() || entry.Size != 0 {
+		t.Errorf("directory listed as %+v", entry)
+	}
+	if entry := byName["plain"]; !entry.ModTime.Equal(modTime) {
+		t.Errorf("modification time %v, want %v", entry.ModTime, modTime)
+	}
+
+	// Entries may be filtered by a pattern.
+	entries, err = c.ListJSON("d1", "", `*"*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != `quote"d` {
+		t.Errorf("listed %v", entries)
+	}
+	if _, err := c.ListJSON("d1", "plain"); err == nil {
+		t.Error("listed a file")
+	}
+}
@@ -0,0 +1,96 @@
+// client/compression.go
+// Compression of the data of reads and writes.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// If the server supports compression, checked once per server and shared
+// with clients derived with WithFlags.
+type compressionSupport struct {
+	lock    sync.Mutex
+	addr    string
+	checked bool
+	gzip    bool
+}
+
+// If the data of reads and writes is compressed.
+func (c *client) Compression() bool {
+	return c.compression
+}
+
+// Set if the data of reads and writes is compressed.
+func (c *client) SetCompression(v bool) {
+	c.compression = v
+}
+
+// Check if the server accepts compressed writes, asking it with a ping the
+// first time. Failed checks aren't remembered, so they are retried.
+func (c *client) serverSupportsGzip() bool {
+	c.support.lock.Lock()
+	defer c.support.lock.Unlock()
+	if c.support.checked && c.support.addr == c.addr {
+		return c.support.gzip
+	}
+
+	// Ping the server, which replies with the compressions it supports.
+	r, err := c.newRequest()
+	if err != nil {
+		return false
+	}
+	defer r.conn.Close()
+	if err := r.sendSimpleRequest("ping", c.key, ""); err != nil {
+		return false
+	}
+	if err := r.receiveHeader(); err != nil {
+		return false
+	}
+	line, err := r.getString()
+	if err != nil {
+		return false
+	}
+	if err := r.consume(); err != nil {
+		return false
+	}
+
+	c.support.addr, c.support.checked, c.support.gzip = c.addr, true, false
+	for _, field := range strings.Fields(line) {
+		if field == protocol.Gzip {
+			c.support.gzip = true
+		}
+	}
+	return c.support.gzip
+}
+
+// Compress the data of a write if compression is enabled, the server
+// supports it, and the data is worth compressing. Returns the length line to
+// send, and the data to send in place of the stream.
+func (c *client) compressWrite(size int64, stream io.Reader) (string, io.Reader, error) {
+	lengthLine := strconv.FormatInt(size, 10)
+	if !c.compression || size < protocol.MinCompressSize || size > protocol.MaxCompressSize || !c.serverSupportsGzip() {
+		return lengthLine, stream, nil
+	}
+
+	// Buffer the data, sending it as is if the stream is short, so the
+	// server reports the error.
+	data, err := io.ReadAll(io.LimitReader(stream, size))
+	if err != nil {
+		return "", nil, err
+	}
+	if int64(len(data)) != size {
+		return lengthLine, bytes.NewReader(data), nil
+	}
+	compressed, ok := protocol.Compress(data)
+	if !ok {
+		return lengthLine, bytes.NewReader(data), nil
+	}
+	return protocol.FormatCompressedLength(int64(len(compressed)), size), bytes.NewReader(compressed), nil
+}
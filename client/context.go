@@ -0,0 +1,86 @@
+// client/context.go
+// Cancelling requests with contexts.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Watch a context for the duration of a request. Its deadline is applied to
+// the connection, and cancelling it closes the connection, aborting any
+// transfer. The returned function stops watching, and replaces errors caused
+// by the context with the context's error.
+func (r *request) watch(ctx context.Context) func(error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		r.writer.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			r.abort()
+		case <-done:
+		}
+	}()
+
+	return func(err error) error {
+		close(done)
+		<-stopped
+		if err == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+}
+
+// Close the connection of a request, so it isn't reused.
+func (r *request) abort() {
+	if pooled, ok := r.conn.(*pooledConn); ok {
+		pooled.Conn.Close()
+		return
+	}
+	r.conn.Close()
+}
+
+// Read a file on the server into a stream. The context's deadline applies to
+// the whole read, and cancelling the context aborts it, closing the
+// connection and returning the context's error.
+func (c *client) ReadContext(ctx context.Context, drive, path string, stream io.Writer) (int64, error) {
+	if c.cache != nil {
+		return c.cachedRead(ctx, drive, path, stream)
+	}
+	return c.read(ctx, drive+"\n"+path+"\n", stream)
+}
+
+// Write a file on the server from a stream. The context's deadline applies
+// to the whole write, and cancelling the context aborts it, closing the
+// connection and returning the context's error.
+func (c *client) WriteContext(ctx context.Context, drive, path string, size int64, stream io.Reader) (string, error) {
+	// Hash the data as it is sent.
+	hash := sha256.New()
+	checksum, err := c.write(ctx, "write", drive+"\n"+path+"\n", size, io.TeeReader(stream, hash))
+	if err != nil {
+		return "", err
+	}
+	if sent := hex.EncodeToString(hash.Sum(nil)); checksum != sent {
+		return checksum, errors.New(fmt.Sprintf("checksum mismatch: sent %s, server received %s", sent, checksum))
+	}
+	return checksum, nil
+}
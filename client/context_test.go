@@ -0,0 +1,99 @@
+// client/context_test.go
+// Tests for cancelling requests with contexts.
+
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A writer which cancels a context once it is written to.
+type cancellingWriter struct {
+	cancel  context.CancelFunc
+	written int
+}
+
+func (w *cancellingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	w.cancel()
+	time.Sleep(50 * time.Millisecond)
+	return len(p), nil
+}
+
+// A reader which produces a byte at a time, slowly.
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(20 * time.Millisecond)
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestReadContext(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	c.SetMaxIdleConns(2)
+	data := strings.Repeat("0123456789", 1000000)
+	writeFiles(t, dir, map[string]string{"file": data})
+
+	// Reads with a context which isn't cancelled complete.
+	buf := &bytes.Buffer{}
+	if n, err := c.ReadContext(context.Background(), "d1", "file", buf); err != nil || n != int64(len(data)) || buf.String() != data {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+
+	// Cancelling part way through aborts the read.
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancellingWriter{cancel: cancel}
+	if _, err := c.ReadContext(ctx, "d1", "file", w); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a context canceled error", err)
+	}
+	if w.written == 0 || w.written >= len(data) {
+		t.Fatalf("read %d bytes before cancelling", w.written)
+	}
+
+	// Contexts which are already cancelled fail, and the aborted connection
+	// isn't reused.
+	if _, err := c.ReadContext(ctx, "d1", "file", io.Discard); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a context canceled error", err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	writeFiles(t, dir, map[string]string{"file": ""})
+
+	// Writes with a context which isn't cancelled complete.
+	if _, err := c.WriteContext(context.Background(), "d1", "file", 4, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "data" {
+		t.Fatalf("wrote %q: %v", data, err)
+	}
+
+	// Writes which run past the deadline are aborted.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.WriteContext(ctx, "d1", "file", 1000, slowReader{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("write aborted after %v", elapsed)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
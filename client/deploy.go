@@ -0,0 +1,167 @@
+// client/deploy.go
+// Atomic deployments of local directories.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The suffixes of the staging directory of a deployment, and of the previous
+// deployment it replaced.
+const (
+	deployStagingSuffix  = ".staging-"
+	deployPreviousSuffix = ".previous"
+)
+
+// Deploy a local directory to a path on the server. The directory is uploaded
+// to a staging directory next to the path and verified against the local
+// files, then the current contents of the path are moved aside to
+// <path>.previous, replacing any older previous deployment, and the staging
+// directory is renamed into place. Readers see either the old or the new
+// deployment, never a partial one, although the path is briefly missing
+// between the two renames. If the upload or verification fails, the staging
+// directory is removed and the current deployment is left untouched. If the
+// final rename fails, the previous deployment is moved back.
+func (c *client) Deploy(localDir, drive, remotePath string) error {
+	remotePath = path.Clean("/" + filepath.ToSlash(remotePath))[1:]
+	if remotePath == "" {
+		return errors.New("cannot deploy to the root of a drive")
+	}
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(fmt.Sprintf("not a directory: %s", localDir))
+	}
+	staging := remotePath + deployStagingSuffix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	previous := remotePath + deployPreviousSuffix
+
+	// Upload the directory to the staging directory.
+	checksums, err := c.uploadTree(localDir, drive, staging)
+	if err != nil {
+		c.removeDeployment(drive, staging)
+		return err
+	}
+
+	// Verify the staging directory.
+	if err := c.verifyDeployment(drive, staging, checksums); err != nil {
+		c.removeDeployment(drive, staging)
+		return err
+	}
+
+	// Move the current deployment aside, if there is one.
+	_, err = c.Stat(drive, remotePath)
+	live := err == nil
+	if live {
+		if _, err := c.Stat(drive, previous); err == nil {
+			if err := c.removeDeployment(drive, previous); err != nil {
+				c.removeDeployment(drive, staging)
+				return err
+			}
+		}
+		if err := c.Move(drive, remotePath, previous); err != nil {
+			c.removeDeployment(drive, staging)
+			return err
+		}
+	}
+
+	// Rename the staging directory into place, rolling back on failure.
+	if err := c.Move(drive, staging, remotePath); err != nil {
+		if live {
+			if rollbackErr := c.Move(drive, previous, remotePath); rollbackErr != nil {
+				return errors.New(fmt.Sprintf("deploying %s failed: %s, and rolling back failed: %s", remotePath, err, rollbackErr))
+			}
+		}
+		c.removeDeployment(drive, staging)
+		return err
+	}
+
+	return nil
+}
+
+// Upload a local directory to a new directory on the server. Returns the
+// SHA-256 checksums of the files uploaded, keyed by path relative to the
+// directory.
+func (c *client) uploadTree(localDir, drive, remoteDir string) (map[string]string, error) {
+	checksums := map[string]string{}
+	err := filepath.WalkDir(localDir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		remote := path.Join(remoteDir, rel)
+
+		if entry.IsDir() {
+			return c.Mkdir(drive, remote, false)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		// Upload the file.
+		file, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if err := c.Create(drive, remote); err != nil {
+			return err
+		}
+		checksum, err := c.Write(drive, remote, info.Size(), file)
+		if err != nil {
+			return err
+		}
+		checksums[rel] = checksum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// Verify that a directory on the server holds exactly the files uploaded to
+// it, with matching checksums.
+func (c *client) verifyDeployment(drive, remoteDir string, checksums map[string]string) error {
+	manifest, err := c.Manifest(drive, remoteDir)
+	if err != nil {
+		return err
+	}
+	for rel, checksum := range checksums {
+		digest, ok := manifest[rel]
+		if !ok {
+			return errors.New(fmt.Sprintf("deployment verification failed: missing %s", rel))
+		}
+		if digest.Checksum != checksum {
+			return errors.New(fmt.Sprintf("deployment verification failed: checksum mismatch for %s", rel))
+		}
+	}
+	for rel := range manifest {
+		if _, ok := checksums[rel]; !ok {
+			return errors.New(fmt.Sprintf("deployment verification failed: unexpected file %s", rel))
+		}
+	}
+	return nil
+}
+
+// Remove a directory of a deployment, without confirmation.
+func (c *client) removeDeployment(drive, remoteDir string) error {
+	return c.RemoveTree(drive, remoteDir, func(count int) bool { return true }, nil)
+}
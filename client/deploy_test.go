@@ -0,0 +1,131 @@
+// client/deploy_test.go
+// Tests for atomic deployments of local directories.
+
+package client_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// A drive which fails writes to files named "bad", and whose manifests list
+// an extra file once it is told to.
+type faultyDrive struct {
+	drive.Drive
+	extra atomic.Bool
+}
+
+func (d *faultyDrive) Write(path string, stream io.Reader, size int64) error {
+	if filepath.Base(path) == "bad" {
+		return errors.New("disk failure")
+	}
+	return d.Drive.Write(path, stream, size)
+}
+
+func (d *faultyDrive) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	if err := d.Drive.Manifest(path, fn); err != nil {
+		return err
+	}
+	if d.extra.Load() {
+		return fn("extra", "", 0)
+	}
+	return nil
+}
+
+// Write a local directory to deploy.
+func writeDeployment(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	return dir
+}
+
+// Check the names in a directory on the server.
+func checkNames(t *testing.T, dir string, want ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("names %v, want %v", names, want)
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+
+	// The first deployment creates the path.
+	if err := c.Deploy(writeDeployment(t, map[string]string{"index": "v1", "assets/style": "old"}), "d1", "site"); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, filepath.Join(dir, "site"), map[string]string{"index": "v1", "assets/style": "old"})
+	checkNames(t, dir, "site")
+
+	// Later deployments replace it whole, keeping the previous deployment.
+	for _, version := range []string{"v2", "v3"} {
+		if err := c.Deploy(writeDeployment(t, map[string]string{"index": version}), "d1", "/site/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFiles(t, filepath.Join(dir, "site"), map[string]string{"index": "v3"})
+	checkFiles(t, filepath.Join(dir, "site.previous"), map[string]string{"index": "v2"})
+	checkNames(t, dir, "site", "site.previous")
+
+	// Invalid deployments fail before uploading anything.
+	if err := c.Deploy(writeDeployment(t, nil), "d1", "/"); err == nil || !strings.Contains(err.Error(), "root of a drive") {
+		t.Errorf("got %v, want a root of a drive error", err)
+	}
+	local := writeDeployment(t, map[string]string{"file": "data"})
+	if err := c.Deploy(filepath.Join(local, "file"), "d1", "site"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("got %v, want a not a directory error", err)
+	}
+	if err := c.Deploy(filepath.Join(local, "missing"), "d1", "site"); err == nil {
+		t.Error("deployed a missing directory")
+	}
+	checkNames(t, dir, "site", "site.previous")
+}
+
+func TestDeployRollback(t *testing.T) {
+	faulty := &faultyDrive{}
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		drives := s.Drives()
+		faulty.Drive = drives["d1"]
+		drives["d1"] = faulty
+		s.SetDrives(drives)
+	})
+	c := newTestClient(t, s)
+	if err := c.Deploy(writeDeployment(t, map[string]string{"index": "v1"}), "d1", "site"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed uploads leave the live deployment untouched, and remove the
+	// staging directory.
+	if err := c.Deploy(writeDeployment(t, map[string]string{"index": "v2", "bad": "x"}), "d1", "site"); err == nil || !strings.Contains(err.Error(), "disk failure") {
+		t.Fatalf("got %v, want a disk failure error", err)
+	}
+	checkFiles(t, filepath.Join(dir, "site"), map[string]string{"index": "v1"})
+	checkNames(t, dir, "site")
+
+	// So do failed verifications.
+	faulty.extra.Store(true)
+	if err := c.Deploy(writeDeployment(t, map[string]string{"index": "v2"}), "d1", "site"); err == nil || !strings.Contains(err.Error(), "unexpected file extra") {
+		t.Fatalf("got %v, want an unexpected file error", err)
+	}
+	checkFiles(t, filepath.Join(dir, "site"), map[string]string{"index": "v1"})
+	checkNames(t, dir, "site")
+}
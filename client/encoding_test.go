@@ -0,0 +1,57 @@
+// client/encoding_test.go
+// Tests for transcoded reads and writes.
+
+package client_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestEncodedReadWrite(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	text := "hello, 日本語\n"
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shiftJIS, err := japanese.ShiftJIS.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are stored as UTF-8.
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteEncoded("d1", "file", "UTF-16LE", int64(len(utf16)), strings.NewReader(utf16)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != text {
+		t.Fatalf("stored %q: %v", data, err)
+	}
+
+	for encoding, want := range map[string]string{"shift_jis": shiftJIS, "utf-16le": utf16, "utf-8": text, "": text} {
+		var buf bytes.Buffer
+		if _, err := c.ReadEncoded("d1", "file", encoding, &buf); err != nil || buf.String() != want {
+			t.Errorf("%q: read %q, %v, want %q", encoding, buf.String(), err, want)
+		}
+	}
+
+	if _, err := c.ReadEncoded("d1", "file", "klingon", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unknown encoding: klingon") {
+		t.Errorf("read with an unknown encoding: %v", err)
+	}
+	if _, err := c.WriteEncoded("d1", "file", "klingon", 1, strings.NewReader("a")); err == nil || !strings.Contains(err.Error(), "unknown encoding: klingon") {
+		t.Errorf("wrote with an unknown encoding: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "file")); string(data) != text {
+		t.Errorf("failed write changed the file to %q", data)
+	}
+}
@@ -0,0 +1,84 @@
+// client/follow.go
+// Following growing files.
+
+package client
+
+import (
+	"io"
+	"time"
+)
+
+// The default interval to poll followed files on.
+const DefaultFollowInterval = time.Second
+
+// Follow a file on the server, like tail -f, writing the data appended to it
+// to a stream. Only data appended after following starts is written. The
+// file is polled every follow interval, and if it shrinks (e.g. it was
+// truncated or rotated), it is followed again from the start. Follow runs
+// until the file can't be read or writing to the stream fails, so the stream
+// should return an error to stop following.
+func (c *client) Follow(drive, path string, stream io.Writer) error {
+	// Start at the end of the file.
+	info, err := c.Stat(drive, path)
+	if err != nil {
+		return err
+	}
+	offset := info.Size
+
+	// Record the errors writing to the stream, since reads may not return
+	// them once all the data has been written.
+	w := &followWriter{w: stream}
+	for {
+		// Wait for the file to grow.
+		time.Sleep(c.FollowInterval())
+		info, err := c.Stat(drive, path)
+		if err != nil {
+			return err
+		}
+		if info.Size < offset {
+			// The file was truncated or rotated, restart from the beginning.
+			offset = 0
+		}
+		if info.Size == offset {
+			continue
+		}
+
+		// Read the new data.
+		n, err := c.ReadRange(drive, path, offset, info.Size-offset, w)
+		offset += n
+		if w.err != nil {
+			return w.err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// A writer which records the first error writing to a stream.
+type followWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write to the stream.
+func (f *followWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Get the interval followed files are polled on.
+func (c *client) FollowInterval() time.Duration {
+	if c.followInterval == 0 {
+		return DefaultFollowInterval
+	}
+	return c.followInterval
+}
+
+// Set the interval followed files are polled on.
+func (c *client) SetFollowInterval(interval time.Duration) {
+	c.followInterval = interval
+}
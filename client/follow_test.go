@@ -0,0 +1,111 @@
+// client/follow_test.go
+// Tests for following growing files.
+
+package client_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/client"
+)
+
+// The error returned by a follow stream once it is stopped.
+var errStopFollowing = errors.New("stop following")
+
+// A stream which sends the data written to it to a channel, and fails once
+// stopped.
+type followStream struct {
+	data    chan string
+	stopped atomic.Bool
+}
+
+// Write to the stream.
+func (f *followStream) Write(p []byte) (int, error) {
+	if f.stopped.Load() {
+		return 0, errStopFollowing
+	}
+	f.data <- string(p)
+	return len(p), nil
+}
+
+// Wait for the stream to receive some data.
+func (f *followStream) expect(t *testing.T, want string) {
+	t.Helper()
+	got := ""
+	timeout := time.After(5 * time.Second)
+	for got != want {
+		select {
+		case data := <-f.data:
+			got += data
+		case <-timeout:
+			t.Fatalf("followed %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if c.FollowInterval() != client.DefaultFollowInterval {
+		t.Fatalf("follow interval %v, expected the default", c.FollowInterval())
+	}
+	c.SetFollowInterval(10 * time.Millisecond)
+	path := filepath.Join(dir, "log")
+	if err := os.WriteFile(path, []byte("old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	appendString := func(data string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := &followStream{data: make(chan string, 16)}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Follow("d1", "log", stream)
+	}()
+
+	// Wait for following to start, so only appended data is followed.
+	time.Sleep(200 * time.Millisecond)
+	appendString("one\n")
+	stream.expect(t, "one\n")
+	appendString("two\n")
+	stream.expect(t, "two\n")
+
+	// A truncated file is followed from the start.
+	if err := os.WriteFile(path, []byte("x"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	stream.expect(t, "x")
+
+	// Following stops once writing to the stream fails.
+	stream.stopped.Store(true)
+	appendString("three\n")
+	select {
+	case err := <-done:
+		if err != errStopFollowing {
+			t.Fatalf("got %v, want the stream's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("following didn't stop")
+	}
+}
+
+func TestFollowMissing(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := c.Follow("d1", "missing", &followStream{}); err == nil {
+		t.Fatal("followed a missing file")
+	}
+}
@@ -0,0 +1,84 @@
+// client/parallel.go
+// Parallel transfers.
+
+package client
+
+import (
+	"io"
+	"sync"
+)
+
+// The maximum number of ranges fetched concurrently by a parallel read.
+const maxParallelReads = 8
+
+// The number of times a failed range is retried by a parallel read.
+const parallelReadRetries = 3
+
+// A writer which writes sequentially to an offset in an io.WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// Read a file on the server in parallel byte ranges, writing each range to
+// its offset in the writer.
+func (c *client) ParallelRead(drive, path string, w io.WriterAt, parts int) (int64, error) {
+	// Get the size of the file.
+	info, err := c.Stat(drive, path)
+	if err != nil {
+		return 0, err
+	}
+	if parts < 1 {
+		parts = 1
+	}
+	partSize := info.Size / int64(parts)
+	if partSize == 0 {
+		parts = 1
+		partSize = info.Size
+	}
+
+	// Fetch the ranges, limiting the concurrency.
+	sem := make(chan struct{}, maxParallelReads)
+	errs := make([]error, parts)
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		offset := int64(i) * partSize
+		length := partSize
+		if i == parts-1 {
+			length = info.Size - offset
+		}
+
+		wg.Add(1)
+		go func(i int, offset, length int64) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// Retry just this range on failure.
+			for attempt := 0; attempt < parallelReadRetries; attempt++ {
+				n, err := c.ReadRange(drive, path, offset, length, &offsetWriter{w: w, off: offset})
+				if err == nil && n != length {
+					err = io.ErrUnexpectedEOF
+				}
+				errs[i] = err
+				if err == nil {
+					return
+				}
+			}
+		}(i, offset, length)
+	}
+	wg.Wait()
+
+	for i := range errs {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+	}
+	return info.Size, nil
+}
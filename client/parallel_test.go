@@ -0,0 +1,103 @@
+// client/parallel_test.go
+// Tests for parallel transfers.
+
+package client_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// A buffer which implements io.WriterAt.
+type writerAt struct {
+	buf []byte
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, end-len(w.buf))...)
+	}
+	return copy(w.buf[off:], p), nil
+}
+
+func TestParallelRead(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	data := make([]byte, 100003)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "small"), []byte("abc"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		parts int
+		data  []byte
+	}{
+		{"file", 1, data},
+		{"file", 7, data},
+		{"file", 0, data},
+		{"small", 10, []byte("abc")},
+	}
+	for _, test := range tests {
+		t.Run(test.path+"/"+strconv.Itoa(test.parts), func(t *testing.T) {
+			w := &writerAt{}
+			n, err := c.ParallelRead("d1", test.path, w, test.parts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(test.data)) || !bytes.Equal(w.buf, test.data) {
+				t.Fatalf("read %d bytes, wrong data", n)
+			}
+		})
+	}
+
+	if _, err := c.ParallelRead("d1", "missing", &writerAt{}, 4); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("0123456789"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges past the end of the file are clamped to it.
+	tests := []struct {
+		offset, length int64
+		data           string
+		valid          bool
+	}{
+		{0, 10, "0123456789", true},
+		{3, 4, "3456", true},
+		{9, 1, "9", true},
+		{10, 0, "", true},
+		{8, 5, "89", true},
+		{11, 3, "", true},
+		{-1, 2, "", false},
+		{0, -2, "", false},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		n, err := c.ReadRange("d1", "file", test.offset, test.length, &buf)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("read the invalid range %d+%d", test.offset, test.length)
+			}
+			continue
+		}
+		if err != nil || n != int64(len(test.data)) || buf.String() != test.data {
+			t.Errorf("read %q from %d+%d: %v", buf.String(), test.offset, test.length, err)
+		}
+	}
+}
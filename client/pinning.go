@@ -0,0 +1,132 @@
+// client/pinning.go
+// Certificate pinning and trust on first use.
+
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The lock over the known hosts files, so concurrent connections don't both
+// record a server.
+var knownHostsLock sync.Mutex
+
+// The error returned when the certificate of a server doesn't match its
+// pinned or known fingerprint.
+type CertificateChangedError struct {
+	Addr     string
+	Expected string
+	Actual   string
+}
+
+// Get the error message.
+func (e *CertificateChangedError) Error() string {
+	return fmt.Sprintf("server certificate for %s has changed: expected fingerprint %s, got %s", e.Addr, e.Expected, e.Actual)
+}
+
+// Get the SHA-256 fingerprint of a DER encoded certificate, as a hex string.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Normalize a fingerprint, removing any colons and lowercasing it.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// Pin the certificate of the server to a SHA-256 fingerprint.
+func (c *client) PinCertificate(fingerprint string) {
+	c.pinned = normalizeFingerprint(fingerprint)
+}
+
+// Set the known hosts file.
+func (c *client) SetKnownHostsFile(path string) {
+	c.knownHosts = path
+}
+
+// Get the TLS config to dial with. If the certificate is pinned or verified
+// against the known hosts, it is verified against the fingerprint in place
+// of the root CAs.
+func (c *client) dialConfig() *tls.Config {
+	if c.pinned == "" && c.knownHosts == "" {
+		return c.tlsConfig
+	}
+
+	config := c.tlsConfig.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = c.verifyFingerprint
+	return config
+}
+
+// Verify the certificate of the server against its pinned or known
+// fingerprint. If the server isn't known yet, its fingerprint is recorded.
+func (c *client) verifyFingerprint(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	actual := CertificateFingerprint(state.PeerCertificates[0].Raw)
+
+	expected := c.pinned
+	if expected == "" {
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+
+		known, err := lookupKnownHost(c.knownHosts, c.addr)
+		if err != nil {
+			return err
+		}
+		if known == "" {
+			// Trust the server on first use.
+			return addKnownHost(c.knownHosts, c.addr, actual)
+		}
+		expected = known
+	}
+	if actual != expected {
+		return &CertificateChangedError{Addr: c.addr, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// Look up the fingerprint of a server in a known hosts file. Returns an empty
+// string if the server isn't known.
+func lookupKnownHost(path, addr string) (string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Each line is an address and its fingerprint.
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == addr {
+			return normalizeFingerprint(fields[1]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// Record the fingerprint of a server in a known hosts file.
+func addKnownHost(path, addr, fingerprint string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(addr + " " + fingerprint + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
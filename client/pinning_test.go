@@ -0,0 +1,107 @@
+// client/pinning_test.go
+// Tests for certificate pinning and trust on first use.
+
+package client_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// Start a test server, returning it and the fingerprint of its certificate.
+func startPinnedServer(t *testing.T) (server.Server, string) {
+	t.Helper()
+	cert, _ := testCertificate(t)
+	s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	})
+	return s, client.CertificateFingerprint(cert.Certificate[0])
+}
+
+// Format a fingerprint with colons between the bytes, in upper case.
+func colonFingerprint(fingerprint string) string {
+	parts := []string{}
+	for i := 0; i < len(fingerprint); i += 2 {
+		parts = append(parts, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// Check an error is a certificate changed error for a fingerprint.
+func checkCertificateChanged(t *testing.T, err error, actual string) {
+	t.Helper()
+	var changed *client.CertificateChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("got %v, want a certificate changed error", err)
+	}
+	if changed.Actual != actual {
+		t.Fatalf("got fingerprint %s, want %s", changed.Actual, actual)
+	}
+}
+
+func TestPinCertificate(t *testing.T) {
+	s, fingerprint := startPinnedServer(t)
+	_, other := startPinnedServer(t)
+	tests := []struct {
+		name    string
+		pin     string
+		changed bool
+	}{
+		{"matching", fingerprint, false},
+		{"colons", colonFingerprint(fingerprint), false},
+		{"changed", other, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := client.NewClient(5 * time.Second)
+			c.Connect(s.ActualAddress(), testKey)
+			defer c.Close()
+			c.PinCertificate(test.pin)
+			err := c.Ping()
+			if test.changed {
+				checkCertificateChanged(t, err, fingerprint)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	s, fingerprint := startPinnedServer(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	newClient := func() client.Client {
+		c := client.NewClient(5 * time.Second)
+		c.Connect(s.ActualAddress(), testKey)
+		c.SetKnownHostsFile(path)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// The server is trusted and recorded on first use, and trusted after.
+	for i := 0; i < 2; i++ {
+		if err := newClient().Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if want := s.ActualAddress() + " " + fingerprint + "\n"; err != nil || string(data) != want {
+		t.Fatalf("recorded %q, want %q: %v", data, want, err)
+	}
+
+	// A changed certificate is rejected.
+	_, other := startPinnedServer(t)
+	if err := os.WriteFile(path, []byte("other:1 "+fingerprint+"\n"+s.ActualAddress()+" "+colonFingerprint(other)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkCertificateChanged(t, newClient().Ping(), fingerprint)
+}
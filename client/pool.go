@@ -0,0 +1,138 @@
+// client/pool.go
+// Pooling of idle connections, reused for later requests.
+
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// How long to wait for data when checking if an idle connection is clean.
+const poolCheckTimeout = time.Millisecond
+
+// A pool of idle connections, shared with clients derived with WithFlags.
+type connPool struct {
+	lock sync.Mutex
+	max  int
+	idle []net.Conn
+}
+
+// Take an idle connection from the pool, discarding any which the server has
+// closed or which have unread data. Returns nil if there are none.
+func (p *connPool) get() net.Conn {
+	for {
+		p.lock.Lock()
+		if len(p.idle) == 0 {
+			p.lock.Unlock()
+			return nil
+		}
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.lock.Unlock()
+
+		if connClean(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// Return an idle connection to the pool. Returns false if the pool is full.
+func (p *connPool) put(conn net.Conn) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.idle) >= p.max {
+		return false
+	}
+	p.idle = append(p.idle, conn)
+	return true
+}
+
+// Close every idle connection.
+func (p *connPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+}
+
+// Check that an idle connection is still open and has no unread data, by
+// reading from it with a short deadline. A clean connection times out.
+func connClean(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(poolCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return false
+	}
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+// A pooled connection, returned to the pool when the request on it is closed
+// if its response was read completely.
+type pooledConn struct {
+	net.Conn
+	pool *connPool
+	r    *request
+}
+
+// Close the request, returning the connection to the pool if it is clean.
+func (p *pooledConn) Close() error {
+	if p.r.complete && p.r.reader.Buffered() == 0 && p.Conn.SetDeadline(time.Time{}) == nil && p.pool.put(p.Conn) {
+		return nil
+	}
+	return p.Conn.Close()
+}
+
+// Set the maximum number of idle connections kept to reuse for later
+// requests. Zero disables pooling.
+func (c *client) SetMaxIdleConns(n int) {
+	c.pool.lock.Lock()
+	c.pool.max = n
+	c.pool.lock.Unlock()
+	if n == 0 {
+		c.pool.close()
+	}
+}
+
+// Create a request on a pooled connection, reusing an idle connection if
+// there is one.
+func (c *client) newPooledRequest() (*request, error) {
+	conn := c.pool.get()
+	if conn == nil {
+		var err error
+		conn, err = c.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pooled := &pooledConn{Conn: conn, pool: c.pool}
+	r := c.prepareRequest(newRequest(pooled, c.timeout))
+	pooled.r = r
+	r.flags = withKeepAlive(r.flags)
+	return r, nil
+}
+
+// Check if connections are pooled.
+func (c *client) pooling() bool {
+	c.pool.lock.Lock()
+	defer c.pool.lock.Unlock()
+	return c.pool.max > 0
+}
+
+// Add the keep-alive flag to the flags of a request.
+func withKeepAlive(flags map[string]string) map[string]string {
+	withFlag := map[string]string{protocol.KeepAliveFlag: "true"}
+	for k, v := range flags {
+		withFlag[k] = v
+	}
+	return withFlag
+}
@@ -0,0 +1,144 @@
+// client/pool_test.go
+// Tests for pooling idle connections.
+
+package client_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/client"
+)
+
+// A proxy to a server which counts the connections it accepts, and can close
+// them.
+type countingProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+// Start a proxy to an address. The proxy is closed when the test finishes.
+func startCountingProxy(t *testing.T, addr string) *countingProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &countingProxy{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		p.closeAll()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, conn)
+			p.lock.Unlock()
+			go func() {
+				io.Copy(target, conn)
+				target.Close()
+			}()
+			go func() {
+				io.Copy(conn, target)
+				conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+// Get the number of connections accepted.
+func (p *countingProxy) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.conns)
+}
+
+// Close every connection accepted.
+func (p *countingProxy) closeAll() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	writeFiles(t, dir, map[string]string{"file": "data"})
+	p := startCountingProxy(t, s.ActualAddress())
+	c := client.NewClient(5 * time.Second)
+	c.Connect(p.listener.Addr().String(), testKey)
+	c.SetInsecureSkipVerify(true)
+	defer c.Close()
+
+	// Without a pool, each request dials a new connection.
+	for i := 0; i < 3; i++ {
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.count() != 3 {
+		t.Fatalf("dialed %d connections, want 3", p.count())
+	}
+
+	// Pooled requests reuse an idle connection.
+	c.SetMaxIdleConns(2)
+	for i := 0; i < 10; i++ {
+		if _, err := c.Stat("d1", "file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.count() != 4 {
+		t.Fatalf("dialed %d connections, want 4", p.count())
+	}
+
+	// Reads end at the end of the data, without waiting for the connection
+	// to close, so it is reused too.
+	buf := &bytes.Buffer{}
+	start := time.Now()
+	if _, err := c.Read("d1", "file", buf); err != nil || buf.String() != "data" {
+		t.Fatalf("read %q: %v", buf.String(), err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("read took %v", elapsed)
+	}
+	if p.count() != 4 {
+		t.Fatalf("dialed %d connections after a read, want 4", p.count())
+	}
+
+	// Failed requests leave the connection clean, so it is reused.
+	if _, err := c.Stat("d1", "missing"); err == nil {
+		t.Fatal("got the info of a missing file")
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if p.count() != 4 {
+		t.Fatalf("dialed %d connections after a failed request, want 4", p.count())
+	}
+
+	// Connections closed while idle are discarded, and a new one is dialed.
+	p.closeAll()
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if p.count() != 5 {
+		t.Fatalf("dialed %d connections after closing the idle ones, want 5", p.count())
+	}
+}
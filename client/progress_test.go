@@ -0,0 +1,70 @@
+// client/progress_test.go
+// Tests for progress events of long-running commands.
+
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/client"
+)
+
+func TestProgress(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	writeFiles(t, dir, map[string]string{"tree/a": "1", "tree/b": "22", "tree/sub/c": "333"})
+	events := []client.Progress{}
+	c := newTestClient(t, s).WithProgress(func(p client.Progress) {
+		events = append(events, p)
+	})
+
+	// Copies send an event before and after the copy.
+	if err := c.Copy("d1", "tree/b", "copied"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != (client.Progress{Total: 2, Item: "tree/b"}) || events[1] != (client.Progress{Done: 2, Total: 2, Item: "tree/b"}) {
+		t.Fatalf("copy events %+v", events)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "copied")); err != nil || string(data) != "22" {
+		t.Fatalf("copied %q: %v", data, err)
+	}
+
+	// Manifests send an event for each file, then the manifest.
+	events = events[:0]
+	manifest, err := c.Manifest("d1", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 || len(events) != 3 || events[2].Done != 3 {
+		t.Fatalf("manifest %v with events %+v", manifest, events)
+	}
+
+	// Removals send an event after each batch, counting the paths removed.
+	events = events[:0]
+	if err := c.RemoveTree("d1", "tree", func(int) bool { return true }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[len(events)-1].Done != 5 || events[len(events)-1].Percent() != 100 {
+		t.Fatalf("removal events %+v", events)
+	}
+
+	// Failures part way through are reported after the events.
+	events = events[:0]
+	if err := c.Copy("d1", "missing", "other"); err == nil {
+		t.Fatal("copied a missing file")
+	}
+	if err := c.Copy("d1", "copied", "copied"); err == nil || !strings.Contains(err.Error(), "path already exists") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+
+	// Clients with flags set afterwards don't ask for events.
+	events = events[:0]
+	if err := c.WithFlags(nil).Copy("d1", "copied", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("events %+v without asking", events)
+	}
+}
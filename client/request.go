@@ -5,30 +5,43 @@ package client
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cubeflix/deepwell/conn"
 	"github.com/cubeflix/deepwell/protocol"
+	"github.com/hashicorp/yamux"
 )
 
 // The request struct.
 type request struct {
 	// The underlying connection. The reader and writer should be used in all
 	// cases.
-	conn   *tls.Conn
+	conn   net.Conn
 	writer *conn.Conn
 	reader *bufio.Reader
 
 	// The request information.
 	command string
+
+	// The flags sent after the command.
+	flags map[string]string
+
+	// If the response has been read completely.
+	complete bool
 }
 
 // Create a new request.
-func newRequest(c *tls.Conn, timeout time.Duration) *request {
+func newRequest(c net.Conn, timeout time.Duration) *request {
 	conn := conn.NewConn(c, timeout)
 	return &request{
 		conn:   c,
@@ -39,11 +52,127 @@ func newRequest(c *tls.Conn, timeout time.Duration) *request {
 
 // Create a new request.
 func (c *client) newRequest() (*request, error) {
-	conn, err := tls.Dial("tcp", c.addr, c.tlsConfig)
+	if c.multiplex {
+		return c.newStreamRequest()
+	}
+	if c.pooling() {
+		return c.newPooledRequest()
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	return c.prepareRequest(newRequest(conn, c.timeout)), nil
+}
+
+// Connect to the server, signing the connection if a secret is set.
+func (c *client) connect() (net.Conn, error) {
+	tlsConn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if c.hmacSecret == nil {
+		return tlsConn, nil
+	}
+
+	// Exchange nonces with the server, and derive the key of the connection.
+	// The server doesn't send anything else until we do, so nothing past its
+	// nonce is buffered.
+	tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	clientNonce := make([]byte, conn.HMACNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	_, err = tlsConn.Write([]byte(protocol.HMACHeader + "\n" + c.key + "\n" + hex.EncodeToString(clientNonce) + "\n"))
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	line, err := bufio.NewReader(tlsConn).ReadString('\n')
 	if err != nil {
+		tlsConn.Close()
 		return nil, err
 	}
-	return newRequest(conn, c.timeout), nil
+	serverNonce, err := hex.DecodeString(strings.TrimSuffix(line, "\n"))
+	if err != nil || len(serverNonce) != conn.HMACNonceSize {
+		tlsConn.Close()
+		return nil, errors.New("server refused to sign the connection: no secret for key")
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return conn.NewHMACConn(tlsConn, conn.HMACSessionKey(c.hmacSecret, clientNonce, serverNonce), true), nil
+}
+
+// Attach the flags and the bandwidth limit of the client to a request.
+func (c *client) prepareRequest(r *request) *request {
+	r.flags = c.flags
+	r.writer.SetBandwidthLimit(c.bandwidth)
+	return r
+}
+
+// Dial the server, returning a descriptive error if the certificate of the
+// server can't be verified.
+func (c *client) dial() (*tls.Conn, error) {
+	if !c.tlsConfig.InsecureSkipVerify && !c.hasRootCA && c.pinned == "" && c.knownHosts == "" {
+		return nil, errors.New("no root CAs added: add the server's CA with AddRootCA, pin its certificate, or skip verification")
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: c.timeout}, "tcp", c.addr, c.dialConfig())
+	if err != nil {
+		// Explain verification failures.
+		var hostnameErr x509.HostnameError
+		var authorityErr x509.UnknownAuthorityError
+		if errors.As(err, &hostnameErr) {
+			serverName := c.tlsConfig.ServerName
+			if serverName == "" {
+				serverName, _, _ = net.SplitHostPort(c.addr)
+			}
+			return nil, errors.New(fmt.Sprintf("server certificate is not valid for server name %s, set the server name to a name in the certificate: %s", serverName, err.Error()))
+		} else if errors.As(err, &authorityErr) {
+			return nil, errors.New(fmt.Sprintf("server certificate is not signed by an added root CA: %s", err.Error()))
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Create a new request as a stream in the multiplexed session.
+func (c *client) newStreamRequest() (*request, error) {
+	c.mux.lock.Lock()
+	defer c.mux.lock.Unlock()
+
+	// Open a stream, starting a new session if we don't have one or it has
+	// been closed.
+	if c.mux.session != nil && !c.mux.session.IsClosed() {
+		stream, err := c.mux.session.OpenStream()
+		if err == nil {
+			return c.prepareRequest(newRequest(stream, c.timeout)), nil
+		}
+		c.mux.session.Close()
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(protocol.MuxHeader + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	session, err := yamux.Client(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.mux.session = session
+
+	stream, err := c.mux.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.prepareRequest(newRequest(stream, c.timeout)), nil
 }
 
 // Get a string from the connection. Terminates once it reaches a newline.
@@ -65,6 +194,11 @@ func (r *request) sendString(s string) error {
 
 // Send a simple request (does not require chunk data).
 func (r *request) sendSimpleRequest(command, key, data string) error {
+	return r.sendDataRequest(command, key, data, nil)
+}
+
+// Send a request along with a chunk of data.
+func (r *request) sendDataRequest(command, key, args string, data []byte) error {
 	// Send the header.
 	err := r.sendString(protocol.Header)
 	if err != nil {
@@ -76,24 +210,30 @@ func (r *request) sendSimpleRequest(command, key, data string) error {
 	if err != nil {
 		return err
 	}
-	err = r.sendString(command)
+	err = r.sendString(command + protocol.EncodeFlags(r.flags))
 	if err != nil {
 		return err
 	}
 
-	// Send the length of the data.
-	err = r.sendString(strconv.Itoa(len(data)))
+	// Send the length of the arguments.
+	err = r.sendString(strconv.Itoa(len(args)))
 	if err != nil {
 		return err
 	}
 
-	// Send the data.
-	_, err = r.writer.Write([]byte(data))
+	// Send the arguments.
+	_, err = r.writer.Write([]byte(args))
 	if err != nil {
 		return err
 	}
 
-	return r.sendString("0")
+	// Send the data.
+	err = r.sendString(strconv.Itoa(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = r.writer.Write(data)
+	return err
 }
 
 // Receive the header.
@@ -113,11 +253,12 @@ func (r *request) receiveHeader() error {
 		return err
 	}
 	if strings.ToLower(status) == "failed" {
-		// Failed. Receive the error.
+		// Failed. Receive the error, and the end of the response.
 		errString, err := r.getString()
 		if err != nil {
 			return err
 		}
+		r.consume()
 		return errors.New(errString)
 	}
 	if strings.ToLower(status) != "success" {
@@ -127,6 +268,34 @@ func (r *request) receiveHeader() error {
 	return nil
 }
 
+// Receive the progress events of a command, until its result follows. The
+// progress function is called with each event, if it isn't nil.
+func (r *request) receiveProgress(progress func(Progress)) error {
+	for {
+		line, err := r.getString()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case protocol.ProgressResult:
+			return nil
+		case protocol.ProgressError:
+			message, err := r.getString()
+			if err != nil {
+				return err
+			}
+			return errors.New(message)
+		}
+		event, ok := protocol.ParseProgress(line)
+		if !ok {
+			return errors.New("invalid server response")
+		}
+		if progress != nil {
+			progress(event)
+		}
+	}
+}
+
 // Consume a chunk of data, prefixed with the length.
 func (r *request) consume() error {
 	// Get the length of the data.
@@ -138,23 +307,34 @@ func (r *request) consume() error {
 	if err != nil {
 		return err
 	}
+	if len < 0 {
+		return errors.New(fmt.Sprintf("invalid length: %d", len))
+	}
 
-	buf := make([]byte, protocol.ChunkSize)
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
 	n := int64(0)
 	for {
-		// Read the chunk.
+		// Read the chunk. Reads may return less than a full chunk, so read
+		// until the chunk is filled.
 		if len-n < int64(protocol.ChunkSize) {
-			smallBuf := make([]byte, len-n)
-			_, err := r.reader.Read(smallBuf)
+			smallBuf := buf[:len-n]
+			_, err := io.ReadFull(r.reader, smallBuf)
 			if err != nil {
 				return err
 			}
+			if len == 0 {
+				// The end of the response.
+				r.complete = true
+			}
 			return nil
 		} else {
-			_, err := r.reader.Read(buf)
+			i, err := io.ReadFull(r.reader, buf)
 			if err != nil {
 				return err
 			}
+			n += int64(i)
 		}
 	}
 }
@@ -0,0 +1,108 @@
+// client/request_test.go
+// Tests for reading responses.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Write data to a connection one byte at a time, as a fragmented TCP stream
+// would deliver it. Stops once the connection is closed.
+func writeFragmented(c net.Conn, data []byte) {
+	go func() {
+		for i := range data {
+			if _, err := c.Write(data[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestConsumeFragmented(t *testing.T) {
+	sizes := []int{1, protocol.ChunkSize - 1, protocol.ChunkSize, protocol.ChunkSize + 1, 3*protocol.ChunkSize + 17}
+	for _, size := range sizes {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			// Send a chunk followed by a line, which must be read intact
+			// after the chunk is consumed.
+			var msg bytes.Buffer
+			msg.WriteString(strconv.Itoa(size) + "\n")
+			msg.Write(bytes.Repeat([]byte{'x'}, size))
+			msg.WriteString("next\n")
+			writeFragmented(server, msg.Bytes())
+
+			r := newRequest(client, 5*time.Second)
+			if err := r.consume(); err != nil {
+				t.Fatalf("failed to consume: %v", err)
+			}
+			if r.complete {
+				t.Fatal("a chunk with data completed the response")
+			}
+			next, err := r.getString()
+			if err != nil || next != "next" {
+				t.Fatalf("got %q, %v after the chunk, want \"next\"", next, err)
+			}
+		})
+	}
+}
+
+func TestConsumeEnd(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writeFragmented(server, []byte("0\n"))
+
+	// An empty chunk ends the response.
+	r := newRequest(client, 5*time.Second)
+	if err := r.consume(); err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	if !r.complete {
+		t.Fatal("an empty chunk didn't complete the response")
+	}
+}
+
+func TestConsumeNegativeLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writeFragmented(server, []byte("-1\n"))
+
+	// A negative length is rejected rather than slicing the chunk with it.
+	r := newRequest(client, 5*time.Second)
+	if err := r.consume(); err == nil || err.Error() != "invalid length: -1" {
+		t.Fatalf("got %v, want an invalid length error", err)
+	}
+}
+
+// Benchmark the allocations of consuming chunks through the pooled chunk
+// buffers.
+func BenchmarkConsume(b *testing.B) {
+	var msg bytes.Buffer
+	msg.WriteString(strconv.Itoa(4*protocol.ChunkSize) + "\n")
+	msg.Write(make([]byte, 4*protocol.ChunkSize))
+	data := msg.Bytes()
+
+	source := bytes.NewReader(data)
+	r := &request{reader: bufio.NewReader(source)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		source.Reset(data)
+		r.reader.Reset(source)
+		if err := r.consume(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// client/server_test.go
+// Helpers for testing the client against a real server.
+
+package client_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// The key of test servers which may use every drive.
+const testKey = "key"
+
+// Create a self-signed certificate for localhost. Returns the certificate and
+// its PEM encoding.
+func testCertificate(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM
+}
+
+// Start a server on a free port with two drives, d1 and d2, in a temporary
+// directory. The server may be configured before it starts serving. Returns
+// the server and the directory of d1, next to which d2 is. The server is
+// stopped when the test finishes.
+func startTestServer(t *testing.T, configure func(s server.Server, a auth.Authentication)) (server.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	drives := map[string]drive.Drive{}
+	for _, name := range []string{"d1", "d2"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		drives[name] = drive.NewDrive(filepath.Join(dir, name))
+	}
+	s := server.NewServer()
+	s.SetAddress("127.0.0.1:0")
+	s.SetHTTPAddress("")
+	s.SetTimeout(5 * time.Second)
+	s.SetHandshakeTimeout(5 * time.Second)
+	s.SetBacklogSize(10)
+	s.SetNumWorkers(5)
+	s.SetIdempotencyLimits(0, 0)
+	cert, _ := testCertificate(t)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	s.SetDrives(drives)
+	s.SetHealthCheckInterval(-1)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	a := auth.NewAuthentication()
+	a.AddKey(testKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "d2"}, CanWrite: true, IsAdmin: true})
+	s.SetAuthentication(a)
+	if configure != nil {
+		configure(s, a)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActualAddress() == "" {
+		select {
+		case err := <-served:
+			t.Fatalf("failed to serve: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(s.Stop)
+	return s, filepath.Join(dir, "d1")
+}
+
+// Create a client of a test server.
+func newTestClient(t *testing.T, s server.Server) client.Client {
+	t.Helper()
+	c := client.NewClient(5 * time.Second)
+	c.Connect(s.ActualAddress(), testKey)
+	c.SetInsecureSkipVerify(true)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
@@ -0,0 +1,144 @@
+// client/transaction.go
+// Transactions of staged operations.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A transaction on a drive on the server. Operations are staged on the
+// server, and only applied once the transaction is committed. If any
+// operation fails to apply, the operations already applied are undone. The
+// commit is not atomic if the server crashes.
+type Transaction struct {
+	c     *client
+	drive string
+	id    string
+}
+
+// Begin a transaction on a drive on the server. Uncommitted transactions are
+// discarded after an hour.
+func (c *client) Begin(drive string) (*Transaction, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("begin", c.key, drive+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the ID of the transaction.
+	id, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transaction{c: c, drive: drive, id: id}, nil
+}
+
+// Get the ID of the transaction.
+func (t *Transaction) ID() string {
+	return t.id
+}
+
+// Get the drive of the transaction.
+func (t *Transaction) Drive() string {
+	return t.drive
+}
+
+// Send a transaction command which has no response.
+func (t *Transaction) send(cmd, args string) error {
+	// Create a connection.
+	r, err := t.c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest(cmd, t.c.key, t.id+"\n"+args)
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stage writing a file from a stream, creating or replacing it. The data is
+// sent to the server immediately, and fails if the data the server received
+// doesn't match the data sent.
+func (t *Transaction) Write(path string, size int64, stream io.Reader) error {
+	// Hash the data as it is sent.
+	hash := sha256.New()
+	checksum, err := t.c.write(context.Background(), "stagewrite", t.id+"\n"+path+"\n", size, io.TeeReader(stream, hash))
+	if err != nil {
+		return err
+	}
+	if sent := hex.EncodeToString(hash.Sum(nil)); checksum != sent {
+		return errors.New(fmt.Sprintf("checksum mismatch: sent %s, server received %s", sent, checksum))
+	}
+	return nil
+}
+
+// Stage creating a directory.
+func (t *Transaction) Mkdir(path string) error {
+	return t.send("stage", "mkdir\n"+path+"\n")
+}
+
+// Stage removing a file or directory. Directories are removed along with
+// their contents.
+func (t *Transaction) Remove(path string) error {
+	return t.send("stage", "remove\n"+path+"\n")
+}
+
+// Stage moving a file or directory, replacing any existing destination.
+func (t *Transaction) Move(src, dest string) error {
+	return t.send("stage", "move\n"+src+"\n"+dest+"\n")
+}
+
+// Apply the staged operations in order. If any fails, the operations already
+// applied are undone, and the error is returned. The transaction is closed
+// either way.
+func (t *Transaction) Commit() error {
+	return t.send("commit", "")
+}
+
+// Discard the staged operations, closing the transaction.
+func (t *Transaction) Rollback() error {
+	return t.send("rollback", "")
+}
@@ -0,0 +1,194 @@
+// client/transaction_test.go
+// Tests for transactions of staged operations.
+
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// Write files into a directory.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check a directory holds exactly some files, with no transaction staging
+// directories left behind.
+func checkFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	found := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		found[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(files) {
+		t.Fatalf("found %v, want %v", found, files)
+	}
+	for name, contents := range files {
+		if found[name] != contents {
+			t.Fatalf("found %v, want %v", found, files)
+		}
+	}
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), ".txn-") {
+			t.Fatalf("staging directory %s left", item.Name())
+		}
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	writeFiles(t, dir, map[string]string{"site/index.html": "old index", "site/old.html": "old", "current": "v1"})
+
+	txn, err := c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Drive() != "d1" || txn.ID() == "" {
+		t.Fatalf("began %q on %q", txn.ID(), txn.Drive())
+	}
+	if err := txn.Write("site/index.html", 9, strings.NewReader("new index")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Mkdir("site/assets"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("site/assets/app.js", 2, strings.NewReader("js")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Remove("site/old.html"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("next", 2, strings.NewReader("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Move("next", "current"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is applied until the transaction is committed.
+	checkFiles(t, filepath.Join(dir, "site"), map[string]string{"index.html": "old index", "old.html": "old"})
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, map[string]string{"site/index.html": "new index", "site/assets/app.js": "js", "current": "v2"})
+
+	// Committed transactions are closed.
+	if err := txn.Mkdir("late"); err == nil || !strings.Contains(err.Error(), "unknown transaction") {
+		t.Fatalf("got %v, want an unknown transaction error", err)
+	}
+	if err := txn.Commit(); err == nil {
+		t.Fatal("committed a transaction twice")
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	files := map[string]string{"a": "old a", "b": "old b", "dir/c": "c"}
+	writeFiles(t, dir, files)
+
+	// A failure in the middle of the commit undoes the operations before it.
+	txn, err := c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("a", 5, strings.NewReader("new a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("new", 3, strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Mkdir("made"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Remove("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Move("b", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Move("missing", "elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("after", 5, strings.NewReader("after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err == nil || !strings.Contains(err.Error(), "move missing") {
+		t.Fatalf("got %v, want the failed move", err)
+	}
+	checkFiles(t, dir, files)
+	if _, err := os.Stat(filepath.Join(dir, "made")); !os.IsNotExist(err) {
+		t.Fatalf("created directory not removed: %v", err)
+	}
+
+	// Rolling back discards the staged operations.
+	txn, err = c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("a", 5, strings.NewReader("new a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, files)
+	if err := txn.Commit(); err == nil {
+		t.Fatal("committed a rolled back transaction")
+	}
+}
+
+func TestTransactionPermissions(t *testing.T) {
+	s, _ := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+
+	// Keys without write access can't begin transactions.
+	if _, err := reader.Begin("d1"); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Fatalf("got %v, want a no write permissions error", err)
+	}
+	if _, err := newTestClient(t, s).Begin("missing"); err == nil {
+		t.Fatal("began a transaction on a missing drive")
+	}
+}
@@ -0,0 +1,141 @@
+// client/transfer.go
+// Verified transfers.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Verify that a copy matches its source, removing the copy if it does not.
+func (c *client) verifyCopy(srcDrive, src, destDrive, dest string) error {
+	srcChecksum, err := c.Checksum(srcDrive, src)
+	if err != nil {
+		c.Remove(destDrive, dest)
+		return err
+	}
+	destChecksum, err := c.Checksum(destDrive, dest)
+	if err != nil {
+		c.Remove(destDrive, dest)
+		return err
+	}
+	if srcChecksum != destChecksum {
+		c.Remove(destDrive, dest)
+		return errors.New(fmt.Sprintf("checksum mismatch copying %s to %s", src, dest))
+	}
+	return nil
+}
+
+// Move a file on the server by copying it, verifying the checksum of the copy,
+// and then removing the source. If verification fails, the copy is removed and
+// the source is left intact.
+func (c *client) SafeMove(drive, src, dest string) error {
+	// Copy the file.
+	if err := c.Copy(drive, src, dest); err != nil {
+		return err
+	}
+
+	// Verify the copy.
+	if err := c.verifyCopy(drive, src, drive, dest); err != nil {
+		return err
+	}
+
+	return c.Remove(drive, src)
+}
+
+// Move a file between drives on the server by copying it, verifying the
+// checksum of the copy, and then removing the source. If verification fails,
+// the copy is removed and the source is left intact.
+func (c *client) SafeMoveCrossDrive(srcDrive, src, destDrive, dest string) error {
+	info, err := c.Stat(srcDrive, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return errors.New(fmt.Sprintf("cannot move a directory: %s", src))
+	}
+
+	// Copy the file through the client.
+	if err := c.Create(destDrive, dest); err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := c.Read(srcDrive, src, writer)
+		writer.CloseWithError(err)
+	}()
+	_, err = c.Write(destDrive, dest, info.Size, reader)
+	reader.Close()
+	if err != nil {
+		c.Remove(destDrive, dest)
+		return err
+	}
+
+	// Verify the copy.
+	if err := c.verifyCopy(srcDrive, src, destDrive, dest); err != nil {
+		return err
+	}
+
+	return c.Remove(srcDrive, src)
+}
+
+// Upload a file to the server, resuming a previous partial upload of it. The
+// size of the file on the server is taken as the amount already uploaded, and
+// only the rest of the stream is written, with WriteAt. Once complete, the
+// checksum of the whole file is compared with the stream, so a resumed upload
+// is identical to a single upload. If the file on the server is larger than
+// the stream, it is uploaded again from the start. Returns the checksum of the
+// file.
+func (c *client) ResumeWrite(drive, path string, size int64, stream io.ReadSeeker) (string, error) {
+	// Get the size of the partial upload, creating the file if there is none.
+	offset := int64(0)
+	info, err := c.Stat(drive, path)
+	if err != nil {
+		if err := c.Create(drive, path); err != nil {
+			return "", err
+		}
+	} else if info.IsDir {
+		return "", errors.New(fmt.Sprintf("cannot be written: %s", path))
+	} else {
+		offset = info.Size
+	}
+	if offset > size {
+		// The partial upload can't be of this stream, so start over.
+		if _, err := stream.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		return c.Write(drive, path, size, stream)
+	}
+
+	// Upload the rest of the stream.
+	if offset < size {
+		if _, err := stream.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		if err := c.WriteAt(drive, path, offset, size-offset, stream); err != nil {
+			return "", err
+		}
+	}
+
+	// Verify the whole file.
+	if _, err := stream.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, stream, size); err != nil {
+		return "", err
+	}
+	sent := hex.EncodeToString(hash.Sum(nil))
+	checksum, err := c.Checksum(drive, path)
+	if err != nil {
+		return "", err
+	}
+	if checksum != sent {
+		return checksum, errors.New(fmt.Sprintf("checksum mismatch resuming upload of %s: the partial upload differs from the stream", path))
+	}
+	return checksum, nil
+}
@@ -0,0 +1,154 @@
+// client/transfer_test.go
+// Tests for verified transfers.
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i % 13)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	checksum, err := c.Checksum("d1", "file")
+	if err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum %s: %v", checksum, err)
+	}
+	if _, err := c.Checksum("d1", "missing"); err == nil {
+		t.Fatal("checksum of a missing file")
+	}
+}
+
+func TestSafeMove(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	d2 := filepath.Join(filepath.Dir(dir), "d2")
+	data := []byte("the contents of the file")
+	for _, name := range []string{"a", "b", "exists"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.SafeMove("d1", "a", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SafeMoveCrossDrive("d1", "b", "d2", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "moved"), filepath.Join(d2, "moved")} {
+		if moved, err := os.ReadFile(path); err != nil || string(moved) != string(data) {
+			t.Errorf("%s not moved: %q %v", path, moved, err)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("source %s left after the move: %v", path, err)
+		}
+	}
+
+	// Failed moves leave the source intact.
+	if err := c.SafeMove("d1", "missing", "dest"); err == nil {
+		t.Error("moved a missing file")
+	}
+	if err := c.SafeMove("d1", "exists", "moved"); err == nil {
+		t.Error("moved over an existing file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "exists")); err != nil {
+		t.Errorf("source removed by a failed move: %v", err)
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	checksum, err := c.Write("d1", "file", int64(len(data)), bytes.NewReader(data))
+	if err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("write returned checksum %s: %v", checksum, err)
+	}
+
+	// Encoded writes return the checksum of the stored data.
+	sum = sha256.Sum256([]byte("hi"))
+	checksum, err = c.WriteEncoded("d1", "file", "utf-16le", 4, bytes.NewReader([]byte("h\x00i\x00")))
+	if err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("encoded write returned checksum %s: %v", checksum, err)
+	}
+
+	if checksum, err := c.Write("d1", "missing/file", 1, bytes.NewReader([]byte("a"))); err == nil || checksum != "" {
+		t.Fatalf("failed write returned checksum %q: %v", checksum, err)
+	}
+}
+
+func TestResumeWrite(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s)
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	// Resuming from any partial upload gives the same file as a single
+	// upload, including from no upload, a complete upload, or a larger file.
+	tests := []struct {
+		name    string
+		partial []byte
+	}{
+		{"none", nil},
+		{"empty", []byte{}},
+		{"partial", data[:123457]},
+		{"complete", data},
+		{"larger", append(append([]byte{}, data...), "extra"...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if test.partial != nil {
+				if err := os.WriteFile(path, test.partial, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checksum, err := c.ResumeWrite("d1", test.name, int64(len(data)), bytes.NewReader(data))
+			if err != nil || checksum != want {
+				t.Fatalf("checksum %s: %v", checksum, err)
+			}
+			if written, err := os.ReadFile(path); err != nil || !bytes.Equal(written, data) {
+				t.Fatalf("wrote %d bytes: %v", len(written), err)
+			}
+		})
+	}
+
+	// Partial uploads of other data fail verification.
+	if err := os.WriteFile(filepath.Join(dir, "other"), []byte("other data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ResumeWrite("d1", "other", int64(len(data)), bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("got %v, want a checksum mismatch error", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ResumeWrite("d1", "dir", 1, bytes.NewReader([]byte("x"))); err == nil || !strings.Contains(err.Error(), "cannot be written") {
+		t.Fatalf("got %v, want a cannot be written error", err)
+	}
+}
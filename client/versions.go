@@ -0,0 +1,146 @@
+// client/versions.go
+// Previous versions of files on versioned drives.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A previous version of a file on a versioned drive.
+type Version struct {
+	ID   string
+	Time time.Time
+	Size int64
+}
+
+// List the previous versions of a file on a versioned drive, newest first.
+func (c *client) ListVersions(drive, path string) ([]Version, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return nil, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("versions", c.key, drive+"\n"+path+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive the number of versions.
+	countStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Receive each version: its ID, time, and size.
+	versions := make([]Version, count)
+	for i := range versions {
+		line, err := r.getString()
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("invalid server response")
+		}
+		nanos, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = Version{ID: fields[0], Time: time.Unix(0, nanos), Size: size}
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// Read a previous version of a file on a versioned drive into a stream.
+func (c *client) ReadVersion(drive, path, version string, stream io.Writer) (int64, error) {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return 0, err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("readversion", c.key, drive+"\n"+path+"\n"+version+"\n")
+	if err != nil {
+		return 0, err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the length of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return 0, err
+	}
+	len, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.CopyN(stream, r.reader, len)
+}
+
+// Restore a previous version of a file on a versioned drive. The current
+// contents of the file are kept as a version, so the restore can be undone.
+func (c *client) RestoreVersion(drive, path, version string) error {
+	// Create a connection.
+	r, err := c.newRequest()
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+
+	// Send the request.
+	err = r.sendSimpleRequest("restoreversion", c.key, drive+"\n"+path+"\n"+version+"\n")
+	if err != nil {
+		return err
+	}
+
+	// Receive the header.
+	err = r.receiveHeader()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	err = r.consume()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// client/versions_test.go
+// Tests for previous versions of files on versioned drives.
+
+package client_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// Start a test server whose drive d1 is versioned.
+func startVersionedServer(t *testing.T) (server.Server, string) {
+	t.Helper()
+	return startTestServer(t, func(s server.Server, a auth.Authentication) {
+		drives := s.Drives()
+		drives["d1"] = drive.NewVersionedDrive(drives["d1"], 0, 0)
+		s.SetDrives(drives)
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+}
+
+func TestVersions(t *testing.T) {
+	s, dir := startVersionedServer(t)
+	c := newTestClient(t, s)
+	writeFiles(t, dir, map[string]string{"file": "one"})
+	for _, data := range []string{"two", "three"} {
+		if _, err := c.Write("d1", "file", int64(len(data)), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The previous versions are listed newest first.
+	versions, err := c.ListVersions("d1", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Size != 3 || versions[1].Size != 3 || !versions[0].Time.After(versions[1].Time) {
+		t.Fatalf("versions %+v", versions)
+	}
+	buf := &bytes.Buffer{}
+	if n, err := c.ReadVersion("d1", "file", versions[1].ID, buf); err != nil || n != 3 || buf.String() != "one" {
+		t.Fatalf("read %d bytes %q: %v", n, buf.String(), err)
+	}
+
+	// Restoring replaces the file, keeping its contents as a version.
+	if err := c.RestoreVersion("d1", "file", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "one" {
+		t.Fatalf("restored %q: %v", data, err)
+	}
+	if versions, err := c.ListVersions("d1", "file"); err != nil || len(versions) != 3 || versions[0].Size != 5 {
+		t.Fatalf("versions %+v: %v", versions, err)
+	}
+
+	// Unknown versions and unversioned drives fail.
+	if _, err := c.ReadVersion("d1", "file", "20200101T000000.000000000Z", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unknown version") {
+		t.Errorf("got %v, want an unknown version error", err)
+	}
+	if err := c.RestoreVersion("d1", "file", "latest"); err == nil || !strings.Contains(err.Error(), "invalid version") {
+		t.Errorf("got %v, want an invalid version error", err)
+	}
+	if _, err := c.ListVersions("d2", "file"); err == nil || !strings.Contains(err.Error(), "drive is not versioned") {
+		t.Errorf("got %v, want a drive is not versioned error", err)
+	}
+
+	// The versions directory is hidden.
+	if entries, err := c.List("d1", ""); err != nil || len(entries) != 1 {
+		t.Errorf("listed %v: %v", entries, err)
+	}
+}
+
+func TestVersionsPermissions(t *testing.T) {
+	s, dir := startVersionedServer(t)
+	writeFiles(t, dir, map[string]string{"file": "one"})
+	if _, err := newTestClient(t, s).Write("d1", "file", 3, strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	reader := client.NewClient(5 * time.Second)
+	reader.Connect(s.ActualAddress(), "reader")
+	reader.SetInsecureSkipVerify(true)
+	defer reader.Close()
+
+	// Keys which can read may list and read versions, but not restore them.
+	versions, err := reader.ListVersions("d1", "file")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions %+v: %v", versions, err)
+	}
+	if _, err := reader.ReadVersion("d1", "file", versions[0].ID, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.RestoreVersion("d1", "file", versions[0].ID); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Fatalf("got %v, want a no write permissions error", err)
+	}
+}
@@ -0,0 +1,391 @@
+// client/webdav.go
+// WebDAV gateway for drives.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// The size of the ranges files are read from the server in.
+const webdavReadSize = 1 << 20
+
+// A WebDAV handler, which authenticates each request and serves it over a
+// drive.
+type webdavHandler struct {
+	c       *client
+	drive   string
+	handler *webdav.Handler
+
+	// If requests without basic auth use the client's key.
+	fallback bool
+
+	// The keys which have been verified against the server.
+	verified sync.Map
+}
+
+// Get an HTTP handler which exposes a drive on the server over WebDAV. The
+// password of each request's basic auth is used as its key, and requests
+// without one are unauthorized.
+func (c *client) WebDAVHandler(drive string) http.Handler {
+	return c.newWebDAVHandler(drive, false)
+}
+
+// Get an HTTP handler which exposes a drive on the server over WebDAV, like
+// WebDAVHandler, but serves requests without basic auth with the client's
+// key. Anyone who can reach the handler gets the permissions of the key.
+func (c *client) WebDAVHandlerWithFallback(drive string) http.Handler {
+	return c.newWebDAVHandler(drive, true)
+}
+
+// Create a WebDAV handler for a drive.
+func (c *client) newWebDAVHandler(drive string, fallback bool) http.Handler {
+	return &webdavHandler{c: c, drive: drive, fallback: fallback, handler: &webdav.Handler{
+		LockSystem: webdav.NewMemLS(),
+	}}
+}
+
+// Serve a WebDAV request.
+func (h *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Get the key of the request.
+	key := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		key = password
+	} else if h.fallback {
+		key = h.c.key
+	}
+	if key == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="DEEPWELL"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Verify the key, so bad credentials are reported as such rather than
+	// as failed operations.
+	c := *h.c
+	c.key = key
+	if _, ok := h.verified.Load(key); !ok {
+		_, err := c.Stat(h.drive, "")
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "invalid authentication key") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="DEEPWELL"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			} else if strings.HasPrefix(err.Error(), "drive not allowed") {
+				http.Error(w, "forbidden", http.StatusForbidden)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		h.verified.Store(key, struct{}{})
+	}
+
+	// Serve the request over the drive with the key.
+	handler := *h.handler
+	handler.FileSystem = &webdavFS{c: &c, drive: h.drive}
+	handler.ServeHTTP(w, r)
+}
+
+// A WebDAV file system over a drive on the server.
+type webdavFS struct {
+	c     *client
+	drive string
+}
+
+// Get the drive path of a WebDAV name.
+func webdavPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Convert an error from the server into the file system error it stands for,
+// so the WebDAV handler responds with the right status.
+func webdavError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "no such file or directory") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if strings.Contains(msg, "file exists") || strings.HasPrefix(msg, "path already exists") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	if strings.HasPrefix(msg, "no write permissions") || strings.HasPrefix(msg, "drive not allowed") || strings.Contains(msg, "read-only") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return err
+}
+
+// Create a directory.
+func (f *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return webdavError("mkdir", name, f.c.Mkdir(f.drive, webdavPath(name), false))
+}
+
+// Open a file or directory.
+func (f *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := webdavPath(name)
+	info, err := f.stat(p)
+	exists := err == nil
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if err != nil && (!os.IsNotExist(err) || flag&os.O_CREATE == 0 || !writable) {
+		return nil, err
+	}
+	if exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	file := &webdavFile{fs: f, path: p, info: info}
+	if !writable {
+		return file, nil
+	}
+
+	// Writes are buffered in a temporary file, which is uploaded once the
+	// file is closed.
+	if exists && info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file.tmp, err = os.CreateTemp("", "deepwell-webdav-*")
+	if err != nil {
+		return nil, err
+	}
+	if exists && flag&os.O_TRUNC == 0 {
+		// Keep the existing contents.
+		_, err = f.c.ReadRange(f.drive, p, 0, info.Size(), file.tmp)
+		if err == nil {
+			_, err = file.tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			file.discard()
+			return nil, webdavError("open", name, err)
+		}
+	}
+	return file, nil
+}
+
+// Remove a file or directory, along with its contents.
+func (f *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	p := webdavPath(name)
+	if p == "" {
+		// Don't remove the root of the drive.
+		return os.ErrInvalid
+	}
+	info, err := f.stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = f.c.RemoveTree(f.drive, p, func(int) bool { return true }, nil)
+	} else {
+		err = f.c.Remove(f.drive, p)
+	}
+	return webdavError("remove", name, err)
+}
+
+// Rename a file or directory.
+func (f *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return webdavError("rename", oldName, f.c.Move(f.drive, webdavPath(oldName), webdavPath(newName)))
+}
+
+// Stat a file or directory.
+func (f *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return f.stat(webdavPath(name))
+}
+
+// Stat a drive path.
+func (f *webdavFS) stat(p string) (*webdavFileInfo, error) {
+	info, err := f.c.Stat(f.drive, p)
+	if err != nil {
+		return nil, webdavError("stat", p, err)
+	}
+	return &webdavFileInfo{name: path.Base("/" + p), info: info}, nil
+}
+
+// The info of a file or directory on the server.
+type webdavFileInfo struct {
+	name string
+	info PathInfo
+}
+
+func (i *webdavFileInfo) Name() string       { return i.name }
+func (i *webdavFileInfo) Size() int64        { return i.info.Size }
+func (i *webdavFileInfo) ModTime() time.Time { return i.info.ModTime }
+func (i *webdavFileInfo) IsDir() bool        { return i.info.IsDir }
+func (i *webdavFileInfo) Sys() any           { return nil }
+
+func (i *webdavFileInfo) Mode() fs.FileMode {
+	if i.info.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// A file or directory on the server opened over WebDAV. Reads are served
+// from ranges of the file, and writes are buffered in a temporary file.
+type webdavFile struct {
+	fs   *webdavFS
+	path string
+	info *webdavFileInfo
+
+	// The offset of the reader, and the range of the file buffered.
+	pos    int64
+	buf    []byte
+	bufOff int64
+
+	// The entries of the directory not yet returned by Readdir.
+	entries []fs.FileInfo
+	listed  bool
+
+	// The temporary file writes are buffered in.
+	tmp *os.File
+}
+
+// Read from the file.
+func (f *webdavFile) Read(p []byte) (int, error) {
+	if f.tmp != nil {
+		return f.tmp.Read(p)
+	}
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if f.pos >= f.info.Size() {
+		return 0, io.EOF
+	}
+
+	// Fetch the range at the offset, if it isn't buffered.
+	if f.pos < f.bufOff || f.pos >= f.bufOff+int64(len(f.buf)) {
+		var buf bytes.Buffer
+		_, err := f.fs.c.ReadRange(f.fs.drive, f.path, f.pos, webdavReadSize, &buf)
+		if err != nil {
+			return 0, webdavError("read", f.path, err)
+		}
+		if buf.Len() == 0 {
+			return 0, io.EOF
+		}
+		f.buf = buf.Bytes()
+		f.bufOff = f.pos
+	}
+	n := copy(p, f.buf[f.pos-f.bufOff:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+// Seek in the file.
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	if f.tmp != nil {
+		return f.tmp.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Write to the file.
+func (f *webdavFile) Write(p []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, &fs.PathError{Op: "write", Path: f.path, Err: fs.ErrPermission}
+	}
+	return f.tmp.Write(p)
+}
+
+// Read the entries of the directory. If count is positive, at most count
+// entries are returned, and io.EOF once there are none left.
+func (f *webdavFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if f.info == nil || !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if !f.listed {
+		items, err := f.fs.c.List(f.fs.drive, f.path)
+		if err != nil {
+			return nil, webdavError("readdir", f.path, err)
+		}
+		for _, item := range items {
+			// Only files need to be stated for their sizes.
+			if item.IsDir {
+				f.entries = append(f.entries, &webdavFileInfo{name: item.Name, info: PathInfo{IsDir: true}})
+				continue
+			}
+			info, err := f.fs.stat(path.Join(f.path, item.Name))
+			if err != nil {
+				return nil, err
+			}
+			f.entries = append(f.entries, info)
+		}
+		f.listed = true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+// Stat the file.
+func (f *webdavFile) Stat() (fs.FileInfo, error) {
+	if f.tmp != nil {
+		info, err := f.tmp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return &webdavFileInfo{name: path.Base("/" + f.path), info: PathInfo{Size: info.Size()}}, nil
+	}
+	return f.info, nil
+}
+
+// Close the file, uploading any writes to the server.
+func (f *webdavFile) Close() error {
+	if f.tmp == nil {
+		return nil
+	}
+	defer f.discard()
+
+	size, err := f.tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.fs.c.Create(f.fs.drive, f.path); err != nil {
+		return webdavError("close", f.path, err)
+	}
+	if size == 0 {
+		return nil
+	}
+	_, err = f.fs.c.Write(f.fs.drive, f.path, size, f.tmp)
+	return webdavError("close", f.path, err)
+}
+
+// Remove the temporary file.
+func (f *webdavFile) discard() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+	f.tmp = nil
+}
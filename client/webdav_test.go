@@ -0,0 +1,186 @@
+// client/webdav_test.go
+// Tests for the WebDAV gateway.
+
+package client_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/server"
+)
+
+// Make a WebDAV request, returning the status and the body of the response.
+// If key is not empty, it is sent as the basic auth password.
+func webdavRequest(t *testing.T, gateway *httptest.Server, key, method, path string, headers map[string]string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, gateway.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.SetBasicAuth("user", key)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := gateway.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// Start a WebDAV gateway with a handler.
+func startWebDAVGateway(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	gateway := httptest.NewServer(handler)
+	t.Cleanup(gateway.Close)
+	return gateway
+}
+
+func TestWebDAV(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	gateway := startWebDAVGateway(t, newTestClient(t, s).WebDAVHandlerWithFallback("d1"))
+	destination := func(path string) map[string]string {
+		return map[string]string{"Destination": gateway.URL + path}
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		body    string
+		status  int
+	}{
+		{"mkcol", "MKCOL", "/dir", nil, "", http.StatusCreated},
+		{"mkcol existing", "MKCOL", "/dir", nil, "", http.StatusMethodNotAllowed},
+		{"put", "PUT", "/dir/file", nil, "hello", http.StatusCreated},
+		{"put over", "PUT", "/dir/file", nil, "hello, world", http.StatusCreated},
+		{"put empty", "PUT", "/empty", nil, "", http.StatusCreated},
+		{"copy", "COPY", "/dir/file", destination("/copy"), "", http.StatusCreated},
+		{"move", "MOVE", "/copy", destination("/moved"), "", http.StatusCreated},
+		{"copy directory", "COPY", "/dir", destination("/dir2"), "", http.StatusCreated},
+		{"delete", "DELETE", "/dir2", nil, "", http.StatusNoContent},
+		{"delete missing", "DELETE", "/missing", nil, "", http.StatusNotFound},
+		{"get missing", "GET", "/missing", nil, "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status, body := webdavRequest(t, gateway, "", test.method, test.path, test.headers, test.body); status != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, status, test.status, body)
+		}
+	}
+
+	// The drive reflects the requests.
+	for path, want := range map[string]string{"dir/file": "hello, world", "empty": "", "moved": "hello, world"} {
+		if data, err := os.ReadFile(filepath.Join(dir, path)); err != nil || string(data) != want {
+			t.Errorf("%s: read %q: %v", path, data, err)
+		}
+	}
+	for _, path := range []string{"copy", "dir2"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", path, err)
+		}
+	}
+
+	// Files are read whole or in ranges.
+	if status, body := webdavRequest(t, gateway, "", "GET", "/dir/file", nil, ""); status != http.StatusOK || body != "hello, world" {
+		t.Errorf("got %d %q", status, body)
+	}
+	if status, body := webdavRequest(t, gateway, "", "GET", "/dir/file", map[string]string{"Range": "bytes=7-11"}, ""); status != http.StatusPartialContent || body != "world" {
+		t.Errorf("got %d %q for a range", status, body)
+	}
+
+	// Directories are listed with the sizes of their files.
+	status, body := webdavRequest(t, gateway, "", "PROPFIND", "/", map[string]string{"Depth": "1"}, "")
+	if status != http.StatusMultiStatus {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	for _, want := range []string{"<D:href>/dir/</D:href>", "<D:href>/moved</D:href>", "<D:href>/empty</D:href>", "<D:getcontentlength>12</D:getcontentlength>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing missing %s: %s", want, body)
+		}
+	}
+
+	// The root of the drive can't be removed.
+	if status, _ := webdavRequest(t, gateway, "", "DELETE", "/", nil, ""); status == http.StatusNoContent {
+		t.Error("removed the root of the drive")
+	}
+}
+
+func TestWebDAVAuthentication(t *testing.T) {
+	s, dir := startTestServer(t, func(s server.Server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+		a.AddKey("other", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d2"}, CanWrite: true})
+	})
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request must supply a key, even if the client has one.
+	gateway := startWebDAVGateway(t, newTestClient(t, s).WebDAVHandler("d1"))
+
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		status int
+	}{
+		{"no key", "", "GET", http.StatusUnauthorized},
+		{"unknown key", "unknown", "GET", http.StatusUnauthorized},
+		{"other drive", "other", "GET", http.StatusForbidden},
+		{"key", testKey, "GET", http.StatusOK},
+		{"read-only key", "reader", "GET", http.StatusOK},
+
+		// The WebDAV handler reports failed writes as not allowed.
+		{"read-only key writing", "reader", "PUT", http.StatusMethodNotAllowed},
+		{"read-only key removing", "reader", "DELETE", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		status, body := webdavRequest(t, gateway, test.key, test.method, "/file", nil, "new")
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, status, test.status, body)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "data" {
+		t.Errorf("read %q: %v", data, err)
+	}
+
+	// Requests without a key only use the client's key when falling back is
+	// enabled, and only if the client has a key.
+	anonymous := client.NewClient(5 * time.Second)
+	anonymous.Connect(s.ActualAddress(), "")
+	anonymous.SetInsecureSkipVerify(true)
+	defer anonymous.Close()
+	fallbacks := []struct {
+		name   string
+		c      client.Client
+		key    string
+		status int
+	}{
+		{"fallback", newTestClient(t, s), "", http.StatusOK},
+		{"fallback with a key", newTestClient(t, s), "unknown", http.StatusUnauthorized},
+		{"fallback without a client key", anonymous, "", http.StatusUnauthorized},
+	}
+	for _, test := range fallbacks {
+		gateway := startWebDAVGateway(t, test.c.WebDAVHandlerWithFallback("d1"))
+		status, body := webdavRequest(t, gateway, test.key, "GET", "/file", nil, "")
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, status, test.status, body)
+		}
+	}
+}
@@ -20,6 +20,13 @@ var host string
 var port int
 var skipVerification bool
 var key string
+var pin string
+var knownHosts string
+var hmacSecret string
+var compression bool
+var bandwidth int64
+var listen string
+var fallbackKey bool
 
 // Root command.
 func root(cmd *cobra.Command, args []string) {
@@ -39,6 +46,11 @@ func root(cmd *cobra.Command, args []string) {
 		Addr:             fmt.Sprintf("%s:%d", host, port),
 		Key:              key,
 		SkipVerification: skipVerification,
+		Pin:              pin,
+		KnownHosts:       knownHosts,
+		HMACSecret:       hmacSecret,
+		Compression:      compression,
+		Bandwidth:        bandwidth,
 	}
 	err := cli.Run()
 	if err != nil {
@@ -47,6 +59,26 @@ func root(cmd *cobra.Command, args []string) {
 	}
 }
 
+// WebDAV command.
+func webdav(cmd *cobra.Command, args []string) {
+	cli := cli.CLI{
+		Hostname:         host,
+		Addr:             fmt.Sprintf("%s:%d", host, port),
+		Key:              key,
+		SkipVerification: skipVerification,
+		Pin:              pin,
+		KnownHosts:       knownHosts,
+		HMACSecret:       hmacSecret,
+		Compression:      compression,
+		Bandwidth:        bandwidth,
+	}
+	err := cli.ServeWebDAV(args[0], listen, fallbackKey)
+	if err != nil {
+		fmt.Println("deepwell-cli:", err.Error())
+		os.Exit(1)
+	}
+}
+
 // Version command.
 func version(cmd *cobra.Command, args []string) {
 	fmt.Println("deepwell-cli", Version, runtime.GOOS)
@@ -59,6 +91,14 @@ var rootCmd = &cobra.Command{
 	Run:   root,
 }
 
+var webdavCmd = &cobra.Command{
+	Use:   "webdav <drive>",
+	Short: "Serve a drive over WebDAV.",
+	Long:  `Serve a drive over WebDAV. The password of each request's basic auth is used as its key, and requests without one are unauthorized. With --fallback-key, requests without one use the key supplied with --key.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   webdav,
+}
+
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Display the deepwell-cli version.",
@@ -69,9 +109,18 @@ func main() {
 	rootCmd.PersistentFlags().StringVarP(&host, "host", "n", "localhost", "The hostname of the server to connect to. Defaults to localhost.")
 	rootCmd.PersistentFlags().IntVarP(&port, "port", "p", 20001, "The port of the server to connect to. Defaults to 20001.")
 	rootCmd.PersistentFlags().BoolVarP(&skipVerification, "skip", "s", false, "If the client should skip TLS verification. Defaults to false.")
+	rootCmd.PersistentFlags().StringVar(&pin, "pin", "", "The SHA-256 fingerprint of the server certificate to pin. The certificate is verified against the fingerprint instead of the root CAs.")
+	rootCmd.PersistentFlags().StringVar(&knownHosts, "known-hosts", "", "A known hosts file to trust the server certificate on first use with. The fingerprint is recorded on the first connection, and later connections fail if it changes.")
+	rootCmd.PersistentFlags().StringVar(&hmacSecret, "hmac-secret", "", "The secret to sign connections with, if the server requires signing.")
+	rootCmd.PersistentFlags().BoolVar(&compression, "compress", false, "If the data of reads and writes should be compressed with gzip, when the server supports it. Defaults to false.")
+	rootCmd.PersistentFlags().Int64Var(&bandwidth, "bandwidth", 0, "The maximum number of bytes per second sent and received on each connection. Defaults to 0, which is unlimited.")
 	rootCmd.PersistentFlags().StringVarP(&key, "key", "k", "", "The access key to use when making requests. If it is not supplied, you will be prompted to input your key.")
 
+	webdavCmd.Flags().StringVarP(&listen, "listen", "l", "localhost:8080", "The address to serve WebDAV on. Defaults to localhost:8080.")
+	webdavCmd.Flags().BoolVar(&fallbackKey, "fallback-key", false, "If WebDAV requests without basic auth should use the key supplied with --key, giving anyone who can reach the address its permissions. Defaults to false.")
+
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(webdavCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println("deepwell-cli:", err.Error())
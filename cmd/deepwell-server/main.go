@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"syscall"
 
+	"github.com/cubeflix/deepwell/auth"
 	"github.com/cubeflix/deepwell/server"
 	"github.com/spf13/cobra"
 )
@@ -17,26 +18,42 @@ import (
 const Version = "0.0.0"
 
 var cfgFile string
+var profile string
 
 // Version command.
 func version(cmd *cobra.Command, args []string) {
 	fmt.Println("deepwell-server", Version, runtime.GOOS)
 }
 
+// Hash key command.
+func hashKey(cmd *cobra.Command, args []string) {
+	fmt.Println(auth.HashKey(args[0]))
+}
+
 // Serve command.
 func serve(cmd *cobra.Command, args []string) {
 	if cfgFile == "" {
 		cfgFile = ".deepwell.toml"
 	}
 
+	if profile == "" {
+		profile = os.Getenv("DEEPWELL_PROFILE")
+	}
+
 	// Create the server.
 	s := server.NewServer()
+	s.SetProfile(profile)
 	err := s.LoadConfig(cfgFile)
 	if err != nil {
 		fmt.Println("deepwell-server:", err.Error())
 		os.Exit(1)
 	}
-	go s.Serve()
+	go func() {
+		if err := s.Serve(); err != nil {
+			fmt.Println("deepwell-server:", err.Error())
+			os.Exit(1)
+		}
+	}()
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop,
 		syscall.SIGHUP,
@@ -60,6 +77,13 @@ var versionCmd = &cobra.Command{
 	Run:   version,
 }
 
+var hashKeyCmd = &cobra.Command{
+	Use:   "hashkey <key>",
+	Short: "Hash a key for storing in the config with Hashed = true.",
+	Args:  cobra.ExactArgs(1),
+	Run:   hashKey,
+}
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start serving the DEEPWELL server.",
@@ -68,9 +92,11 @@ var serveCmd = &cobra.Command{
 
 func main() {
 	serveCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "The server config TOML file. Defaults to .deepwell.toml.")
+	serveCmd.PersistentFlags().StringVarP(&profile, "profile", "P", "", "The config profile to apply over the base config. Defaults to the DEEPWELL_PROFILE environment variable.")
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(hashKeyCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println("deepwell-server:", err.Error())
@@ -0,0 +1,95 @@
+// conn/bandwidth.go
+// Limiting the bandwidth of connections.
+
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket limiting the rate of data to a number of bytes per second.
+// The bucket holds up to a second of data, so transfers can burst after
+// being idle. Tokens may be taken before they are available, leaving the
+// bucket in debt, so callers wait their turn behind earlier ones.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+// Create a full token bucket for a rate in bytes per second.
+func newTokenBucket(bps int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bps), burst: bps, tokens: float64(bps), last: time.Now()}
+}
+
+// Limit a buffer to the size of the bucket, so a single read or write never
+// takes more than a second of data.
+func (b *tokenBucket) limit(p []byte) []byte {
+	if int64(len(p)) > b.burst {
+		return p[:b.burst]
+	}
+	return p
+}
+
+// Take n tokens, returning how long to wait until they are available.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Refill the bucket for the time passed.
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limit the bandwidth of the connection to a number of bytes per second in
+// each direction. Reads and writes sleep as needed to honor the limit. Zero
+// means unlimited. Must be set before the connection is used.
+func (c *Conn) SetBandwidthLimit(bps int64) {
+	c.bandwidth = bps
+	c.readBucket, c.writeBucket = nil, nil
+	if bps > 0 {
+		c.readBucket, c.writeBucket = newTokenBucket(bps), newTokenBucket(bps)
+	}
+}
+
+// Share the bandwidth limit of another connection, so the data of both counts
+// against a single limit. Must be set before the connection is used.
+func (c *Conn) ShareBandwidthLimit(other *Conn) {
+	c.bandwidth = other.bandwidth
+	c.readBucket, c.writeBucket = other.readBucket, other.writeBucket
+}
+
+// Get the bandwidth limit of the connection in bytes per second. Zero means
+// unlimited.
+func (c *Conn) BandwidthLimit() int64 {
+	return c.bandwidth
+}
+
+// Wait for the tokens taken from a bucket to become available. Fails if the
+// connection is closed while waiting.
+func (c *Conn) waitBandwidth(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
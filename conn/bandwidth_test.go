@@ -0,0 +1,112 @@
+// conn/bandwidth_test.go
+// Tests for limiting the bandwidth of connections.
+
+package conn
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100)
+
+	// Buffers are limited to a second of data.
+	if n := len(b.limit(make([]byte, 150))); n != 100 {
+		t.Fatalf("limited to %d bytes, want 100", n)
+	}
+	if n := len(b.limit(make([]byte, 50))); n != 50 {
+		t.Fatalf("limited to %d bytes, want 50", n)
+	}
+
+	// The full bucket allows a burst, after which callers wait in turn.
+	if d := b.reserve(100); d != 0 {
+		t.Fatalf("waited %v for a burst", d)
+	}
+	tests := []time.Duration{500 * time.Millisecond, time.Second}
+	for _, want := range tests {
+		if d := b.reserve(50); d < want-50*time.Millisecond || d > want {
+			t.Fatalf("waited %v, want %v", d, want)
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		bps      int64
+		min, max time.Duration
+	}{
+		{"unlimited", 0, 0, 200 * time.Millisecond},
+		{"limited", 1000, 400 * time.Millisecond, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := NewConn(server, 5*time.Second)
+			defer c.Close()
+			c.SetBandwidthLimit(test.bps)
+			if c.BandwidthLimit() != test.bps {
+				t.Fatalf("limit %d, want %d", c.BandwidthLimit(), test.bps)
+			}
+
+			// A second of data bursts, and the rest is throttled.
+			data := make([]byte, 1500)
+			start := time.Now()
+			go io.ReadFull(client, make([]byte, len(data)))
+			if n, err := c.Write(data); err != nil || n != len(data) {
+				t.Fatalf("wrote %d bytes: %v", n, err)
+			}
+			if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+				t.Fatalf("write took %v, want between %v and %v", elapsed, test.min, test.max)
+			}
+
+			start = time.Now()
+			go client.Write(data)
+			if _, err := io.ReadFull(c, make([]byte, len(data))); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < test.min || elapsed > test.max {
+				t.Fatalf("read took %v, want between %v and %v", elapsed, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestBandwidthClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewConn(server, 5*time.Second)
+	c.SetBandwidthLimit(10)
+
+	// Closing the connection aborts writes waiting for bandwidth.
+	go io.Copy(io.Discard, client)
+	time.AfterFunc(100*time.Millisecond, func() { c.Close() })
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 100)); err == nil {
+		t.Fatal("write succeeded after closing")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("write aborted after %v", elapsed)
+	}
+}
+
+func TestShareBandwidthLimit(t *testing.T) {
+	_, a := net.Pipe()
+	_, b := net.Pipe()
+	first, second := NewConn(a, time.Second), NewConn(b, time.Second)
+	first.SetBandwidthLimit(100)
+	second.ShareBandwidthLimit(first)
+
+	// Data on either connection counts against the same limit.
+	if second.BandwidthLimit() != 100 || second.writeBucket != first.writeBucket || second.readBucket != first.readBucket {
+		t.Fatal("limit not shared")
+	}
+	first.writeBucket.reserve(100)
+	if d := second.writeBucket.reserve(50); d < 400*time.Millisecond {
+		t.Fatalf("waited %v after the other connection used the limit", d)
+	}
+}
@@ -1,45 +1,197 @@
 // conn/conn.go
-// Package conn provides an interface for interacting with TLS connections.
+// Package conn provides an interface for interacting with TLS connections and
+// multiplexed streams.
 
 package conn
 
 import (
-	"crypto/tls"
+	"context"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
+// The maximum size of each write to the underlying connection, so the
+// deadline is reset as large writes make progress.
+const maxWriteSize = 64 << 10
+
 // The connection handler. Implements io.ReadWriteCloser.
 type Conn struct {
-	// The underlying TLS connection.
-	Conn *tls.Conn
+	// The underlying TLS connection or stream.
+	Conn net.Conn
 
-	// The timeout duration.
+	// The idle timeout duration. Each read and write to the underlying
+	// connection must make progress within it.
 	Timeout time.Duration
+
+	// A fixed deadline. If set, it is used instead of the timeout.
+	deadline time.Time
+
+	// The context of the connection, cancelled once an operation on the
+	// connection fails (e.g. the peer disconnected or the deadline passed) or
+	// the connection is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Data read while watching for the peer closing the connection, returned
+	// by the next reads.
+	peeked []byte
+
+	// The number of bytes read from and written to the connection.
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	// The bandwidth limit in bytes per second, and the token buckets
+	// limiting reads and writes. The buckets are nil if unlimited.
+	bandwidth   int64
+	readBucket  *tokenBucket
+	writeBucket *tokenBucket
 }
 
 // Create a new conn object.
-func NewConn(conn *tls.Conn, timeout time.Duration) *Conn {
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Conn{
 		Conn:    conn,
 		Timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
-// Read.
+// Get the context of the connection, which is cancelled once an operation on
+// the connection fails or the connection is closed.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Watch for the peer closing the connection while nothing reads from it,
+// cancelling the context if it does. Watching ends early if the peer sends
+// data, which is kept for the next read. Returns the function to stop
+// watching, which must be called before the connection is read again.
+func (c *Conn) WatchClose() func() {
+	if len(c.peeked) > 0 {
+		return func() {}
+	}
+
+	// Wait without a deadline, since the peer isn't expected to send
+	// anything. The deadline is cleared before watching starts, so stopping
+	// straight away still interrupts the read.
+	c.Conn.SetReadDeadline(time.Time{})
+	var stopping atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		n, err := c.Conn.Read(buf)
+		c.bytesRead.Add(int64(n))
+		c.peeked = buf[:n]
+		if err != nil && !stopping.Load() {
+			c.cancel()
+		}
+	}()
+	return func() {
+		// Interrupt the read.
+		stopping.Store(true)
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+// Set a fixed deadline for the connection, overriding the timeout. A zero
+// value clears the deadline and restores the timeout.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// Get the deadline for the next operation.
+func (c *Conn) nextDeadline() time.Time {
+	if !c.deadline.IsZero() {
+		return c.deadline
+	}
+	return time.Now().Add(c.Timeout)
+}
+
+// Get the number of bytes read from the connection.
+func (c *Conn) BytesRead() int64 {
+	return c.bytesRead.Load()
+}
+
+// Get the number of bytes written to the connection.
+func (c *Conn) BytesWritten() int64 {
+	return c.bytesWritten.Load()
+}
+
+// Read. If the bandwidth is limited, waits after reading until the data read
+// is within the limit.
 func (c *Conn) Read(p []byte) (n int, err error) {
-	// Set the deadline.
-	c.Conn.SetDeadline(time.Now().Add(c.Timeout))
-	return c.Conn.Read(p)
+	if len(c.peeked) > 0 {
+		n = copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	if c.readBucket != nil {
+		p = c.readBucket.limit(p)
+	}
+
+	// Set the deadline. It is reset on each read, so the timeout only fails
+	// reads which make no progress.
+	c.Conn.SetReadDeadline(c.nextDeadline())
+	n, err = c.Conn.Read(p)
+	c.bytesRead.Add(int64(n))
+	if err != nil {
+		c.cancel()
+	}
+	if c.readBucket != nil && n > 0 {
+		if waitErr := c.waitBandwidth(c.readBucket.reserve(n)); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
 }
 
-// Write.
+// Write. The data is written in pieces, resetting the deadline before each,
+// so large writes only time out if they stop making progress. If the
+// bandwidth is limited, waits before each piece until it is within the limit.
 func (c *Conn) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return c.write(p)
+	}
+	for n < len(p) {
+		piece := p[n:]
+		if len(piece) > maxWriteSize {
+			piece = piece[:maxWriteSize]
+		}
+		if c.writeBucket != nil {
+			piece = c.writeBucket.limit(piece)
+			if err := c.waitBandwidth(c.writeBucket.reserve(len(piece))); err != nil {
+				return n, err
+			}
+		}
+		written, err := c.write(piece)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write to the underlying connection.
+func (c *Conn) write(p []byte) (n int, err error) {
 	// Set the deadline.
-	c.Conn.SetDeadline(time.Now().Add(c.Timeout))
-	return c.Conn.Write(p)
+	c.Conn.SetWriteDeadline(c.nextDeadline())
+	n, err = c.Conn.Write(p)
+	c.bytesWritten.Add(int64(n))
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
 }
 
 // Close.
 func (c *Conn) Close() error {
+	c.cancel()
 	return c.Conn.Close()
 }
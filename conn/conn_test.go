@@ -0,0 +1,221 @@
+// conn/conn_test.go
+// Tests for connections.
+
+package conn
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Check if the context of a connection is cancelled.
+func cancelled(c *Conn) bool {
+	select {
+	case <-c.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestContext(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(c *Conn, peer net.Conn)
+	}{
+		{"peer closed on read", func(c *Conn, peer net.Conn) {
+			peer.Close()
+			c.Read(make([]byte, 1))
+		}},
+		{"peer closed on write", func(c *Conn, peer net.Conn) {
+			peer.Close()
+			c.Write([]byte("a"))
+		}},
+		{"timeout", func(c *Conn, peer net.Conn) {
+			c.Timeout = 10 * time.Millisecond
+			c.Read(make([]byte, 1))
+		}},
+		{"closed", func(c *Conn, peer net.Conn) {
+			c.Close()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := NewConn(server, time.Second)
+			defer c.Close()
+
+			// Successful operations leave the context alone.
+			go client.Write([]byte("a"))
+			if _, err := c.Read(make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if cancelled(c) {
+				t.Fatal("context cancelled by a successful read")
+			}
+
+			test.fail(c, client)
+			if !cancelled(c) {
+				t.Fatal("context not cancelled")
+			}
+		})
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewConn(server, time.Second)
+	defer c.Close()
+
+	// Stopping leaves the connection usable.
+	stop := c.WatchClose()
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	if cancelled(c) {
+		t.Fatal("context cancelled by stopping")
+	}
+	go client.Write([]byte("ab"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ab" {
+		t.Fatalf("read %q after watching: %v", buf, err)
+	}
+
+	// Stopping straight away doesn't wait for the peer.
+	for i := 0; i < 100; i++ {
+		stopped := make(chan struct{})
+		go func() {
+			c.WatchClose()()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stopping straight away blocked")
+		}
+	}
+
+	// Data sent while watching is kept.
+	stop = c.WatchClose()
+	go client.Write([]byte("cd"))
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "cd" {
+		t.Fatalf("read %q sent while watching: %v", buf, err)
+	}
+
+	// Closing the connection is noticed without reading.
+	stop = c.WatchClose()
+	defer stop()
+	client.Close()
+	select {
+	case <-c.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled")
+	}
+}
+
+func TestByteCounts(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewConn(server, time.Second)
+	defer c.Close()
+
+	go client.Write([]byte("hello"))
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(client, make([]byte, 3))
+	if _, err := c.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if c.BytesRead() != 5 || c.BytesWritten() != 3 {
+		t.Fatalf("counted %d bytes read and %d written, want 5 and 3", c.BytesRead(), c.BytesWritten())
+	}
+}
+
+// Connect a pair of TCP connections with small buffers, so writes only
+// complete as fast as the peer reads.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []net.Conn{client, server} {
+		conn.(*net.TCPConn).SetReadBuffer(16 << 10)
+		conn.(*net.TCPConn).SetWriteBuffer(16 << 10)
+		t.Cleanup(func() { conn.Close() })
+	}
+	return client, server
+}
+
+func TestIdleTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("transfers for 5 seconds")
+	}
+
+	// Transfers in a single call which take longer than the timeout, at a
+	// steady trickle, succeed in both directions.
+	const chunk, chunks = 16 << 10, 50
+	t.Run("write", func(t *testing.T) {
+		peer, server := tcpPair(t)
+		c := NewConn(server, time.Second)
+		go func() {
+			buf := make([]byte, chunk)
+			for {
+				time.Sleep(100 * time.Millisecond)
+				if _, err := io.ReadFull(peer, buf); err != nil {
+					return
+				}
+			}
+		}()
+		start := time.Now()
+		if n, err := c.Write(make([]byte, chunk*chunks)); err != nil {
+			t.Fatalf("wrote %d bytes in %v: %v", n, time.Since(start), err)
+		}
+		if elapsed := time.Since(start); elapsed < 3*time.Second {
+			t.Fatalf("write took %v, not a trickle", elapsed)
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		peer, server := tcpPair(t)
+		c := NewConn(server, time.Second)
+		go func() {
+			for i := 0; i < chunks; i++ {
+				time.Sleep(100 * time.Millisecond)
+				if _, err := peer.Write(make([]byte, chunk)); err != nil {
+					return
+				}
+			}
+		}()
+		if n, err := io.Copy(io.Discard, io.LimitReader(c, chunk*chunks)); err != nil || n != chunk*chunks {
+			t.Fatalf("read %d bytes: %v", n, err)
+		}
+	})
+
+	// Transfers which stop making progress still time out.
+	t.Run("stalled", func(t *testing.T) {
+		_, server := tcpPair(t)
+		c := NewConn(server, time.Second)
+		start := time.Now()
+		if _, err := c.Write(make([]byte, chunk*chunks)); err == nil {
+			t.Fatal("write to a stalled peer succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("write timed out after %v", elapsed)
+		}
+	})
+}
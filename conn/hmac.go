@@ -0,0 +1,170 @@
+// conn/hmac.go
+// Connections with each message signed with an HMAC.
+
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The maximum size of the data of a signed frame. Larger writes are split
+// into multiple frames.
+const MaxHMACFrameSize = 64 << 10
+
+// The size of the nonces exchanged to derive the key of a signed connection.
+const HMACNonceSize = 32
+
+// The error returned when a frame fails verification.
+var ErrInvalidMAC = errors.New("invalid message authentication code")
+
+// Derive the key of a signed connection from the shared secret and the
+// nonces of the client and the server, so each connection is signed with a
+// different key and frames can't be replayed across connections.
+func HMACSessionKey(secret, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("deepwell-hmac"))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// A connection on which each write is sent as frames signed with an HMAC,
+// and each frame read is verified. Each frame is the length of its data, the
+// data, and an HMAC-SHA256 over the direction, the sequence number of the
+// frame, the length, and the data, so frames can't be tampered with,
+// reordered, replayed, or reflected back. Reads fail with ErrInvalidMAC if a
+// frame fails verification.
+type hmacConn struct {
+	net.Conn
+	key []byte
+
+	// The directions of the frames written and read.
+	writeDir, readDir byte
+
+	writeLock sync.Mutex
+	writeSeq  uint64
+
+	readLock sync.Mutex
+	readSeq  uint64
+	pending  []byte
+	err      error
+
+	// The frame being read, kept across reads until it is complete.
+	frame []byte
+}
+
+// Create a signed connection over a connection with the key of the
+// connection. The client and the server sign frames in different directions.
+func NewHMACConn(c net.Conn, key []byte, client bool) net.Conn {
+	h := &hmacConn{Conn: c, key: key, writeDir: 's', readDir: 'c'}
+	if client {
+		h.writeDir, h.readDir = 'c', 's'
+	}
+	return h
+}
+
+// Compute the MAC of a frame.
+func (h *hmacConn) mac(dir byte, seq uint64, data []byte) []byte {
+	var header [13]byte
+	header[0] = dir
+	binary.BigEndian.PutUint64(header[1:], seq)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(data)))
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(header[:])
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Write, sending the data as signed frames.
+func (h *hmacConn) Write(p []byte) (int, error) {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		data := p[n:]
+		if len(data) > MaxHMACFrameSize {
+			data = data[:MaxHMACFrameSize]
+		}
+		frame := make([]byte, 4, 4+len(data)+sha256.Size)
+		binary.BigEndian.PutUint32(frame, uint32(len(data)))
+		frame = append(frame, data...)
+		frame = append(frame, h.mac(h.writeDir, h.writeSeq, data)...)
+		if _, err := h.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		h.writeSeq++
+		n += len(data)
+	}
+	return n, nil
+}
+
+// Read, verifying each frame. Once a frame fails verification, every read
+// fails.
+func (h *hmacConn) Read(p []byte) (int, error) {
+	h.readLock.Lock()
+	defer h.readLock.Unlock()
+
+	for len(h.pending) == 0 {
+		if h.err != nil {
+			return 0, h.err
+		}
+		if err := h.readFrame(); err != nil {
+			if err == ErrInvalidMAC {
+				h.err = err
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, h.pending)
+	h.pending = h.pending[n:]
+	return n, nil
+}
+
+// Read and verify the next frame. A frame read in part, such as when a read
+// times out, is kept so the next read continues it.
+func (h *hmacConn) readFrame() error {
+	for {
+		// Get the size of the frame once its length has been read.
+		need := 4
+		if len(h.frame) >= 4 {
+			size := binary.BigEndian.Uint32(h.frame[:4])
+			if size > MaxHMACFrameSize {
+				return ErrInvalidMAC
+			}
+			need += int(size) + sha256.Size
+		}
+		if len(h.frame) == need && need > 4 {
+			break
+		}
+
+		// Read the rest of the length or the frame.
+		if cap(h.frame) < need {
+			h.frame = append(make([]byte, 0, need), h.frame...)
+		}
+		n, err := h.Conn.Read(h.frame[len(h.frame):need])
+		h.frame = h.frame[:len(h.frame)+n]
+		if err != nil {
+			if err == io.EOF && len(h.frame) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	size := binary.BigEndian.Uint32(h.frame[:4])
+	data, mac := h.frame[4:4+size], h.frame[4+size:]
+	if !hmac.Equal(mac, h.mac(h.readDir, h.readSeq, data)) {
+		return ErrInvalidMAC
+	}
+	h.readSeq++
+	h.pending = data
+	h.frame = nil
+	return nil
+}
@@ -0,0 +1,161 @@
+// conn/hmac_test.go
+// Tests for signed connections.
+
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// A connection which records writes, and returns a fixed series of data and
+// errors from reads.
+type scriptedConn struct {
+	net.Conn
+	written bytes.Buffer
+	reads   []interface{}
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	switch next := c.reads[0].(type) {
+	case error:
+		c.reads = c.reads[1:]
+		return 0, next
+	case []byte:
+		n := copy(p, next)
+		if n == len(next) {
+			c.reads = c.reads[1:]
+		} else {
+			c.reads[0] = next[n:]
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+func TestHMACPartialFrame(t *testing.T) {
+	key := []byte("key")
+	sent := &scriptedConn{}
+	if _, err := NewHMACConn(sent, key, true).Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame := sent.written.Bytes()
+
+	// A read which times out part way through the length or the frame is
+	// continued by the next read.
+	for _, split := range []int{2, 7, len(frame) - 1} {
+		received := &scriptedConn{reads: []interface{}{frame[:split], os.ErrDeadlineExceeded, frame[split:]}}
+		h := NewHMACConn(received, key, false)
+		buf := make([]byte, 5)
+		if _, err := h.Read(buf); err != os.ErrDeadlineExceeded {
+			t.Fatalf("split at %d: got %v, want a timeout", split, err)
+		}
+		if _, err := io.ReadFull(h, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("split at %d: read %q, %v", split, buf, err)
+		}
+	}
+
+	// Tampered frames still fail.
+	frame[5] ^= 1
+	h := NewHMACConn(&scriptedConn{reads: []interface{}{frame}}, key, false)
+	if _, err := h.Read(make([]byte, 5)); err != ErrInvalidMAC {
+		t.Fatalf("tampered frame read: %v", err)
+	}
+}
+
+// Sign writes with a key, returning the frames written.
+func signedFrames(t *testing.T, key []byte, client bool, writes ...[]byte) [][]byte {
+	t.Helper()
+	sent := &scriptedConn{}
+	h := NewHMACConn(sent, key, client)
+	frames := [][]byte{}
+	for _, data := range writes {
+		before := sent.written.Len()
+		if n, err := h.Write(data); err != nil || n != len(data) {
+			t.Fatalf("wrote %d bytes: %v", n, err)
+		}
+		frames = append(frames, append([]byte{}, sent.written.Bytes()[before:]...))
+	}
+	return frames
+}
+
+func TestHMACRoundTrip(t *testing.T) {
+	key := []byte("key")
+
+	// Large writes are split into frames, which are read back in order.
+	large := bytes.Repeat([]byte("0123456789"), MaxHMACFrameSize/4)
+	frames := signedFrames(t, key, true, []byte("hello"), large, []byte{})
+	if len(frames[1]) <= MaxHMACFrameSize || len(frames[2]) != 0 {
+		t.Fatalf("wrote frames of %d and %d bytes", len(frames[1]), len(frames[2]))
+	}
+	h := NewHMACConn(&scriptedConn{reads: []interface{}{frames[0], frames[1]}}, key, false)
+	got, err := io.ReadAll(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append([]byte("hello"), large...)) {
+		t.Fatalf("read %d bytes, want %d", len(got), 5+len(large))
+	}
+
+	// Session keys differ with each nonce.
+	a := HMACSessionKey([]byte("secret"), []byte("client"), []byte("server"))
+	b := HMACSessionKey([]byte("secret"), []byte("client"), []byte("other"))
+	if bytes.Equal(a, b) {
+		t.Fatal("session keys match for different nonces")
+	}
+}
+
+func TestHMACTampered(t *testing.T) {
+	key := []byte("key")
+	frames := signedFrames(t, key, true, []byte("first"), []byte("second"))
+	tampered := func(i int) []byte {
+		frame := append([]byte{}, frames[0]...)
+		frame[i] ^= 1
+		return frame
+	}
+	tests := []struct {
+		name   string
+		key    []byte
+		client bool
+		reads  []interface{}
+	}{
+		{"data", key, false, []interface{}{tampered(6)}},
+		{"mac", key, false, []interface{}{tampered(len(frames[0]) - 1)}},
+		{"length", key, false, []interface{}{tampered(3)}},
+		{"reordered", key, false, []interface{}{frames[1], frames[0]}},
+		{"replayed", key, false, []interface{}{frames[0], frames[0]}},
+		{"reflected", key, true, []interface{}{frames[0]}},
+		{"wrong key", []byte("other"), false, []interface{}{frames[0]}},
+		{"too large", key, false, []interface{}{[]byte{0xff, 0xff, 0xff, 0xff}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewHMACConn(&scriptedConn{reads: test.reads}, test.key, test.client)
+			_, err := io.ReadAll(h)
+			if err != ErrInvalidMAC {
+				t.Fatalf("got %v, want ErrInvalidMAC", err)
+			}
+
+			// Once a frame fails, every read fails.
+			if _, err := h.Read(make([]byte, 1)); err != ErrInvalidMAC {
+				t.Fatalf("got %v after a failed frame", err)
+			}
+		})
+	}
+
+	// Connections closed part way through a frame are reported.
+	h := NewHMACConn(&scriptedConn{reads: []interface{}{frames[0][:len(frames[0])-1]}}, key, false)
+	if _, err := io.ReadAll(h); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want an unexpected EOF", err)
+	}
+}
@@ -0,0 +1,55 @@
+// drive/cache.go
+// Dropping the caches of drives.
+
+package drive
+
+// A drive which caches data or holds written data not yet flushed.
+type Cacher interface {
+	// Flush any written data not yet flushed and drop any cached data, so
+	// the drive reflects changes made to its backing store outside the drive.
+	DropCache() error
+}
+
+// Drop the caches of a drive, if it has any.
+func DropCache(d Drive) error {
+	if cacher, ok := d.(Cacher); ok {
+		return cacher.DropCache()
+	}
+	return nil
+}
+
+// Drop the caches of the drive, flushing the files written but not yet
+// flushed in write-back mode, and recounting the usage of the drive.
+func (d *drive) DropCache() error {
+	d.flushDirty()
+	d.recountUsage()
+	return nil
+}
+
+// Drop the caches of the backing drive.
+func (e *encrypted) DropCache() error {
+	return DropCache(e.backing)
+}
+
+// Drop the caches of the backing drive.
+func (c *compressed) DropCache() error {
+	return DropCache(c.backing)
+}
+
+// Drop the caches of the backing drive.
+func (v *versioned) DropCache() error {
+	return DropCache(v.backing)
+}
+
+// Drop the caches of both layers.
+func (o *overlay) DropCache() error {
+	if err := DropCache(o.upper); err != nil {
+		return err
+	}
+	return DropCache(o.lower)
+}
+
+// Drop the caches of the backing drive.
+func (d *ignoring) DropCache() error {
+	return DropCache(d.backing)
+}
@@ -0,0 +1,92 @@
+// drive/cache_test.go
+// Tests for dropping the caches of drives.
+
+package drive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// A drive which counts the times its caches are dropped.
+type droppingDrive struct {
+	Drive
+	drops int
+}
+
+func (d *droppingDrive) DropCache() error {
+	d.drops++
+	return nil
+}
+
+func TestDropCache(t *testing.T) {
+	// Dropping the caches of a write-back drive flushes its files.
+	d := NewDriveWithOptions(t.TempDir(), Options{WriteMode: WriteModeBack, FlushInterval: time.Hour})
+	for _, name := range []string{"a", "b"} {
+		if err := d.Write(name, bytes.NewReader([]byte(name)), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dirtyFiles(d) != 2 {
+		t.Fatalf("%d files not flushed, want 2", dirtyFiles(d))
+	}
+	if err := DropCache(d); err != nil {
+		t.Fatal(err)
+	}
+	if dirtyFiles(d) != 0 {
+		t.Fatalf("%d files not flushed after dropping the caches", dirtyFiles(d))
+	}
+
+	// Drives without caches have none to drop.
+	plain, _ := newTestDrive(t)
+	if err := DropCache(struct{ Drive }{plain}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDropCacheLayered(t *testing.T) {
+	tests := []struct {
+		name  string
+		layer func(t *testing.T, backing, other Drive) Drive
+		drops int
+	}{
+		{"encrypted", func(t *testing.T, backing, other Drive) Drive {
+			e, err := NewEncryptedDrive(backing, [][]byte{testEncryptionKey(1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return e
+		}, 1},
+		{"compressed", func(t *testing.T, backing, other Drive) Drive {
+			return NewCompressedDrive(backing)
+		}, 1},
+		{"versioned", func(t *testing.T, backing, other Drive) Drive {
+			return NewVersionedDrive(backing, 0, 0)
+		}, 1},
+		{"ignoring", func(t *testing.T, backing, other Drive) Drive {
+			d, err := NewIgnoringDrive(backing, []string{"*.tmp"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d
+		}, 1},
+		{"overlay", func(t *testing.T, backing, other Drive) Drive {
+			return NewOverlayDrive(backing, other)
+		}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Layered drives drop the caches of the drives they are over.
+			upper, _ := newTestDrive(t)
+			lower, _ := newTestDrive(t)
+			backing, other := &droppingDrive{Drive: upper}, &droppingDrive{Drive: lower}
+			if err := DropCache(test.layer(t, backing, other)); err != nil {
+				t.Fatal(err)
+			}
+			if drops := backing.drops + other.drops; drops != test.drops {
+				t.Fatalf("dropped the caches of %d drives, want %d", drops, test.drops)
+			}
+		})
+	}
+}
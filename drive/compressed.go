@@ -0,0 +1,651 @@
+// drive/compressed.go
+// Compressed drives, which transparently compress files on a backing drive
+// in independently seekable blocks.
+
+package drive
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The magic bytes at the start of every compressed file.
+const compressedMagic = "DWCMP\x01"
+
+// The size of the header of compressed files: the magic bytes and the size of
+// the uncompressed data.
+const compressedHeaderSize = len(compressedMagic) + 8
+
+// The size of the uncompressed data of each compressed block.
+const compressedBlockSize = 64 << 10
+
+// The size of each entry of the block index.
+const compressedIndexEntrySize = 8
+
+// The maximum size of the uncompressed data of a compressed file.
+const maxCompressedFileSize = 1 << 50
+
+// The compressed drive implementation. Files are stored on the backing drive
+// as a header, followed by an index of the blocks, followed by the data in
+// blocks of compressedBlockSize bytes, each compressed separately with
+// DEFLATE. The index holds the end offset of each block relative to the start
+// of the first block, so a range of blocks can be located by reading only the
+// index entries around it, and ranged reads only decompress the blocks
+// overlapping the range.
+type compressed struct {
+	backing Drive
+
+	// The write locks of the files records are being appended to.
+	locks pathLocks
+}
+
+// Create a new compressed drive over a backing drive.
+func NewCompressedDrive(backing Drive) Drive {
+	return &compressed{backing: backing}
+}
+
+// Get the number of blocks of a file with a given uncompressed size.
+func compressedBlockCount(size int64) int64 {
+	return (size + compressedBlockSize - 1) / compressedBlockSize
+}
+
+// Get the uncompressed size of a block of a file.
+func compressedBlockLength(size, index int64) int64 {
+	if index == compressedBlockCount(size)-1 {
+		return size - index*compressedBlockSize
+	}
+	return compressedBlockSize
+}
+
+// Get the offset of the first block of a file on the backing drive.
+func compressedDataStart(size int64) int64 {
+	return int64(compressedHeaderSize) + compressedBlockCount(size)*compressedIndexEntrySize
+}
+
+// The error returned when a compressed file is corrupt.
+func errCorrupt(path string) error {
+	return errors.New(fmt.Sprintf("compressed file is corrupt: %s", path))
+}
+
+// Parse the header of a file, returning the uncompressed size.
+func parseCompressedHeader(raw []byte, path string) (int64, error) {
+	if len(raw) != compressedHeaderSize || string(raw[:len(compressedMagic)]) != compressedMagic {
+		return 0, errors.New(fmt.Sprintf("not a compressed file: %s", path))
+	}
+	size := int64(binary.BigEndian.Uint64(raw[len(compressedMagic):]))
+	if size < 0 || size > maxCompressedFileSize {
+		return 0, errCorrupt(path)
+	}
+	return size, nil
+}
+
+// Read the header of a file, returning the uncompressed size.
+func (c *compressed) readHeader(path string) (int64, error) {
+	var buf bytes.Buffer
+	if err := c.backing.ReadRange(path, &buf, 0, int64(compressedHeaderSize)); err != nil {
+		return 0, err
+	}
+	return parseCompressedHeader(buf.Bytes(), path)
+}
+
+// Get the compressed lengths of the blocks from first to last from the index
+// entries covering them, which start with the entry before the first block
+// unless it is the first block of the file. Returns the offset of the first
+// block relative to the start of the data, and the lengths.
+func parseCompressedIndex(entries []byte, first, last int64, path string) (int64, []int64, error) {
+	count := last - first + 1
+	if first > 0 {
+		count++
+	}
+	if int64(len(entries)) != count*compressedIndexEntrySize {
+		return 0, nil, errCorrupt(path)
+	}
+	prev := int64(0)
+	if first > 0 {
+		prev = int64(binary.BigEndian.Uint64(entries))
+		entries = entries[compressedIndexEntrySize:]
+	}
+	start := prev
+	lengths := make([]int64, 0, last-first+1)
+	for i := 0; i < len(entries); i += compressedIndexEntrySize {
+		end := int64(binary.BigEndian.Uint64(entries[i:]))
+		if end <= prev {
+			return 0, nil, errCorrupt(path)
+		}
+		lengths = append(lengths, end-prev)
+		prev = end
+	}
+	return start, lengths, nil
+}
+
+// Locate the blocks from first to last of a file on the backing drive,
+// reading only their entries of the index. Returns the offset of the first
+// block on the backing drive, and the compressed lengths of the blocks.
+func (c *compressed) locateBlocks(path string, size, first, last int64) (int64, []int64, error) {
+	from := first
+	if first > 0 {
+		from = first - 1
+	}
+	var buf bytes.Buffer
+	if err := c.backing.ReadRange(path, &buf, int64(compressedHeaderSize)+from*compressedIndexEntrySize, (last-from+1)*compressedIndexEntrySize); err != nil {
+		return 0, nil, err
+	}
+	start, lengths, err := parseCompressedIndex(buf.Bytes(), first, last, path)
+	if err != nil {
+		return 0, nil, err
+	}
+	return compressedDataStart(size) + start, lengths, nil
+}
+
+// Decompress blocks from a stream of the compressed blocks, starting at the
+// block at index first. Skips the first skip bytes of data, then writes length
+// bytes of data to the writer.
+func decompressBlocks(src io.Reader, size, first int64, lengths []int64, skip, length int64, w io.Writer, path string) error {
+	buf := make([]byte, compressedBlockSize)
+	var reader io.ReadCloser
+	for i := range lengths {
+		index := first + int64(i)
+
+		// Decompress the block, consuming all of its compressed data.
+		block := io.LimitReader(src, lengths[i])
+		if reader == nil {
+			reader = flate.NewReader(block)
+		} else if err := reader.(flate.Resetter).Reset(block, nil); err != nil {
+			return err
+		}
+		data := buf[:compressedBlockLength(size, index)]
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return errCorrupt(path)
+		}
+		if n, err := io.Copy(io.Discard, reader); err != nil || n != 0 {
+			return errCorrupt(path)
+		}
+		if n, err := io.Copy(io.Discard, block); err != nil || n != 0 {
+			return errCorrupt(path)
+		}
+
+		// Write the part of the block in the range.
+		data = data[skip:]
+		skip = 0
+		if int64(len(data)) > length {
+			data = data[:length]
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		length -= int64(len(data))
+	}
+	return nil
+}
+
+// A compressed file, buffered in a temporary file on the host.
+type compressedFile struct {
+	reader io.Reader
+	temp   *os.File
+	size   int64
+}
+
+// Read the compressed file. Reads fill the buffer unless the end of the file
+// is reached.
+func (f *compressedFile) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(f.reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close and remove the temporary file.
+func (f *compressedFile) Close() error {
+	f.temp.Close()
+	return os.Remove(f.temp.Name())
+}
+
+// Compress a stream of a given size. The compressed blocks are buffered in a
+// temporary file on the host, since the index must be written before them.
+func compress(src io.Reader, size int64) (*compressedFile, error) {
+	if size < 0 || size > maxCompressedFileSize {
+		return nil, errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+	temp, err := os.CreateTemp("", "deepwell-compressed-*")
+	if err != nil {
+		return nil, err
+	}
+	file := &compressedFile{temp: temp}
+
+	// Compress the blocks, recording the end of each in the index.
+	blocks := compressedBlockCount(size)
+	index := make([]byte, 0, blocks*compressedIndexEntrySize)
+	counter := &countingWriter{w: temp}
+	writer, err := flate.NewWriter(counter, flate.DefaultCompression)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	buf := make([]byte, compressedBlockSize)
+	for i := int64(0); i < blocks; i++ {
+		data := buf[:compressedBlockLength(size, i)]
+		if _, err := io.ReadFull(src, data); err != nil {
+			file.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		writer.Reset(counter)
+		if _, err := writer.Write(data); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		index = binary.BigEndian.AppendUint64(index, uint64(counter.n))
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 0, compressedHeaderSize)
+	header = append(header, compressedMagic...)
+	header = binary.BigEndian.AppendUint64(header, uint64(size))
+	file.reader = io.MultiReader(bytes.NewReader(header), bytes.NewReader(index), temp)
+	file.size = int64(len(header)+len(index)) + counter.n
+	return file, nil
+}
+
+// Create a file.
+func (c *compressed) Create(path string) error {
+	return c.Write(path, bytes.NewReader(nil), 0)
+}
+
+// Create a file of a given size. The file is filled with compressed zeros.
+func (c *compressed) CreateSized(path string, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	return c.Write(path, io.LimitReader(zeroReader{}, size), size)
+}
+
+// Create a uniquely named file in a directory.
+func (c *compressed) CreateTemp(dir, pattern string) (string, error) {
+	path, err := c.backing.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Create(path); err != nil {
+		c.backing.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// Create a directory.
+func (c *compressed) CreateDirectory(path string) error {
+	return c.backing.CreateDirectory(path)
+}
+
+// Read a file into a stream.
+func (c *compressed) Read(path string, stream io.Writer) error {
+	size, err := c.readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	return c.readBlocks(path, size, 0, size, stream)
+}
+
+// Read a byte range of a file into a stream. Only the blocks overlapping the
+// range are read and decompressed.
+func (c *compressed) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return errors.New("invalid range")
+	}
+	size, err := c.readHeader(path)
+	if err != nil {
+		return err
+	}
+	if offset >= size {
+		return nil
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+
+	return c.readBlocks(path, size, offset, length, stream)
+}
+
+// Read and decompress the blocks of a file overlapping a byte range.
+func (c *compressed) readBlocks(path string, size, offset, length int64, stream io.Writer) error {
+	if length == 0 {
+		return nil
+	}
+	first := offset / compressedBlockSize
+	last := (offset + length - 1) / compressedBlockSize
+	start, lengths, err := c.locateBlocks(path, size, first, last)
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	for i := range lengths {
+		total += lengths[i]
+	}
+
+	// Stream the compressed blocks from the backing drive.
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(c.backing.ReadRange(path, writer, start, total))
+	}()
+	defer reader.Close()
+
+	return decompressBlocks(reader, size, first, lengths, offset-first*compressedBlockSize, length, stream, path)
+}
+
+// Read a directory. The sizes of files are their uncompressed sizes.
+func (c *compressed) ReadDir(path string) ([]os.DirEntry, error) {
+	items, err := c.backing.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i] = &compressedEntry{DirEntry: items[i], c: c, path: path}
+	}
+	return items, nil
+}
+
+// A directory entry of a compressed drive.
+type compressedEntry struct {
+	os.DirEntry
+	c    *compressed
+	path string
+}
+
+// Get information about the entry.
+func (entry *compressedEntry) Info() (os.FileInfo, error) {
+	info, err := entry.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return entry.c.uncompressedInfo(info, filepath.Join(entry.path, entry.Name()))
+}
+
+// Get information about a file or directory. The size of a file is its
+// uncompressed size.
+func (c *compressed) Stat(path string) (os.FileInfo, error) {
+	info, err := c.backing.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.uncompressedInfo(info, path)
+}
+
+// Get information about a file with its uncompressed size.
+func (c *compressed) uncompressedInfo(info os.FileInfo, path string) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	size, err := c.readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedInfo{FileInfo: info, size: size}, nil
+}
+
+// Information about a compressed file.
+type compressedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Get the uncompressed size.
+func (info *compressedInfo) Size() int64 {
+	return info.size
+}
+
+// Write a file from a stream.
+func (c *compressed) Write(path string, stream io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+	file, err := compress(stream, size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.backing.Write(path, file, file.size)
+}
+
+// Write into an existing file at an offset. The whole file is recompressed,
+// since the sizes of the blocks after the offset may change.
+func (c *compressed) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if offset < 0 {
+		return errors.New(fmt.Sprintf("invalid offset: %d", offset))
+	}
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+	oldSize, err := c.readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	// Splice the data into the current data.
+	newSize := oldSize
+	if offset+size > newSize {
+		newSize = offset + size
+	}
+	readers := []io.Reader{}
+	if offset > 0 {
+		head := offset
+		if head > oldSize {
+			head = oldSize
+		}
+		readers = append(readers, c.rangeReader(path, oldSize, 0, head))
+	}
+	if offset > oldSize {
+		readers = append(readers, io.LimitReader(zeroReader{}, offset-oldSize))
+	}
+	readers = append(readers, io.LimitReader(stream, size))
+	if offset+size < oldSize {
+		readers = append(readers, c.rangeReader(path, oldSize, offset+size, oldSize-offset-size))
+	}
+	for i := range readers {
+		if closer, ok := readers[i].(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	// The file is fully read while compressing, before it is rewritten.
+	file, err := compress(io.MultiReader(readers...), newSize)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.backing.Write(path, file, file.size)
+}
+
+// Get a reader of a decompressed byte range of a file.
+func (c *compressed) rangeReader(path string, size, offset, length int64) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(c.readBlocks(path, size, offset, length, writer))
+	}()
+	return reader
+}
+
+// Append data to a file, creating it if it doesn't exist. The file is
+// rewritten to append the data, so appends are only atomic with respect to
+// other appends through the drive.
+func (c *compressed) Append(path string, stream io.Reader, size int64) error {
+	return appendAt(c, &c.locks, path, stream, size)
+}
+
+// Append a record to a file. The file is rewritten to append the record, so
+// appends are only atomic with respect to other appends through the drive.
+func (c *compressed) AppendRecord(path string, record []byte) error {
+	return appendRecordAt(c, &c.locks, path, record)
+}
+
+// Remove a file or directory.
+func (c *compressed) Remove(path string) error {
+	return c.backing.Remove(path)
+}
+
+// Move a file or directory.
+func (c *compressed) Move(src string, dest string) error {
+	return c.backing.Move(src, dest)
+}
+
+// Move a file or directory, failing if the destination already exists.
+func (c *compressed) MoveNoReplace(src string, dest string) error {
+	return c.backing.MoveNoReplace(src, dest)
+}
+
+// Copy a file. The compressed file is copied as is.
+func (c *compressed) Copy(src string, dest string) error {
+	return c.backing.Copy(src, dest)
+}
+
+// Flush a file or directory to stable storage.
+func (c *compressed) Sync(path string) error {
+	return c.backing.Sync(path)
+}
+
+// Change the user and group IDs of the owner of a file or directory.
+func (c *compressed) Chown(path string, uid, gid int) error {
+	return c.backing.Chown(path, uid, gid)
+}
+
+// Compute the SHA-256 checksum of the uncompressed data of a file, as a hex
+// string.
+func (c *compressed) Checksum(path string) (string, error) {
+	hash := sha256.New()
+	if err := c.Read(path, hash); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Replace the contents of a file with new contents if its current contents
+// equal the expected contents. The compressed file is compared and swapped on
+// the backing drive, so the swap stays atomic.
+func (c *compressed) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	// Only read the file if it could match.
+	info, err := c.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+	if info.Size() != int64(len(expected)) {
+		return false, nil
+	}
+
+	// Compare the current contents.
+	var raw bytes.Buffer
+	if err := c.backing.Read(path, &raw); err != nil {
+		return false, err
+	}
+	current, err := decompressFile(raw.Bytes(), path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current, expected) {
+		return false, nil
+	}
+
+	// Swap the compressed file, failing if it changed since it was read.
+	file, err := compress(bytes.NewReader(new), int64(len(new)))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	compressedNew, err := io.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
+	return c.backing.CompareAndSwap(path, raw.Bytes(), compressedNew)
+}
+
+// Decompress a compressed file in memory.
+func decompressFile(raw []byte, path string) ([]byte, error) {
+	if len(raw) < compressedHeaderSize {
+		return nil, errors.New(fmt.Sprintf("not a compressed file: %s", path))
+	}
+	size, err := parseCompressedHeader(raw[:compressedHeaderSize], path)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return []byte{}, nil
+	}
+	dataStart := compressedDataStart(size)
+	if int64(len(raw)) < dataStart {
+		return nil, errCorrupt(path)
+	}
+	_, lengths, err := parseCompressedIndex(raw[compressedHeaderSize:dataStart], 0, compressedBlockCount(size)-1, path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := decompressBlocks(bytes.NewReader(raw[dataStart:]), size, 0, lengths, 0, size, &buf, path); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Get the type of the drive.
+func (c *compressed) Type() string {
+	return "compressed"
+}
+
+// Get the storage quota of the drive in bytes. The quota applies to the
+// backing drive.
+func (c *compressed) Quota() int64 {
+	return c.backing.Quota()
+}
+
+// Get the total size of the files under a path in bytes, as stored on the
+// backing drive, after compression.
+func (c *compressed) Usage(path string) (int64, error) {
+	return c.backing.Usage(path)
+}
+
+// Get the total size of the files of the drive in bytes, as stored on the
+// backing drive.
+func (c *compressed) TotalUsage() (int64, error) {
+	return c.backing.TotalUsage()
+}
+
+// Get the total uncompressed size in bytes and the number of files under a
+// directory.
+func (c *compressed) DirSize(path string) (int64, int, error) {
+	return walkDirSize(c, path)
+}
+
+// Count the files and directories under a directory, and the total
+// uncompressed size of the files in bytes.
+func (c *compressed) CountTree(path string) (int, int, int64, error) {
+	return walkCountTree(c, path)
+}
+
+// Compute the SHA-256 checksum of the uncompressed data of every file under a
+// directory. The function is called for each file with its path relative to
+// the directory.
+func (c *compressed) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	return walkManifest(c, path, fn)
+}
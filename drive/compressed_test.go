@@ -0,0 +1,320 @@
+// drive/compressed_test.go
+// Tests for compressed drives.
+
+package drive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A drive which counts the bytes of ranged reads from it.
+type rangeCountingDrive struct {
+	Drive
+	read atomic.Int64
+}
+
+// Read a byte range of a file, counting the bytes before writing them.
+func (d *rangeCountingDrive) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	return d.Drive.ReadRange(path, &preCountingWriter{w: stream, n: &d.read}, offset, length)
+}
+
+// A writer which counts bytes before writing them, so the count is up to date
+// once a reader receives them.
+type preCountingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+// Count and write the bytes.
+func (w *preCountingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.w.Write(p)
+}
+
+// Create a compressed drive over a local drive in a temporary directory.
+// Returns the drive and the directory of the backing drive.
+func newTestCompressed(t *testing.T) (Drive, string) {
+	t.Helper()
+	backing, dir := newTestDrive(t)
+	return NewCompressedDrive(backing), dir
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	c, dir := newTestCompressed(t)
+	for _, size := range []int{0, 1, compressedBlockSize - 1, compressedBlockSize, compressedBlockSize + 1, 3*compressedBlockSize + 5} {
+		plain := testPlaintext(size)
+		if err := c.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		var buf bytes.Buffer
+		if err := c.Read("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), plain) {
+			t.Fatalf("%d bytes: read %d bytes: %v", size, buf.Len(), err)
+		}
+		if stat, err := c.Stat("file"); err != nil || stat.Size() != int64(size) {
+			t.Fatalf("%d bytes: stat failed: %v", size, err)
+		}
+
+		// The file on disk is compressed.
+		raw, err := os.ReadFile(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(raw, []byte(compressedMagic)) || (size > 1000 && len(raw) > size/10) {
+			t.Fatalf("%d bytes: stored %d bytes", size, len(raw))
+		}
+	}
+
+	if err := c.Write("file", strings.NewReader("short"), 10); err == nil {
+		t.Error("wrote a short stream")
+	}
+}
+
+func TestCompressedReadRange(t *testing.T) {
+	c, _ := newTestCompressed(t)
+	size := 2*compressedBlockSize + compressedBlockSize/2
+	plain := testPlaintext(size)
+	if err := c.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset int64
+		length int64
+	}{
+		{0, 10},
+		{compressedBlockSize - 5, 10},
+		{10, 2 * compressedBlockSize},
+		{compressedBlockSize, compressedBlockSize},
+		{int64(size) - 5, 100},
+		{int64(size), 10},
+		{0, 0},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := c.ReadRange("file", &buf, test.offset, test.length); err != nil {
+			t.Fatalf("%d+%d: %v", test.offset, test.length, err)
+		}
+		end := test.offset + test.length
+		if end > int64(size) {
+			end = int64(size)
+		}
+		want := []byte{}
+		if test.offset < end {
+			want = plain[test.offset:end]
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%d+%d: read %d bytes, want %d", test.offset, test.length, buf.Len(), len(want))
+		}
+	}
+
+	if err := c.ReadRange("file", &bytes.Buffer{}, -1, 10); err == nil {
+		t.Error("read an invalid range")
+	}
+}
+
+func TestCompressedReadRangeBlocks(t *testing.T) {
+	backing, dir := newTestDrive(t)
+	counter := &rangeCountingDrive{Drive: backing}
+	c := NewCompressedDrive(counter)
+	blocks := int64(8)
+	size := blocks * compressedBlockSize
+	plain := testPlaintext(int(size))
+	if err := c.Write("file", bytes.NewReader(plain), size); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get the compressed lengths of the blocks from the index.
+	raw, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lengths, err := parseCompressedIndex(raw[compressedHeaderSize:compressedDataStart(size)], 0, blocks-1, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the header, the index entries around the blocks, and the blocks
+	// overlapping the range are read.
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+		read   int64
+	}{
+		{"first block", 10, 100, int64(compressedHeaderSize) + compressedIndexEntrySize + lengths[0]},
+		{"middle block", 3*compressedBlockSize + 10, 100, int64(compressedHeaderSize) + 2*compressedIndexEntrySize + lengths[3]},
+		{"across blocks", 5*compressedBlockSize - 10, 20, int64(compressedHeaderSize) + 3*compressedIndexEntrySize + lengths[4] + lengths[5]},
+	}
+	for _, test := range tests {
+		counter.read.Store(0)
+		var buf bytes.Buffer
+		if err := c.ReadRange("file", &buf, test.offset, test.length); err != nil || !bytes.Equal(buf.Bytes(), plain[test.offset:test.offset+test.length]) {
+			t.Fatalf("%s: read %d bytes: %v", test.name, buf.Len(), err)
+		}
+		if read := counter.read.Load(); read != test.read {
+			t.Errorf("%s: read %d bytes from the backing drive, want %d", test.name, read, test.read)
+		}
+	}
+}
+
+func TestCompressedCorrupt(t *testing.T) {
+	size := compressedBlockSize + 100
+	tests := []struct {
+		name    string
+		corrupt func(raw []byte) []byte
+		err     string
+	}{
+		{"changed size", func(raw []byte) []byte {
+			raw[compressedHeaderSize-1] ^= 0xff
+			return raw
+		}, "corrupt"},
+		{"changed index", func(raw []byte) []byte {
+			raw[compressedHeaderSize+7] ^= 0xff
+			return raw
+		}, "corrupt"},
+		{"truncated", func(raw []byte) []byte {
+			return raw[:len(raw)-10]
+		}, ""},
+		{"not compressed", func(raw []byte) []byte {
+			return []byte("plain file, long enough for a header")
+		}, "not a compressed file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, dir := newTestCompressed(t)
+			if err := c.Write("file", bytes.NewReader(testPlaintext(size)), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "file")
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.corrupt(raw), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Read("file", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCompressedFiles(t *testing.T) {
+	c, dir := newTestCompressed(t)
+	if err := c.CreateDirectory("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write("dir/a", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateSized("dir/b", 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, c, "dir/b"); got != "\x00\x00\x00" {
+		t.Errorf("read %q from a sized file", got)
+	}
+
+	// Sizes are the uncompressed sizes.
+	items, err := c.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{}
+	for _, item := range items {
+		info, err := item.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[item.Name()] = info.Size()
+	}
+	if sizes["a"] != 5 || sizes["b"] != 3 {
+		t.Errorf("listed sizes %v", sizes)
+	}
+
+	// Checksums are of the uncompressed data.
+	sum := sha256.Sum256([]byte("hello"))
+	if checksum, err := c.Checksum("dir/a"); err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum %s: %v", checksum, err)
+	}
+
+	// Appends add to the uncompressed data.
+	if err := c.Append("dir/a", strings.NewReader(" world"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, c, "dir/a"); got != "hello world" {
+		t.Errorf("read %q from an appended file", got)
+	}
+
+	// Copied and moved files can still be read.
+	if err := c.Copy("dir/a", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Move("copy", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, c, "moved"); got != "hello world" {
+		t.Errorf("read %q from a moved copy", got)
+	}
+
+	// Swaps compare the uncompressed data.
+	if swapped, err := c.CompareAndSwap("dir/a", []byte("hello"), []byte("new")); err != nil || swapped {
+		t.Fatalf("swapped mismatched contents: %v", err)
+	}
+	if swapped, err := c.CompareAndSwap("dir/a", []byte("hello world"), []byte("new")); err != nil || !swapped {
+		t.Fatalf("contents not swapped: %v", err)
+	}
+	if got := readString(t, c, "dir/a"); got != "new" {
+		t.Errorf("read %q from a swapped file", got)
+	}
+	if raw, err := os.ReadFile(filepath.Join(dir, "dir", "a")); err != nil || !bytes.HasPrefix(raw, []byte(compressedMagic)) {
+		t.Errorf("swapped file not compressed: %v", err)
+	}
+}
+
+func TestCompressedWriteAt(t *testing.T) {
+	size := 2*compressedBlockSize + 100
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+	}{
+		{"start", 0, 10},
+		{"across blocks", compressedBlockSize - 5, 10},
+		{"end", int64(size) - 10, 10},
+		{"past the end", int64(size) - 10, 100},
+		{"gap", int64(size) + 10, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestCompressed(t)
+			plain := testPlaintext(size)
+			if err := c.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			patch := bytes.Repeat([]byte{'#'}, test.length)
+			if err := c.WriteAt("file", test.offset, bytes.NewReader(patch), int64(len(patch))); err != nil {
+				t.Fatal(err)
+			}
+
+			// The surrounding bytes are untouched.
+			want := append([]byte{}, plain...)
+			for int64(len(want)) < test.offset+int64(len(patch)) {
+				want = append(want, 0)
+			}
+			copy(want[test.offset:], patch)
+			var buf bytes.Buffer
+			if err := c.Read("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("read %d bytes, want %d: %v", buf.Len(), len(want), err)
+			}
+		})
+	}
+}
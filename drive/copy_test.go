@@ -0,0 +1,193 @@
+// drive/copy_test.go
+// Tests for copying files within a drive.
+
+package drive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Leave the partial file of an interrupted copy, with the first n bytes of
+// the copy replaced by a marker.
+func interruptCopy(t *testing.T, d *drive, src, dest string, n int) {
+	t.Helper()
+	stat, err := os.Stat(filepath.Join(d.path, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, progress := d.stagingPaths(filepath.Join(d.path, dest))
+	if err := os.MkdirAll(filepath.Dir(partial), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, bytes.Repeat([]byte("x"), n), 0666); err != nil {
+		t.Fatal(err)
+	}
+	record := strconv.FormatInt(stat.Size(), 10) + " " + strconv.FormatInt(stat.ModTime().UnixNano(), 10)
+	if err := os.WriteFile(progress, []byte(record), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	d, dir := newTestDrive(t)
+	data := []byte("0123456789")
+	if err := os.WriteFile(filepath.Join(dir, "src"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	interruptCopy(t, d.(*drive), "src", "dest", 4)
+
+	// The copy resumes after the partial file.
+	if err := d.Copy("src", "dest"); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile(filepath.Join(dir, "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(copied) != "xxxx456789" {
+		t.Fatalf("copy not resumed: %q", copied)
+	}
+	items, err := os.ReadDir(filepath.Join(dir, stagingDir))
+	if err != nil || len(items) != 0 {
+		t.Fatalf("staging files left after the copy: %v %v", items, err)
+	}
+}
+
+func TestCopyRestart(t *testing.T) {
+	d, dir := newTestDrive(t)
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("0123456789"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	interruptCopy(t, d.(*drive), "src", "dest", 4)
+
+	// The source changed since the partial copy, so the copy starts over.
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("abcdefghijk"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy("src", "dest"); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile(filepath.Join(dir, "dest"))
+	if err != nil || string(copied) != "abcdefghijk" {
+		t.Fatalf("copy not restarted: %q %v", copied, err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	d, dir := newTestDrive(t)
+	for _, size := range []int{0, 1, protocol.ChunkSize, 3*protocol.ChunkSize + 7} {
+		name := strconv.Itoa(size)
+		data := bytes.Repeat([]byte("copy"), size/4+1)[:size]
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Copy(name, "copies/"+name); err == nil {
+			t.Fatal("copied into a missing directory")
+		}
+		if err := d.Copy(name, name+".copy"); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		copied, err := os.ReadFile(filepath.Join(dir, name+".copy"))
+		if err != nil || !bytes.Equal(copied, data) {
+			t.Fatalf("%d bytes: copied %d bytes: %v", size, len(copied), err)
+		}
+	}
+}
+
+func TestCopyInvalid(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"src": "data", "dest": "old", "dir/a": "a"})
+	if err := d.Copy("src", "dest"); err == nil || !strings.Contains(err.Error(), "path already exists: dest") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+	if err := d.Copy("src", "dir"); err == nil || !strings.Contains(err.Error(), "path already exists") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+	if err := d.Copy("dir", "dir2"); err == nil {
+		t.Fatal("copied a directory")
+	}
+	if err := d.Copy("missing", "dest2"); err == nil {
+		t.Fatal("copied a missing file")
+	}
+	checkTree(t, dir, map[string]string{"src": "data", "dest": "old", "dir/a": "a"})
+}
+
+func TestCopyDestinationCreated(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"src": "data"})
+
+	// A destination created while the copy waits for its lock isn't
+	// overwritten.
+	unlock := d.(*drive).lockPath(filepath.Join(d.(*drive).path, "dest"))
+	done := make(chan error)
+	go func() {
+		done <- d.Copy("src", "dest")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeTree(t, dir, map[string]string{"dest": "new"})
+	unlock()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "path already exists: dest") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+	checkTree(t, dir, map[string]string{"src": "data", "dest": "new"})
+}
+
+func TestCopyStagingHidden(t *testing.T) {
+	d, dir := newTestDrive(t)
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("0123456789"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	interruptCopy(t, d.(*drive), "src", "dest", 4)
+
+	// The staging directory isn't listed or walked.
+	items, err := d.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name() != "src" {
+		t.Fatalf("staging directory listed: %v", items)
+	}
+	if _, count, err := d.DirSize(""); err != nil || count != 1 {
+		t.Fatalf("staging files counted: %d %v", count, err)
+	}
+	if files, dirs, _, err := d.CountTree(""); err != nil || files != 1 || dirs != 0 {
+		t.Fatalf("staging files counted: %d files, %d dirs, %v", files, dirs, err)
+	}
+	walked := []string{}
+	err = d.Manifest("", func(path, checksum string, size int64) error {
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil || len(walked) != 1 {
+		t.Fatalf("staging files in manifest: %v %v", walked, err)
+	}
+
+	// The staging files can't be used through the drive.
+	partial, _ := d.(*drive).stagingPaths(filepath.Join(dir, "dest"))
+	name := filepath.Base(partial)
+	for _, path := range []string{stagingDir, "/" + stagingDir, stagingDir + "/" + name, "./" + stagingDir + "/" + name + ".progress"} {
+		if _, err := d.Stat(path); err == nil {
+			t.Errorf("staging path %s can be stat'd", path)
+		}
+		if err := d.Read(path, &bytes.Buffer{}); err == nil {
+			t.Errorf("staging path %s can be read", path)
+		}
+		if err := d.Write(path, bytes.NewReader(nil), 0); err == nil {
+			t.Errorf("staging path %s can be written", path)
+		}
+		if err := d.Remove(path); err == nil {
+			t.Errorf("staging path %s can be removed", path)
+		}
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Fatalf("partial file changed: %v", err)
+	}
+}
@@ -6,27 +6,54 @@ package drive
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cubeflix/deepwell/protocol"
 )
 
+// The maximum number of entries visited in a single recursive walk.
+const MaxWalkEntries = 100000
+
+// The directory at the root of a drive holding the partial files of copies in
+// progress. It is hidden from the paths of the drive.
+const stagingDir = ".staging"
+
 // The drive interface.
 type Drive interface {
 	// Create a file.
 	Create(path string) error
 
+	// Create a file of a given size, without writing its contents. The file
+	// is sparse where the filesystem supports it.
+	CreateSized(path string, size int64) error
+
+	// Create a uniquely named file in a directory, like os.CreateTemp. The
+	// name is generated from the pattern, with the last "*" replaced by a
+	// random string. Returns the path of the file.
+	CreateTemp(dir, pattern string) (string, error)
+
 	// Create a directory.
 	CreateDirectory(path string) error
 
 	// Read a file into a stream.
 	Read(path string, stream io.Writer) error
 
+	// Read a byte range of a file into a stream. Reading past the end of the
+	// file only reads the available data.
+	ReadRange(path string, stream io.Writer, offset, length int64) error
+
 	// Read a directory.
 	ReadDir(path string) ([]os.DirEntry, error)
 
@@ -36,24 +63,136 @@ type Drive interface {
 	// Write a file from a stream.
 	Write(path string, stream io.Reader, size int64) error
 
+	// Write size bytes from a stream into an existing file at an offset,
+	// without truncating the rest of the file. Writing past the end of the
+	// file extends it, filling any gap with zeros.
+	WriteAt(path string, offset int64, stream io.Reader, size int64) error
+
+	// Append size bytes from a stream to the end of a file, creating the
+	// file if it doesn't exist.
+	Append(path string, stream io.Reader, size int64) error
+
+	// Append a record to a file, framed by its length, creating the file if
+	// it doesn't exist. The record is appended under the write lock of the
+	// path, so concurrent appends never interleave. Records may be read with
+	// ReadRecords.
+	AppendRecord(path string, record []byte) error
+
 	// Remove a file or directory. In the case of a directory, the directory
 	// must be empty.
 	Remove(path string) error
 
-	// Move a file.
+	// Move a file or directory.
 	Move(src string, dest string) error
+
+	// Move a file or directory, failing if the destination already exists.
+	// The destination is checked under its lock, so it is never replaced.
+	MoveNoReplace(src string, dest string) error
+
+	// Copy a file. The copy is written to a hidden partial file and renamed
+	// into place once complete. If a previous copy of
+	// the same, unchanged source was interrupted, the copy resumes from the
+	// end of the partial file. Fails if the destination already exists.
+	Copy(src string, dest string) error
+
+	// Flush a file or directory to stable storage.
+	Sync(path string) error
+
+	// Change the user and group IDs of the owner of a file or directory. A
+	// negative ID leaves it unchanged. Changing the owner usually requires
+	// the server to run with elevated privileges, and fails on platforms
+	// without file ownership.
+	Chown(path string, uid, gid int) error
+
+	// Compute the SHA-256 checksum of a file, as a hex string.
+	Checksum(path string) (string, error)
+
+	// Replace the contents of a file with new contents if its current
+	// contents equal the expected contents. The comparison and the write are
+	// done under the write lock of the path, so the swap is atomic with
+	// respect to other writes. Returns if the contents were swapped.
+	CompareAndSwap(path string, expected, new []byte) (bool, error)
+
+	// Get the type of the drive (e.g. "local" or "overlay").
+	Type() string
+
+	// Get the storage quota of the drive in bytes. Zero means the drive is
+	// unlimited.
+	Quota() int64
+
+	// Get the total size of the files under a path in bytes.
+	Usage(path string) (int64, error)
+
+	// Get the total size of the files of the drive in bytes. Drives with a
+	// quota keep their usage counted, so this doesn't walk the drive.
+	TotalUsage() (int64, error)
+
+	// Get the total size in bytes and the number of files under a directory.
+	// The walk is capped at MaxWalkEntries entries.
+	DirSize(path string) (size int64, count int, err error)
+
+	// Count the files and directories under a directory, and the total size
+	// of the files in bytes, without listing them. The directory itself isn't
+	// counted. The walk is capped at MaxWalkEntries entries.
+	CountTree(path string) (files, dirs int, bytes int64, err error)
+
+	// Compute the SHA-256 checksum of every file under a directory. The
+	// function is called for each file with its path relative to the
+	// directory.
+	Manifest(path string, fn func(path, checksum string, size int64) error) error
 }
 
 // The drive implementation.
 type drive struct {
 	// The base path of the drive on the host filesystem.
 	path string
+
+	// The drive options.
+	options Options
+
+	// The files written but not yet flushed, in write-back mode.
+	dirty dirtySet
+
+	// The write locks of the paths being written.
+	locks pathLocks
+
+	// The usage of the drive, if it has a quota.
+	usage quotaUsage
+}
+
+// Drive options.
+type Options struct {
+	// Preallocate files being written with a size of at least this many
+	// bytes. Zero disables preallocation.
+	Preallocate int64
+
+	// The storage quota of the drive in bytes. Zero means the drive is
+	// unlimited.
+	Quota int64
+
+	// The mode writes are acknowledged in.
+	WriteMode WriteMode
+
+	// The interval written files are flushed on in write-back mode. Zero
+	// uses DefaultFlushInterval.
+	FlushInterval time.Duration
+
+	// The number of chunks to read ahead of the stream when reading files,
+	// overlapping disk reads with sending. Each chunk held uses
+	// protocol.ChunkSize bytes of memory. Zero disables read-ahead.
+	ReadAhead int
 }
 
 // Create a new drive.
 func NewDrive(path string) Drive {
+	return NewDriveWithOptions(path, Options{})
+}
+
+// Create a new drive with options.
+func NewDriveWithOptions(path string, options Options) Drive {
 	return &drive{
-		path: path,
+		path:    path,
+		options: options,
 	}
 }
 
@@ -67,9 +206,28 @@ func (d *drive) getHostPath(path string) (string, error) {
 		return "", errors.New(fmt.Sprintf("path is invalid: %s", path))
 	}
 
+	// The staging directory is hidden.
+	rooted := filepath.Clean("/" + path)
+	if rooted == "/"+stagingDir || strings.HasPrefix(rooted, "/"+stagingDir+"/") {
+		return "", errors.New(fmt.Sprintf("path is invalid: %s", path))
+	}
+
 	return filepath.Join(d.path, cleanPath), nil
 }
 
+// Get the host path of the staging directory, which walks skip.
+func (d *drive) stagingRoot() string {
+	return filepath.Join(d.path, stagingDir)
+}
+
+// Get the host paths of the partial file and progress file of a copy to a
+// destination, in the staging directory.
+func (d *drive) stagingPaths(dest string) (string, string) {
+	sum := sha256.Sum256([]byte(dest))
+	partial := filepath.Join(d.stagingRoot(), hex.EncodeToString(sum[:]))
+	return partial, partial + ".progress"
+}
+
 // Create a file.
 func (d *drive) Create(path string) error {
 	// Get the cleaned, final path.
@@ -78,10 +236,76 @@ func (d *drive) Create(path string) error {
 		return err
 	}
 
+	// Lock the path. Creating a file truncates any existing file.
+	unlock := d.lockPath(path)
+	defer unlock()
+	record := d.trackUsage(path)
+	defer record()
+
 	_, err = os.Create(path)
 	return err
 }
 
+// Create a uniquely named file in a directory. Returns the path of the file.
+func (d *drive) CreateTemp(dir, pattern string) (string, error) {
+	// Get the cleaned, final path.
+	hostDir, err := d.getHostPath(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Check the quota.
+	release, err := d.reserveQuota("", 0)
+	if err != nil {
+		return "", err
+	}
+	release()
+
+	file, err := os.CreateTemp(hostDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return filepath.Join(filepath.Clean(dir), filepath.Base(file.Name())), nil
+}
+
+// Create a file of a given size, without writing its contents. The file is
+// sparse where the filesystem supports it.
+func (d *drive) CreateSized(path string, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Reserve the space of the file.
+	release, err := d.reserveQuota(path, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Create the file and extend it to the size.
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 // Create a directory.
 func (d *drive) CreateDirectory(path string) error {
 	// Get the cleaned, final path.
@@ -108,32 +332,53 @@ func (d *drive) Read(path string, stream io.Writer) error {
 	}
 	defer file.Close()
 
+	// Read ahead of the stream if enabled.
+	if d.options.ReadAhead > 0 {
+		return readAhead(stream, file, d.options.ReadAhead)
+	}
+
 	// Read the file in chunks to the stream.
-	reader := bufio.NewReader(file)
-	buf := make([]byte, protocol.ChunkSize)
-	for {
-		// Read the chunk.
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	_, err = io.CopyBuffer(stream, file, buf)
+	return err
+}
 
-		// Write the chunk to the output stream.
-		if n < protocol.ChunkSize {
-			if _, err := stream.Write(buf[:n]); err != nil {
-				return err
-			}
-			return nil
-		}
-		if _, err := stream.Write(buf); err != nil {
-			return err
-		}
+// Read a byte range of a file into a stream. Reading past the end of the file
+// only reads the available data.
+func (d *drive) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return errors.New("invalid range")
 	}
 
-	return nil
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Open the file and seek to the offset.
+	file, err := os.OpenFile(path, os.O_RDONLY, 0777)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Read ahead of the stream if enabled.
+	if d.options.ReadAhead > 0 {
+		return readAhead(stream, io.LimitReader(file, length), d.options.ReadAhead)
+	}
+
+	// Read the range in chunks to the stream.
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	_, err = io.CopyBuffer(stream, io.LimitReader(file, length), buf)
+	return err
 }
 
 // Read a directory.
@@ -144,7 +389,19 @@ func (d *drive) ReadDir(path string) ([]os.DirEntry, error) {
 		return nil, err
 	}
 
-	return os.ReadDir(path)
+	items, err := os.ReadDir(path)
+	if err != nil || path != d.path {
+		return items, err
+	}
+
+	// Hide the staging directory.
+	filtered := make([]os.DirEntry, 0, len(items))
+	for _, item := range items {
+		if item.Name() != stagingDir {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered, nil
 }
 
 // Get information about a file or directory.
@@ -158,14 +415,37 @@ func (d *drive) Stat(path string) (os.FileInfo, error) {
 	return os.Stat(path)
 }
 
+// Cut a preallocated file down to the data written to it, as it would be
+// without preallocation, rather than leaving it at its full length.
+func truncateWritten(file *os.File) {
+	if written, err := file.Seek(0, io.SeekCurrent); err == nil {
+		file.Truncate(written)
+	}
+}
+
 // Write a file from a stream.
 func (d *drive) Write(path string, stream io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
 	// Get the cleaned, final path.
 	path, err := d.getHostPath(path)
 	if err != nil {
 		return err
 	}
 
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Reserve the space of the file before creating it.
+	release, err := d.reserveQuota(path, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	// Open the file.
 	file, err := os.Create(path)
 	if err != nil {
@@ -173,44 +453,256 @@ func (d *drive) Write(path string, stream io.Reader, size int64) error {
 	}
 	defer file.Close()
 
-	// Write the file in chunks from the stream.
+	// Preallocate large files up front, reducing fragmentation and failing
+	// early if there is not enough space. Small files are not worth it.
+	preallocated := false
+	if d.options.Preallocate > 0 && size >= d.options.Preallocate {
+		if err := preallocate(file, size); err != nil {
+			file.Truncate(0)
+			return err
+		}
+		preallocated = true
+	}
+
+	// Write the file from the stream. Reads may return less than a full
+	// chunk, so copy exactly size bytes rather than whole chunks.
 	writer := bufio.NewWriter(file)
-	buf := make([]byte, protocol.ChunkSize)
-	i := int64(0)
-	for {
-		var n int
-		if size-i < int64(protocol.ChunkSize) {
-			// Read the chunk.
-			n, err = stream.Read(buf[:size-i])
-			if err != nil {
-				return err
-			}
-
-			// Write the chunk to the file.
-			if _, err := writer.Write(buf[:size-i]); err != nil {
-				return err
-			}
-		} else {
-			// Read the chunk.
-			n, err = stream.Read(buf)
-			if err != nil {
-				return err
-			}
-
-			// Write the chunk to the file.
-			if _, err := writer.Write(buf); err != nil {
-				return err
-			}
-		}
-
-		i += int64(n)
-		if i >= size {
-			break
+	if _, err := io.CopyN(writer, stream, size); err != nil {
+		if preallocated {
+			writer.Flush()
+			truncateWritten(file)
 		}
+		return err
 	}
 
 	// Flush the writer.
-	writer.Flush()
+	if err := writer.Flush(); err != nil {
+		if preallocated {
+			truncateWritten(file)
+		}
+		return err
+	}
+
+	switch d.options.WriteMode {
+	case WriteModeThrough:
+		// Flush the file to stable storage before acknowledging.
+		return file.Sync()
+	case WriteModeBack:
+		// Acknowledge now and flush the file in the background.
+		d.markDirty(path)
+	}
+
+	return nil
+}
+
+// Write size bytes from a stream into an existing file at an offset, without
+// truncating the rest of the file. Writing past the end of the file extends
+// it, filling any gap with zeros.
+func (d *drive) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if offset < 0 {
+		return errors.New(fmt.Sprintf("invalid offset: %d", offset))
+	}
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Ensure it is a file.
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+
+	// Check the quota against the size of the file after the write.
+	newSize := stat.Size()
+	if offset+size > newSize {
+		newSize = offset + size
+	}
+	release, err := d.reserveQuota(path, newSize)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Open the file without truncating it.
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Write the data in chunks from the stream.
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	for i := int64(0); i < size; {
+		n := int64(len(buf))
+		if size-i < n {
+			n = size - i
+		}
+		if _, err := io.ReadFull(stream, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(buf[:n], offset+i); err != nil {
+			return err
+		}
+		i += n
+	}
+
+	switch d.options.WriteMode {
+	case WriteModeThrough:
+		// Flush the file to stable storage before acknowledging.
+		return file.Sync()
+	case WriteModeBack:
+		// Acknowledge now and flush the file in the background.
+		d.markDirty(path)
+	}
+
+	return nil
+}
+
+// Append size bytes from a stream to the end of a file, creating the file if
+// it doesn't exist. A failed append is truncated away.
+func (d *drive) Append(path string, stream io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Get the current size of the file.
+	oldSize := int64(0)
+	if stat, err := os.Stat(path); err == nil {
+		if !stat.Mode().IsRegular() {
+			return errors.New(fmt.Sprintf("not a file: %s", path))
+		}
+		oldSize = stat.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Reserve the space of the appended data.
+	release, err := d.reserveQuota(path, oldSize+size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Open the file for appending.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Write the data in chunks from the stream.
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	for i := int64(0); i < size; {
+		n := int64(len(buf))
+		if size-i < n {
+			n = size - i
+		}
+		if _, err := io.ReadFull(stream, buf[:n]); err != nil {
+			file.Truncate(oldSize)
+			return err
+		}
+		if _, err := file.Write(buf[:n]); err != nil {
+			file.Truncate(oldSize)
+			return err
+		}
+		i += n
+	}
+
+	switch d.options.WriteMode {
+	case WriteModeThrough:
+		// Flush the file to stable storage before acknowledging.
+		return file.Sync()
+	case WriteModeBack:
+		// Acknowledge now and flush the file in the background.
+		d.markDirty(path)
+	}
+
+	return nil
+}
+
+// Append a record to a file, framed by its length, under the write lock of the
+// path. The framed record is appended in a single write, and a failed append
+// is truncated away so later records stay aligned.
+func (d *drive) AppendRecord(path string, record []byte) error {
+	framed, err := frameRecord(record)
+	if err != nil {
+		return err
+	}
+
+	// Get the cleaned, final path.
+	path, err = d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Get the current size of the file.
+	size := int64(0)
+	if stat, err := os.Stat(path); err == nil {
+		if !stat.Mode().IsRegular() {
+			return errors.New(fmt.Sprintf("not a file: %s", path))
+		}
+		size = stat.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Reserve the space of the record.
+	release, err := d.reserveQuota(path, size+int64(len(framed)))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Append the record.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(framed); err != nil {
+		file.Truncate(size)
+		return err
+	}
+
+	switch d.options.WriteMode {
+	case WriteModeThrough:
+		// Flush the file to stable storage before acknowledging.
+		return file.Sync()
+	case WriteModeBack:
+		// Acknowledge now and flush the file in the background.
+		d.markDirty(path)
+	}
 
 	return nil
 }
@@ -224,20 +716,584 @@ func (d *drive) Remove(path string) error {
 		return err
 	}
 
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+	record := d.trackUsage(path)
+	defer record()
+
 	return os.Remove(path)
 }
 
-// Move a file.
+// The functions moves rename and copy with, replaced in tests to move across
+// filesystems.
+var (
+	renamePath = os.Rename
+	copyPath   = copyTree
+)
+
+// Move a file or directory. Within a single filesystem, the move is an atomic
+// rename. Across filesystems, the source is copied recursively and then
+// removed. If the copy fails, the partial destination is removed and the
+// source is left intact. Either way, an existing destination file or empty
+// directory is replaced.
 func (d *drive) Move(src string, dest string) error {
+	return d.move(src, dest, true)
+}
+
+// Move a file or directory, failing if the destination already exists.
+func (d *drive) MoveNoReplace(src string, dest string) error {
+	return d.move(src, dest, false)
+}
+
+// Move a file or directory, replacing an existing destination if replace is
+// set.
+func (d *drive) move(src string, dest string, replace bool) error {
 	// Get the cleaned, final paths.
 	src, err := d.getHostPath(src)
 	if err != nil {
 		return err
 	}
+	destPath := dest
 	dest, err = d.getHostPath(dest)
 	if err != nil {
 		return err
 	}
 
-	return os.Rename(src, dest)
+	// Ensure we are not moving a directory into itself.
+	rel, err := filepath.Rel(src, dest)
+	if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		return errors.New("cannot move a directory into itself")
+	}
+
+	// Lock the paths. A file moved over another replaces it, unless replacing
+	// is disabled.
+	unlock := d.lockPaths(src, dest)
+	defer unlock()
+	if !replace {
+		if _, err := os.Lstat(dest); err == nil {
+			return errors.New(fmt.Sprintf("path already exists: %s", destPath))
+		}
+	}
+	record := d.trackUsage(src, dest)
+	defer record()
+
+	// Attempt a rename first.
+	err = renamePath(src, dest)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// The paths are on different filesystems, so fall back to copying. The
+	// copy is made next to the destination and renamed into place, so the
+	// destination never holds a partial copy, and is replaced as it would be
+	// by a rename.
+	temp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".move")
+	os.RemoveAll(temp)
+	if err := copyPath(src, temp); err != nil {
+		// Roll back the partial copy.
+		os.RemoveAll(temp)
+		return err
+	}
+	if err := os.Rename(temp, dest); err != nil {
+		os.RemoveAll(temp)
+		return errors.New(fmt.Sprintf("cannot replace: %s", destPath))
+	}
+
+	return os.RemoveAll(src)
+}
+
+// Copy a file. The copy is written to a partial file in the staging directory
+// and renamed into place once complete. If a previous copy of the same,
+// unchanged source was interrupted, the copy resumes from the end of the
+// partial file. Fails if the destination already exists.
+func (d *drive) Copy(src string, dest string) error {
+	// Get the cleaned, final paths.
+	src, err := d.getHostPath(src)
+	if err != nil {
+		return err
+	}
+	destPath := dest
+	dest, err = d.getHostPath(dest)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the source is a file.
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return errors.New(fmt.Sprintf("cannot copy a directory: %s", src))
+	}
+
+	// Lock the partial file. It is counted in the usage, so the space of the
+	// copy is reserved in place of it.
+	partialPath, progressPath := d.stagingPaths(dest)
+	if err := os.MkdirAll(filepath.Dir(partialPath), 0777); err != nil {
+		return err
+	}
+	unlock := d.lockPaths(dest, partialPath)
+	defer unlock()
+
+	// Never overwrite the destination. It is checked under the lock, so it
+	// can't be created before the copy is renamed into place.
+	if _, err := os.Lstat(dest); err == nil {
+		return errors.New(fmt.Sprintf("path already exists: %s", destPath))
+	}
+
+	release, err := d.reserveQuota(partialPath, stat.Size())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The progress file records the source size and modification time, so we
+	// can tell whether the source has changed since the partial copy.
+	record := strconv.FormatInt(stat.Size(), 10) + " " + strconv.FormatInt(stat.ModTime().UnixNano(), 10)
+
+	// Determine the offset to resume from.
+	offset := int64(0)
+	saved, err := os.ReadFile(progressPath)
+	if err == nil && string(saved) == record {
+		partialStat, err := os.Stat(partialPath)
+		if err == nil && partialStat.Size() <= stat.Size() {
+			offset = partialStat.Size()
+		}
+	} else {
+		// Restart the copy.
+		recordProgress := d.trackUsage(progressPath)
+		err := os.WriteFile(progressPath, []byte(record), 0666)
+		recordProgress()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Open the source file.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Open the partial file.
+	out, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(offset); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+
+	// Copy the remaining data in chunks.
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	if _, err := io.CopyBuffer(out, in, buf); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// Move the completed copy into place, recording its size first.
+	release()
+	if err := os.Rename(partialPath, dest); err != nil {
+		return err
+	}
+	recordProgress := d.trackUsage(progressPath)
+	defer recordProgress()
+	return os.Remove(progressPath)
+}
+
+// Recursively copy a file or directory on the host filesystem.
+func copyTree(src, dest string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return copyFile(src, dest, stat.Mode())
+	}
+
+	// Create the directory and copy its contents.
+	if err := os.Mkdir(dest, stat.Mode().Perm()); err != nil {
+		return err
+	}
+	items, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		name := items[i].Name()
+		if err := copyTree(filepath.Join(src, name), filepath.Join(dest, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy a single file on the host filesystem.
+func copyFile(src, dest string, mode os.FileMode) error {
+	// Open the source file.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Create the destination file.
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	// Copy the data in chunks.
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	if _, err := io.CopyBuffer(out, in, buf); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Flush a file or directory to stable storage.
+func (d *drive) Sync(path string) error {
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Open and sync the file.
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	d.markClean(path)
+	return file.Close()
+}
+
+// Change the user and group IDs of the owner of a file or directory.
+func (d *drive) Chown(path string, uid, gid int) error {
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	return chown(path, uid, gid)
+}
+
+// Replace the contents of a file with new contents if its current contents
+// equal the expected contents, under the write lock of the path. Returns if
+// the contents were swapped.
+func (d *drive) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return false, err
+	}
+
+	// Lock the path.
+	unlock := d.lockPath(path)
+	defer unlock()
+
+	// Compare the current contents.
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !stat.Mode().IsRegular() {
+		return false, errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+	if stat.Size() != int64(len(expected)) {
+		return false, nil
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current, expected) {
+		return false, nil
+	}
+
+	// Reserve the space of the new contents.
+	release, err := d.reserveQuota(path, int64(len(new)))
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	// Write the new contents.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if _, err := file.Write(new); err != nil {
+		return false, err
+	}
+	switch d.options.WriteMode {
+	case WriteModeThrough:
+		if err := file.Sync(); err != nil {
+			return false, err
+		}
+	case WriteModeBack:
+		d.markDirty(path)
+	}
+
+	return true, nil
+}
+
+// Compute the SHA-256 checksum of a file, as a hex string.
+func (d *drive) Checksum(path string) (string, error) {
+	// Get the cleaned, final path.
+	path, err := d.getHostPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Open the file.
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Hash the file in chunks.
+	hash := sha256.New()
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	if _, err := io.CopyBuffer(hash, file, buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Get the type of the drive.
+func (d *drive) Type() string {
+	return "local"
+}
+
+// Get the storage quota of the drive in bytes. Zero means the drive is
+// unlimited.
+func (d *drive) Quota() int64 {
+	return d.options.Quota
+}
+
+// Get the total size of the files of the drive in bytes, using the counted
+// usage if the drive has a quota.
+func (d *drive) TotalUsage() (int64, error) {
+	if d.options.Quota == 0 {
+		return d.Usage("")
+	}
+
+	d.usage.lock.Lock()
+	defer d.usage.lock.Unlock()
+	if err := d.countUsage(); err != nil {
+		return 0, err
+	}
+	return d.usage.used, nil
+}
+
+// Get the total size of the files under a path in bytes. The usage of the
+// drive includes the partial files of copies in progress.
+func (d *drive) Usage(path string) (int64, error) {
+	// Get the cleaned, final path.
+	root, err := d.getHostPath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Walk the tree, summing the sizes of the files.
+	total := int64(0)
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// Get the total size in bytes and the number of files under a directory.
+func (d *drive) DirSize(path string) (int64, int, error) {
+	// Get the cleaned, final path.
+	root, err := d.getHostPath(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Walk the tree, summing the sizes of the files.
+	size := int64(0)
+	count := 0
+	visited := 0
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == d.stagingRoot() {
+			return filepath.SkipDir
+		}
+
+		// Cap the size of the walk.
+		visited++
+		if visited > MaxWalkEntries {
+			return errors.New("too many entries")
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return size, count, nil
+}
+
+// Count the files and directories under a directory, and the total size of
+// the files in bytes.
+func (d *drive) CountTree(path string) (int, int, int64, error) {
+	// Get the cleaned, final path.
+	root, err := d.getHostPath(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Walk the tree, counting the entries.
+	files := 0
+	dirs := 0
+	bytes := int64(0)
+	visited := 0
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if path == d.stagingRoot() {
+			return filepath.SkipDir
+		}
+
+		// Cap the size of the walk.
+		visited++
+		if visited > MaxWalkEntries {
+			return errors.New("too many entries")
+		}
+		if entry.IsDir() {
+			dirs++
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		bytes += info.Size()
+		files++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return files, dirs, bytes, nil
+}
+
+// Compute the SHA-256 checksum of every file under a directory. The function
+// is called for each file with its path relative to the directory.
+func (d *drive) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	// Get the cleaned, final path.
+	root, err := d.getHostPath(path)
+	if err != nil {
+		return err
+	}
+
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
+	visited := 0
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if path == d.stagingRoot() {
+			return filepath.SkipDir
+		}
+
+		// Cap the size of the walk.
+		visited++
+		if visited > MaxWalkEntries {
+			return errors.New("too many entries")
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		// Hash the file.
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.CopyBuffer(hash, file, buf)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), hex.EncodeToString(hash.Sum(nil)), size)
+	})
 }
@@ -0,0 +1,495 @@
+// drive/drive_test.go
+// Tests for local drives.
+
+package drive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Create a drive in a temporary directory.
+func newTestDrive(t *testing.T) (Drive, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return NewDrive(dir), dir
+}
+
+func TestWriteOneByteReader(t *testing.T) {
+	d, dir := newTestDrive(t)
+	sizes := []int{0, 1, protocol.ChunkSize - 1, protocol.ChunkSize, protocol.ChunkSize + 1, 5*protocol.ChunkSize + 3}
+	for _, size := range sizes {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+
+			// The stream has more data than the size, which must be left
+			// unread.
+			stream := bytes.NewReader(append(append([]byte{}, data...), "extra"...))
+			if err := d.Write("file", iotest.OneByteReader(stream), int64(size)); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			written, err := os.ReadFile(filepath.Join(dir, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, data) {
+				t.Fatalf("wrote %d bytes, want %d", len(written), len(data))
+			}
+			if stream.Len() != len("extra") {
+				t.Fatalf("read %d bytes past the size", len("extra")-stream.Len())
+			}
+		})
+	}
+}
+
+func TestWriteShortStream(t *testing.T) {
+	d, _ := newTestDrive(t)
+	stream := iotest.OneByteReader(bytes.NewReader([]byte("short")))
+	if err := d.Write("file", stream, 100); err == nil {
+		t.Fatal("wrote a file from a stream shorter than the size")
+	}
+}
+
+func TestWriteNegativeSize(t *testing.T) {
+	plain, dir := newTestDrive(t)
+	compressed, _ := newTestCompressed(t)
+	drives := map[string]Drive{"plain": plain, "compressed": compressed}
+	for name, d := range drives {
+		if err := d.Write("file", strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+
+		// Negative sizes are rejected, leaving the file untouched.
+		if err := d.Write("file", strings.NewReader("new"), -1); err == nil || !strings.Contains(err.Error(), "invalid size") {
+			t.Errorf("%s: got %v, want an invalid size error", name, err)
+		}
+		if data := readString(t, d, "file"); data != "data" {
+			t.Errorf("%s: read %q after the failed write", name, data)
+		}
+	}
+	checkTree(t, dir, map[string]string{"file": "data"})
+}
+
+func TestSync(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"dir/file": "data"})
+	for _, path := range []string{"dir/file", "dir", ""} {
+		if err := d.Sync(path); err != nil {
+			t.Errorf("failed to sync %q: %v", path, err)
+		}
+	}
+	if err := d.Sync("missing"); err == nil {
+		t.Error("synced a missing file")
+	}
+}
+
+func TestReadSizes(t *testing.T) {
+	dir := t.TempDir()
+	drives := map[string]Drive{"default": NewDrive(dir), "read ahead": NewDriveWithOptions(dir, Options{ReadAhead: 2})}
+	sizes := []int{0, 1, protocol.ChunkSize - 1, protocol.ChunkSize, protocol.ChunkSize + 1, 4096, 4097, 5*protocol.ChunkSize + 3, 100000}
+	for name, d := range drives {
+		for _, size := range sizes {
+			t.Run(name+"/"+strconv.Itoa(size), func(t *testing.T) {
+				data := make([]byte, size)
+				for i := range data {
+					data[i] = byte(i % 251)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				if err := d.Read("file", &buf); err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if !bytes.Equal(buf.Bytes(), data) {
+					t.Fatalf("read %d bytes, want %d", buf.Len(), size)
+				}
+			})
+		}
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	d, dir := newTestDrive(t)
+	size := 3*protocol.ChunkSize + 7
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges past the end of the file are clamped to it.
+	tests := []struct {
+		offset int64
+		length int64
+	}{
+		{0, int64(size)},
+		{10, 20},
+		{protocol.ChunkSize - 5, protocol.ChunkSize + 10},
+		{int64(size) - 5, 100},
+		{int64(size), 10},
+		{int64(size) + 10, 10},
+		{0, 0},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := d.ReadRange("file", &buf, test.offset, test.length); err != nil {
+			t.Fatalf("%d+%d: %v", test.offset, test.length, err)
+		}
+		end := test.offset + test.length
+		if end > int64(size) {
+			end = int64(size)
+		}
+		want := []byte{}
+		if test.offset < end {
+			want = data[test.offset:end]
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%d+%d: read %d bytes, want %d", test.offset, test.length, buf.Len(), len(want))
+		}
+	}
+
+	if err := d.ReadRange("file", &bytes.Buffer{}, -1, 10); err == nil {
+		t.Error("read a negative offset")
+	}
+	if err := d.ReadRange("file", &bytes.Buffer{}, 0, -1); err == nil {
+		t.Error("read a negative length")
+	}
+	if err := d.ReadRange("missing", &bytes.Buffer{}, 0, 1); err == nil {
+		t.Error("read a missing file")
+	}
+}
+
+func TestCreateSized(t *testing.T) {
+	d, dir := newTestDrive(t)
+	if err := d.CreateSized("file", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil || len(data) != 1<<20 || !bytes.Equal(data, make([]byte, 1<<20)) {
+		t.Fatalf("created %d bytes: %v", len(data), err)
+	}
+
+	// Existing files are replaced.
+	if err := d.CreateSized("file", 10); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "file")); err != nil || stat.Size() != 10 {
+		t.Fatalf("file not replaced: %v", err)
+	}
+
+	if err := d.CreateSized("negative", -1); err == nil {
+		t.Error("created a file with a negative size")
+	}
+	if err := d.CreateSized("missing/file", 10); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"a": "12345", "dir/b": "123", "dir/sub/c": "1234567", "dir/empty": ""})
+	if err := os.Mkdir(filepath.Join(dir, "dir", "none"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		size  int64
+		count int
+	}{
+		{"", 15, 4},
+		{"dir", 10, 3},
+		{"dir/none", 0, 0},
+	}
+	for _, test := range tests {
+		size, count, err := d.DirSize(test.path)
+		if err != nil || size != test.size || count != test.count {
+			t.Errorf("%q: %d bytes in %d files, %v, want %d in %d", test.path, size, count, err, test.size, test.count)
+		}
+	}
+	if _, _, err := d.DirSize("missing"); err == nil {
+		t.Error("size of a missing directory")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"file": "old"})
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+		new      string
+		swapped  bool
+		contents string
+		valid    bool
+	}{
+		{"mismatch", "file", "other", "new", false, "old", true},
+		{"different size", "file", "older", "new", false, "old", true},
+		{"swap", "file", "old", "new", true, "new", true},
+		{"shrink", "file", "new", "", true, "", true},
+		{"empty", "file", "", "grown", true, "grown", true},
+		{"missing", "missing", "", "new", false, "", false},
+		{"directory", "dir", "", "new", false, "", false},
+	}
+	for _, test := range tests {
+		swapped, err := d.CompareAndSwap(test.path, []byte(test.expected), []byte(test.new))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: swapped an invalid path", test.name)
+			}
+			continue
+		}
+		if err != nil || swapped != test.swapped {
+			t.Fatalf("%s: swapped %t, %v, want %t", test.name, swapped, err, test.swapped)
+		}
+		checkTree(t, dir, map[string]string{"file": test.contents})
+	}
+}
+
+func TestCompareAndSwapContenders(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"lock": "free"})
+
+	// Only one of the contenders swaps the contents.
+	var wg sync.WaitGroup
+	var won atomic.Int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			swapped, err := d.CompareAndSwap("lock", []byte("free"), []byte("held by "+strconv.Itoa(i)))
+			if err != nil {
+				t.Error(err)
+			}
+			if swapped {
+				won.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if won.Load() != 1 {
+		t.Fatalf("%d contenders swapped, want 1", won.Load())
+	}
+}
+
+func TestCreateTemp(t *testing.T) {
+	d, dir := newTestDrive(t)
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent calls create unique files matching the pattern.
+	paths := make(chan string, 16)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(paths); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := d.CreateTemp("tmp", "scratch-*.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			paths <- path
+		}()
+	}
+	wg.Wait()
+	close(paths)
+	seen := map[string]bool{}
+	for path := range paths {
+		if seen[path] {
+			t.Errorf("created %s twice", path)
+		}
+		seen[path] = true
+		name := filepath.Base(path)
+		if filepath.Dir(path) != "tmp" || !strings.HasPrefix(name, "scratch-") || !strings.HasSuffix(name, ".txt") {
+			t.Errorf("created %s, which doesn't match the pattern", path)
+		}
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(seen) != 16 {
+		t.Fatalf("created %d files, want 16", len(seen))
+	}
+
+	if path, err := d.CreateTemp("", "root"); err != nil || !strings.HasPrefix(path, "root") {
+		t.Errorf("created %q in the root: %v", path, err)
+	}
+	if _, err := d.CreateTemp("missing", "*"); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+	if _, err := d.CreateTemp("tmp", "sub/*"); err == nil {
+		t.Error("created a file with a separator in the pattern")
+	}
+	if _, err := d.CreateTemp("..", "*"); err == nil {
+		t.Error("created a file outside the drive")
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		data   string
+		want   string
+	}{
+		{"middle", 3, "XYZ", "012XYZ6789"},
+		{"start", 0, "AB", "AB23456789"},
+		{"end", 8, "YZ", "01234567YZ"},
+		{"past the end", 8, "WXYZ", "01234567WXYZ"},
+		{"gap", 12, "Z", "0123456789\x00\x00Z"},
+		{"empty", 5, "", "0123456789"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, dir := newTestDrive(t)
+			writeTree(t, dir, map[string]string{"file": "0123456789"})
+			if err := d.WriteAt("file", test.offset, strings.NewReader(test.data), int64(len(test.data))); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, dir, map[string]string{"file": test.want})
+		})
+	}
+
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"file": "0123456789"})
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteAt("file", -1, strings.NewReader("x"), 1); err == nil {
+		t.Error("wrote at a negative offset")
+	}
+	if err := d.WriteAt("file", 0, strings.NewReader("x"), -1); err == nil {
+		t.Error("wrote a negative size")
+	}
+	if err := d.WriteAt("missing", 0, strings.NewReader("x"), 1); err == nil {
+		t.Error("wrote into a missing file")
+	}
+	if err := d.WriteAt("dir", 0, strings.NewReader("x"), 1); err == nil {
+		t.Error("wrote into a directory")
+	}
+	if err := d.WriteAt("file", 0, strings.NewReader("x"), 2); err == nil {
+		t.Error("wrote a short stream")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	d, dir := newTestDrive(t)
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending to a missing file creates it, and later appends add to the
+	// end.
+	large := strings.Repeat("x", 2*protocol.ChunkSize+1)
+	for _, data := range []string{"first ", "", large, " last"} {
+		if err := d.Append("file", strings.NewReader(data+"extra"), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTree(t, dir, map[string]string{"file": "first " + large + " last"})
+
+	// Failed appends leave the file as it was.
+	if err := d.Append("file", strings.NewReader("short"), 100); err == nil {
+		t.Error("appended a short stream")
+	}
+	checkTree(t, dir, map[string]string{"file": "first " + large + " last"})
+	if err := d.Append("file", strings.NewReader("x"), -1); err == nil {
+		t.Error("appended a negative size")
+	}
+	if err := d.Append("dir", strings.NewReader("x"), 1); err == nil {
+		t.Error("appended to a directory")
+	}
+	if err := d.Append("missing/file", strings.NewReader("x"), 1); err == nil {
+		t.Error("appended to a file in a missing directory")
+	}
+}
+
+func TestCountTree(t *testing.T) {
+	local, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"top": "1", "dir/a": "22", "dir/sub/b": "333", "dir/sub/deep/c": "4444"})
+	if err := os.Mkdir(filepath.Join(dir, "dir", "empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local drives walk the tree directly, and layered drives through the
+	// drive interface, with the same counts.
+	lower, _ := newTestDrive(t)
+	for name, d := range map[string]Drive{"local": local, "layered": NewOverlayDrive(local, lower)} {
+		tests := []struct {
+			path  string
+			files int
+			dirs  int
+			bytes int64
+		}{
+			{"", 4, 4, 10},
+			{"dir", 3, 3, 9},
+			{"dir/empty", 0, 0, 0},
+		}
+		for _, test := range tests {
+			files, dirs, bytes, err := d.CountTree(test.path)
+			if err != nil || files != test.files || dirs != test.dirs || bytes != test.bytes {
+				t.Errorf("%s: counted %d files and %d directories of %d bytes in %q: %v", name, files, dirs, bytes, test.path, err)
+			}
+		}
+		if _, _, _, err := d.CountTree("missing"); err == nil {
+			t.Errorf("%s: counted a missing directory", name)
+		}
+	}
+
+	// Paths outside the drive are invalid.
+	if _, _, _, err := local.CountTree("../"); err == nil {
+		t.Error("counted outside the drive")
+	}
+}
+
+// Benchmark the allocations of reading and writing files through the pooled
+// chunk buffers.
+func BenchmarkReadWrite(b *testing.B) {
+	dir := b.TempDir()
+	d := NewDrive(dir)
+	data := make([]byte, 4*protocol.ChunkSize)
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := d.Read("file", io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("write", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if err := d.Write("file", bytes.NewReader(data), int64(len(data))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
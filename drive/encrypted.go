@@ -0,0 +1,669 @@
+// drive/encrypted.go
+// Encrypted drives, which transparently encrypt files at rest on a backing
+// drive.
+
+package drive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The magic bytes at the start of every encrypted file.
+const encryptedMagic = "DWENC\x01"
+
+// The size of the header of encrypted files: the magic bytes, the ID of the
+// key, the nonce prefix, and the size of the plaintext.
+const encryptedHeaderSize = len(encryptedMagic) + 8 + 8 + 8
+
+// The size of the plaintext of each encrypted chunk.
+const encryptedChunkSize = 64 << 10
+
+// The size of the authentication tag of each encrypted chunk.
+const encryptedTagSize = 16
+
+// The size of encryption keys. Keys are AES-256 keys.
+const EncryptionKeySize = 32
+
+// The encrypted drive implementation. Files are stored on the backing drive
+// as a header followed by the plaintext in chunks, each sealed with
+// AES-256-GCM. The nonce of each chunk is a random prefix, unique to each
+// write of the file, followed by the index of the chunk. The header and if
+// the chunk is the last one are authenticated with every chunk, so chunks
+// can't be reordered, truncated, or swapped between files, and the size of
+// the plaintext in the header can be trusted once a chunk is opened. Every
+// file has at least one chunk, so the last chunk of a file whose size is a
+// multiple of the chunk size is empty.
+type encrypted struct {
+	backing Drive
+
+	// The key files are written with, and the keys by ID.
+	current encryptionKey
+	keys    map[string]encryptionKey
+
+	// The write locks of the files records are being appended to.
+	locks pathLocks
+}
+
+// An encryption key.
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// The header of an encrypted file.
+type encryptedHeader struct {
+	raw    []byte
+	key    encryptionKey
+	prefix []byte
+	size   int64
+}
+
+// Create a new encrypted drive over a backing drive. The first key is used to
+// encrypt files, and every key may decrypt them, so keys can be rotated by
+// adding a new first key while keeping the previous keys until every file
+// has been rewritten.
+func NewEncryptedDrive(backing Drive, keys [][]byte) (Drive, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+
+	e := &encrypted{backing: backing, keys: map[string]encryptionKey{}}
+	for i := range keys {
+		if len(keys[i]) != EncryptionKeySize {
+			return nil, errors.New(fmt.Sprintf("invalid encryption key size: %d, keys must be %d bytes", len(keys[i]), EncryptionKeySize))
+		}
+		block, err := aes.NewCipher(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		// Identify the key by the start of its hash.
+		sum := sha256.Sum256(keys[i])
+		key := encryptionKey{id: sum[:8], aead: aead}
+		if i == 0 {
+			e.current = key
+		}
+		e.keys[string(key.id)] = key
+	}
+	return e, nil
+}
+
+// Get the number of chunks of a file with a given plaintext size.
+func encryptedChunks(size int64) int64 {
+	return size/encryptedChunkSize + 1
+}
+
+// Get the size on the backing drive of a file with a given plaintext size.
+func encryptedSize(size int64) int64 {
+	return int64(encryptedHeaderSize) + size + encryptedChunks(size)*encryptedTagSize
+}
+
+// Get the size of the plaintext of a chunk.
+func (h *encryptedHeader) chunkSize(index int64) int64 {
+	if index == encryptedChunks(h.size)-1 {
+		return h.size % encryptedChunkSize
+	}
+	return encryptedChunkSize
+}
+
+// Get the nonce of a chunk.
+func (h *encryptedHeader) nonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.prefix)
+	binary.BigEndian.PutUint32(nonce[8:], uint32(index))
+	return nonce
+}
+
+// Get the additional data authenticated with a chunk.
+func (h *encryptedHeader) additionalData(index int64) []byte {
+	last := byte(0)
+	if index == encryptedChunks(h.size)-1 {
+		last = 1
+	}
+	return append(append([]byte{}, h.raw...), last)
+}
+
+// Create the header of a new file, with a new nonce prefix.
+func (e *encrypted) newHeader(size int64) (*encryptedHeader, error) {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 0, encryptedHeaderSize)
+	raw = append(raw, encryptedMagic...)
+	raw = append(raw, e.current.id...)
+	raw = append(raw, prefix...)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(size))
+	return &encryptedHeader{raw: raw, key: e.current, prefix: prefix, size: size}, nil
+}
+
+// Parse the header of a file.
+func (e *encrypted) parseHeader(raw []byte, path string) (*encryptedHeader, error) {
+	if len(raw) != encryptedHeaderSize || string(raw[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, errors.New(fmt.Sprintf("not an encrypted file: %s", path))
+	}
+	raw = raw[len(encryptedMagic):]
+	key, ok := e.keys[string(raw[:8])]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("file is encrypted with an unknown key %s: %s", hex.EncodeToString(raw[:8]), path))
+	}
+	size := int64(binary.BigEndian.Uint64(raw[16:24]))
+	if size < 0 {
+		return nil, errors.New(fmt.Sprintf("not an encrypted file: %s", path))
+	}
+	return &encryptedHeader{
+		raw:    append([]byte(encryptedMagic), raw...),
+		key:    key,
+		prefix: raw[8:16],
+		size:   size,
+	}, nil
+}
+
+// Read the header of a file.
+func (e *encrypted) readHeader(path string) (*encryptedHeader, error) {
+	var buf bytes.Buffer
+	if err := e.backing.ReadRange(path, &buf, 0, int64(encryptedHeaderSize)); err != nil {
+		return nil, err
+	}
+	return e.parseHeader(buf.Bytes(), path)
+}
+
+// A reader which encrypts a stream of plaintext of a known size.
+type encryptingReader struct {
+	src    io.Reader
+	header *encryptedHeader
+	index  int64
+	out    []byte
+}
+
+// Create a reader which encrypts a stream of plaintext of a given size.
+func (e *encrypted) newEncryptingReader(src io.Reader, size int64) (*encryptingReader, error) {
+	header, err := e.newHeader(size)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{src: src, header: header, out: header.raw}, nil
+}
+
+// Read the encrypted stream. Reads fill the buffer unless the end of the
+// stream is reached.
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.out) == 0 {
+			if r.index == encryptedChunks(r.header.size) {
+				break
+			}
+
+			// Seal the next chunk.
+			plain := make([]byte, r.header.chunkSize(r.index))
+			if _, err := io.ReadFull(r.src, plain); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			r.out = r.header.key.aead.Seal(nil, r.header.nonce(r.index), plain, r.header.additionalData(r.index))
+			r.index++
+		}
+		copied := copy(p[n:], r.out)
+		r.out = r.out[copied:]
+		n += copied
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Encrypt a plaintext.
+func (e *encrypted) seal(plain []byte) ([]byte, error) {
+	reader, err := e.newEncryptingReader(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// Decrypt chunks from a stream of the sealed chunks, starting at the chunk at
+// index first. Skips the first skip bytes of plaintext, then writes length
+// bytes of plaintext to the writer.
+func decryptChunks(src io.Reader, header *encryptedHeader, first, skip, length int64, w io.Writer) error {
+	sealed := make([]byte, encryptedChunkSize+encryptedTagSize)
+	for index := first; length > 0 || index == first; index++ {
+		if index >= encryptedChunks(header.size) {
+			break
+		}
+
+		// Open the chunk.
+		chunk := sealed[:header.chunkSize(index)+encryptedTagSize]
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return err
+		}
+		plain, err := header.key.aead.Open(chunk[:0], header.nonce(index), chunk, header.additionalData(index))
+		if err != nil {
+			return errors.New("encrypted file failed authentication")
+		}
+
+		// Write the part of the chunk in the range.
+		plain = plain[skip:]
+		skip = 0
+		if int64(len(plain)) > length {
+			plain = plain[:length]
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		length -= int64(len(plain))
+	}
+	return nil
+}
+
+// Decrypt a sealed file in memory.
+func (e *encrypted) open(sealed []byte, path string) ([]byte, error) {
+	if len(sealed) < encryptedHeaderSize {
+		return nil, errors.New(fmt.Sprintf("not an encrypted file: %s", path))
+	}
+	header, err := e.parseHeader(sealed[:encryptedHeaderSize], path)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(sealed)) != encryptedSize(header.size) {
+		return nil, errors.New("encrypted file failed authentication")
+	}
+	var buf bytes.Buffer
+	if err := decryptChunks(bytes.NewReader(sealed[encryptedHeaderSize:]), header, 0, 0, header.size, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Create a file.
+func (e *encrypted) Create(path string) error {
+	return e.Write(path, bytes.NewReader(nil), 0)
+}
+
+// Create a file of a given size. The file is filled with encrypted zeros, so
+// it is never sparse.
+func (e *encrypted) CreateSized(path string, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+
+	return e.Write(path, io.LimitReader(zeroReader{}, size), size)
+}
+
+// A reader of zeros.
+type zeroReader struct{}
+
+// Read zeros.
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Create a uniquely named file in a directory.
+func (e *encrypted) CreateTemp(dir, pattern string) (string, error) {
+	path, err := e.backing.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if err := e.Create(path); err != nil {
+		e.backing.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// Create a directory.
+func (e *encrypted) CreateDirectory(path string) error {
+	return e.backing.CreateDirectory(path)
+}
+
+// Read a file into a stream.
+func (e *encrypted) Read(path string, stream io.Writer) error {
+	header, err := e.readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	return e.readChunks(path, header, 0, header.size, stream)
+}
+
+// Read a byte range of a file into a stream. Only the chunks overlapping the
+// range are read and decrypted.
+func (e *encrypted) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return errors.New("invalid range")
+	}
+	header, err := e.readHeader(path)
+	if err != nil {
+		return err
+	}
+	if offset >= header.size {
+		return nil
+	}
+	if length > header.size-offset {
+		length = header.size - offset
+	}
+
+	return e.readChunks(path, header, offset, length, stream)
+}
+
+// Read and decrypt the chunks of a file overlapping a byte range.
+func (e *encrypted) readChunks(path string, header *encryptedHeader, offset, length int64, stream io.Writer) error {
+	first := offset / encryptedChunkSize
+	last := first
+	if length > 0 {
+		last = (offset + length - 1) / encryptedChunkSize
+	}
+	start := int64(encryptedHeaderSize) + first*(encryptedChunkSize+encryptedTagSize)
+	end := int64(encryptedHeaderSize) + (last+1)*(encryptedChunkSize+encryptedTagSize)
+	if last == encryptedChunks(header.size)-1 {
+		end = encryptedSize(header.size)
+	}
+
+	// Stream the sealed chunks from the backing drive.
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(e.backing.ReadRange(path, writer, start, end-start))
+	}()
+	defer reader.Close()
+
+	err := decryptChunks(reader, header, first, offset-first*encryptedChunkSize, length, stream)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return errors.New("encrypted file failed authentication")
+	}
+	return err
+}
+
+// Read a directory. The sizes of files are the sizes of their plaintext.
+func (e *encrypted) ReadDir(path string) ([]os.DirEntry, error) {
+	items, err := e.backing.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i] = &encryptedEntry{DirEntry: items[i], e: e, path: path}
+	}
+	return items, nil
+}
+
+// A directory entry of an encrypted drive.
+type encryptedEntry struct {
+	os.DirEntry
+	e    *encrypted
+	path string
+}
+
+// Get information about the entry.
+func (entry *encryptedEntry) Info() (os.FileInfo, error) {
+	info, err := entry.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return entry.e.plainInfo(info, filepath.Join(entry.path, entry.Name()))
+}
+
+// Get information about a file or directory. The size of a file is the size
+// of its plaintext.
+func (e *encrypted) Stat(path string) (os.FileInfo, error) {
+	info, err := e.backing.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.plainInfo(info, path)
+}
+
+// Get information about a file with the size of its plaintext.
+func (e *encrypted) plainInfo(info os.FileInfo, path string) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	header, err := e.readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedInfo{FileInfo: info, size: header.size}, nil
+}
+
+// Information about an encrypted file.
+type encryptedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Get the size of the plaintext.
+func (info *encryptedInfo) Size() int64 {
+	return info.size
+}
+
+// Write a file from a stream.
+func (e *encrypted) Write(path string, stream io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+	reader, err := e.newEncryptingReader(stream, size)
+	if err != nil {
+		return err
+	}
+
+	return e.backing.Write(path, reader, encryptedSize(size))
+}
+
+// Write into an existing file at an offset. Chunks must never be sealed twice
+// with the same nonce, so the whole file is re-encrypted with a new nonce
+// prefix into a temporary file, which then replaces the file.
+func (e *encrypted) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if offset < 0 {
+		return errors.New(fmt.Sprintf("invalid offset: %d", offset))
+	}
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", size))
+	}
+	header, err := e.readHeader(path)
+	if err != nil {
+		return err
+	}
+
+	// Splice the data into the current plaintext.
+	oldSize := header.size
+	newSize := oldSize
+	if offset+size > newSize {
+		newSize = offset + size
+	}
+	readers := []io.Reader{}
+	if offset > 0 {
+		head := offset
+		if head > oldSize {
+			head = oldSize
+		}
+		readers = append(readers, e.rangeReader(path, header, 0, head))
+	}
+	if offset > oldSize {
+		readers = append(readers, io.LimitReader(zeroReader{}, offset-oldSize))
+	}
+	readers = append(readers, io.LimitReader(stream, size))
+	if offset+size < oldSize {
+		readers = append(readers, e.rangeReader(path, header, offset+size, oldSize-offset-size))
+	}
+	for i := range readers {
+		if closer, ok := readers[i].(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	// Write the new file next to the file, then move it into place.
+	temp, err := e.backing.CreateTemp(filepath.Dir(filepath.Clean(path)), ".writeat-*")
+	if err != nil {
+		return err
+	}
+	if err := e.Write(temp, io.MultiReader(readers...), newSize); err != nil {
+		e.backing.Remove(temp)
+		return err
+	}
+	if err := e.backing.Move(temp, path); err != nil {
+		e.backing.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// Get a reader of a decrypted byte range of a file.
+func (e *encrypted) rangeReader(path string, header *encryptedHeader, offset, length int64) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(e.readChunks(path, header, offset, length, writer))
+	}()
+	return reader
+}
+
+// Append data to a file, creating it if it doesn't exist. The file is
+// rewritten to append the data, so appends are only atomic with respect to
+// other appends through the drive.
+func (e *encrypted) Append(path string, stream io.Reader, size int64) error {
+	return appendAt(e, &e.locks, path, stream, size)
+}
+
+// Append a record to a file. The file is rewritten to append the record, so
+// appends are only atomic with respect to other appends through the drive.
+func (e *encrypted) AppendRecord(path string, record []byte) error {
+	return appendRecordAt(e, &e.locks, path, record)
+}
+
+// Remove a file or directory.
+func (e *encrypted) Remove(path string) error {
+	return e.backing.Remove(path)
+}
+
+// Move a file or directory.
+func (e *encrypted) Move(src string, dest string) error {
+	return e.backing.Move(src, dest)
+}
+
+// Move a file or directory, failing if the destination already exists.
+func (e *encrypted) MoveNoReplace(src string, dest string) error {
+	return e.backing.MoveNoReplace(src, dest)
+}
+
+// Copy a file. The encrypted file is copied as is, since files don't depend
+// on their paths.
+func (e *encrypted) Copy(src string, dest string) error {
+	return e.backing.Copy(src, dest)
+}
+
+// Flush a file or directory to stable storage.
+func (e *encrypted) Sync(path string) error {
+	return e.backing.Sync(path)
+}
+
+// Change the user and group IDs of the owner of a file or directory.
+func (e *encrypted) Chown(path string, uid, gid int) error {
+	return e.backing.Chown(path, uid, gid)
+}
+
+// Compute the SHA-256 checksum of the plaintext of a file, as a hex string.
+func (e *encrypted) Checksum(path string) (string, error) {
+	hash := sha256.New()
+	if err := e.Read(path, hash); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Replace the contents of a file with new contents if its current contents
+// equal the expected contents. The encrypted file is compared and swapped on
+// the backing drive, so the swap stays atomic.
+func (e *encrypted) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	// Only read the file if it could match.
+	info, err := e.backing.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+	if info.Size() != encryptedSize(int64(len(expected))) {
+		return false, nil
+	}
+
+	// Compare the current contents.
+	var sealed bytes.Buffer
+	if err := e.backing.Read(path, &sealed); err != nil {
+		return false, err
+	}
+	current, err := e.open(sealed.Bytes(), path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current, expected) {
+		return false, nil
+	}
+
+	// Swap the encrypted file, failing if it changed since it was read.
+	sealedNew, err := e.seal(new)
+	if err != nil {
+		return false, err
+	}
+	return e.backing.CompareAndSwap(path, sealed.Bytes(), sealedNew)
+}
+
+// Get the type of the drive.
+func (e *encrypted) Type() string {
+	return "encrypted"
+}
+
+// Get the storage quota of the drive in bytes. The quota applies to the
+// backing drive.
+func (e *encrypted) Quota() int64 {
+	return e.backing.Quota()
+}
+
+// Get the total size of the files under a path in bytes, as stored on the
+// backing drive, including the encryption overhead.
+func (e *encrypted) Usage(path string) (int64, error) {
+	return e.backing.Usage(path)
+}
+
+// Get the total size of the files of the drive in bytes, as stored on the
+// backing drive.
+func (e *encrypted) TotalUsage() (int64, error) {
+	return e.backing.TotalUsage()
+}
+
+// Get the total size in bytes of the plaintext and the number of files under
+// a directory.
+func (e *encrypted) DirSize(path string) (int64, int, error) {
+	return walkDirSize(e, path)
+}
+
+// Count the files and directories under a directory, and the total size of
+// the plaintext of the files in bytes.
+func (e *encrypted) CountTree(path string) (int, int, int64, error) {
+	return walkCountTree(e, path)
+}
+
+// Compute the SHA-256 checksum of the plaintext of every file under a
+// directory. The function is called for each file with its path relative to
+// the directory.
+func (e *encrypted) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	return walkManifest(e, path, fn)
+}
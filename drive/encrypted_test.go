@@ -0,0 +1,340 @@
+// drive/encrypted_test.go
+// Tests for encrypted drives.
+
+package drive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create a test encryption key, filled with a byte.
+func testEncryptionKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+// Create an encrypted drive with keys over a local drive in a temporary
+// directory. Returns the drive and the directory of the backing drive.
+func newTestEncrypted(t *testing.T, keys ...[]byte) (Drive, string) {
+	t.Helper()
+	backing, dir := newTestDrive(t)
+	e, err := NewEncryptedDrive(backing, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, dir
+}
+
+// Create plaintext of a size which is easy to find in the ciphertext.
+func testPlaintext(size int) []byte {
+	return bytes.Repeat([]byte("plaintext!"), size/10+1)[:size]
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e, dir := newTestEncrypted(t, testEncryptionKey(1))
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		plain := testPlaintext(size)
+		if err := e.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		var buf bytes.Buffer
+		if err := e.Read("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), plain) {
+			t.Fatalf("%d bytes: read %d bytes: %v", size, buf.Len(), err)
+		}
+		if stat, err := e.Stat("file"); err != nil || stat.Size() != int64(size) {
+			t.Fatalf("%d bytes: stat failed: %v", size, err)
+		}
+
+		// The file on disk is encrypted.
+		sealed, err := os.ReadFile(filepath.Join(dir, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(sealed)) != encryptedSize(int64(size)) || !bytes.HasPrefix(sealed, []byte(encryptedMagic)) {
+			t.Fatalf("%d bytes: stored %d bytes", size, len(sealed))
+		}
+		if size >= 10 && bytes.Contains(sealed, plain[:10]) {
+			t.Fatalf("%d bytes: stored the plaintext", size)
+		}
+	}
+
+	if err := e.Write("file", bytes.NewReader([]byte("short")), 10); err == nil {
+		t.Error("wrote a short stream")
+	}
+}
+
+func TestEncryptedNonces(t *testing.T) {
+	e, dir := newTestEncrypted(t, testEncryptionKey(1))
+	plain := testPlaintext(100)
+
+	// Writing the same plaintext twice produces different ciphertext.
+	for _, name := range []string{"a", "b"} {
+		if err := e.Write(name, bytes.NewReader(plain), int64(len(plain))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := os.ReadFile(filepath.Join(dir, "a"))
+	b, _ := os.ReadFile(filepath.Join(dir, "b"))
+	if bytes.Equal(a[encryptedHeaderSize:], b[encryptedHeaderSize:]) {
+		t.Fatal("files encrypted with the same nonces")
+	}
+}
+
+func TestEncryptedReadRange(t *testing.T) {
+	e, _ := newTestEncrypted(t, testEncryptionKey(1))
+	size := 2*encryptedChunkSize + encryptedChunkSize/2
+	plain := testPlaintext(size)
+	if err := e.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset int64
+		length int64
+	}{
+		{0, 10},
+		{encryptedChunkSize - 5, 10},
+		{10, 2 * encryptedChunkSize},
+		{encryptedChunkSize, encryptedChunkSize},
+		{int64(size) - 5, 100},
+		{int64(size), 10},
+		{0, 0},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := e.ReadRange("file", &buf, test.offset, test.length); err != nil {
+			t.Fatalf("%d+%d: %v", test.offset, test.length, err)
+		}
+		end := test.offset + test.length
+		if end > int64(size) {
+			end = int64(size)
+		}
+		want := []byte{}
+		if test.offset < end {
+			want = plain[test.offset:end]
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%d+%d: read %d bytes, want %d", test.offset, test.length, buf.Len(), len(want))
+		}
+	}
+
+	if err := e.ReadRange("file", &bytes.Buffer{}, -1, 10); err == nil {
+		t.Error("read an invalid range")
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	size := encryptedChunkSize + 100
+	tests := []struct {
+		name   string
+		tamper func(sealed []byte) []byte
+	}{
+		{"flipped byte", func(sealed []byte) []byte {
+			sealed[encryptedHeaderSize+10] ^= 1
+			return sealed
+		}},
+		{"flipped tag", func(sealed []byte) []byte {
+			sealed[len(sealed)-1] ^= 1
+			return sealed
+		}},
+		{"changed size", func(sealed []byte) []byte {
+			sealed[encryptedHeaderSize-1] ^= 1
+			return sealed
+		}},
+		{"truncated", func(sealed []byte) []byte {
+			return sealed[:len(sealed)-100-encryptedTagSize]
+		}},
+		{"not encrypted", func(sealed []byte) []byte {
+			return []byte("plain file")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, dir := newTestEncrypted(t, testEncryptionKey(1))
+			if err := e.Write("file", bytes.NewReader(testPlaintext(size)), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "file")
+			sealed, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.tamper(sealed), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Read("file", &bytes.Buffer{}); err == nil {
+				t.Fatal("read a tampered file")
+			}
+		})
+	}
+}
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	backing, _ := newTestDrive(t)
+	oldKey, newKey := testEncryptionKey(1), testEncryptionKey(2)
+	old, err := NewEncryptedDrive(backing, [][]byte{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewEncryptedDrive(backing, [][]byte{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files written with the old key can be read after rotating.
+	if err := old.Write("old", strings.NewReader("old data"), 8); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, rotated, "old"); got != "old data" {
+		t.Fatalf("read %q", got)
+	}
+
+	// Files written after rotating use the new key.
+	if err := rotated.Write("new", strings.NewReader("new data"), 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Read("new", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("got %v, want an unknown key error", err)
+	}
+}
+
+func TestNewEncryptedDrive(t *testing.T) {
+	backing, _ := newTestDrive(t)
+	if _, err := NewEncryptedDrive(backing, nil); err == nil {
+		t.Error("created a drive without keys")
+	}
+	if _, err := NewEncryptedDrive(backing, [][]byte{testEncryptionKey(1), make([]byte, 16)}); err == nil {
+		t.Error("created a drive with a short key")
+	}
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	e, dir := newTestEncrypted(t, testEncryptionKey(1))
+	if err := e.CreateDirectory("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Write("dir/a", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CreateSized("dir/b", 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, e, "dir/b"); got != "\x00\x00\x00" {
+		t.Errorf("read %q from a sized file", got)
+	}
+
+	// Sizes are the sizes of the plaintext.
+	items, err := e.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{}
+	for _, item := range items {
+		info, err := item.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[item.Name()] = info.Size()
+	}
+	if sizes["a"] != 5 || sizes["b"] != 3 {
+		t.Errorf("listed sizes %v", sizes)
+	}
+	if size, count, err := e.DirSize(""); err != nil || size != 8 || count != 2 {
+		t.Errorf("%d bytes in %d files: %v", size, count, err)
+	}
+	if usage, err := e.Usage(""); err != nil || usage != encryptedSize(5)+encryptedSize(3) {
+		t.Errorf("usage %d: %v", usage, err)
+	}
+
+	// Checksums are of the plaintext.
+	sum := sha256.Sum256([]byte("hello"))
+	if checksum, err := e.Checksum("dir/a"); err != nil || checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum %s: %v", checksum, err)
+	}
+
+	// Copied and moved files can still be read.
+	if err := e.Copy("dir/a", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Move("copy", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, e, "moved"); got != "hello" {
+		t.Errorf("read %q from a moved copy", got)
+	}
+
+	// Swaps compare the plaintext.
+	if swapped, err := e.CompareAndSwap("dir/a", []byte("other"), []byte("new")); err != nil || swapped {
+		t.Fatalf("swapped mismatched contents: %v", err)
+	}
+	if swapped, err := e.CompareAndSwap("dir/a", []byte("hello"), []byte("new")); err != nil || !swapped {
+		t.Fatalf("contents not swapped: %v", err)
+	}
+	if got := readString(t, e, "dir/a"); got != "new" {
+		t.Errorf("read %q from a swapped file", got)
+	}
+	if sealed, err := os.ReadFile(filepath.Join(dir, "dir", "a")); err != nil || bytes.Contains(sealed, []byte("new")) {
+		t.Errorf("stored the plaintext of a swapped file: %v", err)
+	}
+}
+
+func TestEncryptedWriteAt(t *testing.T) {
+	size := 2*encryptedChunkSize + 100
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+	}{
+		{"start", 0, 10},
+		{"across chunks", encryptedChunkSize - 5, 10},
+		{"end", int64(size) - 10, 10},
+		{"past the end", int64(size) - 10, 100},
+		{"gap", int64(size) + 10, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, dir := newTestEncrypted(t, testEncryptionKey(1))
+			plain := testPlaintext(size)
+			if err := e.Write("file", bytes.NewReader(plain), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.ReadFile(filepath.Join(dir, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			patch := bytes.Repeat([]byte{'#'}, test.length)
+			if err := e.WriteAt("file", test.offset, bytes.NewReader(patch), int64(len(patch))); err != nil {
+				t.Fatal(err)
+			}
+
+			// The surrounding bytes are untouched.
+			want := append([]byte{}, plain...)
+			for int64(len(want)) < test.offset+int64(len(patch)) {
+				want = append(want, 0)
+			}
+			copy(want[test.offset:], patch)
+			var buf bytes.Buffer
+			if err := e.Read("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("read %d bytes, want %d: %v", buf.Len(), len(want), err)
+			}
+
+			// The file is encrypted with new nonces, and no temporary files
+			// are left.
+			after, err := os.ReadFile(filepath.Join(dir, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(before[encryptedHeaderSize:encryptedHeaderSize+16], after[encryptedHeaderSize:encryptedHeaderSize+16]) {
+				t.Error("file rewritten with the same nonces")
+			}
+			if names := listNames(t, e, ""); names != "file" {
+				t.Errorf("listed %s", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// drive/ignore.go
+// Drives which hide paths matching ignore patterns.
+
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The ignoring drive implementation. Paths matching any of the patterns, or
+// within a directory matching them, are hidden from listings and don't exist
+// to any other operation. Patterns are globs, as in path.Match, and are
+// matched against both the name of each element of a path and the path from
+// the root of the drive to it, so "*.tmp" hides every temporary file and
+// "build/out" hides only the one directory.
+type ignoring struct {
+	backing  Drive
+	patterns []string
+}
+
+// An ignoring drive over a versioned drive, which keeps the versioning.
+type ignoringVersioner struct {
+	*ignoring
+	versioner Versioner
+}
+
+// Create a new ignoring drive over a backing drive, hiding the paths matching
+// the patterns.
+func NewIgnoringDrive(backing Drive, patterns []string) (Drive, error) {
+	for i := range patterns {
+		if patterns[i] == "" {
+			return nil, errors.New("ignore pattern is empty")
+		}
+		if _, err := path.Match(patterns[i], ""); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid ignore pattern: %s", patterns[i]))
+		}
+	}
+
+	d := &ignoring{backing: backing, patterns: patterns}
+	if versioner, ok := backing.(Versioner); ok {
+		return &ignoringVersioner{ignoring: d, versioner: versioner}, nil
+	}
+	return d, nil
+}
+
+// Check if a path is ignored, either itself or one of its parents.
+func (d *ignoring) ignored(p string) bool {
+	rel := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if rel == "" {
+		return false
+	}
+	elems := strings.Split(rel, "/")
+	for i := range elems {
+		prefix := strings.Join(elems[:i+1], "/")
+		for _, pattern := range d.patterns {
+			if ok, _ := path.Match(pattern, elems[i]); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check that a path isn't ignored, returning a not-exist error if it is.
+func (d *ignoring) check(op, path string) error {
+	if d.ignored(path) {
+		return notExist(op, path)
+	}
+	return nil
+}
+
+// Create a file.
+func (d *ignoring) Create(path string) error {
+	if err := d.check("create", path); err != nil {
+		return err
+	}
+	return d.backing.Create(path)
+}
+
+// Create a file of a given size, without writing its contents.
+func (d *ignoring) CreateSized(path string, size int64) error {
+	if err := d.check("create", path); err != nil {
+		return err
+	}
+	return d.backing.CreateSized(path, size)
+}
+
+// Create a uniquely named file in a directory. Files whose generated name is
+// ignored are removed.
+func (d *ignoring) CreateTemp(dir, pattern string) (string, error) {
+	if err := d.check("create", dir); err != nil {
+		return "", err
+	}
+	path, err := d.backing.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if d.ignored(path) {
+		d.backing.Remove(path)
+		return "", errors.New(fmt.Sprintf("pattern is ignored: %s", pattern))
+	}
+	return path, nil
+}
+
+// Create a directory.
+func (d *ignoring) CreateDirectory(path string) error {
+	if err := d.check("mkdir", path); err != nil {
+		return err
+	}
+	return d.backing.CreateDirectory(path)
+}
+
+// Read a file into a stream.
+func (d *ignoring) Read(path string, stream io.Writer) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.Read(path, stream)
+}
+
+// Read a byte range of a file into a stream.
+func (d *ignoring) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.ReadRange(path, stream, offset, length)
+}
+
+// Read a directory, leaving out the ignored entries.
+func (d *ignoring) ReadDir(dir string) ([]os.DirEntry, error) {
+	if err := d.check("open", dir); err != nil {
+		return nil, err
+	}
+	items, err := d.backing.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	filtered := items[:0]
+	for i := range items {
+		if !d.ignored(filepath.Join(dir, items[i].Name())) {
+			filtered = append(filtered, items[i])
+		}
+	}
+	return filtered, nil
+}
+
+// Get information about a file or directory.
+func (d *ignoring) Stat(path string) (os.FileInfo, error) {
+	if err := d.check("stat", path); err != nil {
+		return nil, err
+	}
+	return d.backing.Stat(path)
+}
+
+// Write a file from a stream.
+func (d *ignoring) Write(path string, stream io.Reader, size int64) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.Write(path, stream, size)
+}
+
+// Write size bytes from a stream into an existing file at an offset.
+func (d *ignoring) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.WriteAt(path, offset, stream, size)
+}
+
+// Append size bytes from a stream to the end of a file.
+func (d *ignoring) Append(path string, stream io.Reader, size int64) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.Append(path, stream, size)
+}
+
+// Append a record to a file.
+func (d *ignoring) AppendRecord(path string, record []byte) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.backing.AppendRecord(path, record)
+}
+
+// Remove a file or directory.
+func (d *ignoring) Remove(path string) error {
+	if err := d.check("remove", path); err != nil {
+		return err
+	}
+	return d.backing.Remove(path)
+}
+
+// Move a file or directory.
+func (d *ignoring) Move(src string, dest string) error {
+	if err := d.check("rename", src); err != nil {
+		return err
+	}
+	if err := d.check("rename", dest); err != nil {
+		return err
+	}
+	return d.backing.Move(src, dest)
+}
+
+// Move a file or directory, failing if the destination already exists.
+func (d *ignoring) MoveNoReplace(src string, dest string) error {
+	if err := d.check("rename", src); err != nil {
+		return err
+	}
+	if err := d.check("rename", dest); err != nil {
+		return err
+	}
+	return d.backing.MoveNoReplace(src, dest)
+}
+
+// Copy a file.
+func (d *ignoring) Copy(src string, dest string) error {
+	if err := d.check("copy", src); err != nil {
+		return err
+	}
+	if err := d.check("copy", dest); err != nil {
+		return err
+	}
+	return d.backing.Copy(src, dest)
+}
+
+// Flush a file or directory to stable storage.
+func (d *ignoring) Sync(path string) error {
+	if err := d.check("sync", path); err != nil {
+		return err
+	}
+	return d.backing.Sync(path)
+}
+
+// Change the owner of a file or directory.
+func (d *ignoring) Chown(path string, uid, gid int) error {
+	if err := d.check("chown", path); err != nil {
+		return err
+	}
+	return d.backing.Chown(path, uid, gid)
+}
+
+// Compute the SHA-256 checksum of a file.
+func (d *ignoring) Checksum(path string) (string, error) {
+	if err := d.check("open", path); err != nil {
+		return "", err
+	}
+	return d.backing.Checksum(path)
+}
+
+// Replace the contents of a file if its current contents equal the expected
+// contents.
+func (d *ignoring) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	if err := d.check("open", path); err != nil {
+		return false, err
+	}
+	return d.backing.CompareAndSwap(path, expected, new)
+}
+
+// Get the type of the backing drive.
+func (d *ignoring) Type() string {
+	return d.backing.Type()
+}
+
+// Get the storage quota of the backing drive in bytes.
+func (d *ignoring) Quota() int64 {
+	return d.backing.Quota()
+}
+
+// Get the total size of the files under a path in bytes. Ignored files still
+// take up space, so they are included.
+func (d *ignoring) Usage(path string) (int64, error) {
+	if err := d.check("stat", path); err != nil {
+		return 0, err
+	}
+	return d.backing.Usage(path)
+}
+
+// Get the total size of the files of the drive in bytes, including the
+// ignored files.
+func (d *ignoring) TotalUsage() (int64, error) {
+	return d.backing.TotalUsage()
+}
+
+// Get the total size in bytes and the number of files under a directory,
+// excluding the ignored files.
+func (d *ignoring) DirSize(path string) (int64, int, error) {
+	return walkDirSize(d, path)
+}
+
+// Count the files and directories under a directory, and the total size of
+// the files in bytes, excluding the ignored files.
+func (d *ignoring) CountTree(path string) (int, int, int64, error) {
+	return walkCountTree(d, path)
+}
+
+// Compute the SHA-256 checksum of every file under a directory, excluding the
+// ignored files.
+func (d *ignoring) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	return walkManifest(d, path, fn)
+}
+
+// List the previous versions of a file.
+func (d *ignoringVersioner) ListVersions(path string) ([]Version, error) {
+	if err := d.check("open", path); err != nil {
+		return nil, err
+	}
+	return d.versioner.ListVersions(path)
+}
+
+// Read a previous version of a file into a stream.
+func (d *ignoringVersioner) ReadVersion(path, version string, stream io.Writer) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.versioner.ReadVersion(path, version, stream)
+}
+
+// Restore a previous version of a file.
+func (d *ignoringVersioner) RestoreVersion(path, version string) error {
+	if err := d.check("open", path); err != nil {
+		return err
+	}
+	return d.versioner.RestoreVersion(path, version)
+}
@@ -0,0 +1,130 @@
+// drive/ignore_test.go
+// Tests for drives which hide ignored paths.
+
+package drive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create an ignoring drive over a drive in a temporary directory, with a tree
+// of files.
+func newTestIgnoring(t *testing.T, patterns []string) (Drive, string) {
+	t.Helper()
+	backing, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{
+		"keep":           "1",
+		".DS_Store":      "x",
+		"a.tmp":          "x",
+		".git/config":    "x",
+		"build/out/bin":  "x",
+		"build/keep":     "22",
+		"src/.DS_Store":  "x",
+		"src/main.go":    "333",
+		"src/out/kept":   "4444",
+		"src/cache.tmp":  "x",
+		"src/.git/HEAD":  "x",
+		"src/nested.tmp": "x",
+	})
+	d, err := NewIgnoringDrive(backing, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, dir
+}
+
+func TestIgnoringListing(t *testing.T) {
+	d, _ := newTestIgnoring(t, []string{".DS_Store", "*.tmp", ".git", "build/out"})
+
+	// Patterns match names anywhere, and paths from the root.
+	tests := []struct {
+		dir   string
+		names string
+	}{
+		{"", "build,keep,src"},
+		{"build", "keep"},
+		{"src", "main.go,out"},
+		{"src/out", "kept"},
+	}
+	for _, test := range tests {
+		if names := listNames(t, d, test.dir); names != test.names {
+			t.Errorf("listed %q in %q, want %q", names, test.dir, test.names)
+		}
+	}
+
+	// Totals exclude the ignored files.
+	if size, files, err := d.DirSize(""); err != nil || size != 10 || files != 4 {
+		t.Errorf("size %d of %d files: %v", size, files, err)
+	}
+	if files, dirs, size, err := d.CountTree(""); err != nil || files != 4 || dirs != 3 || size != 10 {
+		t.Errorf("counted %d files and %d directories of %d bytes: %v", files, dirs, size, err)
+	}
+	manifest := []string{}
+	if err := d.Manifest("", func(path, checksum string, size int64) error {
+		manifest = append(manifest, path)
+		return nil
+	}); err != nil || len(manifest) != 4 {
+		t.Errorf("manifest %v: %v", manifest, err)
+	}
+}
+
+func TestIgnoringAccess(t *testing.T) {
+	d, dir := newTestIgnoring(t, []string{".DS_Store", "*.tmp", ".git", "build/out"})
+
+	// Ignored paths, and paths within them, don't exist.
+	for _, path := range []string{".DS_Store", "src/cache.tmp", ".git", ".git/config", "src/.git/HEAD", "build/out/bin", "src/../a.tmp"} {
+		if _, err := d.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stat %s: got %v, want a not exist error", path, err)
+		}
+		if err := d.Read(path, &bytes.Buffer{}); !os.IsNotExist(err) {
+			t.Errorf("read %s: got %v, want a not exist error", path, err)
+		}
+		if err := d.Write(path, strings.NewReader("new"), 3); !os.IsNotExist(err) {
+			t.Errorf("write %s: got %v, want a not exist error", path, err)
+		}
+		if err := d.Remove(path); !os.IsNotExist(err) {
+			t.Errorf("remove %s: got %v, want a not exist error", path, err)
+		}
+	}
+	if err := d.Create("new.tmp"); !os.IsNotExist(err) {
+		t.Errorf("created an ignored file: %v", err)
+	}
+	if err := d.Move("keep", "moved.tmp"); !os.IsNotExist(err) {
+		t.Errorf("moved onto an ignored path: %v", err)
+	}
+	if err := d.Copy("a.tmp", "copied"); !os.IsNotExist(err) {
+		t.Errorf("copied an ignored file: %v", err)
+	}
+	checkTree(t, filepath.Join(dir, ".git"), map[string]string{"config": "x"})
+
+	// Other paths work, including ones only partly matching a pattern.
+	if got := readString(t, d, "src/out/kept"); got != "4444" {
+		t.Errorf("read %q", got)
+	}
+	if err := d.Write("keep", strings.NewReader("new"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, d, "keep"); got != "new" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestIgnoringPatterns(t *testing.T) {
+	backing, _ := newTestDrive(t)
+	for _, patterns := range [][]string{{""}, {"[a-"}, {"*.tmp", "["}} {
+		if _, err := NewIgnoringDrive(backing, patterns); err == nil {
+			t.Errorf("created a drive ignoring %q", patterns)
+		}
+	}
+
+	// Versioned drives keep their versioning.
+	if d, err := NewIgnoringDrive(NewVersionedDrive(backing, 0, 0), []string{"*.tmp"}); err != nil {
+		t.Fatal(err)
+	} else if _, ok := d.(Versioner); !ok {
+		t.Fatal("versioning lost")
+	}
+}
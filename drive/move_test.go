@@ -0,0 +1,218 @@
+// drive/move_test.go
+// Tests for moving files and directories within a drive.
+
+package drive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Create a tree of files under a directory on the host filesystem.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check the files under a directory on the host filesystem.
+func checkTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	found := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if expected, ok := files[filepath.ToSlash(rel)]; !ok || string(data) != expected {
+			t.Errorf("unexpected file %s: %q", rel, data)
+		}
+		found++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != len(files) {
+		t.Fatalf("found %d files, expected %d", found, len(files))
+	}
+}
+
+var testTree = map[string]string{
+	"a":         "a",
+	"sub/b":     "bb",
+	"sub/c/d":   "ddd",
+	"sub/empty": "",
+}
+
+func TestMoveDirectory(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, filepath.Join(dir, "src"), testTree)
+	if err := d.Move("src", "dest"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(dir, "dest"), testTree)
+	if _, err := os.Stat(filepath.Join(dir, "src")); !os.IsNotExist(err) {
+		t.Fatalf("source left after the move: %v", err)
+	}
+}
+
+func TestMoveDirectoryIntoItself(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, filepath.Join(dir, "src"), testTree)
+	for _, dest := range []string{"src/sub", "src/new", "./src/sub/c"} {
+		if err := d.Move("src", dest); err == nil {
+			t.Fatalf("moved a directory into itself: %s", dest)
+		}
+	}
+	checkTree(t, filepath.Join(dir, "src"), testTree)
+
+	// A sibling with the directory's name as a prefix isn't inside it.
+	if err := d.Move("src", "src2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	// Moves across filesystems fall back to copying the tree.
+	dir := t.TempDir()
+	writeTree(t, filepath.Join(dir, "src"), testTree)
+	if err := copyTree(filepath.Join(dir, "src"), filepath.Join(dir, "dest")); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(dir, "dest"), testTree)
+	checkTree(t, filepath.Join(dir, "src"), testTree)
+	stat, err := os.Stat(filepath.Join(dir, "dest", "sub", "b"))
+	if err != nil || stat.Mode().Perm() != 0640 {
+		t.Fatalf("file mode not copied: %v %v", stat.Mode(), err)
+	}
+
+	// Copying over an existing file fails.
+	if err := copyTree(filepath.Join(dir, "src", "a"), filepath.Join(dir, "dest", "a")); err == nil {
+		t.Fatal("copied over an existing file")
+	}
+}
+
+// Make moves fail to rename across filesystems until the test finishes, so
+// they fall back to copying.
+func simulateCrossDevice(t *testing.T) {
+	t.Helper()
+	renamePath = func(src, dest string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { renamePath = os.Rename })
+}
+
+func TestMoveAcrossFilesystems(t *testing.T) {
+	for _, crossDevice := range []bool{false, true} {
+		d, dir := newTestDrive(t)
+		if crossDevice {
+			simulateCrossDevice(t)
+		}
+
+		// Directories are moved whole.
+		writeTree(t, filepath.Join(dir, "src"), testTree)
+		if err := d.Move("src", "dest"); err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, filepath.Join(dir, "dest"), testTree)
+		if _, err := os.Stat(filepath.Join(dir, "src")); !os.IsNotExist(err) {
+			t.Fatalf("source left after the move: %v", err)
+		}
+
+		// Existing files are replaced the same way on both paths.
+		writeTree(t, dir, map[string]string{"new": "new", "old": "old"})
+		if err := d.Move("new", "old"); err != nil {
+			t.Fatalf("cross device %v: %v", crossDevice, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "old")); err != nil || string(data) != "new" {
+			t.Fatalf("cross device %v: read %q: %v", crossDevice, data, err)
+		}
+
+		// Directories which aren't empty aren't replaced, and the error
+		// doesn't reveal the host path.
+		if err := d.Move("old", "dest"); err == nil {
+			t.Fatalf("cross device %v: replaced a directory which isn't empty", crossDevice)
+		} else if crossDevice && strings.Contains(err.Error(), dir) {
+			t.Fatalf("error reveals the host path: %v", err)
+		}
+	}
+}
+
+func TestMoveFailedCopy(t *testing.T) {
+	d, dir := newTestDrive(t)
+	simulateCrossDevice(t)
+	copyPath = func(src, dest string) error {
+		copyTree(src, dest)
+		return errors.New("disk failure")
+	}
+	t.Cleanup(func() { copyPath = copyTree })
+
+	// The source survives, and the partial copy is removed.
+	writeTree(t, filepath.Join(dir, "src"), testTree)
+	if err := d.Move("src", "dest"); err == nil || err.Error() != "disk failure" {
+		t.Fatalf("got %v, want a disk failure error", err)
+	}
+	checkTree(t, filepath.Join(dir, "src"), testTree)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "src" && !strings.HasPrefix(entry.Name(), ".") {
+			t.Fatalf("partial copy left at %s", entry.Name())
+		}
+		if strings.HasSuffix(entry.Name(), ".move") {
+			t.Fatalf("partial copy left at %s", entry.Name())
+		}
+	}
+}
+
+func TestMoveNoReplace(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"src": "data", "existing": "old"})
+
+	// Existing destinations aren't replaced.
+	if err := d.MoveNoReplace("src", "existing"); err == nil || !strings.Contains(err.Error(), "path already exists: existing") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+
+	// Nor are destinations created while the move waits for its lock.
+	unlock := d.(*drive).lockPath(filepath.Join(d.(*drive).path, "dest"))
+	done := make(chan error)
+	go func() {
+		done <- d.MoveNoReplace("src", "dest")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeTree(t, dir, map[string]string{"dest": "new"})
+	unlock()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "path already exists: dest") {
+		t.Fatalf("got %v, want a path already exists error", err)
+	}
+	checkTree(t, dir, map[string]string{"src": "data", "existing": "old", "dest": "new"})
+
+	// Other destinations are moved to.
+	if err := d.MoveNoReplace("src", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, map[string]string{"moved": "data", "existing": "old", "dest": "new"})
+}
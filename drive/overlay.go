@@ -0,0 +1,701 @@
+// drive/overlay.go
+// Overlay drives, which present a writable upper drive layered over a
+// read-only lower drive.
+
+package drive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The prefix of whiteout files, which mark a path in the lower drive as
+// removed.
+const whiteoutPrefix = ".wh."
+
+// The name of the opaque marker file, which hides the contents of a directory
+// in the lower drive.
+const opaqueName = ".wh.__opaque"
+
+// The overlay drive implementation. Reads check the upper drive, then fall
+// through to the lower drive. Writes always go to the upper drive, copying
+// files up from the lower drive as needed. Removing a path that exists in the
+// lower drive creates a whiteout in the upper drive.
+type overlay struct {
+	upper Drive
+	lower Drive
+}
+
+// Create a new overlay drive.
+func NewOverlayDrive(upper, lower Drive) Drive {
+	return &overlay{
+		upper: upper,
+		lower: lower,
+	}
+}
+
+// Return a not-exist error for a path.
+func notExist(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+// Check that a path does not refer to a whiteout or opaque marker.
+func checkOverlayPath(path string) error {
+	if strings.HasPrefix(filepath.Base(filepath.Clean(path)), whiteoutPrefix) {
+		return errors.New(fmt.Sprintf("path is invalid: %s", path))
+	}
+	return nil
+}
+
+// Get the whiteout path for a path.
+func whiteoutPath(path string) string {
+	path = filepath.Clean(path)
+	return filepath.Join(filepath.Dir(path), whiteoutPrefix+filepath.Base(path))
+}
+
+// Check if a path exists on a drive.
+func exists(d Drive, path string) bool {
+	_, err := d.Stat(path)
+	return err == nil
+}
+
+// Check if a path in the lower drive is visible, i.e. neither it nor any of
+// its parents have been whited out.
+func (o *overlay) lowerVisible(path string) bool {
+	clean := filepath.Clean(path)
+	if clean == "." {
+		return true
+	}
+
+	parts := strings.Split(filepath.ToSlash(clean), "/")
+	current := ""
+	for i, part := range parts {
+		if exists(o.upper, filepath.Join(current, whiteoutPrefix+part)) {
+			return false
+		}
+		current = filepath.Join(current, part)
+		if i < len(parts)-1 && exists(o.upper, filepath.Join(current, opaqueName)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if a path exists in the visible part of the lower drive.
+func (o *overlay) inLower(path string) bool {
+	return o.lowerVisible(path) && exists(o.lower, path)
+}
+
+// Ensure a directory and its parents exist in the upper drive.
+func (o *overlay) ensureUpperDir(path string) error {
+	clean := filepath.Clean(path)
+	if clean == "." {
+		return nil
+	}
+
+	current := ""
+	for _, part := range strings.Split(filepath.ToSlash(clean), "/") {
+		current = filepath.Join(current, part)
+		stat, err := o.upper.Stat(current)
+		if err == nil {
+			if !stat.IsDir() {
+				return errors.New(fmt.Sprintf("not a directory: %s", current))
+			}
+			continue
+		}
+		if err := o.upper.CreateDirectory(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the whiteout for a path, if there is one. Returns whether a whiteout
+// was removed.
+func (o *overlay) removeWhiteout(path string) (bool, error) {
+	whiteout := whiteoutPath(path)
+	if !exists(o.upper, whiteout) {
+		return false, nil
+	}
+	return true, o.upper.Remove(whiteout)
+}
+
+// Copy a file or directory up from the lower drive into the upper drive.
+func (o *overlay) copyUp(path string) error {
+	if exists(o.upper, path) {
+		stat, err := o.upper.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return nil
+		}
+	}
+
+	stat, err := o.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+
+	if stat.IsDir() {
+		// Copy up the directory and its contents.
+		if err := o.ensureUpperDir(path); err != nil {
+			return err
+		}
+		items, err := o.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			if err := o.copyUp(filepath.Join(path, items[i].Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return o.copyFromLower(path, path, stat.Size())
+}
+
+// Copy a file from the lower drive into the upper drive.
+func (o *overlay) copyFromLower(src, dest string, size int64) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(o.lower.Read(src, writer))
+	}()
+	err := o.upper.Write(dest, reader, size)
+	reader.Close()
+	return err
+}
+
+// Create a file.
+func (o *overlay) Create(path string) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(path); err != nil {
+		return err
+	}
+
+	return o.upper.Create(path)
+}
+
+// Create a file of a given size, without writing its contents.
+func (o *overlay) CreateSized(path string, size int64) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(path); err != nil {
+		return err
+	}
+
+	return o.upper.CreateSized(path, size)
+}
+
+// Create a uniquely named file in a directory. Names which exist in the lower
+// drive are skipped.
+func (o *overlay) CreateTemp(dir, pattern string) (string, error) {
+	if err := checkOverlayPath(filepath.Join(dir, pattern)); err != nil {
+		return "", err
+	}
+	stat, err := o.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !stat.IsDir() {
+		return "", errors.New(fmt.Sprintf("not a directory: %s", dir))
+	}
+	if err := o.ensureUpperDir(dir); err != nil {
+		return "", err
+	}
+
+	for {
+		path, err := o.upper.CreateTemp(dir, pattern)
+		if err != nil {
+			return "", err
+		}
+		if !o.inLower(path) {
+			if _, err := o.removeWhiteout(path); err != nil {
+				return "", err
+			}
+			return path, nil
+		}
+		if err := o.upper.Remove(path); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Create a directory.
+func (o *overlay) CreateDirectory(path string) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if _, err := o.Stat(path); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	removed, err := o.removeWhiteout(path)
+	if err != nil {
+		return err
+	}
+	if err := o.upper.CreateDirectory(path); err != nil {
+		return err
+	}
+
+	// If we are replacing a removed directory in the lower drive, hide its
+	// contents.
+	if removed && exists(o.lower, path) {
+		return o.upper.Create(filepath.Join(path, opaqueName))
+	}
+	return nil
+}
+
+// Read a file into a stream.
+func (o *overlay) Read(path string, stream io.Writer) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if exists(o.upper, path) {
+		return o.upper.Read(path, stream)
+	}
+	if !o.lowerVisible(path) {
+		return notExist("open", path)
+	}
+
+	return o.lower.Read(path, stream)
+}
+
+// Read a byte range of a file into a stream.
+func (o *overlay) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if exists(o.upper, path) {
+		return o.upper.ReadRange(path, stream, offset, length)
+	}
+	if !o.lowerVisible(path) {
+		return notExist("open", path)
+	}
+
+	return o.lower.ReadRange(path, stream, offset, length)
+}
+
+// Read a directory, merging the contents of both drives.
+func (o *overlay) ReadDir(path string) ([]os.DirEntry, error) {
+	if err := checkOverlayPath(path); err != nil {
+		return nil, err
+	}
+
+	entries := map[string]os.DirEntry{}
+	opaque := false
+	found := false
+
+	// Read the upper drive.
+	upperItems, err := o.upper.ReadDir(path)
+	if err == nil {
+		found = true
+		for i := range upperItems {
+			name := upperItems[i].Name()
+			if name == opaqueName {
+				opaque = true
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				continue
+			}
+			entries[name] = upperItems[i]
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Read the lower drive.
+	if !opaque && o.lowerVisible(path) {
+		lowerItems, err := o.lower.ReadDir(path)
+		if err == nil {
+			found = true
+			for i := range lowerItems {
+				name := lowerItems[i].Name()
+				if _, ok := entries[name]; ok {
+					continue
+				}
+				if exists(o.upper, filepath.Join(path, whiteoutPrefix+name)) {
+					continue
+				}
+				entries[name] = lowerItems[i]
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, notExist("open", path)
+	}
+
+	// Sort the entries by name.
+	items := make([]os.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, entry)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name() < items[j].Name()
+	})
+	return items, nil
+}
+
+// Get information about a file or directory.
+func (o *overlay) Stat(path string) (os.FileInfo, error) {
+	if err := checkOverlayPath(path); err != nil {
+		return nil, err
+	}
+	stat, err := o.upper.Stat(path)
+	if err == nil {
+		return stat, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !o.lowerVisible(path) {
+		return nil, notExist("stat", path)
+	}
+
+	return o.lower.Stat(path)
+}
+
+// Write a file from a stream.
+func (o *overlay) Write(path string, stream io.Reader, size int64) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(path); err != nil {
+		return err
+	}
+
+	return o.upper.Write(path, stream, size)
+}
+
+// Write into an existing file at an offset. Files only in the lower drive are
+// copied up first.
+func (o *overlay) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if !exists(o.upper, path) && o.inLower(path) {
+		if err := o.copyUp(path); err != nil {
+			return err
+		}
+	}
+
+	return o.upper.WriteAt(path, offset, stream, size)
+}
+
+// Append data to a file. Files only in the lower drive are copied up first.
+func (o *overlay) Append(path string, stream io.Reader, size int64) error {
+	if err := o.prepareAppend(path); err != nil {
+		return err
+	}
+
+	return o.upper.Append(path, stream, size)
+}
+
+// Append a record to a file. Files only in the lower drive are copied up
+// first.
+func (o *overlay) AppendRecord(path string, record []byte) error {
+	if err := o.prepareAppend(path); err != nil {
+		return err
+	}
+
+	return o.upper.AppendRecord(path, record)
+}
+
+// Prepare the upper drive for an append to a file, copying the file up if it
+// is only in the lower drive, or preparing to create it otherwise.
+func (o *overlay) prepareAppend(path string) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if !exists(o.upper, path) {
+		if o.inLower(path) {
+			return o.copyUp(path)
+		}
+		if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+			return err
+		}
+		if _, err := o.removeWhiteout(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the contents of a file with new contents if its current contents
+// equal the expected contents. Files only in the lower drive are copied up
+// first.
+func (o *overlay) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	if err := checkOverlayPath(path); err != nil {
+		return false, err
+	}
+	if !exists(o.upper, path) && o.inLower(path) {
+		if err := o.copyUp(path); err != nil {
+			return false, err
+		}
+	}
+
+	return o.upper.CompareAndSwap(path, expected, new)
+}
+
+// Remove a file or directory. In the case of a directory, the directory must
+// be empty.
+func (o *overlay) Remove(path string) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	stat, err := o.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		items, err := o.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(items) != 0 {
+			return errors.New(fmt.Sprintf("directory not empty: %s", path))
+		}
+	}
+	lower := o.inLower(path)
+
+	// Remove the path from the upper drive.
+	if exists(o.upper, path) {
+		if stat.IsDir() {
+			// Remove any remaining whiteouts in the directory.
+			items, err := o.upper.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for i := range items {
+				if err := o.upper.Remove(filepath.Join(path, items[i].Name())); err != nil {
+					return err
+				}
+			}
+		}
+		if err := o.upper.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	// Hide the path in the lower drive.
+	if lower {
+		if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(path))); err != nil {
+			return err
+		}
+		return o.upper.Create(whiteoutPath(path))
+	}
+	return nil
+}
+
+// Move a file or directory.
+func (o *overlay) Move(src string, dest string) error {
+	return o.move(src, dest, true)
+}
+
+// Move a file or directory, failing if the destination already exists in
+// either drive.
+func (o *overlay) MoveNoReplace(src string, dest string) error {
+	return o.move(src, dest, false)
+}
+
+// Move a file or directory, replacing an existing destination if replace is
+// set.
+func (o *overlay) move(src string, dest string, replace bool) error {
+	if err := checkOverlayPath(src); err != nil {
+		return err
+	}
+	if err := checkOverlayPath(dest); err != nil {
+		return err
+	}
+	if !replace {
+		if _, err := o.Stat(dest); err == nil {
+			return errors.New(fmt.Sprintf("path already exists: %s", dest))
+		}
+	}
+	lower := o.inLower(src)
+
+	// Copy the source up and move it within the upper drive.
+	if err := o.copyUp(src); err != nil {
+		return err
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(dest))); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(dest); err != nil {
+		return err
+	}
+	move := o.upper.Move
+	if !replace {
+		move = o.upper.MoveNoReplace
+	}
+	if err := move(src, dest); err != nil {
+		return err
+	}
+
+	// Hide the source in the lower drive.
+	if lower {
+		return o.upper.Create(whiteoutPath(src))
+	}
+	return nil
+}
+
+// Copy a file.
+func (o *overlay) Copy(src string, dest string) error {
+	if err := checkOverlayPath(src); err != nil {
+		return err
+	}
+	if err := checkOverlayPath(dest); err != nil {
+		return err
+	}
+	stat, err := o.Stat(src)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return errors.New(fmt.Sprintf("cannot copy a directory: %s", src))
+	}
+	if _, err := o.Stat(dest); err == nil {
+		return errors.New(fmt.Sprintf("path already exists: %s", dest))
+	}
+	if err := o.ensureUpperDir(filepath.Dir(filepath.Clean(dest))); err != nil {
+		return err
+	}
+	if _, err := o.removeWhiteout(dest); err != nil {
+		return err
+	}
+
+	if exists(o.upper, src) {
+		return o.upper.Copy(src, dest)
+	}
+	return o.copyFromLower(src, dest, stat.Size())
+}
+
+// Flush a file or directory to stable storage.
+func (o *overlay) Sync(path string) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if exists(o.upper, path) {
+		return o.upper.Sync(path)
+	}
+	if !o.lowerVisible(path) {
+		return notExist("open", path)
+	}
+
+	return o.lower.Sync(path)
+}
+
+// Change the user and group IDs of the owner of a file or directory. Paths
+// only in the lower drive are copied up first, without the contents of
+// directories.
+func (o *overlay) Chown(path string, uid, gid int) error {
+	if err := checkOverlayPath(path); err != nil {
+		return err
+	}
+	if !exists(o.upper, path) && o.inLower(path) {
+		stat, err := o.lower.Stat(path)
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() {
+			err = o.ensureUpperDir(path)
+		} else {
+			err = o.copyUp(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.upper.Chown(path, uid, gid)
+}
+
+// Compute the SHA-256 checksum of a file, as a hex string.
+func (o *overlay) Checksum(path string) (string, error) {
+	if err := checkOverlayPath(path); err != nil {
+		return "", err
+	}
+	if exists(o.upper, path) {
+		return o.upper.Checksum(path)
+	}
+	if !o.lowerVisible(path) {
+		return "", notExist("open", path)
+	}
+
+	return o.lower.Checksum(path)
+}
+
+// Get the type of the drive.
+func (o *overlay) Type() string {
+	return "overlay"
+}
+
+// Get the storage quota of the drive in bytes. The quota applies to the upper
+// drive, which holds all data written to the overlay.
+func (o *overlay) Quota() int64 {
+	return o.upper.Quota()
+}
+
+// Get the total size of the files of the overlay in bytes. Only the upper
+// drive is counted.
+func (o *overlay) TotalUsage() (int64, error) {
+	return o.upper.TotalUsage()
+}
+
+// Get the total size of the files under a path in bytes. Only the upper drive
+// is counted, since the lower drive does not consume the overlay's storage.
+func (o *overlay) Usage(path string) (int64, error) {
+	if err := checkOverlayPath(path); err != nil {
+		return 0, err
+	}
+	if !exists(o.upper, path) {
+		return 0, nil
+	}
+
+	return o.upper.Usage(path)
+}
+
+// Get the total size in bytes and the number of files under a directory, as
+// seen through the overlay.
+func (o *overlay) DirSize(path string) (int64, int, error) {
+	return walkDirSize(o, path)
+}
+
+// Count the files and directories under a directory across both layers, and
+// the total size of the files in bytes.
+func (o *overlay) CountTree(path string) (int, int, int64, error) {
+	return walkCountTree(o, path)
+}
+
+// Compute the SHA-256 checksum of every file under a directory. The function
+// is called for each file with its path relative to the directory.
+func (o *overlay) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	return walkManifest(o, path, fn)
+}
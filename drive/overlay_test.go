@@ -0,0 +1,362 @@
+// drive/overlay_test.go
+// Tests for overlay drives.
+
+package drive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create an overlay drive over a lower drive holding some files. Returns the
+// overlay and the directories of the upper and lower drives.
+func newTestOverlay(t *testing.T) (Drive, string, string) {
+	t.Helper()
+	upper, upperDir := newTestDrive(t)
+	lower, lowerDir := newTestDrive(t)
+	writeTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+	writeTree(t, upperDir, map[string]string{"b": "upper b"})
+	return NewOverlayDrive(upper, lower), upperDir, lowerDir
+}
+
+// Read a file from a drive as a string.
+func readString(t *testing.T, d Drive, path string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := d.Read(path, &buf); err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return buf.String()
+}
+
+// List the names in a directory of a drive.
+func listNames(t *testing.T, d Drive, path string) string {
+	t.Helper()
+	items, err := d.ReadDir(path)
+	if err != nil {
+		t.Fatalf("failed to list %s: %v", path, err)
+	}
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func TestOverlayRead(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+	if got := readString(t, o, "a"); got != "lower a" {
+		t.Errorf("read %q from the lower drive", got)
+	}
+	if got := readString(t, o, "b"); got != "upper b" {
+		t.Errorf("read %q, the upper drive should take precedence", got)
+	}
+	if got := listNames(t, o, ""); got != "a,b,dir" {
+		t.Errorf("listed %s", got)
+	}
+	if _, err := o.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("stat of a missing path: %v", err)
+	}
+}
+
+func TestOverlayWritesCopyUp(t *testing.T) {
+	o, upperDir, lowerDir := newTestOverlay(t)
+	if err := o.Write("dir/c", strings.NewReader("new c"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Append("a", strings.NewReader("!"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteAt("dir/d", 0, strings.NewReader("L"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writes are visible through the overlay and stored in the upper
+	// drive, leaving the lower drive unchanged.
+	checkTree(t, upperDir, map[string]string{"a": "lower a!", "b": "upper b", "dir/c": "new c", "dir/d": "Lower d"})
+	checkTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+	if got := readString(t, o, "dir/d"); got != "Lower d" {
+		t.Errorf("read %q after writing", got)
+	}
+}
+
+func TestOverlayRemove(t *testing.T) {
+	o, _, lowerDir := newTestOverlay(t)
+	for _, path := range []string{"a", "b", "dir/c"} {
+		if err := o.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s visible after removal: %v", path, err)
+		}
+	}
+	if got := listNames(t, o, ""); got != "dir" {
+		t.Errorf("listed %s after removal", got)
+	}
+	if got := listNames(t, o, "dir"); got != "d" {
+		t.Errorf("listed %s after removal", got)
+	}
+	if err := o.Remove("dir"); err == nil {
+		t.Error("removed a directory which isn't empty")
+	}
+	checkTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+
+	// Creating a removed path replaces it.
+	if err := o.Write("a", strings.NewReader("again"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, o, "a"); got != "again" {
+		t.Errorf("read %q after recreating", got)
+	}
+}
+
+func TestOverlayReplaceDirectory(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+	for _, path := range []string{"dir/c", "dir/d", "dir"} {
+		if err := o.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory replacing a removed one doesn't show the contents of the
+	// lower directory.
+	if err := o.CreateDirectory("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, o, "dir"); got != "" {
+		t.Errorf("listed %s in the new directory", got)
+	}
+	if err := o.Create("dir/c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, o, "dir"); got != "c" {
+		t.Errorf("listed %s in the new directory", got)
+	}
+	if _, err := o.Stat("dir/d"); !os.IsNotExist(err) {
+		t.Errorf("lower file visible in the new directory: %v", err)
+	}
+}
+
+func TestOverlayMove(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+	if err := o.Move("dir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Stat("dir"); !os.IsNotExist(err) {
+		t.Errorf("source visible after the move: %v", err)
+	}
+	if got := readString(t, o, "moved/c"); got != "lower c" {
+		t.Errorf("read %q after the move", got)
+	}
+	if got := listNames(t, o, ""); got != "a,b,moved" {
+		t.Errorf("listed %s after the move", got)
+	}
+}
+
+func TestOverlayMoveNoReplace(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+
+	// Destinations in either drive aren't replaced.
+	for _, dest := range []string{"a", "b"} {
+		if err := o.MoveNoReplace("dir/c", dest); err == nil || !strings.Contains(err.Error(), "path already exists") {
+			t.Errorf("%s: got %v, want a path already exists error", dest, err)
+		}
+	}
+	if got := readString(t, o, "a"); got != "lower a" {
+		t.Errorf("read %q after the failed move", got)
+	}
+	if err := o.MoveNoReplace("dir/c", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, o, "moved"); got != "lower c" {
+		t.Errorf("read %q after the move", got)
+	}
+}
+
+func TestOverlayWhiteoutPaths(t *testing.T) {
+	o, upperDir, _ := newTestOverlay(t)
+	if err := o.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(upperDir, whiteoutPrefix+"a")); err != nil {
+		t.Fatalf("no whiteout for a removed path: %v", err)
+	}
+
+	// Whiteouts can't be used through the overlay.
+	for _, path := range []string{whiteoutPrefix + "a", "dir/" + opaqueName} {
+		if _, err := o.Stat(path); err == nil {
+			t.Errorf("stat of %s", path)
+		}
+		if err := o.Remove(path); err == nil {
+			t.Errorf("removed %s", path)
+		}
+		if err := o.Create(path); err == nil {
+			t.Errorf("created %s", path)
+		}
+	}
+}
+
+func TestOverlaySync(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+	for _, path := range []string{"a", "b", "dir"} {
+		if err := o.Sync(path); err != nil {
+			t.Errorf("failed to sync %s: %v", path, err)
+		}
+	}
+	if err := o.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Sync("a"); err == nil {
+		t.Error("synced a removed file")
+	}
+}
+
+func TestOverlayUsage(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+
+	// Only the upper drive is counted.
+	if usage, err := o.Usage(""); err != nil || usage != int64(len("upper b")) {
+		t.Fatalf("usage is %d: %v", usage, err)
+	}
+	if usage, err := o.Usage("dir"); err != nil || usage != 0 {
+		t.Fatalf("usage of a lower directory is %d: %v", usage, err)
+	}
+}
+
+func TestOverlayCreateSized(t *testing.T) {
+	o, upperDir, _ := newTestOverlay(t)
+	if err := o.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.CreateSized("a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.CreateSized("dir/new", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, o, "a"); got != "\x00\x00\x00" {
+		t.Errorf("read %q from a recreated file", got)
+	}
+	if stat, err := os.Stat(filepath.Join(upperDir, "dir", "new")); err != nil || stat.Size() != 2 {
+		t.Errorf("file not created in the upper drive: %v", err)
+	}
+	if got := listNames(t, o, "dir"); got != "c,d,new" {
+		t.Errorf("listed %s", got)
+	}
+}
+
+func TestOverlayDirSize(t *testing.T) {
+	o, _, _ := newTestOverlay(t)
+	if err := o.Remove("dir/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are counted once, from the drive they are visible from, and
+	// removed files aren't counted.
+	size, count, err := o.DirSize("")
+	if want := int64(len("lower a") + len("upper b") + len("lower d")); err != nil || size != want || count != 3 {
+		t.Fatalf("%d bytes in %d files, %v, want %d in 3", size, count, err, want)
+	}
+}
+
+func TestOverlayCompareAndSwap(t *testing.T) {
+	o, upperDir, lowerDir := newTestOverlay(t)
+
+	// Files only in the lower drive are compared, and copied up when swapped.
+	if swapped, err := o.CompareAndSwap("a", []byte("other"), []byte("new a")); err != nil || swapped {
+		t.Fatalf("swapped a mismatched file: %v", err)
+	}
+	if swapped, err := o.CompareAndSwap("dir/c", []byte("lower c"), []byte("new c")); err != nil || !swapped {
+		t.Fatalf("file not swapped: %v", err)
+	}
+	if got := readString(t, o, "dir/c"); got != "new c" {
+		t.Errorf("read %q from a swapped file", got)
+	}
+	checkTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+
+	// Files in the upper drive hide the lower drive's.
+	if swapped, err := o.CompareAndSwap("b", []byte("lower b"), []byte("new b")); err != nil || swapped {
+		t.Fatalf("swapped against the lower drive's contents: %v", err)
+	}
+	if swapped, err := o.CompareAndSwap("b", []byte("upper b"), []byte("new b")); err != nil || !swapped {
+		t.Fatalf("file not swapped: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(upperDir, "b")); err != nil || string(data) != "new b" {
+		t.Errorf("read %q from the upper drive: %v", data, err)
+	}
+}
+
+func TestOverlayCreateTemp(t *testing.T) {
+	o, upperDir, _ := newTestOverlay(t)
+
+	// Files are created in the upper drive, even in directories only in the
+	// lower drive.
+	path, err := o.CreateTemp("dir", "tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(upperDir, path)); err != nil {
+		t.Fatalf("file not created in the upper drive: %v", err)
+	}
+	if got := listNames(t, o, "dir"); got != "c,d,"+filepath.Base(path) {
+		t.Errorf("listed %s", got)
+	}
+
+	if _, err := o.CreateTemp("a", "*"); err == nil {
+		t.Error("created a file in a file")
+	}
+	if _, err := o.CreateTemp("missing", "*"); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+}
+
+func TestOverlayWriteAt(t *testing.T) {
+	o, upperDir, lowerDir := newTestOverlay(t)
+
+	// Files only in the lower drive are copied up and patched.
+	if err := o.WriteAt("dir/c", 0, strings.NewReader("LOWER"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, o, "dir/c"); got != "LOWER c" {
+		t.Errorf("read %q from a patched file", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(upperDir, "dir", "c")); err != nil || string(data) != "LOWER c" {
+		t.Errorf("read %q from the upper drive: %v", data, err)
+	}
+	checkTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+}
+
+func TestOverlayCopy(t *testing.T) {
+	o, upperDir, lowerDir := newTestOverlay(t)
+
+	// Files in either drive are copied into the upper drive.
+	if err := o.Copy("a", "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Copy("b", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, upperDir, map[string]string{"b": "upper b", "copy": "upper b", "dir/a": "lower a"})
+	checkTree(t, lowerDir, map[string]string{"a": "lower a", "b": "lower b", "dir/c": "lower c", "dir/d": "lower d"})
+
+	// Paths in either drive are never overwritten.
+	for _, dest := range []string{"a", "b", "dir/c", "dir"} {
+		if err := o.Copy("copy", dest); err == nil || !strings.Contains(err.Error(), "path already exists") {
+			t.Errorf("%s: got %v, want a path already exists error", dest, err)
+		}
+	}
+
+	// Removed paths may be copied onto.
+	if err := o.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Copy("copy", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, o, "a"); got != "upper b" {
+		t.Errorf("read %q", got)
+	}
+}
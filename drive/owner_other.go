@@ -0,0 +1,23 @@
+// drive/owner_other.go
+// File ownership on other platforms.
+
+//go:build !unix
+
+package drive
+
+import (
+	"errors"
+	"os"
+)
+
+// Get the user and group IDs of the owner of a file, from its information.
+// Ownership is not supported on this platform, so this always returns false.
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// Change the owner of a file on the host filesystem. Ownership is not
+// supported on this platform.
+func chown(path string, uid, gid int) error {
+	return errors.New("chown is not supported on this platform")
+}
@@ -0,0 +1,104 @@
+// drive/owner_test.go
+// Tests for file ownership.
+
+//go:build unix
+
+package drive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Get the owner of a file on the host.
+func hostOwner(t *testing.T, path string) (int, int) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, ok := Owner(info)
+	if !ok {
+		t.Fatal("no ownership reported")
+	}
+	return uid, gid
+}
+
+func TestOwner(t *testing.T) {
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"file": "data"})
+	info, err := d.Stat("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, ok := Owner(info); !ok || uid != os.Getuid() || gid != os.Getgid() {
+		t.Fatalf("owner %d:%d, want %d:%d", uid, gid, os.Getuid(), os.Getgid())
+	}
+}
+
+func TestChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	d, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"dir/file": "data"})
+
+	if err := d.Chown("dir/file", 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := hostOwner(t, filepath.Join(dir, "dir", "file")); uid != 1234 || gid != 5678 {
+		t.Fatalf("owner %d:%d, want 1234:5678", uid, gid)
+	}
+
+	// Negative IDs are left unchanged.
+	if err := d.Chown("dir/file", -1, 4321); err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := hostOwner(t, filepath.Join(dir, "dir", "file")); uid != 1234 || gid != 4321 {
+		t.Fatalf("owner %d:%d, want 1234:4321", uid, gid)
+	}
+	if err := d.Chown("dir", 1234, -1); err != nil {
+		t.Fatal(err)
+	}
+	if uid, _ := hostOwner(t, filepath.Join(dir, "dir")); uid != 1234 {
+		t.Fatalf("directory owned by %d", uid)
+	}
+
+	if err := d.Chown("missing", 1234, 5678); err == nil {
+		t.Error("changed the owner of a missing file")
+	}
+	if err := d.Chown("../file", 1234, 5678); err == nil {
+		t.Error("changed the owner of a path outside the drive")
+	}
+}
+
+func TestOverlayChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	o, upperDir, lowerDir := newTestOverlay(t)
+
+	// Paths only in the lower drive are copied up, leaving the lower drive
+	// untouched.
+	if err := o.Chown("a", 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Chown("dir", 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "dir"} {
+		if uid, gid := hostOwner(t, filepath.Join(upperDir, path)); uid != 1234 || gid != 5678 {
+			t.Errorf("%s owned by %d:%d in the upper drive", path, uid, gid)
+		}
+		if uid, _ := hostOwner(t, filepath.Join(lowerDir, path)); uid == 1234 {
+			t.Errorf("%s changed in the lower drive", path)
+		}
+	}
+	if got := readString(t, o, "a"); got != "lower a" {
+		t.Errorf("read %q", got)
+	}
+	if got := listNames(t, o, "dir"); got != "c,d" {
+		t.Errorf("listed %s", got)
+	}
+}
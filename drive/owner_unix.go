@@ -0,0 +1,26 @@
+// drive/owner_unix.go
+// File ownership on Unix platforms.
+
+//go:build unix
+
+package drive
+
+import (
+	"os"
+	"syscall"
+)
+
+// Get the user and group IDs of the owner of a file, from its information.
+// Returns false if the information doesn't include ownership.
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// Change the owner of a file on the host filesystem.
+func chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,50 @@
+// drive/pathlock.go
+// Per-path write locks.
+
+package drive
+
+import "sync"
+
+// The write locks of the paths being written, keyed by path.
+type pathLocks struct {
+	lock  sync.Mutex
+	paths map[string]*pathLock
+}
+
+// A write lock of a path, removed once no writers hold or wait for it.
+type pathLock struct {
+	lock sync.Mutex
+	refs int
+}
+
+// Lock a path for writing, returning the function to unlock it.
+func (d *drive) lockPath(hostPath string) func() {
+	return d.locks.acquire(hostPath)
+}
+
+// Acquire the write lock of a path, returning the function to release it.
+func (p *pathLocks) acquire(path string) func() {
+	p.lock.Lock()
+	if p.paths == nil {
+		p.paths = map[string]*pathLock{}
+	}
+	l, ok := p.paths[path]
+	if !ok {
+		l = &pathLock{}
+		p.paths[path] = l
+	}
+	l.refs++
+	p.lock.Unlock()
+
+	l.lock.Lock()
+	return func() {
+		l.lock.Unlock()
+
+		p.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(p.paths, path)
+		}
+		p.lock.Unlock()
+	}
+}
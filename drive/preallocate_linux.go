@@ -0,0 +1,22 @@
+// drive/preallocate_linux.go
+// File preallocation on Linux.
+
+//go:build linux
+
+package drive
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Preallocate space for a file, falling back to truncating it if the
+// filesystem does not support fallocate.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return file.Truncate(size)
+	}
+	return err
+}
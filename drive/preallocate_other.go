@@ -0,0 +1,13 @@
+// drive/preallocate_other.go
+// File preallocation on other platforms.
+
+//go:build !linux
+
+package drive
+
+import "os"
+
+// Preallocate space for a file by truncating it to its final size.
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
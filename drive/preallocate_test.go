@@ -0,0 +1,70 @@
+// drive/preallocate_test.go
+// Tests for file preallocation.
+
+package drive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPreallocatedWrite(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDriveWithOptions(dir, Options{Preallocate: 4096})
+	for _, size := range []int{0, 100, 4095, 4096, 100000} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			data := bytes.Repeat([]byte{'p'}, size)
+			if err := d.Write("file", bytes.NewReader(data), int64(size)); err != nil {
+				t.Fatal(err)
+			}
+			written, err := os.ReadFile(filepath.Join(dir, "file"))
+			if err != nil || !bytes.Equal(written, data) {
+				t.Fatalf("wrote %d bytes, want %d: %v", len(written), size, err)
+			}
+		})
+	}
+
+	// Overwriting a file with a smaller one leaves no preallocated space
+	// behind in its size.
+	if err := d.Write("file", bytes.NewReader([]byte("small")), 5); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filepath.Join(dir, "file"))
+	if err != nil || stat.Size() != 5 {
+		t.Fatalf("file has size %d: %v", stat.Size(), err)
+	}
+}
+
+func TestPreallocatedWriteFailed(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDriveWithOptions(dir, Options{Preallocate: 4096})
+
+	// A stream that ends early leaves only the data written, not a file of
+	// the full preallocated length.
+	data := bytes.Repeat([]byte{'p'}, 10000)
+	if err := d.Write("file", bytes.NewReader(data), 100000); err == nil {
+		t.Fatal("wrote a file from a short stream")
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil || !bytes.Equal(written, data) {
+		t.Fatalf("left %d bytes, want %d: %v", len(written), len(data), err)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := preallocate(file, 65536); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := file.Stat()
+	if err != nil || stat.Size() != 65536 {
+		t.Fatalf("preallocated file has size %d: %v", stat.Size(), err)
+	}
+}
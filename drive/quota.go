@@ -0,0 +1,149 @@
+// drive/quota.go
+// Enforcing the storage quotas of drives.
+
+package drive
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The usage of a drive with a quota. The usage is counted by walking the
+// drive once, and then kept up to date by each change made through the
+// drive, so writes don't walk the drive. Writes reserve the space they may
+// use before writing, so concurrent writes can't exceed the quota together.
+type quotaUsage struct {
+	lock sync.Mutex
+
+	// If the usage has been counted, and the number of times it has been
+	// recounted, so changes counted before a recount aren't applied twice.
+	counted    bool
+	generation int
+
+	// The bytes used by the files of the drive, and the bytes reserved by
+	// writes in progress.
+	used     int64
+	reserved int64
+}
+
+// Get the size of a file on the host filesystem. Zero if it isn't a regular
+// file.
+func regularSize(hostPath string) int64 {
+	stat, err := os.Stat(hostPath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0
+	}
+	return stat.Size()
+}
+
+// Count the usage of the drive if it hasn't been counted. The lock of the
+// usage must be held.
+func (d *drive) countUsage() error {
+	if d.usage.counted {
+		return nil
+	}
+	used, err := d.Usage("")
+	if err != nil {
+		return err
+	}
+	d.usage.used, d.usage.counted = used, true
+	return nil
+}
+
+// Recount the usage of the drive before the next write, so it reflects
+// changes made to the backing store outside the drive.
+func (d *drive) recountUsage() {
+	d.usage.lock.Lock()
+	defer d.usage.lock.Unlock()
+	d.usage.counted = false
+	d.usage.generation++
+}
+
+// Reserve the space for a file to be written with a given size, replacing
+// its current contents. Fails if the write could exceed the quota. Returns
+// the function to call once the file is written, which releases the space
+// and records the new size of the file. It may be called more than once. The
+// write lock of the path must be held until then.
+func (d *drive) reserveQuota(hostPath string, size int64) (func(), error) {
+	if d.options.Quota == 0 {
+		return func() {}, nil
+	}
+
+	d.usage.lock.Lock()
+	defer d.usage.lock.Unlock()
+	if err := d.countUsage(); err != nil {
+		return nil, err
+	}
+	old := regularSize(hostPath)
+	growth := size - old
+	if growth < 0 {
+		growth = 0
+	}
+	if d.usage.used+d.usage.reserved+growth > d.options.Quota {
+		return nil, errors.New("quota exceeded")
+	}
+	d.usage.reserved += growth
+
+	generation, released := d.usage.generation, false
+	return func() {
+		d.usage.lock.Lock()
+		defer d.usage.lock.Unlock()
+		if released {
+			return
+		}
+		released = true
+		d.usage.reserved -= growth
+		if d.usage.generation == generation {
+			d.usage.used += regularSize(hostPath) - old
+		}
+	}, nil
+}
+
+// Track the change in the usage of paths changed without reserving space,
+// such as removed, moved, and truncated files. Returns the function to call
+// once the paths are changed, which records the change. The write locks of
+// the paths must be held until then.
+func (d *drive) trackUsage(hostPaths ...string) func() {
+	if d.options.Quota == 0 {
+		return func() {}
+	}
+
+	d.usage.lock.Lock()
+	defer d.usage.lock.Unlock()
+	generation, before := d.usage.generation, int64(0)
+	for _, path := range hostPaths {
+		before += regularSize(path)
+	}
+	return func() {
+		d.usage.lock.Lock()
+		defer d.usage.lock.Unlock()
+		if !d.usage.counted || d.usage.generation != generation {
+			return
+		}
+		for _, path := range hostPaths {
+			d.usage.used += regularSize(path)
+		}
+		d.usage.used -= before
+	}
+}
+
+// Lock multiple paths for writing in a consistent order, so writers of the
+// same paths can't deadlock. Returns the function to unlock them.
+func (d *drive) lockPaths(hostPaths ...string) func() {
+	sorted := append([]string{}, hostPaths...)
+	sort.Strings(sorted)
+	unlocks := []func(){}
+	for i, path := range sorted {
+		if i > 0 && path == sorted[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, d.lockPath(path))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
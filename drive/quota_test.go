@@ -0,0 +1,283 @@
+// drive/quota_test.go
+// Tests for the storage quotas of drives.
+
+package drive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Create a drive with a quota in a temporary directory.
+func newQuotaDrive(t *testing.T, quota int64) (Drive, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return NewDriveWithOptions(dir, Options{Quota: quota}), dir
+}
+
+// Write a file of a size to a drive.
+func writeSize(d Drive, path string, size int) error {
+	return d.Write(path, bytes.NewReader(make([]byte, size)), int64(size))
+}
+
+// Check the usage of a drive matches the files on disk.
+func checkUsage(t *testing.T, d Drive, want int64) {
+	t.Helper()
+	usage, err := d.Usage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != want {
+		t.Fatalf("usage is %d bytes, want %d", usage, want)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	d, _ := newQuotaDrive(t, 100)
+
+	if err := writeSize(d, "a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "b", 60); err == nil {
+		t.Fatal("write over the quota succeeded")
+	}
+
+	// The current size of a file being replaced isn't counted.
+	if err := writeSize(d, "a", 90); err != nil {
+		t.Fatalf("replacing a file failed: %v", err)
+	}
+	if err := d.Append("a", bytes.NewReader(make([]byte, 20)), 20); err == nil {
+		t.Fatal("append over the quota succeeded")
+	}
+	if err := d.WriteAt("a", 95, bytes.NewReader(make([]byte, 10)), 10); err == nil {
+		t.Fatal("write at an offset over the quota succeeded")
+	}
+	if err := d.CreateSized("c", 20); err == nil {
+		t.Fatal("creating a sized file over the quota succeeded")
+	}
+	checkUsage(t, d, 90)
+
+	// Removing a file frees its space.
+	if err := d.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "b", 100); err != nil {
+		t.Fatalf("write after removing a file failed: %v", err)
+	}
+
+	// Moving a file over another frees the space of the other.
+	if err := d.Create("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move("c", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "d", 100); err != nil {
+		t.Fatalf("write after replacing a file failed: %v", err)
+	}
+
+	// Creating a file over another truncates it.
+	if err := d.Create("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "e", 100); err != nil {
+		t.Fatalf("write after truncating a file failed: %v", err)
+	}
+	checkUsage(t, d, 100)
+}
+
+func TestQuotaCopy(t *testing.T) {
+	d, _ := newQuotaDrive(t, 130)
+	if err := writeSize(d, "a", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy("a", "c"); err != nil {
+		t.Fatalf("copy within the quota failed: %v", err)
+	}
+	if err := d.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "c", 20); err != nil {
+		t.Fatalf("write within the quota failed: %v", err)
+	}
+	if err := d.Copy("a", "d"); err == nil {
+		t.Fatal("copy over the quota succeeded")
+	}
+}
+
+// A reader which waits before returning its data, so writes overlap.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+func TestQuotaConcurrentWrites(t *testing.T) {
+	const quota, size, writers = 1000, 100, 25
+	d, _ := newQuotaDrive(t, quota)
+
+	// Writes to different paths run at once, and together must not exceed
+	// the quota.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream := &slowReader{r: bytes.NewReader(make([]byte, size)), delay: 50 * time.Millisecond}
+			if err := d.Write("file"+strconv.Itoa(i), stream, size); err == nil {
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != quota/size {
+		t.Fatalf("%d writes succeeded, want %d", succeeded, quota/size)
+	}
+	usage, err := d.Usage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage > quota {
+		t.Fatalf("usage of %d bytes exceeds the quota of %d", usage, quota)
+	}
+}
+
+func TestQuotaFailedWrite(t *testing.T) {
+	d, _ := newQuotaDrive(t, 100)
+
+	// A write which fails partway releases its reservation, and only the data
+	// written is counted.
+	if err := d.Write("a", bytes.NewReader(make([]byte, 30)), 100); err == nil {
+		t.Fatal("write from a short stream succeeded")
+	}
+	checkUsage(t, d, 30)
+	if err := writeSize(d, "b", 70); err != nil {
+		t.Fatalf("write within the quota failed: %v", err)
+	}
+	if err := writeSize(d, "c", 1); err == nil {
+		t.Fatal("write over the quota succeeded")
+	}
+}
+
+func TestQuotaRecount(t *testing.T) {
+	d, dir := newQuotaDrive(t, 100)
+	if err := writeSize(d, "a", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files added outside the drive are only counted once the caches are
+	// dropped.
+	if err := os.WriteFile(filepath.Join(dir, "outside"), make([]byte, 50), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "b", 10); err != nil {
+		t.Fatalf("write before recounting failed: %v", err)
+	}
+	if err := DropCache(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSize(d, "c", 10); err == nil {
+		t.Fatal("write over the recounted quota succeeded")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	d, dir := newQuotaDrive(t, 1000)
+	writeTree(t, dir, map[string]string{"a": "12345", "dir/b": "123", "dir/sub/c": "1234567"})
+	if d.Quota() != 1000 {
+		t.Fatalf("quota is %d", d.Quota())
+	}
+	checkUsage(t, d, 15)
+	if usage, err := d.Usage("dir"); err != nil || usage != 10 {
+		t.Fatalf("usage of a directory is %d: %v", usage, err)
+	}
+	if usage, err := d.Usage("a"); err != nil || usage != 5 {
+		t.Fatalf("usage of a file is %d: %v", usage, err)
+	}
+	if _, err := d.Usage("missing"); err == nil {
+		t.Fatal("usage of a missing path")
+	}
+	if unlimited, _ := newTestDrive(t); unlimited.Quota() != 0 {
+		t.Fatal("drive without a quota is limited")
+	}
+}
+
+func TestTotalUsage(t *testing.T) {
+	d, dir := newQuotaDrive(t, 1000)
+	if err := writeSize(d, "a", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drives with a quota report their counted usage rather than walking the
+	// drive, so files added outside the drive are only counted once the
+	// caches are dropped.
+	if err := os.WriteFile(filepath.Join(dir, "outside"), make([]byte, 20), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := d.TotalUsage(); err != nil || usage != 50 {
+		t.Fatalf("total usage is %d: %v", usage, err)
+	}
+	if err := DropCache(d); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := d.TotalUsage(); err != nil || usage != 70 {
+		t.Fatalf("total usage after recounting is %d: %v", usage, err)
+	}
+
+	// Drives without a quota walk the drive.
+	unlimited, dir := newTestDrive(t)
+	writeTree(t, dir, map[string]string{"a": "12345", "dir/b": "123"})
+	if usage, err := unlimited.TotalUsage(); err != nil || usage != 8 {
+		t.Fatalf("total usage of a drive without a quota is %d: %v", usage, err)
+	}
+}
+
+func TestQuotaCreateSized(t *testing.T) {
+	d, _ := newQuotaDrive(t, 100)
+	if err := d.CreateSized("a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateSized("b", 60); err == nil {
+		t.Fatal("created a file over the quota")
+	}
+	if err := d.CreateSized("a", 100); err != nil {
+		t.Fatalf("replacing a file failed: %v", err)
+	}
+	checkUsage(t, d, 100)
+}
+
+func TestQuotaWriteAt(t *testing.T) {
+	d, _ := newQuotaDrive(t, 100)
+	if err := writeSize(d, "a", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes within the file don't use more of the quota.
+	if err := d.WriteAt("a", 10, bytes.NewReader(make([]byte, 40)), 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteAt("a", 90, bytes.NewReader(make([]byte, 20)), 20); err == nil {
+		t.Fatal("extended a file over the quota")
+	}
+	if err := d.WriteAt("a", 90, bytes.NewReader(make([]byte, 10)), 10); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, d, 100)
+}
@@ -0,0 +1,82 @@
+// drive/readahead.go
+// Read-ahead prefetching for sequential reads.
+
+package drive
+
+import (
+	"io"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// A chunk read ahead of the stream.
+type readAheadChunk struct {
+	chunk *[]byte
+	n     int
+	err   error
+}
+
+// Copy a reader to a stream, reading ahead into a ring of chunks on a
+// background goroutine while earlier chunks are written to the stream, so
+// disk reads overlap with writes to the stream. At most buffers chunks are
+// held at once.
+func readAhead(stream io.Writer, src io.Reader, buffers int) error {
+	// Fill the ring with free chunks.
+	free := make(chan *[]byte, buffers)
+	for i := 0; i < buffers; i++ {
+		free <- protocol.GetChunk()
+	}
+
+	// Read chunks in the background. Both channels hold every chunk, so sends
+	// never block.
+	filled := make(chan readAheadChunk, buffers)
+	done := make(chan struct{})
+	go func() {
+		defer close(filled)
+		for {
+			var chunk *[]byte
+			select {
+			case chunk = <-free:
+			case <-done:
+				return
+			}
+			n, err := io.ReadFull(src, *chunk)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// The last chunk.
+				filled <- readAheadChunk{chunk: chunk, n: n}
+				return
+			}
+			filled <- readAheadChunk{chunk: chunk, n: n, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Return the chunks once the reader has stopped.
+	defer func() {
+		close(done)
+		for c := range filled {
+			protocol.PutChunk(c.chunk)
+		}
+		for len(free) > 0 {
+			protocol.PutChunk(<-free)
+		}
+	}()
+
+	// Write the chunks to the stream as they are read.
+	for c := range filled {
+		var err error
+		if c.n > 0 {
+			_, err = stream.Write((*c.chunk)[:c.n])
+		}
+		free <- c.chunk
+		if c.err != nil {
+			return c.err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
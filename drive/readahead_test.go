@@ -0,0 +1,146 @@
+// drive/readahead_test.go
+// Tests for read-ahead prefetching.
+
+package drive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+func TestReadAhead(t *testing.T) {
+	for _, size := range []int{0, 1, protocol.ChunkSize, 3*protocol.ChunkSize + 7} {
+		for _, buffers := range []int{0, 1, 4} {
+			dir := t.TempDir()
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			d := NewDriveWithOptions(dir, Options{ReadAhead: buffers})
+
+			var buf bytes.Buffer
+			if err := d.Read("file", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("%d bytes, %d buffers: read %d bytes: %v", size, buffers, buf.Len(), err)
+			}
+			if size > 10 {
+				buf.Reset()
+				if err := d.ReadRange("file", &buf, 5, int64(size-10)); err != nil || !bytes.Equal(buf.Bytes(), data[5:size-5]) {
+					t.Errorf("%d bytes, %d buffers: read %d bytes of a range: %v", size, buffers, buf.Len(), err)
+				}
+			}
+		}
+	}
+}
+
+// A reader of zeros which counts the bytes read.
+type countingReader struct {
+	read atomic.Int64
+}
+
+// Read zeros.
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.read.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// A writer which blocks until released.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+// Write once released.
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestReadAheadBounded(t *testing.T) {
+	src := &io.LimitedReader{R: &countingReader{}, N: 100 * protocol.ChunkSize}
+	counter := src.R.(*countingReader)
+	w := &blockingWriter{release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- readAhead(w, src, 3) }()
+
+	// While the stream is blocked, at most the ring of chunks is read.
+	time.Sleep(100 * time.Millisecond)
+	if read := counter.read.Load(); read > 3*protocol.ChunkSize {
+		t.Fatalf("read %d bytes ahead, want at most %d", read, 3*protocol.ChunkSize)
+	}
+
+	close(w.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if read := counter.read.Load(); read != 100*protocol.ChunkSize {
+		t.Fatalf("read %d bytes, want %d", read, 100*protocol.ChunkSize)
+	}
+}
+
+// A writer which fails.
+type failingWriter struct{}
+
+// Fail to write.
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+// A reader which fails.
+type failingReader struct{}
+
+// Fail to read.
+func (*failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestReadAheadErrors(t *testing.T) {
+	// Errors writing to the stream stop reading.
+	src := &io.LimitedReader{R: &countingReader{}, N: 100 * protocol.ChunkSize}
+	if err := readAhead(failingWriter{}, src, 2); err == nil || err.Error() != "write failed" {
+		t.Fatalf("got %v, want the stream's error", err)
+	}
+	if src.N == 0 {
+		t.Error("read the whole source after the stream failed")
+	}
+
+	// Errors reading are returned after the chunks before them are written.
+	var buf bytes.Buffer
+	failing := io.MultiReader(bytes.NewReader(make([]byte, protocol.ChunkSize)), &failingReader{})
+	if err := readAhead(&buf, failing, 2); err == nil || err.Error() != "read failed" {
+		t.Fatalf("got %v, want the reader's error", err)
+	}
+	if buf.Len() != protocol.ChunkSize {
+		t.Errorf("wrote %d bytes, want %d", buf.Len(), protocol.ChunkSize)
+	}
+}
+
+// Benchmark reading a large file with and without read-ahead.
+func BenchmarkReadAhead(b *testing.B) {
+	dir := b.TempDir()
+	data := make([]byte, 64<<20)
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0666); err != nil {
+		b.Fatal(err)
+	}
+	for _, buffers := range []int{0, 4, 16} {
+		d := NewDriveWithOptions(dir, Options{ReadAhead: buffers})
+		b.Run("buffers="+strconv.Itoa(buffers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := d.Read("file", io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
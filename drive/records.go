@@ -0,0 +1,112 @@
+// drive/records.go
+// Append-only record files, with each record framed by its length.
+
+package drive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The maximum size of a record.
+const MaxRecordSize = 1 << 20
+
+// The size of the length prefix of each record.
+const RecordHeaderSize = 4
+
+// Frame a record with its length.
+func frameRecord(record []byte) ([]byte, error) {
+	if len(record) > MaxRecordSize {
+		return nil, errors.New(fmt.Sprintf("record too large, the maximum is %d bytes", MaxRecordSize))
+	}
+	framed := make([]byte, 0, RecordHeaderSize+len(record))
+	framed = binary.BigEndian.AppendUint32(framed, uint32(len(record)))
+	return append(framed, record...), nil
+}
+
+// Append a record to a file by rewriting it with WriteAt, for drives which
+// can't append in place. The records are appended under the write lock of
+// the path, so concurrent appends through the drive never interleave.
+func appendRecordAt(d Drive, locks *pathLocks, path string, record []byte) error {
+	framed, err := frameRecord(record)
+	if err != nil {
+		return err
+	}
+	return appendAt(d, locks, path, bytes.NewReader(framed), int64(len(framed)))
+}
+
+// Append data to a file with WriteAt, creating the file with Write if it
+// doesn't exist, for drives which can't append in place. The data is appended
+// under the write lock of the path.
+func appendAt(d Drive, locks *pathLocks, path string, stream io.Reader, size int64) error {
+	// Lock the path.
+	unlock := locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	// Create the file if it doesn't exist.
+	stat, err := d.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d.Write(path, stream, size)
+	} else if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+
+	return d.WriteAt(path, stat.Size(), stream, size)
+}
+
+// Read the records of a file, calling the function with each record in order.
+// Only the records in the file when reading starts are read. Stops early if
+// the function returns an error.
+func ReadRecords(d Drive, path string, fn func(record []byte) error) error {
+	stat, err := d.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.New(fmt.Sprintf("not a file: %s", path))
+	}
+
+	// Stream the file.
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(d.ReadRange(path, writer, 0, stat.Size()))
+	}()
+	defer reader.Close()
+
+	buffered := bufio.NewReader(reader)
+	header := make([]byte, RecordHeaderSize)
+	for {
+		// Read the length of the record.
+		if _, err := io.ReadFull(buffered, header); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return errors.New(fmt.Sprintf("truncated record: %s", path))
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MaxRecordSize {
+			return errors.New(fmt.Sprintf("invalid record: %s", path))
+		}
+
+		// Read the record.
+		record := make([]byte, size)
+		if _, err := io.ReadFull(buffered, record); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New(fmt.Sprintf("truncated record: %s", path))
+		} else if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
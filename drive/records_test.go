@@ -0,0 +1,192 @@
+// drive/records_test.go
+// Tests for append-only record files.
+
+package drive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Read all records of a file.
+func readAllRecords(t *testing.T, d Drive, path string) [][]byte {
+	t.Helper()
+	records := [][]byte{}
+	if err := ReadRecords(d, path, func(record []byte) error {
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAppendRecord(t *testing.T) {
+	tests := []struct {
+		name  string
+		drive func(t *testing.T) Drive
+	}{
+		{"local", func(t *testing.T) Drive {
+			d, _ := newTestDrive(t)
+			return d
+		}},
+		{"overlay", func(t *testing.T) Drive {
+			o, _, _ := newTestOverlay(t)
+			return o
+		}},
+		{"encrypted", func(t *testing.T) Drive {
+			e, _ := newTestEncrypted(t, testEncryptionKey(1))
+			return e
+		}},
+		{"compressed", func(t *testing.T) Drive {
+			c, _ := newTestCompressed(t)
+			return c
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := test.drive(t)
+			want := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{'x'}, 100000), []byte("last\n")}
+			for _, record := range want {
+				if err := d.AppendRecord("log", record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readAllRecords(t, d, "log"); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("read %d records, want %d", len(got), len(want))
+			}
+
+			// Records over the maximum size are rejected without changing
+			// the file.
+			if err := d.AppendRecord("log", make([]byte, MaxRecordSize+1)); err == nil || !strings.Contains(err.Error(), "record too large") {
+				t.Fatalf("got %v, want a record too large error", err)
+			}
+			if got := readAllRecords(t, d, "log"); len(got) != len(want) {
+				t.Fatalf("read %d records after a rejected append", len(got))
+			}
+
+			if err := d.CreateDirectory("records"); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.AppendRecord("records", []byte("record")); err == nil {
+				t.Error("appended a record to a directory")
+			}
+		})
+	}
+}
+
+func TestAppendRecordConcurrent(t *testing.T) {
+	for _, name := range []string{"local", "compressed"} {
+		t.Run(name, func(t *testing.T) {
+			d, _ := newTestDrive(t)
+			if name == "compressed" {
+				d = NewCompressedDrive(d)
+			}
+
+			// Many appenders each append numbered records.
+			appenders, count := 8, 25
+			var wg sync.WaitGroup
+			for i := 0; i < appenders; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < count; j++ {
+						record := fmt.Sprintf("%d:%d:%s", i, j, strings.Repeat("r", i*100+j))
+						if err := d.AppendRecord("log", []byte(record)); err != nil {
+							t.Error(err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// Every record is intact, and each appender's records are in
+			// order.
+			records := readAllRecords(t, d, "log")
+			if len(records) != appenders*count {
+				t.Fatalf("read %d records, want %d", len(records), appenders*count)
+			}
+			next := make([]int, appenders)
+			for _, record := range records {
+				parts := strings.Split(string(record), ":")
+				if len(parts) != 3 {
+					t.Fatalf("corrupt record %.40q", record)
+				}
+				i, err1 := strconv.Atoi(parts[0])
+				j, err2 := strconv.Atoi(parts[1])
+				if err1 != nil || err2 != nil || i < 0 || i >= appenders {
+					t.Fatalf("corrupt record %.40q", record)
+				}
+				if j != next[i] || parts[2] != strings.Repeat("r", i*100+j) {
+					t.Fatalf("record %.40q out of order or corrupt", record)
+				}
+				next[i]++
+			}
+		})
+	}
+}
+
+func TestReadRecordsInvalid(t *testing.T) {
+	framed, err := frameRecord([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	huge := binary.BigEndian.AppendUint32(nil, MaxRecordSize+1)
+	tests := []struct {
+		name     string
+		contents []byte
+		err      string
+	}{
+		{"truncated header", append(append([]byte{}, framed...), 0, 0), "truncated record"},
+		{"truncated record", framed[:len(framed)-1], "truncated record"},
+		{"too large", append(huge, make([]byte, 10)...), "invalid record"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, dir := newTestDrive(t)
+			if err := os.WriteFile(filepath.Join(dir, "log"), test.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+			err := ReadRecords(d, "log", func(record []byte) error { return nil })
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+
+	d, _ := newTestDrive(t)
+	if err := ReadRecords(d, "missing", func(record []byte) error { return nil }); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}
+
+func TestReadRecordsStop(t *testing.T) {
+	d, _ := newTestDrive(t)
+	for _, record := range []string{"a", "b", "c"} {
+		if err := d.AppendRecord("log", []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Errors from the function stop reading and are returned.
+	stop := errors.New("stop")
+	read := 0
+	err := ReadRecords(d, "log", func(record []byte) error {
+		read++
+		if read == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || read != 2 {
+		t.Fatalf("read %d records: %v", read, err)
+	}
+}
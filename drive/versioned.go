@@ -0,0 +1,523 @@
+// drive/versioned.go
+// Versioned drives, which keep the previous versions of files on a backing
+// drive.
+
+package drive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The directory at the root of the backing drive the versions are kept in.
+const versionsDir = ".versions"
+
+// The format of version IDs, which sort in the order they were taken.
+const versionIDFormat = "20060102T150405.000000000Z"
+
+// A previous version of a file.
+type Version struct {
+	// The ID of the version, from the time it was replaced.
+	ID   string
+	Time time.Time
+	Size int64
+}
+
+// A drive which keeps the previous versions of files.
+type Versioner interface {
+	// List the previous versions of a file, newest first.
+	ListVersions(path string) ([]Version, error)
+
+	// Read a previous version of a file into a stream.
+	ReadVersion(path, version string, stream io.Writer) error
+
+	// Restore a previous version of a file. The current contents of the file
+	// are kept as a version, so the restore can be undone.
+	RestoreVersion(path, version string) error
+}
+
+// The versioned drive implementation. Before a file is replaced or modified
+// by Create, CreateSized, Write, WriteAt, or CompareAndSwap, its contents are
+// copied to .versions/<path>/<version> on the backing drive. Appends keep the
+// previous contents, so they aren't versioned. Versions are kept after a file
+// is removed, so removed files can be restored. The versions directory is
+// hidden from the drive.
+type versioned struct {
+	backing Drive
+
+	// The number of versions to keep of each file, and the time to keep
+	// them for. Zero is unlimited.
+	maxVersions int
+	retention   time.Duration
+
+	// The write locks of the files being versioned.
+	locks pathLocks
+}
+
+// Create a new versioned drive over a backing drive, keeping up to
+// maxVersions versions of each file for up to retention. Zero is unlimited.
+func NewVersionedDrive(backing Drive, maxVersions int, retention time.Duration) Drive {
+	return &versioned{backing: backing, maxVersions: maxVersions, retention: retention}
+}
+
+// Check that a path isn't within the versions directory.
+func checkVersionedPath(path string) error {
+	clean := filepath.Clean("/" + path)
+	if clean == "/"+versionsDir || strings.HasPrefix(clean, "/"+versionsDir+"/") {
+		return errors.New(fmt.Sprintf("path is invalid: %s", path))
+	}
+	return nil
+}
+
+// Get the directory the versions of a file are kept in.
+func versionDir(path string) string {
+	return filepath.Join(versionsDir, filepath.Clean("/"+path))
+}
+
+// Get the path of a version of a file, ensuring the version ID is valid.
+func versionPath(path, version string) (string, error) {
+	if _, err := time.Parse(versionIDFormat, version); err != nil {
+		return "", errors.New(fmt.Sprintf("invalid version: %s", version))
+	}
+	return filepath.Join(versionDir(path), version), nil
+}
+
+// Create a directory and its parents on the backing drive.
+func (v *versioned) mkdirAll(path string) error {
+	path = filepath.Clean(path)
+	if path == "." || path == "/" || exists(v.backing, path) {
+		return nil
+	}
+	if err := v.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := v.backing.CreateDirectory(path); err != nil && !exists(v.backing, path) {
+		return err
+	}
+	return nil
+}
+
+// Keep the current contents of a file as a version, if it exists, and prune
+// its old versions. The lock of the path must be held.
+func (v *versioned) snapshot(path string) error {
+	info, err := v.backing.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	dir := versionDir(path)
+	if err := v.mkdirAll(dir); err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format(versionIDFormat)
+	if err := v.backing.Copy(path, filepath.Join(dir, id)); err != nil {
+		return err
+	}
+	return v.prune(path)
+}
+
+// Remove the versions of a file beyond the number of versions to keep, or
+// older than the retention time.
+func (v *versioned) prune(path string) error {
+	versions, err := v.ListVersions(path)
+	if err != nil {
+		return err
+	}
+	for i := range versions {
+		tooMany := v.maxVersions > 0 && i >= v.maxVersions
+		tooOld := v.retention > 0 && time.Since(versions[i].Time) > v.retention
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := v.backing.Remove(filepath.Join(versionDir(path), versions[i].ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the previous versions of a file, newest first.
+func (v *versioned) ListVersions(path string) ([]Version, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return nil, err
+	}
+	items, err := v.backing.ReadDir(versionDir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Version{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+	for i := range items {
+		if !items[i].Type().IsRegular() {
+			continue
+		}
+		t, err := time.Parse(versionIDFormat, items[i].Name())
+		if err != nil {
+			continue
+		}
+		info, err := items[i].Info()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, Version{ID: items[i].Name(), Time: t, Size: info.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+	return versions, nil
+}
+
+// Read a previous version of a file into a stream.
+func (v *versioned) ReadVersion(path, version string, stream io.Writer) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	vpath, err := versionPath(path, version)
+	if err != nil {
+		return err
+	}
+	info, err := v.backing.Stat(vpath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unknown version: %s", version))
+	}
+	return v.backing.ReadRange(vpath, stream, 0, info.Size())
+}
+
+// Restore a previous version of a file. The version is copied next to the
+// other versions, then moved into place, so the file is replaced atomically.
+func (v *versioned) RestoreVersion(path, version string) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	vpath, err := versionPath(path, version)
+	if err != nil {
+		return err
+	}
+	if !exists(v.backing, vpath) {
+		return errors.New(fmt.Sprintf("unknown version: %s", version))
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	// Copy the version before keeping the current contents, which may prune
+	// the version.
+	temp := filepath.Join(versionDir(path), ".restore")
+	v.backing.Remove(temp)
+	if err := v.backing.Copy(vpath, temp); err != nil {
+		return err
+	}
+	if err := v.snapshot(path); err != nil {
+		v.backing.Remove(temp)
+		return err
+	}
+	if err := v.backing.Move(temp, path); err != nil {
+		v.backing.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// Create a file. Creating an existing file truncates it, so its previous
+// contents are kept as a version.
+func (v *versioned) Create(path string) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+	return v.backing.Create(path)
+}
+
+// Create a file of a given size, keeping the previous contents of an existing
+// file as a version.
+func (v *versioned) CreateSized(path string, size int64) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+	return v.backing.CreateSized(path, size)
+}
+
+// Create a uniquely named file in a directory.
+func (v *versioned) CreateTemp(dir, pattern string) (string, error) {
+	if err := checkVersionedPath(dir); err != nil {
+		return "", err
+	}
+	return v.backing.CreateTemp(dir, pattern)
+}
+
+// Create a directory.
+func (v *versioned) CreateDirectory(path string) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.CreateDirectory(path)
+}
+
+// Read a file into a stream.
+func (v *versioned) Read(path string, stream io.Writer) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.Read(path, stream)
+}
+
+// Read a byte range of a file into a stream.
+func (v *versioned) ReadRange(path string, stream io.Writer, offset, length int64) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.ReadRange(path, stream, offset, length)
+}
+
+// Read a directory. The versions directory is hidden.
+func (v *versioned) ReadDir(path string) ([]os.DirEntry, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return nil, err
+	}
+	items, err := v.backing.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Clean("/"+path) != "/" {
+		return items, nil
+	}
+	filtered := items[:0]
+	for i := range items {
+		if items[i].Name() != versionsDir {
+			filtered = append(filtered, items[i])
+		}
+	}
+	return filtered, nil
+}
+
+// Get information about a file or directory.
+func (v *versioned) Stat(path string) (os.FileInfo, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return nil, err
+	}
+	return v.backing.Stat(path)
+}
+
+// Write a file from a stream, keeping the previous contents as a version.
+func (v *versioned) Write(path string, stream io.Reader, size int64) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+	return v.backing.Write(path, stream, size)
+}
+
+// Write into an existing file at an offset, keeping the previous contents as
+// a version.
+func (v *versioned) WriteAt(path string, offset int64, stream io.Reader, size int64) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+	return v.backing.WriteAt(path, offset, stream, size)
+}
+
+// Append data to a file.
+func (v *versioned) Append(path string, stream io.Reader, size int64) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.Append(path, stream, size)
+}
+
+// Append a record to a file.
+func (v *versioned) AppendRecord(path string, record []byte) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.AppendRecord(path, record)
+}
+
+// Remove a file or directory. The versions of a removed file are kept.
+func (v *versioned) Remove(path string) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.Remove(path)
+}
+
+// Move a file or directory. The versions of a moved file stay with its old
+// path.
+func (v *versioned) Move(src string, dest string) error {
+	if err := checkVersionedPath(src); err != nil {
+		return err
+	}
+	if err := checkVersionedPath(dest); err != nil {
+		return err
+	}
+	return v.backing.Move(src, dest)
+}
+
+// Move a file or directory, failing if the destination already exists.
+func (v *versioned) MoveNoReplace(src string, dest string) error {
+	if err := checkVersionedPath(src); err != nil {
+		return err
+	}
+	if err := checkVersionedPath(dest); err != nil {
+		return err
+	}
+	return v.backing.MoveNoReplace(src, dest)
+}
+
+// Copy a file.
+func (v *versioned) Copy(src string, dest string) error {
+	if err := checkVersionedPath(src); err != nil {
+		return err
+	}
+	if err := checkVersionedPath(dest); err != nil {
+		return err
+	}
+	return v.backing.Copy(src, dest)
+}
+
+// Flush a file or directory to stable storage.
+func (v *versioned) Sync(path string) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.Sync(path)
+}
+
+// Change the user and group IDs of the owner of a file or directory.
+func (v *versioned) Chown(path string, uid, gid int) error {
+	if err := checkVersionedPath(path); err != nil {
+		return err
+	}
+	return v.backing.Chown(path, uid, gid)
+}
+
+// Compute the SHA-256 checksum of a file, as a hex string.
+func (v *versioned) Checksum(path string) (string, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return "", err
+	}
+	return v.backing.Checksum(path)
+}
+
+// Replace the contents of a file with new contents if its current contents
+// equal the expected contents, keeping the previous contents as a version if
+// they are swapped.
+func (v *versioned) CompareAndSwap(path string, expected, new []byte) (bool, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return false, err
+	}
+
+	// Lock the path.
+	unlock := v.locks.acquire(filepath.Clean(path))
+	defer unlock()
+
+	// Only keep a version if the swap will happen. Writes through the drive
+	// hold the lock, so the contents can't change before the swap.
+	var current bytes.Buffer
+	info, err := v.backing.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != int64(len(expected)) {
+		return false, nil
+	}
+	if err := v.backing.ReadRange(path, &current, 0, info.Size()); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current.Bytes(), expected) {
+		return false, nil
+	}
+	if err := v.snapshot(path); err != nil {
+		return false, err
+	}
+	return v.backing.CompareAndSwap(path, expected, new)
+}
+
+// Get the type of the drive.
+func (v *versioned) Type() string {
+	return "versioned"
+}
+
+// Get the storage quota of the drive in bytes. The quota applies to the
+// backing drive, including the versions.
+func (v *versioned) Quota() int64 {
+	return v.backing.Quota()
+}
+
+// Get the total size of the files under a path in bytes, including the
+// versions if the path is the root of the drive.
+func (v *versioned) Usage(path string) (int64, error) {
+	if err := checkVersionedPath(path); err != nil {
+		return 0, err
+	}
+	return v.backing.Usage(path)
+}
+
+// Get the total size of the files of the drive in bytes, including the
+// versions.
+func (v *versioned) TotalUsage() (int64, error) {
+	return v.backing.TotalUsage()
+}
+
+// Get the total size in bytes and the number of files under a directory,
+// excluding the versions.
+func (v *versioned) DirSize(path string) (int64, int, error) {
+	return walkDirSize(v, path)
+}
+
+// Count the files and directories under a directory, and the total size of
+// the files in bytes, excluding the versions.
+func (v *versioned) CountTree(path string) (int, int, int64, error) {
+	return walkCountTree(v, path)
+}
+
+// Compute the SHA-256 checksum of every file under a directory, excluding the
+// versions. The function is called for each file with its path relative to
+// the directory.
+func (v *versioned) Manifest(path string, fn func(path, checksum string, size int64) error) error {
+	return walkManifest(v, path, fn)
+}
@@ -0,0 +1,207 @@
+// drive/versioned_test.go
+// Tests for versioned drives.
+
+package drive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a versioned drive over a drive in a temporary directory.
+func newTestVersioned(t *testing.T, maxVersions int, retention time.Duration) (Versioner, Drive, string) {
+	t.Helper()
+	backing, dir := newTestDrive(t)
+	d := NewVersionedDrive(backing, maxVersions, retention)
+	return d.(Versioner), d, dir
+}
+
+// Read a version of a file.
+func readVersion(t *testing.T, v Versioner, path, version string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := v.ReadVersion(path, version, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// Get the contents of each version of a file, newest first.
+func versionContents(t *testing.T, v Versioner, path string) []string {
+	t.Helper()
+	versions, err := v.ListVersions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, version := range versions {
+		data := readVersion(t, v, path, version.ID)
+		if version.Size != int64(len(data)) || version.Time.IsZero() {
+			t.Fatalf("version %+v of %q", version, data)
+		}
+		contents = append(contents, data)
+	}
+	return contents
+}
+
+func TestVersionedWrite(t *testing.T) {
+	v, d, _ := newTestVersioned(t, 0, 0)
+	if err := d.CreateDirectory("dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each write keeps the previous contents as a version.
+	for _, data := range []string{"one", "two", "three"} {
+		if err := d.Write("dir/file", strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := versionContents(t, v, "dir/file"); strings.Join(got, ",") != "two,one" {
+		t.Fatalf("versions %q", got)
+	}
+	if got := readString(t, d, "dir/file"); got != "three" {
+		t.Fatalf("read %q", got)
+	}
+
+	// Writes at an offset and swaps are versioned, but appends and failed
+	// swaps aren't.
+	if err := d.WriteAt("dir/file", 0, strings.NewReader("T"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Append("dir/file", strings.NewReader("!"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := d.CompareAndSwap("dir/file", []byte("wrong"), []byte("new")); err != nil || swapped {
+		t.Fatalf("swapped %v: %v", swapped, err)
+	}
+	if swapped, err := d.CompareAndSwap("dir/file", []byte("Three!"), []byte("four")); err != nil || !swapped {
+		t.Fatalf("swapped %v: %v", swapped, err)
+	}
+	if got := versionContents(t, v, "dir/file"); strings.Join(got, ",") != "Three!,three,two,one" {
+		t.Fatalf("versions %q", got)
+	}
+
+	// Creating over a file truncates it, so its contents are kept.
+	if err := d.Create("dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateSized("dir/file", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := versionContents(t, v, "dir/file"); strings.Join(got, ",") != ",four,Three!,three,two,one" {
+		t.Fatalf("versions %q", got)
+	}
+
+	// Files without versions have none.
+	if versions, err := v.ListVersions("missing"); err != nil || len(versions) != 0 {
+		t.Fatalf("versions %v: %v", versions, err)
+	}
+}
+
+func TestVersionedHidden(t *testing.T) {
+	v, d, dir := newTestVersioned(t, 0, 0)
+	for i := 0; i < 2; i++ {
+		if err := d.Write("file", strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, versionsDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The versions aren't listed or counted.
+	if names := listNames(t, d, ""); names != "file" {
+		t.Fatalf("listed %s", names)
+	}
+	if size, files, err := d.DirSize(""); err != nil || size != 4 || files != 1 {
+		t.Fatalf("size %d of %d files: %v", size, files, err)
+	}
+
+	// Paths in the versions directory are invalid.
+	if _, err := d.Stat(versionsDir); err == nil || !strings.Contains(err.Error(), "path is invalid") {
+		t.Errorf("got %v, want a path is invalid error", err)
+	}
+	if err := d.Write(versionsDir+"/file/x", strings.NewReader("x"), 1); err == nil {
+		t.Error("wrote into the versions directory")
+	}
+	if err := d.Remove("dir/../" + versionsDir); err == nil {
+		t.Error("removed the versions directory")
+	}
+
+	// Versions must be valid IDs.
+	for _, version := range []string{"../file", "latest", "20200101T000000.000000000Z"} {
+		if err := v.ReadVersion("file", version, &bytes.Buffer{}); err == nil {
+			t.Errorf("read version %s", version)
+		}
+		if err := v.RestoreVersion("file", version); err == nil {
+			t.Errorf("restored version %s", version)
+		}
+	}
+}
+
+func TestVersionedRestore(t *testing.T) {
+	v, d, _ := newTestVersioned(t, 0, 0)
+	for _, data := range []string{"one", "two"} {
+		if err := d.Write("file", strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := v.ListVersions("file")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions %v: %v", versions, err)
+	}
+
+	// Restoring keeps the current contents, so the restore can be undone.
+	if err := v.RestoreVersion("file", versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, d, "file"); got != "one" {
+		t.Fatalf("restored %q", got)
+	}
+	if got := versionContents(t, v, "file"); strings.Join(got, ",") != "two,one" {
+		t.Fatalf("versions %q", got)
+	}
+
+	// Removed files keep their versions and can be restored.
+	if err := d.Remove("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.RestoreVersion("file", versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, d, "file"); got != "one" {
+		t.Fatalf("restored %q", got)
+	}
+}
+
+func TestVersionedPrune(t *testing.T) {
+	// Only the newest versions are kept.
+	v, d, _ := newTestVersioned(t, 2, 0)
+	for _, data := range []string{"one", "two", "three", "four"} {
+		if err := d.Write("file", strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := versionContents(t, v, "file"); strings.Join(got, ",") != "three,two" {
+		t.Fatalf("versions %q", got)
+	}
+
+	// Versions older than the retention time are removed.
+	v, d, _ = newTestVersioned(t, 0, 50*time.Millisecond)
+	for _, data := range []string{"one", "two"} {
+		if err := d.Write("file", strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := d.Write("file", strings.NewReader("three"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := versionContents(t, v, "file"); strings.Join(got, ",") != "two" {
+		t.Fatalf("versions %q", got)
+	}
+}
@@ -0,0 +1,160 @@
+// drive/walk.go
+// Walking directories through the drive interface.
+
+package drive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+// Get the total size in bytes and the number of files under a directory by
+// walking it through a drive. The walk is capped at MaxWalkEntries entries.
+func walkDirSize(d Drive, path string) (int64, int, error) {
+	size := int64(0)
+	count := 0
+	visited := 0
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		items, err := d.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			// Cap the size of the walk.
+			visited++
+			if visited > MaxWalkEntries {
+				return errors.New("too many entries")
+			}
+
+			if items[i].IsDir() {
+				if err := walk(filepath.Join(dir, items[i].Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			if !items[i].Type().IsRegular() {
+				continue
+			}
+			info, err := items[i].Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			count++
+		}
+		return nil
+	}
+	if err := walk(path); err != nil {
+		return 0, 0, err
+	}
+
+	return size, count, nil
+}
+
+// Count the files and directories under a directory, and the total size of
+// the files in bytes, by walking it through a drive. The walk is capped at
+// MaxWalkEntries entries.
+func walkCountTree(d Drive, path string) (int, int, int64, error) {
+	files := 0
+	dirs := 0
+	bytes := int64(0)
+	visited := 0
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		items, err := d.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			// Cap the size of the walk.
+			visited++
+			if visited > MaxWalkEntries {
+				return errors.New("too many entries")
+			}
+
+			if items[i].IsDir() {
+				dirs++
+				if err := walk(filepath.Join(dir, items[i].Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			if !items[i].Type().IsRegular() {
+				continue
+			}
+			info, err := items[i].Info()
+			if err != nil {
+				return err
+			}
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	}
+	if err := walk(path); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return files, dirs, bytes, nil
+}
+
+// Compute the SHA-256 checksum of every file under a directory by walking it
+// through a drive, reading each file. The function is called for each file
+// with its path relative to the directory.
+func walkManifest(d Drive, path string, fn func(path, checksum string, size int64) error) error {
+	visited := 0
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		items, err := d.ReadDir(filepath.Join(path, rel))
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			// Cap the size of the walk.
+			visited++
+			if visited > MaxWalkEntries {
+				return errors.New("too many entries")
+			}
+
+			itemRel := filepath.Join(rel, items[i].Name())
+			if items[i].IsDir() {
+				if err := walk(itemRel); err != nil {
+					return err
+				}
+				continue
+			}
+			if !items[i].Type().IsRegular() {
+				continue
+			}
+
+			// Hash the file.
+			hash := sha256.New()
+			counter := &countingWriter{w: hash}
+			if err := d.Read(filepath.Join(path, itemRel), counter); err != nil {
+				return err
+			}
+			if err := fn(filepath.ToSlash(itemRel), hex.EncodeToString(hash.Sum(nil)), counter.n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk("")
+}
+
+// A writer which counts the bytes written to it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+// drive/writeback.go
+// Write modes and the write-back flusher.
+
+package drive
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// The mode writes are acknowledged in.
+type WriteMode string
+
+const (
+	// Writes are acknowledged once they are handed to the operating system,
+	// which flushes them to storage on its own schedule.
+	WriteModeDefault WriteMode = ""
+
+	// Writes are acknowledged only once they are flushed to stable storage.
+	WriteModeThrough WriteMode = "through"
+
+	// Writes are acknowledged once they are handed to the operating system,
+	// and the drive flushes them to stable storage within the flush interval.
+	// Acknowledged writes that have not been flushed are lost if the host
+	// crashes.
+	WriteModeBack WriteMode = "back"
+)
+
+// The default interval write-back drives flush written files on.
+const DefaultFlushInterval = time.Second
+
+// The set of files written but not yet flushed by a write-back drive.
+type dirtySet struct {
+	lock      sync.Mutex
+	files     map[string]bool
+	scheduled bool
+}
+
+// Mark a file as written but not yet flushed, scheduling a flush.
+func (d *drive) markDirty(hostPath string) {
+	d.dirty.lock.Lock()
+	defer d.dirty.lock.Unlock()
+
+	if d.dirty.files == nil {
+		d.dirty.files = map[string]bool{}
+	}
+	d.dirty.files[hostPath] = true
+
+	// Schedule a flush if there isn't one already.
+	if !d.dirty.scheduled {
+		d.dirty.scheduled = true
+		interval := d.options.FlushInterval
+		if interval <= 0 {
+			interval = DefaultFlushInterval
+		}
+		time.AfterFunc(interval, d.flushDirty)
+	}
+}
+
+// Mark a file as flushed.
+func (d *drive) markClean(hostPath string) {
+	d.dirty.lock.Lock()
+	defer d.dirty.lock.Unlock()
+
+	delete(d.dirty.files, hostPath)
+}
+
+// Flush every file written but not yet flushed.
+func (d *drive) flushDirty() {
+	d.dirty.lock.Lock()
+	files := d.dirty.files
+	d.dirty.files = nil
+	d.dirty.scheduled = false
+	d.dirty.lock.Unlock()
+
+	for hostPath := range files {
+		file, err := os.Open(hostPath)
+		if err != nil {
+			// The file was removed or moved since it was written.
+			continue
+		}
+		file.Sync()
+		file.Close()
+	}
+}
@@ -0,0 +1,91 @@
+// drive/writeback_test.go
+// Tests for write modes.
+
+package drive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Get the number of files a drive has written but not flushed.
+func dirtyFiles(d Drive) int {
+	dd := d.(*drive)
+	dd.dirty.lock.Lock()
+	defer dd.dirty.lock.Unlock()
+	return len(dd.dirty.files)
+}
+
+// Get if a drive has a flush scheduled.
+func flushScheduled(d Drive) bool {
+	dd := d.(*drive)
+	dd.dirty.lock.Lock()
+	defer dd.dirty.lock.Unlock()
+	return dd.dirty.scheduled
+}
+
+func TestWriteModes(t *testing.T) {
+	for _, mode := range []WriteMode{WriteModeDefault, WriteModeThrough, WriteModeBack} {
+		dir := t.TempDir()
+		d := NewDriveWithOptions(dir, Options{WriteMode: mode, FlushInterval: 50 * time.Millisecond})
+		if err := d.Write("a", bytes.NewReader([]byte("hello")), 5); err != nil {
+			t.Fatalf("%q: %v", mode, err)
+		}
+		if err := d.Append("a", bytes.NewReader([]byte("!")), 1); err != nil {
+			t.Fatalf("%q: %v", mode, err)
+		}
+		checkTree(t, dir, map[string]string{"a": "hello!"})
+
+		// Only write-back drives leave files to be flushed.
+		if want := map[WriteMode]int{WriteModeBack: 1}[mode]; dirtyFiles(d) != want {
+			t.Errorf("%q: %d files not flushed, want %d", mode, dirtyFiles(d), want)
+		}
+	}
+}
+
+func TestWriteBackFlush(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDriveWithOptions(dir, Options{WriteMode: WriteModeBack, FlushInterval: 50 * time.Millisecond})
+	for _, name := range []string{"a", "b", "removed"} {
+		if err := d.Write(name, bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Remove("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if dirtyFiles(d) != 3 {
+		t.Fatalf("%d files not flushed, want 3", dirtyFiles(d))
+	}
+
+	// Syncing a file flushes it immediately.
+	if err := d.Sync("a"); err != nil {
+		t.Fatal(err)
+	}
+	if dirtyFiles(d) != 2 {
+		t.Fatalf("%d files not flushed after a sync, want 2", dirtyFiles(d))
+	}
+
+	// The rest are flushed within the interval, including files removed
+	// since they were written.
+	deadline := time.Now().Add(5 * time.Second)
+	for dirtyFiles(d) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files not flushed", dirtyFiles(d))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if flushScheduled(d) {
+		t.Fatal("flush still scheduled with no written files")
+	}
+
+	// Later writes schedule another flush.
+	if err := d.Write("c", bytes.NewReader(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+	if dirtyFiles(d) != 1 || !flushScheduled(d) {
+		t.Fatal("write did not schedule a flush")
+	}
+	checkTree(t, dir, map[string]string{"a": "a", "b": "b", "c": ""})
+}
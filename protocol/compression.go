@@ -0,0 +1,82 @@
+// protocol/compression.go
+// Compression of the data of reads and writes.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The flag asking the server to compress the data of a read, with the name of
+// the compression. Servers which support compression reply to ping with the
+// names of the compressions they support after PONG, so clients know they
+// may send compressed writes.
+const CompressionFlag = "compress"
+
+// The name of gzip compression.
+const Gzip = "gzip"
+
+// The minimum size of data worth compressing. Smaller data is sent as is, as
+// the gzip header and trailer would outweigh any savings.
+const MinCompressSize = 1024
+
+// The maximum size of data compressed in a single request. Compressed data
+// is buffered so its length can be sent ahead of it, so larger data is sent
+// as is.
+const MaxCompressSize = 64 << 20
+
+// Format the length line of compressed data: the name of the compression,
+// the length of the compressed data, and the size of the uncompressed data.
+func FormatCompressedLength(length, size int64) string {
+	return Gzip + " " + strconv.FormatInt(length, 10) + " " + strconv.FormatInt(size, 10)
+}
+
+// Parse a length line, which is either the length of the data, or the length
+// line of compressed data. Returns the length of the data sent, the size of
+// the uncompressed data, and if the data is compressed.
+func ParseLength(line string) (int64, int64, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 3 && fields[0] == Gzip {
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || length < 0 {
+			return 0, 0, false, errors.New("invalid compressed length")
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || size < 0 {
+			return 0, 0, false, errors.New("invalid compressed size")
+		}
+		return length, size, true, nil
+	}
+	length, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if length < 0 {
+		return 0, 0, false, errors.New("invalid length")
+	}
+	return length, length, false, nil
+}
+
+// Compress data with gzip. Returns false if the data is outside the sizes
+// worth compressing, or doesn't get any smaller.
+func Compress(data []byte) ([]byte, bool) {
+	if len(data) < MinCompressSize || len(data) > MaxCompressSize {
+		return nil, false
+	}
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
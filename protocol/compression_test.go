@@ -0,0 +1,80 @@
+// protocol/compression_test.go
+// Tests for compression of read and write data.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestParseLength(t *testing.T) {
+	tests := []struct {
+		line       string
+		length     int64
+		size       int64
+		compressed bool
+		valid      bool
+	}{
+		{"42", 42, 42, false, true},
+		{FormatCompressedLength(10, 1000), 10, 1000, true, true},
+		{"-1", 0, 0, false, false},
+		{"0x10", 0, 0, false, false},
+		{"gzip -1 10", 0, 0, false, false},
+		{"gzip 10 x", 0, 0, false, false},
+		{"zstd 10 100", 0, 0, false, false},
+		{"", 0, 0, false, false},
+	}
+	for _, test := range tests {
+		length, size, compressed, err := ParseLength(test.line)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("parsed %q", test.line)
+			}
+			continue
+		}
+		if err != nil || length != test.length || size != test.size || compressed != test.compressed {
+			t.Errorf("parsed %q as %d, %d, %v: %v", test.line, length, size, compressed, err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	tests := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"small", bytes.Repeat([]byte("a"), MinCompressSize-1), false},
+		{"compressible", bytes.Repeat([]byte("a"), MinCompressSize), true},
+		{"incompressible", random, false},
+		{"large", make([]byte, MaxCompressSize+1), false},
+	}
+	for _, test := range tests {
+		compressed, ok := Compress(test.data)
+		if ok != test.compressed {
+			t.Errorf("%s: compressed %v, want %v", test.name, ok, test.compressed)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// Compressed data is smaller, and decompresses to the data.
+		if len(compressed) >= len(test.data) {
+			t.Errorf("%s: compressed %d bytes to %d", test.name, len(test.data), len(compressed))
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := io.ReadAll(reader); err != nil || !bytes.Equal(data, test.data) {
+			t.Errorf("%s: decompressed %d bytes: %v", test.name, len(data), err)
+		}
+	}
+}
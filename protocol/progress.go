@@ -0,0 +1,64 @@
+// protocol/progress.go
+// Progress events of long-running commands.
+
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The flag requesting progress events from commands which support them.
+const ProgressFlag = "progress"
+
+// The lines framing progress events. Commands streaming progress send
+// PROGRESS lines after the success response, then RESULT followed by their
+// result, or ERROR followed by a message if they fail part way through.
+const (
+	ProgressEvent  = "PROGRESS"
+	ProgressResult = "RESULT"
+	ProgressError  = "ERROR"
+)
+
+// A progress event. The total is zero if it isn't known ahead of time.
+type Progress struct {
+	Done  int64
+	Total int64
+
+	// The item being processed, such as the path of a file.
+	Item string
+}
+
+// Get the percentage done. Zero if the total isn't known.
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return float64(p.Done) / float64(p.Total) * 100
+}
+
+// Format a progress event as a line: PROGRESS, the number done, the total,
+// and the item, which may contain spaces.
+func FormatProgress(p Progress) string {
+	return ProgressEvent + " " + strconv.FormatInt(p.Done, 10) + " " + strconv.FormatInt(p.Total, 10) + " " + p.Item
+}
+
+// Parse a progress event line. Returns false if the line isn't one.
+func ParseProgress(line string) (Progress, bool) {
+	if !strings.HasPrefix(line, ProgressEvent+" ") {
+		return Progress{}, false
+	}
+	fields := strings.SplitN(strings.TrimPrefix(line, ProgressEvent+" "), " ", 3)
+	if len(fields) != 3 {
+		return Progress{}, false
+	}
+	done, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Progress{}, false
+	}
+	total, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Progress{}, false
+	}
+	return Progress{Done: done, Total: total, Item: fields[2]}, true
+}
@@ -0,0 +1,31 @@
+// protocol/progress_test.go
+// Tests for progress events.
+
+package protocol
+
+import "testing"
+
+func TestProgress(t *testing.T) {
+	// Events are parsed back from their lines, with spaces in the item kept.
+	for _, p := range []Progress{{Done: 3, Total: 10, Item: "dir/a file"}, {Done: 7}} {
+		parsed, ok := ParseProgress(FormatProgress(p))
+		if !ok || parsed != p {
+			t.Errorf("parsed %+v from %+v", parsed, p)
+		}
+	}
+
+	// Other lines aren't events.
+	for _, line := range []string{ProgressResult, ProgressError, "PROGRESS", "PROGRESS 1 2", "PROGRESS x 2 item", "PROGRESS 1 x item", "progress 1 2 item"} {
+		if p, ok := ParseProgress(line); ok {
+			t.Errorf("parsed %+v from %q", p, line)
+		}
+	}
+
+	// The percentage is zero without a total.
+	if percent := (Progress{Done: 1, Total: 4}).Percent(); percent != 25 {
+		t.Errorf("got %v%%, want 25%%", percent)
+	}
+	if percent := (Progress{Done: 1}).Percent(); percent != 0 {
+		t.Errorf("got %v%% without a total", percent)
+	}
+}
@@ -4,5 +4,93 @@
 
 package protocol
 
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
 const Header = "DEEPWELL-v0"
+
+// The header sent in place of the protocol header to start a multiplexed
+// session, carrying many requests as streams over a single connection.
+const MuxHeader = "DEEPWELL-MUX-v0"
+
+// The header sent in place of the protocol header to sign the rest of the
+// connection. It is followed by the key and the client's nonce, and the
+// server responds with its nonce, or FAILED if the key has no secret. The
+// connection then continues with HMAC-signed frames, starting with a protocol
+// or multiplexing header.
+const HMACHeader = "DEEPWELL-HMAC-v0"
+
+// The flag asking the server to keep the connection open once the request
+// has completed, so it can be reused for another request.
+const KeepAliveFlag = "keepalive"
+
 const ChunkSize = 4086
+
+// The pool of chunk buffers, shared across transfers to reduce allocations.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, ChunkSize)
+		return &buf
+	},
+}
+
+// Get a chunk buffer of ChunkSize bytes from the pool. The buffer must be
+// returned with PutChunk once it is no longer used.
+func GetChunk() *[]byte {
+	return chunkPool.Get().(*[]byte)
+}
+
+// Return a chunk buffer to the pool. The buffer is cleared, so no data is
+// carried over to its next user.
+func PutChunk(buf *[]byte) {
+	b := (*buf)[:ChunkSize]
+	for i := range b {
+		b[i] = 0
+	}
+	*buf = b
+	chunkPool.Put(buf)
+}
+
+// Encode request flags, to follow the command on the command line, separated
+// by spaces (e.g. " encoding=utf-16le"). Keys and values are escaped.
+func EncodeFlags(flags map[string]string) string {
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encoded := ""
+	for _, key := range keys {
+		encoded += " " + url.QueryEscape(key) + "=" + url.QueryEscape(flags[key])
+	}
+	return encoded
+}
+
+// Parse a command line into the command and its flags. Malformed flags are
+// ignored.
+func ParseFlags(line string) (string, map[string]string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", map[string]string{}
+	}
+
+	flags := map[string]string{}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil || key == "" {
+			continue
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		flags[key] = value
+	}
+	return fields[0], flags
+}
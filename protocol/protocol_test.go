@@ -0,0 +1,66 @@
+// protocol/protocol_test.go
+// Tests for the protocol definitions.
+
+package protocol
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChunkPool(t *testing.T) {
+	chunk := GetChunk()
+	if len(*chunk) != ChunkSize {
+		t.Fatalf("chunk has %d bytes, want %d", len(*chunk), ChunkSize)
+	}
+
+	// Returned chunks are cleared and restored to their full size, even if
+	// they were resliced.
+	for i := range *chunk {
+		(*chunk)[i] = 0xff
+	}
+	*chunk = (*chunk)[:10]
+	PutChunk(chunk)
+	if len(*chunk) != ChunkSize {
+		t.Fatalf("returned chunk has %d bytes, want %d", len(*chunk), ChunkSize)
+	}
+	for i, b := range *chunk {
+		if b != 0 {
+			t.Fatalf("returned chunk not cleared at %d", i)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	flags := map[string]string{"b": "2", "a": "1", "odd key": "x=y&z", "empty": ""}
+	encoded := EncodeFlags(flags)
+	if encoded != " a=1 b=2 empty= odd+key=x%3Dy%26z" {
+		t.Fatalf("encoded %q", encoded)
+	}
+	command, parsed := ParseFlags("write" + encoded)
+	if command != "write" || len(parsed) != len(flags) {
+		t.Fatalf("parsed %q, %v", command, parsed)
+	}
+	for key, value := range flags {
+		if parsed[key] != value {
+			t.Errorf("flag %q is %q, want %q", key, parsed[key], value)
+		}
+	}
+
+	tests := []struct {
+		line    string
+		command string
+		flags   string
+	}{
+		{"", "", "map[]"},
+		{"ping", "ping", "map[]"},
+		{"ping  a=1   b", "ping", "map[a:1 b:]"},
+		{"ping =1 %zz=1 c=%zz d=4", "ping", "map[d:4]"},
+	}
+	for _, test := range tests {
+		command, flags := ParseFlags(test.line)
+		if command != test.command || fmt.Sprint(flags) != test.flags {
+			t.Errorf("%q: parsed %q, %v", test.line, command, flags)
+		}
+	}
+}
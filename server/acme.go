@@ -0,0 +1,79 @@
+// server/acme.go
+// Obtaining certificates over ACME (e.g. from Let's Encrypt).
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME options.
+type ACMEOptions struct {
+	// The domains to obtain certificates for. No domains disables ACME.
+	Domains []string
+
+	// The directory to cache certificates and the account key in, so they
+	// persist across restarts.
+	CacheDir string
+
+	// The contact email of the ACME account. Optional.
+	Email string
+
+	// The URL of the ACME directory. Empty uses the Let's Encrypt production
+	// directory.
+	DirectoryURL string
+
+	// The address to answer HTTP-01 challenges on, usually ":80". Empty only
+	// answers TLS-ALPN-01 challenges, which requires the server to listen on
+	// port 443.
+	ChallengeAddress string
+}
+
+// Start obtaining certificates over ACME, using them for the TLS
+// configuration of the server.
+func (s *server) startACME() error {
+	if len(s.acme.Domains) == 0 {
+		return nil
+	}
+	if s.acme.CacheDir == "" {
+		return errors.New("acme configuration must contain a cache directory")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.acme.Domains...),
+		Cache:      autocert.DirCache(s.acme.CacheDir),
+		Email:      s.acme.Email,
+	}
+	if s.acme.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: s.acme.DirectoryURL}
+	}
+
+	// Serve the certificates, answering TLS-ALPN-01 challenges in the
+	// handshake.
+	s.tlsConfig.GetCertificate = manager.GetCertificate
+	s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, acme.ALPNProto)
+
+	// Answer HTTP-01 challenges.
+	if s.acme.ChallengeAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.acme.ChallengeAddress)
+	if err != nil {
+		return err
+	}
+	s.challengeServer = &http.Server{Handler: manager.HTTPHandler(nil)}
+	go func() {
+		err := s.challengeServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			s.err.Println("failed to serve acme challenges: ", err.Error())
+		}
+	}()
+
+	return nil
+}
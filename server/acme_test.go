@@ -0,0 +1,154 @@
+// server/acme_test.go
+// Tests for obtaining certificates over ACME.
+
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+// The domain certificates are obtained for in the tests.
+const testACMEDomain = "deepwell.example"
+
+// Cache a certificate for a domain in an ACME cache directory, so the server
+// uses it without contacting the ACME directory. Returns the certificate.
+func writeACMECache(t *testing.T, dir, domain string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is valid long enough that it isn't renewed.
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		DNSNames:     []string{domain},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, domain), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// Get a free local address.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestACMECertificates(t *testing.T) {
+	cacheDir := t.TempDir()
+	cert := writeACMECache(t, cacheDir, testACMEDomain)
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetACME(ACMEOptions{
+			Domains:  []string{testACMEDomain},
+			CacheDir: cacheDir,
+			// Nothing should be requested from the directory.
+			DirectoryURL: "http://127.0.0.1:1/directory",
+		})
+	})
+
+	// Clients connecting to the domain get the cached certificate.
+	conn, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{ServerName: testACMEDomain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := conn.ConnectionState().PeerCertificates
+	conn.Close()
+	if len(peer) == 0 || !bytes.Equal(peer[0].Raw, cert) {
+		t.Fatal("got a certificate other than the cached one")
+	}
+
+	// Other domains aren't served.
+	if conn, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{ServerName: "other.example", InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Fatal("connected to a domain not in the configuration")
+	}
+
+	// Clients which don't send a server name get the static certificate.
+	if err := newTestClient(t, s, testAdminKey).Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACMEChallenges(t *testing.T) {
+	addr := freeAddress(t)
+	startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetACME(ACMEOptions{
+			Domains:          []string{testACMEDomain},
+			CacheDir:         t.TempDir(),
+			DirectoryURL:     "http://127.0.0.1:1/directory",
+			ChallengeAddress: addr,
+		})
+	})
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// Unknown challenges aren't found, and other requests are redirected to
+	// HTTPS.
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"/file", http.StatusFound},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://"+addr+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = testACMEDomain
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestACMEMissingCacheDir(t *testing.T) {
+	s := NewServer().(*server)
+	s.SetACME(ACMEOptions{Domains: []string{testACMEDomain}})
+	if err := s.startACME(); err == nil {
+		t.Fatal("started without a cache directory")
+	}
+}
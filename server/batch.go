@@ -0,0 +1,116 @@
+// server/batch.go
+// Batches of simple operations in a single request.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The maximum number of operations in a batch.
+const MaxBatchOps = 10000
+
+// The number of arguments of each operation of a batch: the kind, the drive,
+// the path, and the destination of a move.
+const batchOpArgs = 4
+
+// Batch command. Applies a list of create, mkdir, remove, and move
+// operations in order, checking the permissions of each. Failed operations
+// don't abort the batch; the result of each is reported on its own line, as
+// either "ok" or "error" followed by the error.
+func (s *server) batchCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 || len(args)%batchOpArgs != 0 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(args)/batchOpArgs > MaxBatchOps {
+		err := r.sendError(fmt.Sprintf("too many operations, the maximum is %d", MaxBatchOps))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, "", "operations", len(args)/batchOpArgs)
+
+	// Apply each operation, reporting errors inline.
+	var body strings.Builder
+	for i := 0; i < len(args); i += batchOpArgs {
+		kind, driveName, path, dest := args[i], args[i+1], args[i+2], args[i+3]
+		if err := s.batchOp(r, kind, driveName, path, dest); err != nil {
+			body.WriteString("error " + strings.ReplaceAll(err.Error(), "\n", " ") + "\n")
+			continue
+		}
+		body.WriteString("ok\n")
+	}
+
+	return r.sendSuccess(body.String())
+}
+
+// Check if a command is enabled, so commands applied on behalf of others,
+// such as the operations of batches and transactions, honor the enabled
+// commands.
+func (s *server) commandEnabled(command string) bool {
+	_, ok := s.commands[command]
+	return ok
+}
+
+// Apply an operation of a batch.
+func (s *server) batchOp(r *request, kind, driveName, path, dest string) error {
+	paths := []string{path}
+	switch kind {
+	case "create", "mkdir", "remove":
+	case "move":
+		paths = append(paths, dest)
+	default:
+		return errors.New(fmt.Sprintf("invalid operation: %s", kind))
+	}
+	if !s.commandEnabled(kind) {
+		r.logDenial(s, "command not enabled", driveName, path)
+		return errors.New(fmt.Sprintf("command not enabled: %s", kind))
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		r.logDenial(s, "no write permissions", driveName, path)
+		return errors.New("no write permissions")
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, paths...)
+	if err != nil {
+		return err
+	}
+
+	// Apply the operation.
+	switch kind {
+	case "create":
+		err = drive.Create(path)
+	case "mkdir":
+		err = drive.CreateDirectory(path)
+	case "remove":
+		if err = drive.Remove(path); err == nil {
+			s.forgetKeyUsage(driveName, path)
+		}
+	case "move":
+		if err = drive.Move(path, dest); err == nil {
+			s.moveKeyUsage(driveName, path, dest)
+		}
+	}
+	return err
+}
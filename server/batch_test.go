@@ -0,0 +1,170 @@
+// server/batch_test.go
+// Tests for batches.
+
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+)
+
+// Enable only some commands of a server, as the EnabledCommands option does.
+func enableCommands(s *server, names ...string) {
+	enabled := map[string]bool{}
+	for _, name := range names {
+		enabled[name] = true
+	}
+	for name := range s.commands {
+		if !enabled[name] {
+			delete(s.commands, name)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+
+	results, err := c.Batch([]client.Operation{
+		{Kind: "mkdir", Drive: "d1", Path: "dir"},
+		{Kind: "create", Drive: "d1", Path: "dir/a"},
+		{Kind: "move", Drive: "d1", Path: "dir/a", Dest: "dir/b"},
+		{Kind: "remove", Drive: "d1", Path: "missing"},
+		{Kind: "chmod", Drive: "d1", Path: "dir/b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, true, true, false, false} {
+		if (results[i].Err == nil) != want {
+			t.Errorf("operation %d: got %v", i, results[i].Err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "dir", "b")); err != nil {
+		t.Error("batch wasn't applied")
+	}
+}
+
+func TestBatchPermissions(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("scoped", []string{"127.0.0.1"}, auth.Permissions{Drives: map[string]auth.DrivePermissions{"d1": {Read: true, Write: true}, "d2": {Read: true}}})
+	})
+	c := newTestClient(t, s, "scoped")
+
+	// The permissions of each operation are checked separately, so denied
+	// operations don't stop the others.
+	results, err := c.Batch([]client.Operation{
+		{Kind: "create", Drive: "d2", Path: "denied"},
+		{Kind: "create", Drive: "d1", Path: "allowed"},
+		{Kind: "mkdir", Drive: "d3", Path: "unknown"},
+		{Kind: "move", Drive: "d1", Path: "allowed", Dest: "../escaped"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"no write permissions", "", "no write permissions", "path is invalid"} {
+		if want == "" && results[i].Err != nil || want != "" && (results[i].Err == nil || !strings.Contains(results[i].Err.Error(), want)) {
+			t.Errorf("operation %d: got %v, want %q", i, results[i].Err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "allowed")); err != nil {
+		t.Fatal("allowed operation wasn't applied")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d2", "denied")); !os.IsNotExist(err) {
+		t.Fatal("denied operation was applied")
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+
+	// Empty batches aren't sent, and operations can't contain newlines.
+	if results, err := c.Batch(nil); err != nil || len(results) != 0 {
+		t.Fatalf("results %v: %v", results, err)
+	}
+	if _, err := c.Batch([]client.Operation{{Kind: "create", Drive: "d1", Path: "a\nb"}}); err == nil || !strings.Contains(err.Error(), "newlines") {
+		t.Fatalf("got %v, want a newlines error", err)
+	}
+
+	// Operations must each have four arguments.
+	for _, args := range []string{"", "create\nd1\nfile\n"} {
+		if response := rawRequest(t, s, testAdminKey, "batch", args, nil); !strings.Contains(response, "invalid arguments") {
+			t.Errorf("%q: got %q, want an invalid arguments error", args, response)
+		}
+	}
+}
+
+func TestBatchEnabledCommands(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		enableCommands(s, "read", "batch", "create")
+	})
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "keep"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.Batch([]client.Operation{
+		{Kind: "remove", Drive: "d1", Path: "keep"},
+		{Kind: "move", Drive: "d1", Path: "keep", Dest: "moved"},
+		{Kind: "mkdir", Drive: "d1", Path: "dir"},
+		{Kind: "create", Drive: "d1", Path: "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, op := range []string{"remove", "move", "mkdir"} {
+		if results[i].Err == nil || !strings.Contains(results[i].Err.Error(), "not enabled") {
+			t.Errorf("%s of a batch: got %v, want a disabled command error", op, results[i].Err)
+		}
+	}
+	if results[3].Err != nil {
+		t.Errorf("create of a batch: %v", results[3].Err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "d1", "keep"))
+	if err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Fatal("disabled batch operation was applied")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "dir")); err == nil {
+		t.Fatal("disabled batch operation was applied")
+	}
+}
+
+func TestTransactionEnabledCommands(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		enableCommands(s, "begin", "stage", "stagewrite", "commit", "rollback", "mkdir")
+	})
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "keep"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Remove("keep"); err == nil {
+		t.Error("staged a disabled remove")
+	}
+	if err := txn.Write("new", 4, bytes.NewReader([]byte("data"))); err == nil {
+		t.Error("staged a disabled write")
+	}
+	if err := txn.Mkdir("dir"); err != nil {
+		t.Errorf("failed to stage an enabled mkdir: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "keep")); err != nil {
+		t.Fatal("disabled transaction operation was applied")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "dir")); err != nil {
+		t.Fatal("enabled transaction operation wasn't applied")
+	}
+}
@@ -4,14 +4,32 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cubeflix/deepwell/drive"
 	"github.com/cubeflix/deepwell/protocol"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
-// Ping command.
+// Ping command. Replies with PONG, followed by the compressions the server
+// supports.
 func (s *server) pingCommand(r *request) error {
 	// Consume.
 	if err := r.consume(); err != nil {
@@ -21,11 +39,16 @@ func (s *server) pingCommand(r *request) error {
 		return err
 	}
 
+	// Advertise the compressions we support.
+	if s.compression {
+		return r.sendSuccess("PONG " + protocol.Gzip + "\n")
+	}
 	return r.sendSuccess("PONG\n")
 }
 
-// Drives command.
-func (s *server) drivesCommand(r *request) error {
+// Time command. Replies with the current time of the server in UTC, and in
+// its local time zone with the offset and zone name.
+func (s *server) timeCommand(r *request) error {
 	// Consume.
 	if err := r.consume(); err != nil {
 		return err
@@ -34,80 +57,125 @@ func (s *server) drivesCommand(r *request) error {
 		return err
 	}
 
-	numDrivesStr := strconv.Itoa(len(r.permissions.AllowedDrives))
-	return r.sendSuccess(numDrivesStr + "\n" + strings.Join(r.permissions.AllowedDrives, "\n") + "\n")
+	now := time.Now()
+	zone, _ := now.Zone()
+	return r.sendSuccess(now.UTC().Format(time.RFC3339Nano) + "\n" + now.Format(time.RFC3339Nano) + "\n" + zone + "\n")
 }
 
-// Create command.
-func (s *server) createCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
+// Drives command.
+func (s *server) drivesCommand(r *request) error {
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
-
-	// Get the drive.
-	driveName, err := r.getString()
-	if err != nil {
+	if err := r.consume(); err != nil {
 		return err
 	}
 
-	// Get the path of the file to create.
-	path, err := r.getString()
-	if err != nil {
-		return err
+	// Unhealthy drives are left out until they recover.
+	drives := []string{}
+	for _, name := range r.permissions.Accessible() {
+		if s.DriveHealthy(name) {
+			drives = append(drives, name)
+		}
 	}
 
+	numDrivesStr := strconv.Itoa(len(drives))
+	return r.sendSuccess(numDrivesStr + "\n" + strings.Join(drives, "\n") + "\n")
+}
+
+// Drives info command.
+func (s *server) drivesInfoCommand(r *request) error {
 	// Consume.
 	if err := r.consume(); err != nil {
 		return err
 	}
-
-	if !r.permissions.CanWrite {
-		err := r.sendError("no write permissions")
-		if err != nil {
-			return err
-		}
-		return nil
+	if err := r.consume(); err != nil {
+		return err
 	}
 
-	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
-	if err != nil {
-		err = r.sendError(err.Error())
+	// Describe each drive: its name, type, if it is writable, its quota, its
+	// usage, and if it is available. The usage of unavailable drives is
+	// unknown, so it is reported as zero. The drives are only described, so
+	// the request is logged once rather than as an access to each drive.
+	accessible := r.permissions.Accessible()
+	info := strconv.Itoa(len(accessible)) + "\n"
+	for _, name := range accessible {
+		drive, ok := s.drives[name]
+		if !ok {
+			err := r.sendError(fmt.Sprintf("drive not allowed: %s", name))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if !s.DriveHealthy(name) {
+			info += name + "\n" + drive.Type() + "\n" + strconv.FormatBool(r.permissions.CanWriteDrive(name) && !s.DriveReadOnly(name)) + "\n" + strconv.FormatInt(drive.Quota(), 10) + "\n0\nfalse\n"
+			continue
+		}
+		usage, err := drive.TotalUsage()
 		if err != nil {
-			return err
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
 		}
-		return nil
+		info += name + "\n" + drive.Type() + "\n" + strconv.FormatBool(r.permissions.CanWriteDrive(name) && !s.DriveReadOnly(name)) + "\n" + strconv.FormatInt(drive.Quota(), 10) + "\n" + strconv.FormatInt(usage, 10) + "\ntrue\n"
 	}
 
-	// Attempt to create the file.
-	err = drive.Create(path)
-	if err != nil {
-		err = r.sendError(err.Error())
-		if err != nil {
-			return err
-		}
-		return nil
+	s.logCommand(r, "", "drives", len(accessible))
+	return r.sendSuccess(info)
+}
+
+// Load command. Reports the queued requests and the queue size, the busy
+// workers and the number of workers, the average requests per second, and
+// the suggested backoff in milliseconds, zero if the server isn't overloaded.
+func (s *server) loadCommand(r *request) error {
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+	if err := r.consume(); err != nil {
+		return err
 	}
 
-	s.info.Println("create", path)
+	queued := len(s.jobs)
+	busy := s.load.busy()
+	rate := s.load.rate(time.Now())
+	backoff := s.backoff(queued, busy)
 
-	return r.sendSuccess("")
+	return r.sendSuccess(strconv.Itoa(queued) + "\n" + strconv.Itoa(cap(s.jobs)) + "\n" + strconv.Itoa(busy) + "\n" + strconv.Itoa(s.workerCount()) + "\n" + strconv.FormatFloat(rate, 'f', 2, 64) + "\n" + strconv.FormatInt(backoff.Milliseconds(), 10) + "\n")
 }
 
-// Mkdir command.
-func (s *server) mkdirCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
+// Status command. Replies with the uptime of the server in milliseconds, the
+// number of workers, the number of busy workers, the number of queued
+// requests, the number of drives, and the number of unhealthy drives. It
+// needs no authentication, so load balancers can probe it cheaply.
+func (s *server) statusCommand(r *request) error {
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
-
-	// Get the drive.
-	driveName, err := r.getString()
-	if err != nil {
+	if err := r.consume(); err != nil {
 		return err
 	}
 
-	// Get the path of the directory to create.
-	path, err := r.getString()
+	unhealthy := 0
+	for name := range s.drives {
+		if !s.DriveHealthy(name) {
+			unhealthy++
+		}
+	}
+	uptime := time.Since(s.started)
+
+	return r.sendSuccess(strconv.FormatInt(uptime.Milliseconds(), 10) + "\n" + strconv.Itoa(s.workerCount()) + "\n" + strconv.Itoa(s.load.busy()) + "\n" + strconv.Itoa(len(s.jobs)) + "\n" + strconv.Itoa(len(s.drives)) + "\n" + strconv.Itoa(unhealthy) + "\n")
+}
+
+// Set drive read-only command. Only admin keys may use it.
+func (s *server) setDriveReadOnlyCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
 	if err != nil {
 		return err
 	}
@@ -117,27 +185,33 @@ func (s *server) mkdirCommand(r *request) error {
 		return err
 	}
 
-	if !r.permissions.CanWrite {
-		err := r.sendError("no write permissions")
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
-	if err != nil {
-		err = r.sendError(err.Error())
+	if !r.permissions.IsAdmin {
+		err := r.sendDenied(s, "no admin permissions", args[0], "")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	// Attempt to create the directory.
-	err = drive.CreateDirectory(path)
+	readOnly, err := strconv.ParseBool(args[1])
 	if err != nil {
+		err = r.sendError(fmt.Sprintf("invalid value: %s", args[1]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Set the flag.
+	if err := s.SetDriveReadOnly(args[0], readOnly); err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
 			return err
@@ -145,25 +219,16 @@ func (s *server) mkdirCommand(r *request) error {
 		return nil
 	}
 
-	s.info.Println("mkdir", path)
+	s.logCommand(r, "", "drive", args[0], "readonly", readOnly)
 
 	return r.sendSuccess("")
 }
 
-// Read command.
-func (s *server) readCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
-		return err
-	}
-
-	// Get the drive.
-	driveName, err := r.getString()
-	if err != nil {
-		return err
-	}
-
-	// Get the path of the file to read.
-	path, err := r.getString()
+// Drop cache command. Drops the caches of a drive. Only admin keys may use
+// it.
+func (s *server) dropCacheCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
 	if err != nil {
 		return err
 	}
@@ -173,61 +238,74 @@ func (s *server) readCommand(r *request) error {
 		return err
 	}
 
-	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
-	if err != nil {
-		err = r.sendError(err.Error())
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	// Get the size of the data and ensure it is a file.
-	stat, err := drive.Stat(path)
-	if err != nil {
-		err = r.sendError(err.Error())
+	if !r.permissions.IsAdmin {
+		err := r.sendDenied(s, "no admin permissions", args[0], "")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
-	if stat.IsDir() {
-		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+
+	// Drop the caches.
+	if err := s.DropCache(args[0]); err != nil {
+		err = r.sendError(err.Error())
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	s.info.Println("read", path)
+	s.logCommand(r, "", "drive", args[0])
 
-	if err := r.sendString(protocol.Header); err != nil {
-		return err
-	}
-	if err := r.sendString("SUCCESS"); err != nil {
+	return r.sendSuccess("")
+}
+
+// Sessions command. Only admin keys may use it.
+func (s *server) sessionsCommand(r *request) error {
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
-	if err := r.sendString(strconv.FormatInt(stat.Size(), 10)); err != nil {
+	if err := r.consume(); err != nil {
 		return err
 	}
-	return drive.Read(path, r.writer)
-}
 
-// List directory command.
-func (s *server) listCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
-		return err
+	if !r.permissions.IsAdmin {
+		err := r.sendDenied(s, "no admin permissions", "", "")
+		if err != nil {
+			return err
+		}
+		return nil
 	}
 
-	// Get the drive.
-	driveName, err := r.getString()
-	if err != nil {
-		return err
+	// Describe each session: its ID, the IP address of the client, the hash
+	// of its key, its command, the bytes read and written, and its duration
+	// in milliseconds.
+	sessions := s.sessions.list()
+	now := time.Now()
+	info := strconv.Itoa(len(sessions)) + "\n"
+	for _, sess := range sessions {
+		info += strconv.FormatUint(sess.id, 10) + "\n" + sess.ip + "\n" + sess.key + "\n" + sess.command + "\n" +
+			strconv.FormatInt(sess.r.writer.BytesRead(), 10) + "\n" + strconv.FormatInt(sess.r.writer.BytesWritten(), 10) + "\n" +
+			strconv.FormatInt(now.Sub(sess.start).Milliseconds(), 10) + "\n"
 	}
 
-	// Get the path of the directory to list.
-	path, err := r.getString()
+	return r.sendSuccess(info)
+}
+
+// Kill command. Forcibly closes the connection of a session. Only admin keys
+// may use it.
+func (s *server) killCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
 	if err != nil {
 		return err
 	}
@@ -237,41 +315,47 @@ func (s *server) listCommand(r *request) error {
 		return err
 	}
 
-	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
-	if err != nil {
-		err = r.sendError(err.Error())
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	items, err := drive.ReadDir(path)
+	if !r.permissions.IsAdmin {
+		err := r.sendDenied(s, "no admin permissions", "", "")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
 	if err != nil {
-		err = r.sendError(err.Error())
+		err = r.sendError(fmt.Sprintf("invalid session ID: %s", args[0]))
 		if err != nil {
 			return err
 		}
 		return nil
 	}
-	numItemsStr := strconv.Itoa(len(items))
-	text := ""
-	for i := range items {
-		if items[i].IsDir() {
-			text += "d " + items[i].Name() + "\n"
-		} else {
-			text += "f " + items[i].Name() + "\n"
+
+	// Close the connection of the session.
+	if !s.sessions.kill(id) {
+		err = r.sendError(fmt.Sprintf("session does not exist: %d", id))
+		if err != nil {
+			return err
 		}
+		return nil
 	}
 
-	s.info.Println("list", path)
+	s.logCommand(r, "", "session", id)
 
-	return r.sendSuccess(numItemsStr + "\n" + text)
+	return r.sendSuccess("")
 }
 
-// Stat command.
-func (s *server) statCommand(r *request) error {
+// Create command.
+func (s *server) createCommand(r *request) error {
 	if _, err := r.getString(); err != nil {
 		return err
 	}
@@ -282,7 +366,7 @@ func (s *server) statCommand(r *request) error {
 		return err
 	}
 
-	// Get the path.
+	// Get the path of the file to create.
 	path, err := r.getString()
 	if err != nil {
 		return err
@@ -293,8 +377,16 @@ func (s *server) statCommand(r *request) error {
 		return err
 	}
 
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
 	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
+	drive, err := r.getWritableDrive(driveName, s, path)
 	if err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
@@ -303,7 +395,8 @@ func (s *server) statCommand(r *request) error {
 		return nil
 	}
 
-	stat, err := drive.Stat(path)
+	// Attempt to create the file.
+	err = drive.Create(path)
 	if err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
@@ -312,127 +405,236 @@ func (s *server) statCommand(r *request) error {
 		return nil
 	}
 
-	s.info.Println("stat", path)
+	s.logCommand(r, path)
 
-	if stat.IsDir() {
-		return r.sendSuccess("d\n")
-	} else {
-		return r.sendSuccess("f " + strconv.FormatInt(stat.Size(), 10) + "\n")
-	}
+	return r.sendSuccess("")
 }
 
-// Write command.
-func (s *server) writeCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
-		return err
-	}
-
-	// Get the drive.
-	driveName, err := r.getString()
+// Create sized command.
+func (s *server) createSizedCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
 	if err != nil {
 		return err
 	}
 
-	// Get the path of the file to write.
-	path, err := r.getString()
-	if err != nil {
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
 
-	if !r.permissions.CanWrite {
-		// Consume.
-		err2 := r.consume()
-		if err2 != nil {
-			return err2
-		}
-
-		err := r.sendError("no write permissions")
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
+	driveName, path := args[0], args[1]
 
-	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
-	if err != nil {
-		// Consume.
-		err2 := r.consume()
-		if err2 != nil {
-			return err2
-		}
-
-		err2 = r.sendError(err.Error())
-		if err2 != nil {
-			return err2
+	// Get the size of the file.
+	size, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || size < 0 {
+		err = r.sendError(fmt.Sprintf("invalid size: %s", args[2]))
+		if err != nil {
+			return err
 		}
 		return nil
 	}
 
-	// Ensure it is a file.
-	stat, err := drive.Stat(path)
-	if err != nil {
-		// Consume.
-		err2 := r.consume()
-		if err2 != nil {
-			return err2
-		}
-
-		err2 = r.sendError(err.Error())
-		if err2 != nil {
-			return err2
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
 		}
 		return nil
 	}
-	if stat.IsDir() {
-		// Consume.
-		err = r.consume()
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
 		if err != nil {
 			return err
 		}
+		return nil
+	}
 
-		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, driveName, path, size); err != nil {
+		err = r.sendError(err.Error())
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	// Read the size of the data.
-	lenStr, err := r.getString()
-	if err != nil {
-		return err
-	}
-	len, err := strconv.ParseInt(lenStr, 0, 64)
+	// Attempt to create the file.
+	err = drive.CreateSized(path, size)
 	if err != nil {
-		return err
-	}
-
-	// Write
-	if err := drive.Write(path, r.reader, len); err != nil {
-		return err
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
 	}
+	s.recordKeyUsage(r, drive, driveName, path)
 
-	s.info.Println("write", path)
+	s.logCommand(r, path, "size", size)
 
 	return r.sendSuccess("")
 }
 
-// Remove command.
-func (s *server) removeCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
+// Createtemp command.
+func (s *server) createTempCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
 		return err
 	}
 
-	// Get the drive.
-	driveName, err := r.getString()
-	if err != nil {
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
 
-	// Get the path to remove.
-	path, err := r.getString()
-	if err != nil {
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, dir, pattern := args[0], args[1], args[2]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, dir)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Attempt to create the file.
+	path, err := drive.CreateTemp(dir, pattern)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess(path + "\n")
+}
+
+// The maximum size of the expected and new contents of a cas command.
+const maxCASSize = 1 << 20
+
+// Cas command. The data is the expected contents followed by the new
+// contents, split at the length of the expected contents.
+func (s *server) casCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Get the expected and new contents.
+	data, err := r.getData(maxCASSize)
+	if err == errDataTooLarge {
+		err = r.sendError(fmt.Sprintf("contents too large, the maximum is %d bytes", maxCASSize))
+		if err != nil {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Split the contents.
+	expectedSize, err := strconv.Atoi(args[2])
+	if err != nil || expectedSize < 0 || expectedSize > len(data) {
+		err = r.sendError(fmt.Sprintf("invalid size: %s", args[2]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	expected, new := data[:expectedSize], data[expectedSize:]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, driveName, path, int64(len(new))); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Attempt to swap the contents.
+	swapped, err := drive.CompareAndSwap(path, expected, new)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if swapped {
+		s.recordKeyUsage(r, drive, driveName, path)
+	}
+
+	s.logCommand(r, path, "swapped", swapped)
+
+	return r.sendSuccess(strconv.FormatBool(swapped) + "\n")
+}
+
+// Mkdir command. Optionally takes whether creating a directory which already
+// exists succeeds.
+func (s *server) mkdirCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
 		return err
 	}
 
@@ -441,8 +643,28 @@ func (s *server) removeCommand(r *request) error {
 		return err
 	}
 
-	if !r.permissions.CanWrite {
-		err := r.sendError("no write permissions")
+	if len(args) != 2 && len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+	existOK := false
+	if len(args) == 3 {
+		existOK, err = strconv.ParseBool(args[2])
+		if err != nil {
+			err = r.sendError(fmt.Sprintf("invalid value: %s", args[2]))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
 		if err != nil {
 			return err
 		}
@@ -450,7 +672,7 @@ func (s *server) removeCommand(r *request) error {
 	}
 
 	// Get the drive.
-	drive, err := r.getDrive(driveName, s)
+	drive, err := r.getWritableDrive(driveName, s, path)
 	if err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
@@ -459,8 +681,14 @@ func (s *server) removeCommand(r *request) error {
 		return nil
 	}
 
-	// Attempt to remove the path.
-	err = drive.Remove(path)
+	// Attempt to create the directory. If the directory may already exist,
+	// only fail if the path isn't a directory.
+	err = drive.CreateDirectory(path)
+	if err != nil && existOK {
+		if stat, statErr := drive.Stat(path); statErr == nil && stat.IsDir() {
+			err = nil
+		}
+	}
 	if err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
@@ -469,31 +697,206 @@ func (s *server) removeCommand(r *request) error {
 		return nil
 	}
 
-	s.info.Println("remove", path)
+	s.logCommand(r, path)
 
 	return r.sendSuccess("")
 }
 
-// Move command.
-func (s *server) moveCommand(r *request) error {
-	if _, err := r.getString(); err != nil {
+// Read command. Optionally takes an offset and length to read a byte range.
+func (s *server) readCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
 		return err
 	}
 
+	if len(args) < 2 || len(args) > 4 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the encoding to transcode the file to.
+	var enc encoding.Encoding
+	if len(args) == 3 {
+		enc, err = getEncoding(args[2])
+		if err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// Get the byte range.
+	ranged := len(args) == 4
+	offset, length := int64(0), int64(0)
+	if ranged {
+		offset, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || offset < 0 {
+			err = r.sendError(fmt.Sprintf("invalid offset: %s", args[2]))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		length, err = strconv.ParseInt(args[3], 10, 64)
+		if err != nil || length < 0 {
+			err = r.sendError(fmt.Sprintf("invalid length: %s", args[3]))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
 	// Get the drive.
-	driveName, err := r.getString()
+	drive, err := r.getDrive(driveName, s)
 	if err != nil {
-		return err
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
 	}
 
-	// Get the source path.
-	src, err := r.getString()
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the size of the data and ensure it is a file.
+	stat, err := drive.Stat(path)
 	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Clamp the range to the available data.
+	if ranged {
+		if offset > stat.Size() {
+			offset = stat.Size()
+		}
+		if length > stat.Size()-offset {
+			length = stat.Size() - offset
+		}
+	} else {
+		length = stat.Size()
+	}
+
+	s.logCommand(r, path)
+
+	// Transcode the file.
+	if enc != nil {
+		if length > maxTranscodeSize {
+			err = r.sendError(fmt.Sprintf("too large to transcode: %s", path))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		buf := &bytes.Buffer{}
+		writer := transform.NewWriter(buf, enc.NewEncoder())
+		err := drive.Read(path, writer)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+
+		if err := r.sendString(protocol.Header); err != nil {
+			return err
+		}
+		if err := r.sendString("SUCCESS"); err != nil {
+			return err
+		}
+		if err := r.sendString(strconv.Itoa(buf.Len())); err != nil {
+			return err
+		}
+		_, err = r.writer.Write(buf.Bytes())
 		return err
 	}
 
-	// Get the destination path.
-	dest, err := r.getString()
+	// Compress the data if the client asked for it and it is worth
+	// compressing.
+	if s.compression && r.flags[protocol.CompressionFlag] == protocol.Gzip && length >= protocol.MinCompressSize && length <= protocol.MaxCompressSize {
+		buf := &bytes.Buffer{}
+		if err := drive.ReadRange(path, buf, offset, length); err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		lengthLine := strconv.Itoa(buf.Len())
+		data := buf.Bytes()
+		if compressed, ok := protocol.Compress(data); ok {
+			lengthLine = protocol.FormatCompressedLength(int64(len(compressed)), int64(len(data)))
+			data = compressed
+		}
+
+		if err := r.sendString(protocol.Header); err != nil {
+			return err
+		}
+		if err := r.sendString("SUCCESS"); err != nil {
+			return err
+		}
+		if err := r.sendString(lengthLine); err != nil {
+			return err
+		}
+		_, err = r.writer.Write(data)
+		return err
+	}
+
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	if err := r.sendString(strconv.FormatInt(length, 10)); err != nil {
+		return err
+	}
+	if ranged {
+		return drive.ReadRange(path, r.writer, offset, length)
+	}
+	return drive.Read(path, r.writer)
+}
+
+// Chunked read command. After the response header, the client requests each
+// chunk of the file with a NEXT line, giving it control over the rate at which
+// data is sent. Each chunk is sent prefixed with its length, and a zero length
+// chunk marks the end of the file. The client may stop early with a DONE line.
+func (s *server) readChunksCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
 	if err != nil {
 		return err
 	}
@@ -503,13 +906,14 @@ func (s *server) moveCommand(r *request) error {
 		return err
 	}
 
-	if !r.permissions.CanWrite {
-		err := r.sendError("no write permissions")
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
 		if err != nil {
 			return err
 		}
 		return nil
 	}
+	driveName, path := args[0], args[1]
 
 	// Get the drive.
 	drive, err := r.getDrive(driveName, s)
@@ -521,8 +925,2986 @@ func (s *server) moveCommand(r *request) error {
 		return nil
 	}
 
-	// Attempt to move the paths.
-	err = drive.Move(src, dest)
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the size of the data and ensure it is a file.
+	stat, err := drive.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	if err := r.sendString(strconv.FormatInt(stat.Size(), 10)); err != nil {
+		return err
+	}
+
+	// Send each chunk as it is requested.
+	offset := int64(0)
+	for {
+		line, err := r.getString()
+		if err != nil {
+			return err
+		}
+		if line != "NEXT" {
+			return nil
+		}
+
+		length := stat.Size() - offset
+		if length > int64(protocol.ChunkSize) {
+			length = int64(protocol.ChunkSize)
+		}
+		if err := r.sendString(strconv.FormatInt(length, 10)); err != nil {
+			return err
+		}
+		if length == 0 {
+			return nil
+		}
+		if err := drive.ReadRange(path, r.writer, offset, length); err != nil {
+			return err
+		}
+		offset += length
+	}
+}
+
+// The maximum total size of the files returned by a readmany command.
+const maxReadManySize = 64 << 20
+
+// Read many command. Takes the drive, the maximum size of each file, and the
+// paths of the files to read. Each file is returned framed with its path and
+// either "ok" and its length followed by its contents, or "error" and the
+// error reading it, so one missing file doesn't fail the rest.
+func (s *server) readManyCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) < 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, paths := args[0], args[2:]
+	maxSize, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || maxSize < 0 {
+		err = r.sendError(fmt.Sprintf("invalid size: %s", args[1]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, "")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, "", "files", len(paths))
+
+	// Read each file, reporting errors inline.
+	body := &bytes.Buffer{}
+	for _, path := range paths {
+		data, err := readManyFile(drive, path, maxSize, maxReadManySize-int64(body.Len()))
+		if err != nil {
+			body.WriteString(path + "\nerror " + err.Error() + "\n")
+			continue
+		}
+		body.WriteString(path + "\nok " + strconv.Itoa(len(data)) + "\n")
+		body.Write(data)
+	}
+
+	return r.sendSuccess(body.String())
+}
+
+// Read a file for a readmany command, if it is no larger than the maximum
+// size and the space left in the response.
+func readManyFile(d drive.Drive, path string, maxSize, left int64) ([]byte, error) {
+	stat, err := d.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, errors.New(fmt.Sprintf("cannot be read: %s", path))
+	}
+	if stat.Size() > maxSize || stat.Size() > left {
+		return nil, errors.New(fmt.Sprintf("too large: %s", path))
+	}
+	buf := &bytes.Buffer{}
+	if err := d.ReadRange(path, buf, 0, stat.Size()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// List directory command.
+func (s *server) listCommand(r *request) error {
+	return s.list(r, func(item os.DirEntry) (string, error) {
+		if item.IsDir() {
+			return "d " + item.Name() + "\n", nil
+		}
+		return "f " + item.Name() + "\n", nil
+	})
+}
+
+// A directory entry sent by the list JSON command.
+type jsonEntry struct {
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+// List directory JSON command. Each entry is sent as a JSON object on its own
+// line, so names are escaped and may contain any character.
+func (s *server) listJSONCommand(r *request) error {
+	return s.list(r, func(item os.DirEntry) (string, error) {
+		info, err := item.Info()
+		if err != nil {
+			return "", err
+		}
+		entry := jsonEntry{Name: item.Name(), Type: "file", MTime: info.ModTime().UTC()}
+		if item.IsDir() {
+			entry.Type = "dir"
+		} else {
+			entry.Size = info.Size()
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return "", err
+		}
+		return string(line) + "\n", nil
+	})
+}
+
+// List a directory, sending the number of entries followed by each entry in
+// a format.
+func (s *server) list(r *request, format func(item os.DirEntry) (string, error)) error {
+	// Get the arguments: the drive, the path of the directory to list, and
+	// optionally a glob pattern to filter the entries by.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Check the pattern.
+	pattern := ""
+	if len(args) == 3 {
+		pattern = args[2]
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			err = r.sendError(fmt.Sprintf("invalid pattern: %s", pattern))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	items, err := drive.ReadDir(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	numItems := 0
+	text := ""
+	for i := range items {
+		// Filter the entries by the pattern.
+		if pattern != "" {
+			if ok, _ := filepath.Match(pattern, items[i].Name()); !ok {
+				continue
+			}
+		}
+
+		entry, err := format(items[i])
+		if err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		numItems++
+		text += entry
+	}
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess(strconv.Itoa(numItems) + "\n" + text)
+}
+
+// Stat command.
+func (s *server) statCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the path.
+	path, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	d, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	stat, err := d.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	// Report the owner of the path, if the platform supports ownership.
+	owner := ""
+	if uid, gid, ok := drive.Owner(stat); ok {
+		owner = " " + strconv.Itoa(uid) + " " + strconv.Itoa(gid)
+	}
+
+	mtime := " " + strconv.FormatInt(stat.ModTime().Unix(), 10)
+	if stat.IsDir() {
+		return r.sendSuccess("d" + mtime + owner + "\n")
+	} else {
+		return r.sendSuccess("f " + strconv.FormatInt(stat.Size(), 10) + mtime + owner + "\n")
+	}
+}
+
+// Write command.
+func (s *server) writeCommand(r *request) error {
+	// Get the arguments: the drive, the path of the file to write, and
+	// optionally the encoding of the data.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 && len(args) != 3 {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the encoding to transcode the data from.
+	var enc encoding.Encoding
+	if len(args) == 3 {
+		enc, err = getEncoding(args[2])
+		if err != nil {
+			// Consume.
+			err2 := r.consume()
+			if err2 != nil {
+				return err2
+			}
+
+			err2 = r.sendError(err.Error())
+			if err2 != nil {
+				return err2
+			}
+			return nil
+		}
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+
+	// Ensure it is a file.
+	stat, err := drive.Stat(path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+	if stat.IsDir() {
+		// Consume.
+		err = r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Read the size of the data. Compressed data is only accepted if
+	// compression is enabled.
+	lenStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	length, len, compressed, err := protocol.ParseLength(lenStr)
+	if err != nil {
+		return err
+	}
+	if compressed && !s.compression {
+		return errors.New("compression is not enabled")
+	}
+
+	// The data as it was sent, and the data to write, decompressed if it was
+	// compressed.
+	raw := io.LimitReader(r.reader, length)
+	payload := raw
+	if compressed {
+		payload, err = gzip.NewReader(raw)
+		if err != nil {
+			return r.sendWriteError(raw, err)
+		}
+	}
+
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, driveName, path, len); err != nil {
+		return r.sendWriteError(raw, err)
+	}
+
+	// Transcode the data to UTF-8.
+	if enc != nil {
+		if len > maxTranscodeSize {
+			return r.sendWriteError(raw, errors.New(fmt.Sprintf("too large to transcode: %s", path)))
+		}
+		data, err := io.ReadAll(enc.NewDecoder().Reader(io.LimitReader(payload, len)))
+		if err != nil {
+			return r.sendWriteError(raw, err)
+		}
+		if _, err := io.Copy(io.Discard, raw); err != nil {
+			return err
+		}
+
+		// Write
+		reader := bytes.NewReader(data)
+		if err := drive.Write(path, reader, reader.Size()); err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		s.recordKeyUsage(r, drive, driveName, path)
+
+		s.logCommand(r, path)
+
+		hash := sha256.Sum256(data)
+		return r.sendSuccess("sha256 " + hex.EncodeToString(hash[:]) + "\n")
+	}
+
+	// Write, hashing the data as it is received.
+	hash := sha256.New()
+	data := io.LimitReader(payload, len)
+	if err := drive.Write(path, io.TeeReader(data, hash), len); err != nil {
+		return r.sendWriteError(raw, err)
+	}
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return err
+	}
+	s.recordKeyUsage(r, drive, driveName, path)
+
+	s.logCommand(r, path)
+
+	// Send the checksum of the data.
+	return r.sendSuccess("sha256 " + hex.EncodeToString(hash.Sum(nil)) + "\n")
+}
+
+// Write at command.
+func (s *server) writeAtCommand(r *request) error {
+	// Get the arguments: the drive, the path of the file to write, and the
+	// offset to write at.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+	if len(args) != 3 {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+	offset, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || offset < 0 {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError(fmt.Sprintf("invalid offset: %s", args[2]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+
+	// Ensure it is a file.
+	stat, err := drive.Stat(path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+	if stat.IsDir() {
+		// Consume.
+		err = r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError(fmt.Sprintf("cannot be written: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Read the size of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	len, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	if len < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", len))
+	}
+
+	// Check the quota of the key against the size of the file once written.
+	newSize := stat.Size()
+	if offset+len > newSize {
+		newSize = offset + len
+	}
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, driveName, path, newSize); err != nil {
+		if _, err := io.CopyN(io.Discard, r.reader, len); err != nil {
+			return err
+		}
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Write, hashing the data as it is received.
+	hash := sha256.New()
+	data := io.LimitReader(r.reader, len)
+	if err := drive.WriteAt(path, offset, io.TeeReader(data, hash), len); err != nil {
+		return r.sendWriteError(data, err)
+	}
+	s.recordKeyUsage(r, drive, driveName, path)
+
+	s.logCommand(r, path, "offset", offset)
+
+	// Send the checksum of the data.
+	return r.sendSuccess("sha256 " + hex.EncodeToString(hash.Sum(nil)) + "\n")
+}
+
+// Append command.
+func (s *server) appendCommand(r *request) error {
+	// Get the arguments: the drive and the path of the file to append to.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+
+	// Ensure it isn't a directory. Files which don't exist are created.
+	size := int64(0)
+	if stat, err := drive.Stat(path); err == nil && stat.IsDir() {
+		// Consume.
+		err = r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError(fmt.Sprintf("cannot be written: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	} else if err == nil {
+		size = stat.Size()
+	}
+
+	// Read the size of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	len, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	if len < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", len))
+	}
+
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, driveName, path, size+len); err != nil {
+		if _, err := io.CopyN(io.Discard, r.reader, len); err != nil {
+			return err
+		}
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Append, hashing the data as it is received.
+	hash := sha256.New()
+	data := io.LimitReader(r.reader, len)
+	if err := drive.Append(path, io.TeeReader(data, hash), len); err != nil {
+		return r.sendWriteError(data, err)
+	}
+	s.recordKeyUsage(r, drive, driveName, path)
+
+	s.logCommand(r, path)
+
+	// Send the checksum of the data.
+	return r.sendSuccess("sha256 " + hex.EncodeToString(hash.Sum(nil)) + "\n")
+}
+
+// Remove command.
+func (s *server) removeCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the path to remove.
+	path, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Attempt to remove the path.
+	err = drive.Remove(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.forgetKeyUsage(driveName, path)
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess("")
+}
+
+// The default number of paths removed in each batch by removetree.
+const defaultRemoveTreeBatch = 100
+
+// Collect the paths under a directory, including the directory itself, with
+// each directory after its contents.
+func collectTree(ctx context.Context, d drive.Drive, path string) ([]string, error) {
+	paths := []string{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		items, err := d.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			itemPath := filepath.Join(dir, items[i].Name())
+			if items[i].IsDir() {
+				if err := walk(itemPath); err != nil {
+					return err
+				}
+			}
+
+			// Cap the size of the walk.
+			paths = append(paths, itemPath)
+			if len(paths) > drive.MaxWalkEntries {
+				return errors.New("too many entries")
+			}
+		}
+		return nil
+	}
+	if err := walk(path); err != nil {
+		return nil, err
+	}
+	return append(paths, path), nil
+}
+
+// Remove tree command. The server replies with the number of paths to remove
+// and a confirmation token, which the client must echo back to proceed. The
+// paths are then removed in batches, limited to the configured rate, with a
+// progress event sent after each batch. The result is empty, and a mismatched
+// token fails the removal. An interrupted removal can be resumed by removing
+// the tree again.
+func (s *server) removeTreeCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	d, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ensure it is a directory.
+	stat, err := d.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("not a directory: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Collect the paths to remove.
+	paths, err := collectTree(r.ctx, d, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Send the count and the confirmation token.
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	if err := r.sendString(strconv.Itoa(len(paths))); err != nil {
+		return err
+	}
+	if err := r.sendString(token); err != nil {
+		return err
+	}
+
+	// Wait for the confirmation.
+	confirmation, err := r.getString()
+	if err != nil {
+		return err
+	}
+	if confirmation != token {
+		return r.sendProgressError("removal cancelled")
+	}
+	defer r.watchDisconnect()()
+
+	s.logCommand(r, path, "removed", len(paths))
+
+	// Remove the paths in batches.
+	batchSize, rate := s.RemoveTreeLimits()
+	if batchSize <= 0 {
+		batchSize = defaultRemoveTreeBatch
+	}
+	start := time.Now()
+	for i := range paths {
+		// Stop if the client has gone away.
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := d.Remove(paths[i]); err != nil {
+			return r.sendProgressError(err.Error())
+		}
+		s.forgetKeyUsage(driveName, paths[i])
+
+		removed := i + 1
+		if removed%batchSize != 0 && removed != len(paths) {
+			continue
+		}
+		if err := r.sendProgress(protocol.Progress{Done: int64(removed), Total: int64(len(paths)), Item: paths[i]}); err != nil {
+			return err
+		}
+
+		// Wait until the rate allows the next batch.
+		if rate > 0 && removed != len(paths) {
+			wait := time.Duration(removed)*time.Second/time.Duration(rate) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-r.ctx.Done():
+					return r.ctx.Err()
+				}
+			}
+		}
+	}
+
+	return r.sendProgressResult("")
+}
+
+// Move command.
+func (s *server) moveCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the source path.
+	src, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the destination path.
+	dest, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, src)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, src, dest)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Attempt to move the paths.
+	err = drive.Move(src, dest)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.moveKeyUsage(driveName, src, dest)
+
+	s.logCommand(r, src, "dest", dest)
+
+	return r.sendSuccess("")
+}
+
+// Move across drives command. Moves a file from one drive to another by
+// copying it to a temporary file next to the destination, verifying it, and
+// renaming it into place, before removing the source. Moves within a drive
+// are regular moves.
+func (s *server) moveCrossDriveCommand(r *request) error {
+	// Get the arguments: the source drive and path, and the destination drive
+	// and path.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 4 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	srcDriveName, src, destDriveName, dest := args[0], args[1], args[2], args[3]
+
+	if !r.permissions.CanWriteDrive(srcDriveName) {
+		err := r.sendDenied(s, "no write permissions", srcDriveName, src)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if srcDriveName != destDriveName && !r.permissions.CanReadDrive(srcDriveName) {
+		err := r.sendDenied(s, "no read permissions", srcDriveName, src)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !r.permissions.CanWriteDrive(destDriveName) {
+		err := r.sendDenied(s, "no write permissions", destDriveName, dest)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drives.
+	srcDrive, err := r.getWritableDrive(srcDriveName, s, src)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	destDrive, err := r.getWritableDrive(destDriveName, s, dest)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Move the file.
+	if srcDriveName == destDriveName {
+		err = srcDrive.Move(src, dest)
+	} else {
+		err = s.moveAcrossDrives(r, srcDrive, src, destDrive, destDriveName, dest)
+	}
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if srcDriveName == destDriveName {
+		s.moveKeyUsage(srcDriveName, src, dest)
+	} else {
+		s.forgetKeyUsage(srcDriveName, src)
+	}
+
+	s.logCommand(r, src, "drive", srcDriveName, "dest_drive", destDriveName, "dest", dest)
+
+	return r.sendSuccess("")
+}
+
+// Move a file from one drive to another. The file is copied to a temporary
+// file next to the destination, verified, and renamed into place without
+// replacing a destination created meanwhile, so the destination never holds a
+// partial copy. The source is removed last.
+func (s *server) moveAcrossDrives(r *request, srcDrive drive.Drive, src string, destDrive drive.Drive, destDriveName, dest string) error {
+	// Ensure the source is a file, and the destination doesn't exist.
+	stat, err := srcDrive.Stat(src)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return errors.New(fmt.Sprintf("cannot move a directory across drives: %s", src))
+	}
+	if _, err := destDrive.Stat(dest); err == nil {
+		return errors.New(fmt.Sprintf("path already exists: %s", dest))
+	}
+	if err := s.checkKeyQuota(r, destDriveName, dest, stat.Size()); err != nil {
+		return err
+	}
+
+	// Copy the file to a temporary file.
+	temp, err := destDrive.CreateTemp(filepath.Dir(filepath.Clean(dest)), "."+filepath.Base(dest)+".move-*")
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(srcDrive.ReadRange(src, writer, 0, stat.Size()))
+	}()
+	err = destDrive.Write(temp, reader, stat.Size())
+	reader.Close()
+	if err != nil {
+		destDrive.Remove(temp)
+		return err
+	}
+
+	// Verify the copy, then rename it into place.
+	srcChecksum, err := srcDrive.Checksum(src)
+	if err != nil {
+		destDrive.Remove(temp)
+		return err
+	}
+	tempChecksum, err := destDrive.Checksum(temp)
+	if err != nil {
+		destDrive.Remove(temp)
+		return err
+	}
+	if srcChecksum != tempChecksum {
+		destDrive.Remove(temp)
+		return errors.New(fmt.Sprintf("checksum mismatch moving %s to %s", src, dest))
+	}
+	if err := destDrive.MoveNoReplace(temp, dest); err != nil {
+		destDrive.Remove(temp)
+		return err
+	}
+
+	// The file is now on both drives, so a failure to remove the source is
+	// reported as a partial move.
+	s.recordKeyUsage(r, destDrive, destDriveName, dest)
+	if err := srcDrive.Remove(src); err != nil {
+		return errors.New(fmt.Sprintf("moved to %s, but failed to remove the source: %s", dest, err.Error()))
+	}
+	return nil
+}
+
+// Copy command.
+func (s *server) copyCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the source path.
+	src, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the destination path.
+	dest, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, src)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, src, dest)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Check the quota of the key.
+	if stat, err := drive.Stat(src); err == nil {
+		if err := s.checkKeyQuota(r, driveName, dest, stat.Size()); err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// Attempt to copy the file. With progress events, an event is sent
+	// before and after the copy.
+	if r.wantsProgress() {
+		size := int64(0)
+		if stat, err := drive.Stat(src); err == nil {
+			size = stat.Size()
+		}
+		if err := r.sendString(protocol.Header); err != nil {
+			return err
+		}
+		if err := r.sendString("SUCCESS"); err != nil {
+			return err
+		}
+		if err := r.sendProgress(protocol.Progress{Total: size, Item: src}); err != nil {
+			return err
+		}
+		if err := drive.Copy(src, dest); err != nil {
+			return r.sendProgressError(err.Error())
+		}
+		s.recordKeyUsage(r, drive, driveName, dest)
+		s.logCommand(r, src, "dest", dest)
+		if err := r.sendProgress(protocol.Progress{Done: size, Total: size, Item: src}); err != nil {
+			return err
+		}
+		return r.sendProgressResult("")
+	}
+	err = drive.Copy(src, dest)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	s.recordKeyUsage(r, drive, driveName, dest)
+
+	s.logCommand(r, src, "dest", dest)
+
+	return r.sendSuccess("")
+}
+
+// Fsync command.
+func (s *server) fsyncCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the path to sync.
+	path, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Attempt to sync the path.
+	err = drive.Sync(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess("")
+}
+
+// Checksum command. Optionally takes the name of the checksum algorithm.
+func (s *server) checksumCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the algorithm. Only SHA-256 is currently supported.
+	algorithm := "sha256"
+	if len(args) == 3 && args[2] != "" {
+		algorithm = strings.ToLower(args[2])
+	}
+	if algorithm != "sha256" {
+		err := r.sendError(fmt.Sprintf("unsupported checksum algorithm: %s", algorithm))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ensure it is a file.
+	stat, err := drive.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Compute the checksum.
+	checksum, err := drive.Checksum(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess(algorithm + " " + checksum + "\n")
+}
+
+// Compare command. Compares the contents of two files on a drive.
+func (s *server) compareCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, pathA, pathB := args[0], args[1], args[2]
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, pathA)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ensure both are files.
+	sizes := [2]int64{}
+	for i, path := range []string{pathA, pathB} {
+		stat, err := drive.Stat(path)
+		if err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if stat.IsDir() {
+			err = r.sendError(fmt.Sprintf("cannot be read: %s", path))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		sizes[i] = stat.Size()
+	}
+
+	s.logCommand(r, pathA, "other_path", pathB)
+
+	// Files of different sizes can't be equal.
+	if sizes[0] != sizes[1] {
+		return r.sendSuccess("false\n")
+	}
+
+	// Compare the checksums of the files.
+	checksums := [2]string{}
+	for i, path := range []string{pathA, pathB} {
+		checksums[i], err = drive.Checksum(path)
+		if err != nil {
+			err = r.sendError(err.Error())
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	return r.sendSuccess(strconv.FormatBool(checksums[0] == checksums[1]) + "\n")
+}
+
+// Chown command.
+func (s *server) chownCommand(r *request) error {
+	// Get the arguments: the drive, the path, and the user and group IDs.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 4 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+	uid, err := strconv.Atoi(args[2])
+	if err != nil {
+		err = r.sendError("invalid uid")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	gid, err := strconv.Atoi(args[3])
+	if err != nil {
+		err = r.sendError("invalid gid")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Changing ownership is privileged, so it needs both write and admin
+	// permissions.
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !r.permissions.IsAdmin {
+		err := r.sendDenied(s, "no admin permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	err = drive.Chown(path, uid, gid)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path, "uid", uid, "gid", gid)
+
+	return r.sendSuccess("")
+}
+
+// Usage command. Replies with the total size of the files under a path.
+func (s *server) usageCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(args[0], s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(args[0]) {
+		err := r.sendDenied(s, "no read permissions", args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the usage of the path.
+	usage, err := drive.Usage(args[1])
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, args[1])
+
+	// Send the usage.
+	return r.sendSuccess(strconv.FormatInt(usage, 10) + "\n")
+}
+
+// Quota check command.
+func (s *server) quotaCheckCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(args[0], s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(args[0]) {
+		err := r.sendDenied(s, "no read permissions", args[0], "")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the usage of the drive.
+	usage, err := drive.Usage("")
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, "", "drive", args[0])
+
+	// Send the quota, usage, and remaining headroom.
+	quota := drive.Quota()
+	if quota == 0 {
+		return r.sendSuccess("none\n" + strconv.FormatInt(usage, 10) + "\nnone\n")
+	}
+	headroom := quota - usage
+	if headroom < 0 {
+		headroom = 0
+	}
+	return r.sendSuccess(strconv.FormatInt(quota, 10) + "\n" + strconv.FormatInt(usage, 10) + "\n" + strconv.FormatInt(headroom, 10) + "\n")
+}
+
+// Directory size command.
+func (s *server) dirSizeCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(args[0], s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(args[0]) {
+		err := r.sendDenied(s, "no read permissions", args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the size of the directory.
+	size, count, err := drive.DirSize(args[1])
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, args[1])
+
+	// Send the size and the number of files.
+	return r.sendSuccess(strconv.FormatInt(size, 10) + "\n" + strconv.Itoa(count) + "\n")
+}
+
+// Count command. Counts the files and directories under a directory, and the
+// total size of the files, without listing them.
+func (s *server) countCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(args[0], s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(args[0]) {
+		err := r.sendDenied(s, "no read permissions", args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Count the tree.
+	files, dirs, bytes, err := drive.CountTree(args[1])
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, args[1])
+
+	// Send the number of files and directories, and the size.
+	return r.sendSuccess(strconv.Itoa(files) + "\n" + strconv.Itoa(dirs) + "\n" + strconv.FormatInt(bytes, 10) + "\n")
+}
+
+// Readlines command.
+func (s *server) readLinesCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 4 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the range of lines.
+	start, err := strconv.Atoi(args[2])
+	if err != nil || start < 0 {
+		err = r.sendError(fmt.Sprintf("invalid start: %s", args[2]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	count, err := strconv.Atoi(args[3])
+	if err != nil || count < 0 || count > maxReadLines {
+		err = r.sendError(fmt.Sprintf("invalid count: %s, the maximum is %d", args[3], maxReadLines))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Read the lines.
+	lines, err := readLines(drive, path, start, count)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path, "start", start, "count", count)
+
+	// Send the number of lines, followed by the lines.
+	var reply strings.Builder
+	reply.WriteString(strconv.Itoa(len(lines)) + "\n")
+	for _, line := range lines {
+		reply.WriteString(line + "\n")
+	}
+	return r.sendSuccess(reply.String())
+}
+
+// Append record command.
+func (s *server) appendRecordCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Get the record.
+	record, err := r.getData(drive.MaxRecordSize)
+	if err == errDataTooLarge {
+		err = r.sendError(fmt.Sprintf("record too large, the maximum is %d bytes", drive.MaxRecordSize))
+		if err != nil {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+	framedSize := int64(drive.RecordHeaderSize + len(record))
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Check the quota of the key, counting the framed record.
+	size := int64(0)
+	if stat, err := drive.Stat(path); err == nil {
+		size = stat.Size()
+	}
+	if err := s.checkKeyQuota(r, driveName, path, size+framedSize); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Append the record.
+	if err := drive.AppendRecord(path, record); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	s.recordKeyUsage(r, drive, driveName, path)
+
+	s.logCommand(r, path)
+
+	return r.sendSuccess("")
+}
+
+// Read records command.
+func (s *server) readRecordsCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 4 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the range of records.
+	start, err := strconv.Atoi(args[2])
+	if err != nil || start < 0 {
+		err = r.sendError(fmt.Sprintf("invalid start: %s", args[2]))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	count, err := strconv.Atoi(args[3])
+	if err != nil || count < 0 || count > maxReadRecords {
+		err = r.sendError(fmt.Sprintf("invalid count: %s, the maximum is %d", args[3], maxReadRecords))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Read the records.
+	records, err := readRecords(drive, path, start, count)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path, "start", start, "count", count)
+
+	// Send the number of records, followed by the size of each record and
+	// the record.
+	var reply bytes.Buffer
+	reply.WriteString(strconv.Itoa(len(records)) + "\n")
+	for _, record := range records {
+		reply.WriteString(strconv.Itoa(len(record)) + "\n")
+		reply.Write(record)
+	}
+	return r.sendSuccess(reply.String())
+}
+
+// Manifest command.
+func (s *server) manifestCommand(r *request) error {
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	driveName, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Get the path of the directory.
+	path, err := r.getString()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	// Get the drive.
+	drive, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ensure it is a directory.
+	stat, err := drive.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("not a directory: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Count the entries first, so a directory too large to walk is reported
+	// as an error rather than a truncated manifest.
+	if _, _, _, err := drive.CountTree(path); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	// Stream the manifest, one file per line, terminated by an empty line.
+	// With progress events, an event is sent for each file checksummed, and
+	// the manifest is sent once it is complete.
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	progress := r.wantsProgress()
+	entries := []string{}
+	err = drive.Manifest(path, func(path, checksum string, size int64) error {
+		entry := path + " " + checksum + " " + strconv.FormatInt(size, 10)
+		if !progress {
+			return r.sendString(entry)
+		}
+		entries = append(entries, entry)
+		return r.sendProgress(protocol.Progress{Done: int64(len(entries)), Item: path})
+	})
+	if err != nil {
+		if progress {
+			return r.sendProgressError(err.Error())
+		}
+		return err
+	}
+	if progress {
+		if err := r.sendString(protocol.ProgressResult); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := r.sendString(entry); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.sendString(""); err != nil {
+		return err
+	}
+	return r.sendString("0")
+}
+
+// Verify command. The client sends a manifest in the data chunk, one file per
+// line as its checksum and its path relative to the directory. Every file
+// under the directory is checksummed and compared, and the files which are
+// missing, changed, or extra are streamed back, one per line, terminated by
+// an empty line.
+func (s *server) verifyCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Read the manifest.
+	lenStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("invalid manifest length")
+	}
+	manifest := map[string]string{}
+	var manifestErr error
+	scanner := bufio.NewScanner(io.LimitReader(r.reader, size))
+	scanner.Buffer(make([]byte, protocol.ChunkSize), maxArgsSize)
+	for scanner.Scan() {
+		if manifestErr != nil {
+			// Drain the rest of the manifest.
+			continue
+		}
+		checksum, path, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			manifestErr = errors.New("invalid manifest")
+			continue
+		}
+		manifest[filepath.ToSlash(filepath.Clean(path))] = checksum
+		if len(manifest) > drive.MaxWalkEntries {
+			manifestErr = errors.New("too many entries")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+	if manifestErr != nil {
+		err = r.sendError(manifestErr.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	d, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ensure it is a directory.
+	stat, err := d.Stat(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !stat.IsDir() {
+		err = r.sendError(fmt.Sprintf("not a directory: %s", path))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Count the entries first, so a directory too large to walk is reported
+	// as an error rather than a truncated report.
+	if _, _, _, err := d.CountTree(path); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+	defer r.watchDisconnect()()
+
+	// Stream the changed and extra files as the directory is checksummed.
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	err = d.Manifest(path, func(path, checksum string, size int64) error {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		expected, ok := manifest[path]
+		if !ok {
+			return r.sendString("extra " + path)
+		}
+		delete(manifest, path)
+		if expected != checksum {
+			return r.sendString("changed " + path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The files left in the manifest are missing.
+	missing := make([]string, 0, len(manifest))
+	for path := range manifest {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+	for _, path := range missing {
+		if err := r.sendString("missing " + path); err != nil {
+			return err
+		}
+	}
+	if err := r.sendString(""); err != nil {
+		return err
+	}
+	return r.sendString("0")
+}
+
+// Begin command. Begins a transaction on a drive, replying with its ID.
+func (s *server) beginCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName := args[0]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, "")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	drive, err := r.getWritableDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Begin the transaction.
+	s.discardExpiredTransactions()
+	txn, err := s.transactions.begin(drive, driveName, r.key)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, "", "transaction", txn.id)
+
+	return r.sendSuccess(txn.id + "\n")
+}
+
+// Stage command. Stages a mkdir, remove, or move in a transaction.
+func (s *server) stageCommand(r *request) error {
+	// Get the arguments: the transaction ID, the operation, and its paths.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) < 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	id, op := args[0], stagedOp{kind: args[1], path: args[2]}
+	paths := []string{op.path}
+	switch {
+	case (op.kind == "mkdir" || op.kind == "remove") && len(args) == 3:
+	case op.kind == "move" && len(args) == 4:
+		op.dest = args[3]
+		paths = append(paths, op.dest)
+	default:
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	if !s.commandEnabled(op.kind) {
+		err := r.sendDenied(s, "command not enabled: "+op.kind, "", op.path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the transaction.
+	txn, _, err := r.getTransaction(id, s, paths...)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Stage the operation.
+	txn.lock.Lock()
+	err = txn.stage(op)
+	txn.lock.Unlock()
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, op.path, "transaction", id, "kind", op.kind)
+
+	return r.sendSuccess("")
+}
+
+// Stage write command. Stages the write of a file in a transaction, writing
+// the data to the staging directory of the transaction.
+func (s *server) stageWriteCommand(r *request) error {
+	// Get the arguments: the transaction ID and the path of the file to
+	// write.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	id, path := args[0], args[1]
+	if !s.commandEnabled("write") {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendDenied(s, "command not enabled: write", "", path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the transaction.
+	txn, drive, err := r.getTransaction(id, s, path)
+	if err != nil {
+		// Consume.
+		err2 := r.consume()
+		if err2 != nil {
+			return err2
+		}
+
+		err2 = r.sendError(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		return nil
+	}
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+	if txn.done {
+		// Consume.
+		err := r.consume()
+		if err != nil {
+			return err
+		}
+
+		err = r.sendError(fmt.Sprintf("transaction is closed: %s", id))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Read the size of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	len, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	if len < 0 {
+		return errors.New(fmt.Sprintf("invalid size: %d", len))
+	}
+	data := io.LimitReader(r.reader, len)
+
+	// Check the quota of the key.
+	if err := s.checkKeyQuota(r, txn.drive, path, len); err != nil {
+		return r.sendWriteError(data, err)
+	}
+
+	// Write the staged file, hashing the data as it is received.
+	staged := txn.stagedPath("w")
+	hash := sha256.New()
+	if err := drive.Write(staged, io.TeeReader(data, hash), len); err != nil {
+		return r.sendWriteError(data, err)
+	}
+	if err := txn.stage(stagedOp{kind: "write", path: path, staged: staged, size: len}); err != nil {
+		drive.Remove(staged)
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path, "transaction", id)
+
+	// Send the checksum of the data.
+	return r.sendSuccess("sha256 " + hex.EncodeToString(hash.Sum(nil)) + "\n")
+}
+
+// Commit command. Applies the staged operations of a transaction, undoing
+// them all if any fails.
+func (s *server) commitCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	id := args[0]
+
+	// Get the transaction.
+	txn, drive, err := r.getTransaction(id, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+	if txn.done {
+		err = r.sendError(fmt.Sprintf("transaction is closed: %s", id))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Check the quota of the key against the staged writes. Space freed by
+	// staged removes isn't counted until the commit succeeds.
+	sizes := map[string]int64{}
+	for _, op := range txn.ops {
+		if op.kind == "write" {
+			sizes[cleanKeyPath(op.path)] = op.size
+		}
+	}
+	if err := s.checkKeyQuotaFiles(r, txn.drive, sizes); err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Commit the transaction. Either way, the transaction is closed and its
+	// staging directory removed.
+	err = txn.commit(drive)
+	txn.done = true
+	s.transactions.remove(id)
+	if discardErr := txn.discard(drive); discardErr != nil {
+		s.logCommandError(r, discardErr, "transaction", id)
+	}
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Update the usage of keys for the applied operations.
+	for _, op := range txn.ops {
+		switch op.kind {
+		case "write":
+			s.recordKeyUsageSize(r, txn.drive, op.path, op.size)
+		case "remove":
+			s.forgetKeyUsage(txn.drive, op.path)
+		case "move":
+			s.moveKeyUsage(txn.drive, op.path, op.dest)
+		}
+	}
+
+	s.logCommand(r, "", "transaction", id, "operations", len(txn.ops))
+
+	return r.sendSuccess("")
+}
+
+// Rollback command. Discards the staged operations of a transaction.
+func (s *server) rollbackCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	id := args[0]
+
+	// Get the transaction.
+	txn, drive, err := r.getTransaction(id, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+	if txn.done {
+		err = r.sendError(fmt.Sprintf("transaction is closed: %s", id))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Discard the transaction.
+	txn.done = true
+	s.transactions.remove(id)
+	err = txn.discard(drive)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, "", "transaction", id)
+
+	return r.sendSuccess("")
+}
+
+// Get the versioning of a drive, if it is versioned.
+func getVersioner(d drive.Drive, name string) (drive.Versioner, error) {
+	versioner, ok := d.(drive.Versioner)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("drive is not versioned: %s", name))
+	}
+	return versioner, nil
+}
+
+// Check that restoring a version of a file would keep the key of a request
+// within its quota.
+func (s *server) checkVersionQuota(r *request, versioner drive.Versioner, driveName, path, version string) error {
+	if r.permissions.QuotaBytes <= 0 {
+		return nil
+	}
+	versions, err := versioner.ListVersions(path)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v.ID == version {
+			return s.checkKeyQuota(r, driveName, path, v.Size)
+		}
+	}
+	return nil
+}
+
+// Versions command. Lists the previous versions of a file, newest first.
+func (s *server) versionsCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 2 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path := args[0], args[1]
+
+	// Get the drive.
+	d, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// List the versions.
+	versioner, err := getVersioner(d, driveName)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	versions, err := versioner.ListVersions(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path)
+
+	body := strconv.Itoa(len(versions)) + "\n"
+	for i := range versions {
+		body += versions[i].ID + " " + strconv.FormatInt(versions[i].Time.UnixNano(), 10) + " " + strconv.FormatInt(versions[i].Size, 10) + "\n"
+	}
+	return r.sendSuccess(body)
+}
+
+// Read version command. Reads a previous version of a file.
+func (s *server) readVersionCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path, version := args[0], args[1], args[2]
+
+	// Get the drive.
+	d, err := r.getDrive(driveName, s)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !r.permissions.CanReadDrive(driveName) {
+		err := r.sendDenied(s, "no read permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Find the size of the version.
+	versioner, err := getVersioner(d, driveName)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	versions, err := versioner.ListVersions(path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	size := int64(-1)
+	for i := range versions {
+		if versions[i].ID == version {
+			size = versions[i].Size
+		}
+	}
+	if size < 0 {
+		err = r.sendError(fmt.Sprintf("unknown version: %s", version))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	s.logCommand(r, path, "version", version)
+
+	if err := r.sendString(protocol.Header); err != nil {
+		return err
+	}
+	if err := r.sendString("SUCCESS"); err != nil {
+		return err
+	}
+	if err := r.sendString(strconv.FormatInt(size, 10)); err != nil {
+		return err
+	}
+	return versioner.ReadVersion(path, version, r.writer)
+}
+
+// Restore version command. Restores a previous version of a file.
+func (s *server) restoreVersionCommand(r *request) error {
+	// Get the arguments.
+	args, err := r.getArgs()
+	if err != nil {
+		return err
+	}
+
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	if len(args) != 3 {
+		err := r.sendError("invalid arguments")
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	driveName, path, version := args[0], args[1], args[2]
+
+	if !r.permissions.CanWriteDrive(driveName) {
+		err := r.sendDenied(s, "no write permissions", driveName, path)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Get the drive.
+	d, err := r.getWritableDrive(driveName, s, path)
+	if err != nil {
+		err = r.sendError(err.Error())
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Restore the version, checking the quota of the key against its size.
+	versioner, err := getVersioner(d, driveName)
+	if err == nil {
+		err = s.checkVersionQuota(r, versioner, driveName, path, version)
+	}
+	if err == nil {
+		err = versioner.RestoreVersion(path, version)
+	}
 	if err != nil {
 		err = r.sendError(err.Error())
 		if err != nil {
@@ -530,8 +3912,9 @@ func (s *server) moveCommand(r *request) error {
 		}
 		return nil
 	}
+	s.recordKeyUsage(r, d, driveName, path)
 
-	s.info.Println("move", src, dest)
+	s.logCommand(r, path, "version", version)
 
 	return r.sendSuccess("")
 }
@@ -0,0 +1,807 @@
+// server/commands_test.go
+// Tests for the commands.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+func TestWriteOnlyDrive(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("drop", []string{"127.0.0.1"}, auth.Permissions{
+			Drives: map[string]auth.DrivePermissions{"d1": {Write: true}},
+		})
+	})
+	admin := newTestClient(t, s, testAdminKey)
+	drop := newTestClient(t, s, "drop")
+
+	// Writes are allowed.
+	data := []byte("dropped off")
+	if err := drop.Create("d1", "file"); err != nil {
+		t.Fatalf("create denied: %v", err)
+	}
+	if _, err := drop.Write("d1", "file", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("write denied: %v", err)
+	}
+	if err := drop.Mkdir("d1", "dir", false); err != nil {
+		t.Fatalf("mkdir denied: %v", err)
+	}
+
+	// Reads are denied.
+	reads := map[string]func() error{
+		"read": func() error {
+			_, err := drop.Read("d1", "file", &bytes.Buffer{})
+			return err
+		},
+		"read range": func() error {
+			_, err := drop.ReadRange("d1", "file", 0, 4, &bytes.Buffer{})
+			return err
+		},
+		"read many": func() error {
+			_, err := drop.ReadMany("d1", []string{"file"})
+			return err
+		},
+		"list": func() error {
+			_, err := drop.List("d1", "")
+			return err
+		},
+		"stat": func() error {
+			_, err := drop.Stat("d1", "file")
+			return err
+		},
+		"manifest": func() error {
+			_, err := drop.Manifest("d1", "")
+			return err
+		},
+		"checksum": func() error {
+			_, err := drop.Checksum("d1", "file")
+			return err
+		},
+		"compare": func() error {
+			_, err := drop.Compare("d1", "file", "file")
+			return err
+		},
+		"usage": func() error {
+			_, err := drop.Usage("d1", "")
+			return err
+		},
+		"read lines": func() error {
+			_, err := drop.ReadLines("d1", "file", 0, 1)
+			return err
+		},
+	}
+	for name, read := range reads {
+		if err := read(); err == nil || !strings.Contains(err.Error(), "no read permissions") {
+			t.Errorf("%s of a write-only drive: got %v, want a read permission error", name, err)
+		}
+	}
+
+	// Files can't be moved out of the drive to be read elsewhere.
+	if err := drop.MoveCrossDrive("d1", "file", "d2", "file"); err == nil {
+		t.Error("moved a file out of a write-only drive")
+	}
+
+	// Other keys can still read the drive.
+	var buf bytes.Buffer
+	if _, err := admin.Read("d1", "file", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("admin read failed: %v", err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	files := map[string]string{"a": "alpha", "sub/b": "beta", "sub/deep/c": "", "sub/deep/d": "delta"}
+	for name, data := range files {
+		path := filepath.Join(dir, "d1", "root", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d1", "root", "empty"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		prefix string
+	}{
+		{"root", ""},
+		{"root/sub", "sub/"},
+		{"root/empty", "-"},
+	}
+	for _, test := range tests {
+		manifest, err := c.Manifest("d1", test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every file under the directory is listed, by path relative to it.
+		expected := 0
+		for name, data := range files {
+			if !strings.HasPrefix(name, test.prefix) {
+				continue
+			}
+			expected++
+			sum := sha256.Sum256([]byte(data))
+			digest, ok := manifest[strings.TrimPrefix(name, test.prefix)]
+			if !ok || digest.Checksum != hex.EncodeToString(sum[:]) || digest.Size != int64(len(data)) {
+				t.Errorf("%s: wrong digest of %s: %+v", test.path, name, digest)
+			}
+		}
+		if len(manifest) != expected {
+			t.Errorf("%s: got %d entries, want %d", test.path, len(manifest), expected)
+		}
+	}
+
+	if _, err := c.Manifest("d1", "missing"); err == nil {
+		t.Fatal("manifest of a missing directory")
+	}
+}
+
+func TestManifestTooManyEntries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates more than MaxWalkEntries files")
+	}
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+
+	// Create more entries than a walk visits.
+	root := filepath.Join(dir, "d1", "big")
+	for i := 0; i <= drive.MaxWalkEntries/1000; i++ {
+		sub := filepath.Join(root, strconv.Itoa(i))
+		if err := os.MkdirAll(sub, 0777); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			if err := os.WriteFile(filepath.Join(sub, strconv.Itoa(j)), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The error is reported instead of a truncated manifest.
+	if _, err := c.Manifest("d1", "big"); err == nil || !strings.Contains(err.Error(), "too many entries") {
+		t.Fatalf("got %v, want a too many entries error", err)
+	}
+	if _, err := c.Verify("d1", map[string]string{"big/0/0": ""}); err == nil || !strings.Contains(err.Error(), "too many entries") {
+		t.Fatalf("got %v, want a too many entries error", err)
+	}
+	if _, _, err := c.DirSize("d1", "big"); err == nil || !strings.Contains(err.Error(), "too many entries") {
+		t.Fatalf("got %v, want a too many entries error", err)
+	}
+	if _, _, _, err := c.CountTree("d1", "big"); err == nil || !strings.Contains(err.Error(), "too many entries") {
+		t.Fatalf("got %v, want a too many entries error", err)
+	}
+
+	// Smaller directories are still listed.
+	manifest, err := c.Manifest("d1", "big/0")
+	if err != nil || len(manifest) != 1000 {
+		t.Fatalf("got %d entries, %v, want 1000", len(manifest), err)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.MkdirAll(filepath.Join(dir, "d1", "dir", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"dir/a": "12345", "dir/sub/b": "123"} {
+		if err := os.WriteFile(filepath.Join(dir, "d1", name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size, count, err := c.DirSize("d1", "dir")
+	if err != nil || size != 8 || count != 2 {
+		t.Fatalf("%d bytes in %d files: %v", size, count, err)
+	}
+	if _, _, err := c.DirSize("d1", "missing"); err == nil {
+		t.Fatal("size of a missing directory")
+	}
+}
+
+func TestCountTree(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "d1", "dir", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"dir/a": "12345", "dir/sub/b": "123"} {
+		if err := os.WriteFile(filepath.Join(dir, "d1", name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys which can read may count.
+	files, dirs, bytes, err := newTestClient(t, s, "reader").CountTree("d1", "dir")
+	if err != nil || files != 2 || dirs != 1 || bytes != 8 {
+		t.Fatalf("counted %d files and %d directories of %d bytes: %v", files, dirs, bytes, err)
+	}
+	c := newTestClient(t, s, testAdminKey)
+	if _, _, _, err := c.CountTree("d1", "missing"); err == nil {
+		t.Fatal("counted a missing directory")
+	}
+	if _, _, _, err := c.CountTree("d3", ""); err == nil {
+		t.Fatal("counted an unknown drive")
+	}
+	if response := rawRequest(t, s, testAdminKey, "count", "d1\n", nil); !strings.Contains(response, "invalid arguments") {
+		t.Fatalf("got %q, want an invalid arguments error", response)
+	}
+}
+
+func TestUsageCommand(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.MkdirAll(filepath.Join(dir, "d1", "dir", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"top": "12", "dir/a": "12345", "dir/sub/b": "123"} {
+		if err := os.WriteFile(filepath.Join(dir, "d1", name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only files are counted, not directories.
+	for path, want := range map[string]int64{"": 10, "dir": 8, "dir/sub": 3} {
+		if usage, err := c.Usage("d1", path); err != nil || usage != want {
+			t.Errorf("usage of %q is %d, want %d: %v", path, usage, want, err)
+		}
+	}
+	if _, err := c.Usage("d1", "../"); err == nil {
+		t.Error("got the usage outside the drive")
+	}
+	if _, err := c.Usage("d3", ""); err == nil {
+		t.Error("got the usage of an unknown drive")
+	}
+	if response := rawRequest(t, s, testAdminKey, "usage", "d1\n", nil); !strings.Contains(response, "invalid arguments") {
+		t.Fatalf("got %q, want an invalid arguments error", response)
+	}
+}
+
+func TestDriveQuotaCommands(t *testing.T) {
+	quotaDir := t.TempDir()
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.drives["d1"] = drive.NewDriveWithOptions(quotaDir, drive.Options{Quota: 100})
+	})
+	c := newTestClient(t, s, testAdminKey)
+	c.SetMaxIdleConns(1)
+	if err := c.Create("d1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("d1", "a", 60, bytes.NewReader(make([]byte, 60))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes over the quota fail with the rest of their data discarded, so
+	// the connection stays in sync for the next request.
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"write", func() error {
+			_, err := c.Write("d1", "a", 101, bytes.NewReader(make([]byte, 101)))
+			return err
+		}},
+		{"writeat", func() error {
+			return c.WriteAt("d1", "a", 50, 51, bytes.NewReader(make([]byte, 51)))
+		}},
+		{"append", func() error {
+			return c.Append("d1", "b", 41, bytes.NewReader(make([]byte, 41)))
+		}},
+		{"copy", func() error {
+			return c.Copy("d1", "a", "copied")
+		}},
+		{"stagewrite", func() error {
+			txn, err := c.Begin("d1")
+			if err != nil {
+				return err
+			}
+			defer txn.Rollback()
+			return txn.Write("b", 41, bytes.NewReader(make([]byte, 41)))
+		}},
+	}
+	for _, test := range tests {
+		if err := test.fn(); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+			t.Errorf("%s: got %v, want a quota exceeded error", test.name, err)
+		}
+		if err := c.Ping(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(quotaDir, "a")); err != nil || len(data) != 60 {
+		t.Fatalf("file changed to %d bytes: %v", len(data), err)
+	}
+
+	// The quota and the space remaining are reported.
+	info, err := c.QuotaInfo("d1")
+	if err != nil || !info.Limited || info.Quota != 100 || info.Headroom != 40 {
+		t.Fatalf("quota %+v: %v", info, err)
+	}
+	if err := c.Append("d1", "b", 40, bytes.NewReader(make([]byte, 40))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveCrossDriveCommand(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("writer", []string{"127.0.0.1"}, auth.Permissions{Drives: map[string]auth.DrivePermissions{"d1": {Read: true, Write: true}, "d2": {Read: true}}})
+	})
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.MkdirAll(filepath.Join(dir, "d2", "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"d1/file": "data", "d1/other": "other", "d2/existing": "old"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files are moved to the other drive, without leaving temporary files.
+	if err := c.MoveCrossDrive("d1", "file", "d2", "dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d2", "dir", "moved")); err != nil || string(data) != "data" {
+		t.Fatalf("moved %q: %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "file")); !os.IsNotExist(err) {
+		t.Fatalf("source not removed: %v", err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "d2", "dir")); err != nil || len(entries) != 1 {
+		t.Fatalf("destination directory holds %v: %v", entries, err)
+	}
+
+	// Moves within a drive are regular moves.
+	if err := c.MoveCrossDrive("d2", "dir/moved", "d2", "back"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d2", "back")); err != nil || string(data) != "data" {
+		t.Fatalf("moved %q: %v", data, err)
+	}
+
+	// Existing destinations, directories, and drives which can't be written
+	// fail, leaving the source.
+	tests := []struct {
+		name string
+		key  string
+		args string
+		err  string
+	}{
+		{"existing destination", testAdminKey, "d1\nother\nd2\nexisting\n", "path already exists"},
+		{"directory", testAdminKey, "d2\ndir\nd1\ndir\n", "cannot move a directory across drives"},
+		{"missing source", testAdminKey, "d1\nmissing\nd2\nnew\n", "no such file"},
+		{"read-only destination", "writer", "d1\nother\nd2\nnew\n", "no write permissions"},
+		{"invalid arguments", testAdminKey, "d1\nother\nd2\n", "invalid arguments"},
+	}
+	for _, test := range tests {
+		if response := rawRequest(t, s, test.key, "movecrossdrive", test.args, nil); !strings.HasPrefix(response, "FAILED\n") || !strings.Contains(response, test.err) {
+			t.Errorf("%s: got %q, want an error containing %q", test.name, response, test.err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d1", "other")); err != nil || string(data) != "other" {
+		t.Fatalf("source changed to %q: %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d2", "existing")); err != nil || string(data) != "old" {
+		t.Fatalf("destination changed to %q: %v", data, err)
+	}
+}
+
+// A drive which, if create is set, creates that file whenever a file is
+// checksummed, as moves across drives do once they have copied to it.
+// Otherwise, it fails to remove files.
+type racingDrive struct {
+	drive.Drive
+	create string
+}
+
+// Checksum a path, creating the file first.
+func (d *racingDrive) Checksum(path string) (string, error) {
+	if d.create != "" {
+		if err := d.Drive.Write(d.create, strings.NewReader("new"), 3); err != nil {
+			return "", err
+		}
+	}
+	return d.Drive.Checksum(path)
+}
+
+func (d *racingDrive) Remove(path string) error {
+	if d.create == "" {
+		return errors.New("disk failure")
+	}
+	return d.Drive.Remove(path)
+}
+
+func TestMoveCrossDriveRaces(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.drives["d1"] = &racingDrive{Drive: s.drives["d1"]}
+		s.drives["d2"] = &racingDrive{Drive: s.drives["d2"], create: "created"}
+	})
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Destinations created during the move aren't replaced.
+	response := rawRequest(t, s, testAdminKey, "movecrossdrive", "d1\nfile\nd2\ncreated\n", nil)
+	if !strings.HasPrefix(response, "FAILED\n") || !strings.Contains(response, "path already exists") {
+		t.Fatalf("got %q, want a path already exists error", response)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d2", "created")); err != nil || string(data) != "new" {
+		t.Fatalf("destination changed to %q: %v", data, err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "d2")); err != nil || len(entries) != 1 {
+		t.Fatalf("destination drive holds %v: %v", entries, err)
+	}
+
+	// Failing to remove the source is reported as a partial move.
+	response = rawRequest(t, s, testAdminKey, "movecrossdrive", "d1\nfile\nd2\nmoved\n", nil)
+	if !strings.HasPrefix(response, "FAILED\n") || !strings.Contains(response, "moved to moved, but failed to remove the source: disk failure") {
+		t.Fatalf("got %q, want a partial move error", response)
+	}
+	for _, name := range []string{"d1/file", "d2/moved"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != "data" {
+			t.Fatalf("read %q from %s: %v", data, name, err)
+		}
+	}
+}
+
+func TestFsync(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	admin := newTestClient(t, s, testAdminKey)
+	if err := admin.Sync("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Sync("d1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Sync("d1", "missing"); err == nil {
+		t.Fatal("synced a missing file")
+	}
+
+	// Syncing needs write permissions.
+	if err := newTestClient(t, s, "reader").Sync("d1", "file"); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Fatalf("got %v, want a permissions error", err)
+	}
+}
+
+func TestSetDriveReadOnly(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("writer", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	admin := newTestClient(t, s, testAdminKey)
+	writer := newTestClient(t, s, "writer")
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.SetDriveReadOnly("d1", true); err == nil || !strings.Contains(err.Error(), "no admin permissions") {
+		t.Fatalf("key without admin permissions made a drive read-only: %v", err)
+	}
+	if err := admin.SetDriveReadOnly("d3", true); err == nil || !strings.Contains(err.Error(), "unknown drive: d3") {
+		t.Fatalf("made an unknown drive read-only: %v", err)
+	}
+	if err := admin.SetDriveReadOnly("d1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands which modify the drive are rejected, and reads still work.
+	readOnly := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "drive is read-only: d1")
+	}
+	if err := writer.Create("d1", "new"); !readOnly(err) {
+		t.Errorf("created a file: %v", err)
+	}
+	if _, err := writer.Write("d1", "file", 1, strings.NewReader("a")); !readOnly(err) {
+		t.Errorf("wrote a file: %v", err)
+	}
+	if err := writer.Mkdir("d1", "dir", false); !readOnly(err) {
+		t.Errorf("created a directory: %v", err)
+	}
+	if err := writer.Move("d1", "file", "moved"); !readOnly(err) {
+		t.Errorf("moved a file: %v", err)
+	}
+	if err := writer.Remove("d1", "file"); !readOnly(err) {
+		t.Errorf("removed a file: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := writer.Read("d1", "file", &buf); err != nil || buf.String() != "data" {
+		t.Errorf("read %q: %v", buf.String(), err)
+	}
+	if err := admin.Create("d2", "new"); err != nil {
+		t.Errorf("other drive made read-only: %v", err)
+	}
+
+	if err := admin.SetDriveReadOnly("d1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Create("d1", "new"); err != nil {
+		t.Errorf("drive still read-only: %v", err)
+	}
+}
+
+func TestEmptyDriveAndPath(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		err  string
+	}{
+		{"stat no drive", func() error { _, err := c.Stat("", "file"); return err }, "no drive specified"},
+		{"list no drive", func() error { _, err := c.List("", ""); return err }, "no drive specified"},
+		{"create no drive", func() error { return c.Create("", "new") }, "no drive specified"},
+		{"stat root", func() error { _, err := c.Stat("d1", ""); return err }, ""},
+		{"list root", func() error { _, err := c.List("d1", ""); return err }, ""},
+		{"create empty", func() error { return c.Create("d1", "") }, "no path specified"},
+		{"mkdir root", func() error { return c.Mkdir("d1", ".", true) }, "cannot modify the root of a drive"},
+		{"write root", func() error { _, err := c.Write("d1", "/", 1, strings.NewReader("x")); return err }, "cannot modify the root of a drive"},
+		{"remove empty", func() error { return c.Remove("d1", "") }, "no path specified"},
+		{"remove root", func() error { return c.Remove("d1", "sub/..") }, "cannot modify the root of a drive"},
+		{"removetree root", func() error { return c.RemoveTree("d1", "/", nil, nil) }, "cannot modify the root of a drive"},
+		{"move from root", func() error { return c.Move("d1", "", "moved") }, "no path specified"},
+		{"move to root", func() error { return c.Move("d1", "file", ".") }, "cannot modify the root of a drive"},
+		{"copy to empty", func() error { return c.Copy("d1", "file", "") }, "no path specified"},
+	}
+	for _, test := range tests {
+		err := test.run()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// The drive is untouched.
+	if data, err := os.ReadFile(filepath.Join(dir, "d1", "file")); err != nil || string(data) != "data" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+}
+
+func TestTimeCommand(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	before := time.Now()
+	lines := strings.Split(rawRequest(t, s, testAdminKey, "time", "", nil), "\n")
+	if len(lines) != 6 || lines[0] != "SUCCESS" {
+		t.Fatalf("got %q", lines)
+	}
+
+	// The time is sent in UTC, then in the local time zone with its name.
+	utc, err := time.Parse(time.RFC3339Nano, lines[1])
+	if err != nil || !strings.HasSuffix(lines[1], "Z") {
+		t.Fatalf("invalid UTC time %q: %v", lines[1], err)
+	}
+	local, err := time.Parse(time.RFC3339Nano, lines[2])
+	if err != nil {
+		t.Fatalf("invalid local time %q: %v", lines[2], err)
+	}
+	if !local.Equal(utc) || utc.Before(before.Add(-time.Second)) || utc.After(time.Now().Add(time.Second)) {
+		t.Errorf("got times %v and %v, want about %v", utc, local, before)
+	}
+	if zone, _ := before.Zone(); lines[3] != zone {
+		t.Errorf("got time zone %q, want %q", lines[3], zone)
+	}
+}
+
+func TestGuestAccess(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.SetGuest(nil, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	guest := newTestClient(t, s, "unknown")
+
+	// Guests get the guest permissions, but never administrative commands.
+	if _, err := guest.List("d1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guest.List("d2", ""); err == nil {
+		t.Error("guest listed a drive which isn't allowed")
+	}
+	if err := guest.Create("d1", "file"); err == nil {
+		t.Error("guest created a file without write permissions")
+	}
+	if _, err := guest.Sessions(); err == nil {
+		t.Error("guest listed sessions")
+	}
+
+	// Unknown keys are rejected once guest access is disabled.
+	s.Authentication().DisableGuest()
+	if _, err := guest.List("d1", ""); err == nil {
+		t.Error("unknown key listed a drive with guest access disabled")
+	}
+}
+
+func TestListJSONCommand(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	names := []string{"new\nline", "crlf\r\n", `quote"d`}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, "d1", name), []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each entry is a JSON object on its own line, whatever its name.
+	lines := strings.Split(rawRequest(t, s, testAdminKey, "listjson", "d1\n\n", nil), "\n")
+	if len(lines) != len(names)+4 || lines[0] != "SUCCESS" || lines[1] != strconv.Itoa(len(names)) {
+		t.Fatalf("got %q", lines)
+	}
+	listed := map[string]bool{}
+	for _, line := range lines[2 : 2+len(names)] {
+		var entry jsonEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", line, err)
+		}
+		if entry.Type != "file" || entry.Size != 4 || entry.MTime.IsZero() {
+			t.Errorf("entry %+v", entry)
+		}
+		listed[entry.Name] = true
+	}
+	for _, name := range names {
+		if !listed[name] {
+			t.Errorf("%q not listed", name)
+		}
+	}
+}
+
+func TestMkdirCommand(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		args     string
+		response string
+	}{
+		{"new", "d1\ndir\n", "SUCCESS\n"},
+		{"existing", "d1\ndir\n", "FAILED\n"},
+		{"existing with exist ok", "d1\ndir\ntrue\n", "SUCCESS\n"},
+		{"existing without exist ok", "d1\ndir\nfalse\n", "FAILED\n"},
+		{"new with exist ok", "d1\nother\ntrue\n", "SUCCESS\n"},
+		{"file with exist ok", "d1\nfile\ntrue\n", "FAILED\n"},
+		{"invalid exist ok", "d1\nthird\nmaybe\n", "FAILED\ninvalid value: maybe\n"},
+		{"missing path", "d1\n", "FAILED\ninvalid arguments\n"},
+	}
+	for _, test := range tests {
+		if got := rawRequest(t, s, testAdminKey, "mkdir", test.args, nil); !strings.HasPrefix(got, test.response) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.response)
+		}
+	}
+	for _, path := range []string{"dir", "other"} {
+		if info, err := os.Stat(filepath.Join(dir, "d1", path)); err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "third")); !os.IsNotExist(err) {
+		t.Errorf("created third: %v", err)
+	}
+}
+
+func TestReadManyCommand(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	for name, contents := range map[string]string{"a": "abc", "b": "abcdef"} {
+		if err := os.WriteFile(filepath.Join(dir, "d1", name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		args     string
+		response string
+	}{
+		{"files", "d1\n10\na\nb\n", "SUCCESS\na\nok 3\nabcb\nok 6\nabcdef"},
+		{"maximum size", "d1\n4\na\nb\n", "SUCCESS\na\nok 3\nabcb\nerror too large: b\n"},
+		{"missing", "d1\n10\nmissing\na\n", "SUCCESS\nmissing\nerror "},
+		{"no files", "d1\n10\n", "SUCCESS\n"},
+		{"invalid size", "d1\n-1\na\n", "FAILED\ninvalid size: -1\n"},
+		{"missing size", "d1\n", "FAILED\ninvalid arguments\n"},
+	}
+	for _, test := range tests {
+		if got := rawRequest(t, s, testAdminKey, "readmany", test.args, nil); !strings.HasPrefix(got, test.response) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.response)
+		}
+	}
+}
+
+func TestDropCacheCommand(t *testing.T) {
+	quotaDir := t.TempDir()
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.drives["d1"] = drive.NewDriveWithOptions(quotaDir, drive.Options{Quota: 100})
+		a.AddKey("user", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	c := newTestClient(t, s, testAdminKey)
+	write := func(path string, size int) error {
+		if err := c.Create("d1", path); err != nil {
+			return err
+		}
+		_, err := c.Write("d1", path, int64(size), bytes.NewReader(make([]byte, size)))
+		return err
+	}
+	if err := write("a", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files added outside the server are only counted once the caches of
+	// the drive are dropped.
+	if err := os.WriteFile(filepath.Join(quotaDir, "outside"), make([]byte, 40), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("b", 5); err != nil {
+		t.Fatalf("write before dropping the caches failed: %v", err)
+	}
+	if err := c.DropCache("d1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("c", 10); err == nil {
+		t.Fatal("write over the recounted quota succeeded")
+	}
+
+	// Only admin keys may drop caches, of drives which exist.
+	if err := newTestClient(t, s, "user").DropCache("d1"); err == nil || !strings.Contains(err.Error(), "no admin permissions") {
+		t.Errorf("got %v, want a no admin permissions error", err)
+	}
+	if err := c.DropCache("missing"); err == nil || !strings.Contains(err.Error(), "unknown drive") {
+		t.Errorf("got %v, want an unknown drive error", err)
+	}
+	if got := rawRequest(t, s, testAdminKey, "dropcache", "", nil); !strings.HasPrefix(got, "FAILED\ninvalid arguments\n") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDrivePermissionsCommands(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("mixed", []string{"127.0.0.1"}, auth.Permissions{Drives: map[string]auth.DrivePermissions{
+			"d1": {Read: true, Write: true},
+			"d2": {Read: true},
+		}})
+	})
+	if err := os.WriteFile(filepath.Join(dir, "d2", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s, "mixed")
+
+	// The key may write to d1, but only read d2.
+	if err := c.Mkdir("d1", "dir", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mkdir("d2", "dir", false); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("got %v, want a no write permissions error", err)
+	}
+	if err := c.Remove("d2", "file"); err == nil || !strings.Contains(err.Error(), "no write permissions") {
+		t.Errorf("got %v, want a no write permissions error", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.Read("d2", "file", buf); err != nil || buf.String() != "data" {
+		t.Errorf("read %q: %v", buf.String(), err)
+	}
+	if drives, err := c.Drives(); err != nil || strings.Join(drives, ",") != "d1,d2" {
+		t.Errorf("drives %v: %v", drives, err)
+	}
+}
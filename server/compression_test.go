@@ -0,0 +1,137 @@
+// server/compression_test.go
+// Tests for compression of reads and writes.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+func TestCompressedWrite(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetCompression(true)
+	})
+	c := newTestClient(t, s, testAdminKey)
+	c.SetCompression(true)
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("d1", "file", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "d1", "file"))
+	if err != nil || !bytes.Equal(written, data) {
+		t.Fatalf("compressed write wasn't decompressed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.Read("d1", "file", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("compressed read failed: %v", err)
+	}
+}
+
+func TestCompressedWriteDenied(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetCompression(true)
+		a.AddKey("readonly", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	admin := newTestClient(t, s, testAdminKey)
+	readonly := newTestClient(t, s, "readonly")
+	readonly.SetCompression(true)
+	if err := admin.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	tests := []struct {
+		name, drive, path, want string
+	}{
+		{"write denied", "d1", "file", "no write permissions"},
+		{"unknown drive", "missing", "file", "no write permissions"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readonly.Write(test.drive, test.path, int64(len(data)), bytes.NewReader(data))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+
+	// Errors after the permissions are checked are reported too.
+	admin.SetCompression(true)
+	if err := admin.Mkdir("d1", "dir", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := admin.Write("d1", "dir", int64(len(data)), bytes.NewReader(data))
+	if err == nil || strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "connection") {
+		t.Fatalf("got %v, want the error of writing to a directory", err)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	c.SetCompression(true)
+
+	// Servers without compression get plain data from clients asking for it.
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("d1", "file", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := os.ReadFile(filepath.Join(dir, "d1", "file")); err != nil || !bytes.Equal(written, data) {
+		t.Fatalf("wrote %d bytes: %v", len(written), err)
+	}
+	var buf bytes.Buffer
+	if _, err := c.Read("d1", "file", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("read %d bytes: %v", buf.Len(), err)
+	}
+}
+
+func TestWriteNegativeLength(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+			s.SetCompression(compression)
+		})
+		if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		// Negative lengths are rejected whether or not compression is
+		// enabled, without truncating the file.
+		c, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		args := "d1\nfile\n"
+		request := strings.Join([]string{protocol.Header, testAdminKey, "write", strconv.Itoa(len(args))}, "\n") + "\n" + args + "-1\n"
+		if _, err := c.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		response, _ := io.ReadAll(c)
+		c.Close()
+		if strings.Contains(string(response), "SUCCESS") {
+			t.Fatalf("compression %v: wrote a negative length: %q", compression, response)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "d1", "file")); err != nil || string(data) != "data" {
+			t.Fatalf("compression %v: read %q: %v", compression, data, err)
+		}
+	}
+}
@@ -5,9 +5,13 @@ package server
 
 import (
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cubeflix/deepwell/auth"
@@ -19,13 +23,76 @@ import (
 type config struct {
 	Address          string
 	Timeout          string
+	HandshakeTimeout string
 	Backlog          int
 	Workers          int
 	SkipVerification bool
+	RunAsUser        string
+	RunAsGroup       string
+	HTTPAddress      string
+	MetricsAddr      string
 	Certificate      []tlsCert
 	Logging          logConfig
+	ACME             acmeConfig
 	Drive            []driveConfig
 	Auth             []authConfig
+	Guest            guestConfig
+
+	// The interval to rotate TLS session ticket keys on. Empty or zero
+	// leaves ticket keys to the TLS library.
+	TicketKeyRotation string
+
+	// Dynamic worker scaling. If MaxWorkers is non-zero, the pool starts
+	// with MinWorkers workers instead of Workers, grows up to MaxWorkers
+	// while at least ScaleQueueThreshold requests are queued, and retires
+	// workers once idle for WorkerIdleTimeout.
+	MinWorkers          int
+	MaxWorkers          int
+	ScaleQueueThreshold int
+	WorkerIdleTimeout   string
+	ScaleInterval       string
+
+	// The interval to check the drives' backing stores on. Empty uses the
+	// default interval, and a negative interval disables checks.
+	HealthCheckInterval string
+
+	// The number of paths removed in each batch by removetree, and the
+	// maximum number of paths it removes per second. A zero rate is
+	// unlimited.
+	RemoveTreeBatch int
+	RemoveTreeRate  int
+
+	// Compress the data of reads and writes with gzip when the client
+	// supports it.
+	Compression bool
+
+	// The maximum number of bytes per second read from and written to each
+	// connection. Zero is unlimited.
+	Bandwidth int64
+
+	// The file the usage of keys with quotas is persisted to. Empty keeps
+	// the usage in memory only.
+	KeyUsageFile string
+
+	// How long the outcomes of requests with idempotency keys are kept for,
+	// and the maximum number kept. Empty or zero uses the defaults.
+	IdempotencyWindow  string
+	MaxIdempotencyKeys int
+
+	// The maximum number of open connections. Connections over the limit
+	// wait up to ConnectionQueueTimeout for another connection to close,
+	// and are then rejected. As many connections may wait as the limit, and
+	// connections over that are closed immediately. Zero is unlimited.
+	MaxConnections         int
+	ConnectionQueueTimeout string
+
+	// The commands the server accepts. Other commands are rejected as
+	// invalid. Empty enables every command.
+	EnabledCommands []string
+
+	// The secret requests must be signed with, unless their key has its own
+	// secret. Empty doesn't require signing.
+	HMACSecret string
 }
 
 // The TLS certificate struct.
@@ -34,24 +101,123 @@ type tlsCert struct {
 	CertFile string
 }
 
+// The ACME configuration struct.
+type acmeConfig struct {
+	Domains          []string
+	CacheDir         string
+	Email            string
+	DirectoryURL     string
+	ChallengeAddress string
+}
+
 // The logging configuration struct.
 type logConfig struct {
 	Level string
 	File  string
+
+	// The format of log entries: "text" (the default) or "json", which
+	// writes each entry as a JSON object on its own line.
+	Format string
 }
 
 // The drive configuration struct.
 type driveConfig struct {
 	Name string
+	Type string
 	Path string
+
+	// Preallocate files being written with a size of at least this many
+	// bytes. Zero disables preallocation.
+	Preallocate int64
+
+	// The storage quota in bytes. Zero means the drive is unlimited.
+	Quota int64
+
+	// The write mode: empty for the default, "through" to flush writes to
+	// stable storage before acknowledging them, or "back" to acknowledge
+	// writes and flush them in the background every FlushInterval.
+	WriteMode     string
+	FlushInterval string
+
+	// The number of chunks to read ahead of the stream when reading files,
+	// trading memory for throughput. Zero disables read-ahead.
+	ReadAhead int
+
+	// The file to log every access to the drive to. Drives may share a file.
+	AccessLog string
+
+	// Glob patterns of the paths to hide from the drive, such as ".DS_Store"
+	// or "*.tmp". Patterns match both names and paths from the root of the
+	// drive. Drives layered over the drive don't see the ignored paths.
+	Ignore []string
+
+	// HTTP serving options.
+	HTTP         bool
+	IndexFiles   []string
+	Listing      bool
+	ContentTypes map[string]string
+	Headers      map[string]string
+
+	// Overlay drive options.
+	Upper string
+	Lower string
+
+	// Encrypted and compressed drive options. The backing drive stores the
+	// encrypted or compressed files. The key of an encrypted drive is a hex
+	// encoded 256-bit key, given directly or in a key file. Keys which were
+	// previously used remain able to decrypt files, so keys can be rotated.
+	Backing          string
+	Key              string
+	KeyFile          string
+	PreviousKeys     []string
+	PreviousKeyFiles []string
+
+	// Versioned drive options. The backing drive stores the files and their
+	// versions. Up to MaxVersions versions of each file are kept for up to
+	// VersionRetention. Zero or empty is unlimited.
+	MaxVersions      int
+	VersionRetention string
+}
+
+// The guest access configuration struct. Requests with a key that matches no
+// other key get the guest permissions, if guest access is enabled. Guests
+// can never use administrative commands.
+type guestConfig struct {
+	Enabled bool
+
+	// The IPs guests may connect from, which may be exact IPs, CIDR blocks
+	// such as 10.0.0.0/8, or "*". Empty allows any IP.
+	AllowedIPs    []string
+	AllowedDrives []string
+	CanWrite      bool
 }
 
 // The authentication configuration struct.
 type authConfig struct {
-	Key           string
+	Key string
+
+	// If the key is stored as its hash, as generated by deepwell-server
+	// hashkey, instead of in plaintext.
+	Hashed bool
+
+	// The IPs the key may be used from, which may be exact IPs, CIDR blocks
+	// such as 10.0.0.0/8, or "*" to allow any IP.
 	AllowedIPs    []string
 	AllowedDrives []string
 	CanWrite      bool
+	IsAdmin       bool
+
+	// The permissions of individual drives, overriding AllowedDrives and
+	// CanWrite (e.g. Drives = { scratch = { Read = true, Write = true } }).
+	Drives map[string]auth.DrivePermissions
+
+	// The secret requests with the key must be signed with, overriding the
+	// global secret.
+	HMACSecret string
+
+	// The maximum number of bytes the files written by the key may use
+	// across every drive. Zero is unlimited.
+	QuotaBytes int64
 }
 
 // Empty writer.
@@ -61,6 +227,110 @@ func (w *emptyWriter) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// Apply a profile to a configuration file. Profiles are defined in the
+// profiles table (e.g. [profiles.prod]) and are merged over the base
+// configuration. Profile values override base values, except for lists, which
+// are appended to.
+func applyProfile(file []byte, profile string) ([]byte, error) {
+	var base map[string]interface{}
+	if err := toml.Unmarshal(file, &base); err != nil {
+		return nil, err
+	}
+
+	// Find the profile.
+	var profiles map[string]interface{}
+	for key := range base {
+		if strings.EqualFold(key, "profiles") {
+			profiles, _ = base[key].(map[string]interface{})
+			delete(base, key)
+			break
+		}
+	}
+	override, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown config profile: %s", profile))
+	}
+
+	mergeConfig(base, override)
+	return toml.Marshal(base)
+}
+
+// Merge a configuration table over a base table. Keys are matched
+// case-insensitively, as they are when loading the configuration.
+func mergeConfig(base, override map[string]interface{}) {
+	for key, value := range override {
+		// Find the matching base key.
+		baseKey := key
+		for k := range base {
+			if strings.EqualFold(k, key) {
+				baseKey = k
+				break
+			}
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if table, ok := base[baseKey].(map[string]interface{}); ok {
+				mergeConfig(table, v)
+				continue
+			}
+		case []interface{}:
+			if list, ok := base[baseKey].([]interface{}); ok {
+				base[baseKey] = append(list, v...)
+				continue
+			}
+		}
+		base[baseKey] = value
+	}
+}
+
+// Hide the paths matching the ignore patterns of a drive.
+func ignorePaths(drives map[string]drive.Drive, cfg driveConfig) error {
+	if len(cfg.Ignore) == 0 {
+		return nil
+	}
+	ignoring, err := drive.NewIgnoringDrive(drives[cfg.Name], cfg.Ignore)
+	if err != nil {
+		return err
+	}
+	drives[cfg.Name] = ignoring
+	return nil
+}
+
+// Load the encryption keys of an encrypted drive, with the current key first.
+func loadEncryptionKeys(cfg driveConfig) ([][]byte, error) {
+	if (cfg.Key == "") == (cfg.KeyFile == "") {
+		return nil, errors.New(fmt.Sprintf("encrypted drive configuration must contain exactly one of key and key file: %s", cfg.Name))
+	}
+
+	encoded := append([]string{cfg.Key}, cfg.PreviousKeys...)
+	files := append([]string{cfg.KeyFile}, cfg.PreviousKeyFiles...)
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			encoded[0] = string(contents)
+		} else {
+			encoded = append(encoded, string(contents))
+		}
+	}
+
+	keys := [][]byte{}
+	for i := range encoded {
+		key, err := hex.DecodeString(strings.TrimSpace(encoded[i]))
+		if err != nil || len(key) != drive.EncryptionKeySize {
+			return nil, errors.New(fmt.Sprintf("invalid encryption key for drive %s, keys must be %d hex encoded bytes", cfg.Name, drive.EncryptionKeySize))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // Load a configuration file.
 func (s *server) LoadConfig(path string) error {
 	file, err := os.ReadFile(path)
@@ -68,10 +338,19 @@ func (s *server) LoadConfig(path string) error {
 		return err
 	}
 
+	// Apply the selected profile.
+	if s.profile != "" {
+		file, err = applyProfile(file, s.profile)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Load the TOML file.
 	var cfg config = config{
 		Address:          ":20001",
 		Timeout:          "3s",
+		HandshakeTimeout: "3s",
 		Backlog:          10,
 		Workers:          5,
 		SkipVerification: false,
@@ -91,28 +370,257 @@ func (s *server) LoadConfig(path string) error {
 		return err
 	}
 	s.SetTimeout(timeout)
+	handshakeTimeout, err := time.ParseDuration(cfg.HandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	s.SetHandshakeTimeout(handshakeTimeout)
+	if cfg.TicketKeyRotation != "" {
+		ticketKeyRotation, err := time.ParseDuration(cfg.TicketKeyRotation)
+		if err != nil {
+			return err
+		}
+		s.SetTicketKeyRotation(ticketKeyRotation)
+	}
 	s.SetBacklogSize(cfg.Backlog)
 	s.SetNumWorkers(cfg.Workers)
+	if cfg.MaxWorkers != 0 {
+		if cfg.MinWorkers < 1 || cfg.MinWorkers > cfg.MaxWorkers {
+			return errors.New("worker scaling requires 1 <= min workers <= max workers")
+		}
+		scaling := WorkerScaling{Min: cfg.MinWorkers, Max: cfg.MaxWorkers, QueueThreshold: cfg.ScaleQueueThreshold}
+		if cfg.WorkerIdleTimeout != "" {
+			scaling.IdleTimeout, err = time.ParseDuration(cfg.WorkerIdleTimeout)
+			if err != nil {
+				return err
+			}
+		}
+		if cfg.ScaleInterval != "" {
+			scaling.Interval, err = time.ParseDuration(cfg.ScaleInterval)
+			if err != nil {
+				return err
+			}
+		}
+		s.SetWorkerScaling(scaling)
+	}
+	if cfg.HealthCheckInterval != "" {
+		healthInterval, err := time.ParseDuration(cfg.HealthCheckInterval)
+		if err != nil {
+			return err
+		}
+		s.SetHealthCheckInterval(healthInterval)
+	}
+	s.SetRemoveTreeLimits(cfg.RemoveTreeBatch, cfg.RemoveTreeRate)
+	s.SetCompression(cfg.Compression)
+	if cfg.Bandwidth < 0 {
+		return errors.New("invalid bandwidth")
+	}
+	s.SetBandwidthLimit(cfg.Bandwidth)
+	idempotencyWindow := time.Duration(0)
+	if cfg.IdempotencyWindow != "" {
+		idempotencyWindow, err = time.ParseDuration(cfg.IdempotencyWindow)
+		if err != nil {
+			return err
+		}
+	}
+	s.SetIdempotencyLimits(idempotencyWindow, cfg.MaxIdempotencyKeys)
+	if err := s.SetKeyUsageFile(cfg.KeyUsageFile); err != nil {
+		return err
+	}
+	if cfg.MaxConnections < 0 {
+		return errors.New("invalid max connections")
+	}
+	connQueueTimeout := time.Duration(0)
+	if cfg.ConnectionQueueTimeout != "" {
+		connQueueTimeout, err = time.ParseDuration(cfg.ConnectionQueueTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	s.SetConnectionLimit(cfg.MaxConnections, connQueueTimeout)
+	s.SetRunAs(cfg.RunAsUser, cfg.RunAsGroup)
+	s.SetHTTPAddress(cfg.HTTPAddress)
+	s.SetMetricsAddress(cfg.MetricsAddr)
+
+	// Unregister the commands that are not enabled.
+	if len(cfg.EnabledCommands) > 0 {
+		enabled := map[string]bool{}
+		for _, name := range cfg.EnabledCommands {
+			name = strings.ToLower(name)
+			if _, ok := s.commands[name]; !ok {
+				return errors.New(fmt.Sprintf("unknown command: %s", name))
+			}
+			enabled[name] = true
+		}
+		for name := range s.commands {
+			if !enabled[name] {
+				delete(s.commands, name)
+			}
+		}
+	}
 
-	// load the drives.
+	// load the drives. Local drives are loaded first, so overlay drives can
+	// reference them.
 	drives := map[string]drive.Drive{}
 	for i := range cfg.Drive {
+		if cfg.Drive[i].Type != "" && cfg.Drive[i].Type != "local" {
+			continue
+		}
 		if cfg.Drive[i].Name == "" || cfg.Drive[i].Path == "" {
 			return errors.New("drive configuration must contain name and path")
 		}
-		drives[cfg.Drive[i].Name] = drive.NewDrive(cfg.Drive[i].Path)
+		writeMode := drive.WriteMode(strings.ToLower(cfg.Drive[i].WriteMode))
+		switch writeMode {
+		case drive.WriteModeDefault, drive.WriteModeThrough, drive.WriteModeBack:
+		default:
+			return errors.New(fmt.Sprintf("unknown write mode: %s", cfg.Drive[i].WriteMode))
+		}
+		if cfg.Drive[i].ReadAhead < 0 {
+			return errors.New(fmt.Sprintf("invalid read ahead: %d", cfg.Drive[i].ReadAhead))
+		}
+		flushInterval := time.Duration(0)
+		if cfg.Drive[i].FlushInterval != "" {
+			flushInterval, err = time.ParseDuration(cfg.Drive[i].FlushInterval)
+			if err != nil {
+				return err
+			}
+		}
+		drives[cfg.Drive[i].Name] = drive.NewDriveWithOptions(cfg.Drive[i].Path, drive.Options{
+			Preallocate:   cfg.Drive[i].Preallocate,
+			Quota:         cfg.Drive[i].Quota,
+			WriteMode:     writeMode,
+			FlushInterval: flushInterval,
+			ReadAhead:     cfg.Drive[i].ReadAhead,
+		})
+		if err := ignorePaths(drives, cfg.Drive[i]); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.Drive {
+		switch cfg.Drive[i].Type {
+		case "", "local":
+			continue
+		case "overlay":
+			if cfg.Drive[i].Name == "" || cfg.Drive[i].Upper == "" || cfg.Drive[i].Lower == "" {
+				return errors.New("overlay drive configuration must contain name, upper, and lower")
+			}
+			upper, ok := drives[cfg.Drive[i].Upper]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown upper drive: %s", cfg.Drive[i].Upper))
+			}
+			lower, ok := drives[cfg.Drive[i].Lower]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown lower drive: %s", cfg.Drive[i].Lower))
+			}
+			drives[cfg.Drive[i].Name] = drive.NewOverlayDrive(upper, lower)
+		case "encrypted":
+			if cfg.Drive[i].Name == "" || cfg.Drive[i].Backing == "" {
+				return errors.New("encrypted drive configuration must contain name and backing")
+			}
+			backing, ok := drives[cfg.Drive[i].Backing]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown backing drive: %s", cfg.Drive[i].Backing))
+			}
+			keys, err := loadEncryptionKeys(cfg.Drive[i])
+			if err != nil {
+				return err
+			}
+			encrypted, err := drive.NewEncryptedDrive(backing, keys)
+			if err != nil {
+				return err
+			}
+			drives[cfg.Drive[i].Name] = encrypted
+		case "compressed":
+			if cfg.Drive[i].Name == "" || cfg.Drive[i].Backing == "" {
+				return errors.New("compressed drive configuration must contain name and backing")
+			}
+			backing, ok := drives[cfg.Drive[i].Backing]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown backing drive: %s", cfg.Drive[i].Backing))
+			}
+			drives[cfg.Drive[i].Name] = drive.NewCompressedDrive(backing)
+		case "versioned":
+			if cfg.Drive[i].Name == "" || cfg.Drive[i].Backing == "" {
+				return errors.New("versioned drive configuration must contain name and backing")
+			}
+			backing, ok := drives[cfg.Drive[i].Backing]
+			if !ok {
+				return errors.New(fmt.Sprintf("unknown backing drive: %s", cfg.Drive[i].Backing))
+			}
+			if cfg.Drive[i].MaxVersions < 0 {
+				return errors.New(fmt.Sprintf("invalid max versions: %d", cfg.Drive[i].MaxVersions))
+			}
+			retention := time.Duration(0)
+			if cfg.Drive[i].VersionRetention != "" {
+				retention, err = time.ParseDuration(cfg.Drive[i].VersionRetention)
+				if err != nil {
+					return err
+				}
+			}
+			drives[cfg.Drive[i].Name] = drive.NewVersionedDrive(backing, cfg.Drive[i].MaxVersions, retention)
+		default:
+			return errors.New(fmt.Sprintf("unknown drive type: %s", cfg.Drive[i].Type))
+		}
+		if err := ignorePaths(drives, cfg.Drive[i]); err != nil {
+			return err
+		}
 	}
 	s.SetDrives(drives)
 
+	// Load the HTTP options of the drives.
+	httpDrives := map[string]HTTPOptions{}
+	for i := range cfg.Drive {
+		if !cfg.Drive[i].HTTP {
+			continue
+		}
+
+		// Normalize the extensions of the content types.
+		contentTypes := map[string]string{}
+		for ext, contentType := range cfg.Drive[i].ContentTypes {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			contentTypes[ext] = contentType
+		}
+
+		httpDrives[cfg.Drive[i].Name] = HTTPOptions{
+			IndexFiles:   cfg.Drive[i].IndexFiles,
+			Listing:      cfg.Drive[i].Listing,
+			ContentTypes: contentTypes,
+			Headers:      cfg.Drive[i].Headers,
+		}
+	}
+	s.SetHTTPDrives(httpDrives)
+
 	// Load the authentication.
 	authentication := auth.NewAuthentication()
 	for i := range cfg.Auth {
-		if cfg.Auth[i].Key == "" || cfg.Auth[i].AllowedDrives == nil || cfg.Auth[i].AllowedIPs == nil {
+		if cfg.Auth[i].Key == "" || (cfg.Auth[i].AllowedDrives == nil && cfg.Auth[i].Drives == nil) || cfg.Auth[i].AllowedIPs == nil {
 			return errors.New("auth configuration must contain key, allowed drives, and allowed IPs")
 		}
-		authentication.AddKey(cfg.Auth[i].Key, cfg.Auth[i].AllowedIPs, auth.Permissions{AllowedDrives: cfg.Auth[i].AllowedDrives, CanWrite: cfg.Auth[i].CanWrite})
+		permissions := auth.Permissions{AllowedDrives: cfg.Auth[i].AllowedDrives, CanWrite: cfg.Auth[i].CanWrite, Drives: cfg.Auth[i].Drives, IsAdmin: cfg.Auth[i].IsAdmin, QuotaBytes: cfg.Auth[i].QuotaBytes}
+		if cfg.Auth[i].Hashed {
+			if !auth.IsKeyHash(cfg.Auth[i].Key) {
+				return errors.New(fmt.Sprintf("invalid key hash: %s", cfg.Auth[i].Key))
+			}
+			authentication.AddHashedKey(cfg.Auth[i].Key, cfg.Auth[i].AllowedIPs, permissions)
+		} else {
+			authentication.AddKey(cfg.Auth[i].Key, cfg.Auth[i].AllowedIPs, permissions)
+		}
+		if cfg.Auth[i].HMACSecret != "" {
+			authentication.SetHMACSecret(cfg.Auth[i].Key, []byte(cfg.Auth[i].HMACSecret))
+		}
+	}
+	if cfg.Guest.Enabled {
+		authentication.SetGuest(cfg.Guest.AllowedIPs, auth.Permissions{AllowedDrives: cfg.Guest.AllowedDrives, CanWrite: cfg.Guest.CanWrite})
 	}
 	s.SetAuthentication(authentication)
+	if cfg.HMACSecret != "" {
+		s.SetHMACSecret([]byte(cfg.HMACSecret))
+	} else {
+		s.SetHMACSecret(nil)
+	}
 
 	// Load the TLS configuration.
 	certs := []tls.Certificate{}
@@ -124,11 +632,26 @@ func (s *server) LoadConfig(path string) error {
 		certs = append(certs, cert)
 	}
 	s.SetTLSConfig(&tls.Config{
-		Certificates:       certs,
-		InsecureSkipVerify: cfg.SkipVerification,
+		Certificates:           certs,
+		InsecureSkipVerify:     cfg.SkipVerification,
+		SessionTicketsDisabled: false,
+	})
+	if len(cfg.ACME.Domains) > 0 && cfg.ACME.CacheDir == "" {
+		return errors.New("acme configuration must contain a cache directory")
+	}
+	s.SetACME(ACMEOptions{
+		Domains:          cfg.ACME.Domains,
+		CacheDir:         cfg.ACME.CacheDir,
+		Email:            cfg.ACME.Email,
+		DirectoryURL:     cfg.ACME.DirectoryURL,
+		ChallengeAddress: cfg.ACME.ChallengeAddress,
 	})
 
 	// Load the logger.
+	format := strings.ToLower(cfg.Logging.Format)
+	if format != "" && format != LogFormatText && format != LogFormatJSON {
+		return errors.New(fmt.Sprintf("invalid log format: %s", cfg.Logging.Format))
+	}
 	logFile := os.Stdout
 	if cfg.Logging.File != "" {
 		logFile, err = os.OpenFile(cfg.Logging.File, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
@@ -138,18 +661,41 @@ func (s *server) LoadConfig(path string) error {
 		s.logFile = logFile
 	}
 
+	// Create the loggers in the format, writing levels which are disabled
+	// nowhere.
+	var infoFile, errFile io.Writer = logFile, logFile
 	if cfg.Logging.Level == "none" {
-		s.info = log.New(&emptyWriter{}, "info: ", log.Ldate|log.Ltime|log.Lshortfile)
-		s.err = log.New(&emptyWriter{}, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
-	} else if cfg.Logging.Level == "info" {
-		s.info = log.New(logFile, "info: ", log.Ldate|log.Ltime|log.Lshortfile)
-		s.err = log.New(logFile, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
+		infoFile, errFile = &emptyWriter{}, &emptyWriter{}
 	} else if cfg.Logging.Level == "error" {
-		s.info = log.New(&emptyWriter{}, "info: ", log.Ldate|log.Ltime|log.Lshortfile)
-		s.err = log.New(logFile, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
+		infoFile = &emptyWriter{}
+	}
+	if format == LogFormatJSON {
+		s.info = newJSONLogger(infoFile, "info")
+		s.err = newJSONLogger(errFile, "error")
 	} else {
-		s.info = log.New(logFile, "info: ", log.Ldate|log.Ltime|log.Lshortfile)
-		s.err = log.New(logFile, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
+		s.info = log.New(infoFile, "info: ", log.Ldate|log.Ltime|log.Lshortfile)
+		s.err = log.New(errFile, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
+	}
+
+	// Load the access logs of the drives. Drives sharing a file share a
+	// logger.
+	accessLogs := map[string]*log.Logger{}
+	for i := range cfg.Drive {
+		path := cfg.Drive[i].AccessLog
+		if path == "" {
+			continue
+		}
+		logger, ok := accessLogs[path]
+		if !ok {
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+			if err != nil {
+				return err
+			}
+			s.accessLogFiles = append(s.accessLogFiles, file)
+			logger = log.New(file, "access: ", log.Ldate|log.Ltime)
+			accessLogs[path] = logger
+		}
+		s.SetAccessLog(cfg.Drive[i].Name, logger)
 	}
 
 	return nil
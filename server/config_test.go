@@ -0,0 +1,821 @@
+// server/config_test.go
+// Tests for configuration files.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// Write a configuration file to a temporary directory. Returns its path.
+func writeTestConfig(t *testing.T, cfg string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Load a configuration file into a new server.
+func loadTestConfig(t *testing.T, cfg string) (*server, error) {
+	t.Helper()
+	s := NewServer().(*server)
+	return s, s.LoadConfig(writeTestConfig(t, cfg))
+}
+
+func TestConfigHandshakeTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		timeout time.Duration
+		valid   bool
+	}{
+		{"default", ``, 3 * time.Second, true},
+		{"set", `HandshakeTimeout = "750ms"`, 750 * time.Millisecond, true},
+		{"invalid", `HandshakeTimeout = "soon"`, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.HandshakeTimeout() != test.timeout {
+				t.Fatalf("handshake timeout %v, expected %v", s.HandshakeTimeout(), test.timeout)
+			}
+		})
+	}
+}
+
+func TestConfigConnectionLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		max     int
+		timeout time.Duration
+		valid   bool
+	}{
+		{"default", ``, 0, 0, true},
+		{"set", "MaxConnections = 8\nConnectionQueueTimeout = \"2s\"", 8, 2 * time.Second, true},
+		{"negative", `MaxConnections = -1`, 0, 0, false},
+		{"invalid timeout", `ConnectionQueueTimeout = "later"`, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max, timeout := s.ConnectionLimit(); max != test.max || timeout != test.timeout {
+				t.Fatalf("connection limit %d, %v, expected %d, %v", max, timeout, test.max, test.timeout)
+			}
+		})
+	}
+}
+
+func TestConfigWorkerScaling(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		scaling WorkerScaling
+		valid   bool
+	}{
+		{"default", ``, WorkerScaling{}, true},
+		{"set", "MinWorkers = 2\nMaxWorkers = 16\nScaleQueueThreshold = 4\nWorkerIdleTimeout = \"30s\"\nScaleInterval = \"50ms\"",
+			WorkerScaling{Min: 2, Max: 16, QueueThreshold: 4, IdleTimeout: 30 * time.Second, Interval: 50 * time.Millisecond}, true},
+		{"fixed pool", "MinWorkers = 2", WorkerScaling{}, true},
+		{"min above max", "MinWorkers = 8\nMaxWorkers = 4", WorkerScaling{}, false},
+		{"no min", "MaxWorkers = 4", WorkerScaling{}, false},
+		{"invalid idle timeout", "MinWorkers = 1\nMaxWorkers = 4\nWorkerIdleTimeout = \"idle\"", WorkerScaling{}, false},
+		{"invalid interval", "MinWorkers = 1\nMaxWorkers = 4\nScaleInterval = \"often\"", WorkerScaling{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.WorkerScaling() != test.scaling {
+				t.Fatalf("worker scaling %+v, expected %+v", s.WorkerScaling(), test.scaling)
+			}
+		})
+	}
+}
+
+func TestConfigHealthCheckInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      string
+		interval time.Duration
+		valid    bool
+	}{
+		{"default", ``, 0, true},
+		{"set", `HealthCheckInterval = "30s"`, 30 * time.Second, true},
+		{"disabled", `HealthCheckInterval = "-1s"`, -time.Second, true},
+		{"invalid", `HealthCheckInterval = "sometimes"`, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.HealthCheckInterval() != test.interval {
+				t.Fatalf("health check interval %v, expected %v", s.HealthCheckInterval(), test.interval)
+			}
+		})
+	}
+}
+
+func TestConfigACME(t *testing.T) {
+	s, err := loadTestConfig(t, `
+[ACME]
+Domains = ["deepwell.example"]
+CacheDir = "/var/cache/deepwell"
+Email = "admin@deepwell.example"
+ChallengeAddress = ":80"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options := s.ACME(); len(options.Domains) != 1 || options.CacheDir != "/var/cache/deepwell" || options.Email != "admin@deepwell.example" || options.ChallengeAddress != ":80" {
+		t.Fatalf("loaded acme options %+v", options)
+	}
+
+	if _, err := loadTestConfig(t, "[ACME]\nDomains = [\"deepwell.example\"]"); err == nil {
+		t.Fatal("loaded acme options without a cache directory")
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	path := writeTestConfig(t, `
+Timeout = "1s"
+Workers = 2
+EnabledCommands = ["ping"]
+
+[Guest]
+Enabled = true
+AllowedDrives = ["public"]
+
+[profiles.prod]
+timeout = "9s"
+EnabledCommands = ["status"]
+
+[profiles.prod.guest]
+CanWrite = true
+
+[profiles.empty]
+`)
+	tests := []struct {
+		profile  string
+		timeout  time.Duration
+		commands []string
+		canWrite bool
+	}{
+		{"", time.Second, []string{"ping"}, false},
+		{"empty", time.Second, []string{"ping"}, false},
+		{"prod", 9 * time.Second, []string{"ping", "status"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.profile, func(t *testing.T) {
+			s := NewServer().(*server)
+			s.SetProfile(test.profile)
+			if err := s.LoadConfig(path); err != nil {
+				t.Fatal(err)
+			}
+
+			// Values are overridden, keys match case-insensitively, tables
+			// are merged, and lists are appended to.
+			if s.Timeout() != test.timeout {
+				t.Errorf("timeout %v, want %v", s.Timeout(), test.timeout)
+			}
+			if s.NumWorkers() != 2 {
+				t.Errorf("workers %d, want 2", s.NumWorkers())
+			}
+			if len(s.commands) != len(test.commands) {
+				t.Errorf("%d commands enabled, want %v", len(s.commands), test.commands)
+			}
+			for _, name := range test.commands {
+				if _, ok := s.commands[name]; !ok {
+					t.Errorf("%s not enabled", name)
+				}
+			}
+			perms, err := s.Authentication().Authenticate("anyone", "127.0.0.1")
+			if err != nil || !perms.DriveAllowed("public") || perms.CanWrite != test.canWrite {
+				t.Errorf("guest permissions %+v: %v", perms, err)
+			}
+		})
+	}
+
+	s := NewServer().(*server)
+	s.SetProfile("missing")
+	if err := s.LoadConfig(path); err == nil {
+		t.Fatal("loaded an unknown profile")
+	}
+}
+
+func TestConfigGuest(t *testing.T) {
+	keys := `
+[[Auth]]
+Key = "known"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["private"]
+CanWrite = true
+`
+	tests := []struct {
+		name   string
+		guest  string
+		key    string
+		ip     string
+		drives string
+		write  bool
+		valid  bool
+	}{
+		{"disabled", ``, "unknown", "127.0.0.1", "", false, false},
+		{"explicitly disabled", "[Guest]\nEnabled = false\nAllowedDrives = [\"public\"]", "unknown", "127.0.0.1", "", false, false},
+		{"enabled", "[Guest]\nEnabled = true\nAllowedDrives = [\"public\"]", "unknown", "10.0.0.1", "public", false, true},
+		{"writable", "[Guest]\nEnabled = true\nAllowedDrives = [\"public\"]\nCanWrite = true", "", "127.0.0.1", "public", true, true},
+		{"allowed IP", "[Guest]\nEnabled = true\nAllowedIPs = [\"127.0.0.1\"]\nAllowedDrives = [\"public\"]", "unknown", "127.0.0.1", "public", false, true},
+		{"other IP", "[Guest]\nEnabled = true\nAllowedIPs = [\"127.0.0.1\"]\nAllowedDrives = [\"public\"]", "unknown", "10.0.0.1", "", false, false},
+		{"known key", "[Guest]\nEnabled = true\nAllowedDrives = [\"public\"]", "known", "127.0.0.1", "private", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, keys+test.guest+"\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			perms, err := s.Authentication().Authenticate(test.key, test.ip)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("unknown key authenticated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(perms.AllowedDrives, ","); got != test.drives || perms.CanWrite != test.write || perms.IsAdmin {
+				t.Fatalf("got permissions %+v", perms)
+			}
+		})
+	}
+}
+
+func TestConfigAllowedIPs(t *testing.T) {
+	s, err := loadTestConfig(t, `
+[[Auth]]
+Key = "subnet"
+AllowedIPs = ["10.0.0.0/8", "192.0.2.1"]
+AllowedDrives = ["d1"]
+
+[[Auth]]
+Key = "anywhere"
+AllowedIPs = ["*"]
+AllowedDrives = ["d1"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key     string
+		ip      string
+		allowed bool
+	}{
+		{"subnet", "10.1.2.3", true},
+		{"subnet", "192.0.2.1", true},
+		{"subnet", "192.0.2.2", false},
+		{"anywhere", "203.0.113.9", true},
+	}
+	for _, test := range tests {
+		if _, err := s.Authentication().Authenticate(test.key, test.ip); (err == nil) != test.allowed {
+			t.Errorf("%s from %s: got %v", test.key, test.ip, err)
+		}
+	}
+}
+
+func TestConfigHMACSecret(t *testing.T) {
+	s, err := loadTestConfig(t, `
+HMACSecret = "global"
+
+[[Auth]]
+Key = "keyed"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["d1"]
+HMACSecret = "own"
+
+[[Auth]]
+Key = "plain"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["d1"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := string(s.HMACSecret()); secret != "global" {
+		t.Fatalf("global secret %q", secret)
+	}
+	a := s.Authentication()
+	if secret, plain := string(a.HMACSecret("keyed")), a.HMACSecret("plain"); secret != "own" || plain != nil {
+		t.Fatalf("key secrets %q, %q", secret, plain)
+	}
+
+	// Without a secret, signing isn't required.
+	s, err = loadTestConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := s.HMACSecret(); secret != nil {
+		t.Fatalf("global secret %q", secret)
+	}
+}
+
+func TestConfigHashedKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"hashed", "Key = \"" + auth.HashKey("secret") + "\"\nHashed = true", true},
+		{"plain", "Key = \"secret\"", true},
+		{"invalid hash", "Key = \"secret\"\nHashed = true", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, "[[Auth]]\n"+test.key+"\nAllowedIPs = [\"127.0.0.1\"]\nAllowedDrives = [\"d1\"]\n")
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Authentication().Authenticate("secret", "127.0.0.1"); err != nil {
+				t.Fatalf("key rejected: %v", err)
+			}
+		})
+	}
+
+	// The hash itself isn't accepted as a key.
+	s, err := loadTestConfig(t, "[[Auth]]\nKey = \""+auth.HashKey("secret")+"\"\nHashed = true\nAllowedIPs = [\"127.0.0.1\"]\nAllowedDrives = [\"d1\"]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authentication().Authenticate(auth.HashKey("secret"), "127.0.0.1"); err == nil {
+		t.Fatal("hash of a key accepted as the key")
+	}
+}
+
+func TestConfigDrivePermissions(t *testing.T) {
+	s, err := loadTestConfig(t, `
+[[Auth]]
+Key = "mixed"
+AllowedIPs = ["127.0.0.1"]
+Drives = { scratch = { Read = true, Write = true }, archive = { Read = true } }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := s.Authentication().Authenticate("mixed", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !perms.CanWriteDrive("scratch") || perms.CanWriteDrive("archive") || !perms.CanReadDrive("archive") || perms.DriveAllowed("other") {
+		t.Fatalf("got permissions %+v", perms)
+	}
+
+	// Keys must be allowed some drives.
+	if _, err := loadTestConfig(t, "[[Auth]]\nKey = \"none\"\nAllowedIPs = [\"127.0.0.1\"]\n"); err == nil {
+		t.Fatal("loaded a key without drives")
+	}
+}
+
+func TestConfigIdempotencyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		window  time.Duration
+		maxKeys int
+		valid   bool
+	}{
+		{"defaults", "", 0, 0, true},
+		{"limits", "IdempotencyWindow = \"1h\"\nMaxIdempotencyKeys = 500", time.Hour, 500, true},
+		{"invalid window", "IdempotencyWindow = \"soon\"", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if window, maxKeys := s.IdempotencyLimits(); window != test.window || maxKeys != test.maxKeys {
+				t.Fatalf("limits %v, %d", window, maxKeys)
+			}
+		})
+	}
+}
+
+func TestConfigEnabledCommands(t *testing.T) {
+	s, err := loadTestConfig(t, `EnabledCommands = ["Ping", "read"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.commands) != 2 || s.commands["ping"] == nil || s.commands["read"] == nil {
+		t.Fatalf("enabled commands %v", s.commands)
+	}
+
+	if _, err := loadTestConfig(t, `EnabledCommands = ["ping", "fly"]`); err == nil || err.Error() != "unknown command: fly" {
+		t.Fatalf("unknown command enabled: %v", err)
+	}
+	if s, err := loadTestConfig(t, `EnabledCommands = []`); err != nil || s.commands["write"] == nil {
+		t.Fatalf("empty list didn't enable every command: %v", err)
+	}
+
+	// Disabled commands are rejected as invalid.
+	ts, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		enableCommands(s, "ping")
+	})
+	if got := rawRequest(t, ts, testAdminKey, "list", "d1\n\n", nil); got != "FAILED\ninvalid command list\n0\n" {
+		t.Fatalf("disabled command returned %q", got)
+	}
+	if got := rawRequest(t, ts, testAdminKey, "ping", "", nil); !strings.HasPrefix(got, "SUCCESS\n") {
+		t.Fatalf("enabled command returned %q", got)
+	}
+}
+
+func TestConfigWriteMode(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	tests := []struct {
+		name  string
+		drive string
+		valid bool
+	}{
+		{"default", ``, true},
+		{"write-through", `WriteMode = "through"`, true},
+		{"write-back", `WriteMode = "Back"` + "\n" + `FlushInterval = "250ms"`, true},
+		{"unknown mode", `WriteMode = "sideways"`, false},
+		{"invalid interval", `WriteMode = "back"` + "\n" + `FlushInterval = "often"`, false},
+		{"read ahead", `ReadAhead = 4`, true},
+		{"negative read ahead", `ReadAhead = -1`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, "[[Drive]]\nName = \"d\"\nPath = \""+dir+"\"\n"+test.drive+"\n")
+			if test.valid && err != nil {
+				t.Fatal(err)
+			} else if !test.valid && err == nil {
+				t.Fatal("invalid configuration loaded")
+			}
+		})
+	}
+}
+
+func TestConfigAccessLogs(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := loadTestConfig(t, `
+[[Drive]]
+Name = "a"
+Path = "`+dir+`/a"
+AccessLog = "`+dir+`/shared.log"
+
+[[Drive]]
+Name = "b"
+Path = "`+dir+`/b"
+AccessLog = "`+dir+`/shared.log"
+
+[[Drive]]
+Name = "c"
+Path = "`+dir+`/c"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, file := range s.accessLogFiles {
+			file.Close()
+		}
+	}()
+
+	// Drives sharing a file share a logger, and drives without one don't log.
+	if s.AccessLog("a") == nil || s.AccessLog("a") != s.AccessLog("b") || s.AccessLog("c") != nil {
+		t.Fatal("access logs not loaded")
+	}
+	s.AccessLog("a").Println("entry")
+	data, err := os.ReadFile(filepath.Join(dir, "shared.log"))
+	if err != nil || !strings.HasSuffix(string(data), "entry\n") {
+		t.Fatalf("read %q: %v", data, err)
+	}
+}
+
+func TestConfigEncryptedDrives(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	key := strings.Repeat("ab", drive.EncryptionKeySize)
+	if err := os.WriteFile(filepath.Join(dir, "key"), []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backing := "[[Drive]]\nName = \"backing\"\nPath = \"" + dir + "\"\n\n[[Drive]]\nName = \"secret\"\nType = \"encrypted\"\n"
+	tests := []struct {
+		name  string
+		drive string
+		valid bool
+	}{
+		{"key", `Backing = "backing"` + "\n" + `Key = "` + key + `"`, true},
+		{"key file", `Backing = "backing"` + "\n" + `KeyFile = "` + dir + `/key"`, true},
+		{"previous keys", `Backing = "backing"` + "\n" + `Key = "` + strings.Repeat("cd", drive.EncryptionKeySize) + `"` + "\n" + `PreviousKeyFiles = ["` + dir + `/key"]`, true},
+		{"no key", `Backing = "backing"`, false},
+		{"key and key file", `Backing = "backing"` + "\n" + `Key = "` + key + `"` + "\n" + `KeyFile = "` + dir + `/key"`, false},
+		{"short key", `Backing = "backing"` + "\n" + `Key = "abcd"`, false},
+		{"invalid key", `Backing = "backing"` + "\n" + `Key = "` + strings.Repeat("zz", drive.EncryptionKeySize) + `"`, false},
+		{"missing key file", `Backing = "backing"` + "\n" + `KeyFile = "` + dir + `/missing"`, false},
+		{"no backing", `Key = "` + key + `"`, false},
+		{"unknown backing", `Backing = "missing"` + "\n" + `Key = "` + key + `"`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, backing+test.drive+"\n")
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := s.Drives()["secret"]; d == nil || d.Type() != "encrypted" {
+				t.Fatal("encrypted drive not loaded")
+			}
+		})
+	}
+}
+
+func TestConfigCompressedDrives(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	backing := "[[Drive]]\nName = \"backing\"\nPath = \"" + dir + "\"\n\n[[Drive]]\nName = \"packed\"\nType = \"compressed\"\n"
+	tests := []struct {
+		name  string
+		drive string
+		valid bool
+	}{
+		{"backing", `Backing = "backing"`, true},
+		{"no backing", ``, false},
+		{"unknown backing", `Backing = "missing"`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, backing+test.drive+"\n")
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := s.Drives()["packed"]; d == nil || d.Type() != "compressed" {
+				t.Fatal("compressed drive not loaded")
+			}
+		})
+	}
+}
+
+func TestConfigVersionedDrives(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	backing := "[[Drive]]\nName = \"backing\"\nPath = \"" + dir + "\"\n\n[[Drive]]\nName = \"docs\"\nType = \"versioned\"\n"
+	tests := []struct {
+		name  string
+		drive string
+		valid bool
+	}{
+		{"backing", `Backing = "backing"`, true},
+		{"limits", "Backing = \"backing\"\nMaxVersions = 10\nVersionRetention = \"720h\"", true},
+		{"no backing", ``, false},
+		{"unknown backing", `Backing = "missing"`, false},
+		{"negative max versions", "Backing = \"backing\"\nMaxVersions = -1", false},
+		{"invalid retention", "Backing = \"backing\"\nVersionRetention = \"forever\"", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, backing+test.drive+"\n")
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := s.Drives()["docs"]; d == nil || d.Type() != "versioned" {
+				t.Fatal("versioned drive not loaded")
+			}
+		})
+	}
+}
+
+func TestConfigRemoveTreeLimits(t *testing.T) {
+	s, err := loadTestConfig(t, "RemoveTreeBatch = 50\nRemoveTreeRate = 200\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batchSize, rate := s.RemoveTreeLimits(); batchSize != 50 || rate != 200 {
+		t.Fatalf("limits %d, %d", batchSize, rate)
+	}
+}
+
+func TestConfigAdminKeys(t *testing.T) {
+	s, err := loadTestConfig(t, `
+[[Auth]]
+Key = "admin"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["d1"]
+IsAdmin = true
+
+[[Auth]]
+Key = "user"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["d1"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, admin := range map[string]bool{"admin": true, "user": false} {
+		perms, err := s.Authentication().Authenticate(key, "127.0.0.1")
+		if err != nil || perms.IsAdmin != admin {
+			t.Errorf("%s: admin %v, %v", key, perms.IsAdmin, err)
+		}
+	}
+}
+
+func TestConfigKeyQuotas(t *testing.T) {
+	usage := filepath.Join(t.TempDir(), "usage.json")
+	s, err := loadTestConfig(t, `
+KeyUsageFile = "`+filepath.ToSlash(usage)+`"
+
+[[Auth]]
+Key = "limited"
+AllowedIPs = ["127.0.0.1"]
+AllowedDrives = ["d1"]
+CanWrite = true
+QuotaBytes = 1024
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyUsageFile() != usage {
+		t.Fatalf("key usage file %q, want %q", s.KeyUsageFile(), usage)
+	}
+	perms, err := s.Authentication().Authenticate("limited", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.QuotaBytes != 1024 {
+		t.Fatalf("quota %d, want 1024", perms.QuotaBytes)
+	}
+
+	// Usage files which can't be parsed fail to load.
+	if err := os.WriteFile(usage, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTestConfig(t, "KeyUsageFile = \""+filepath.ToSlash(usage)+"\""); err == nil {
+		t.Fatal("loaded an invalid key usage file")
+	}
+}
+
+func TestConfigIgnoredPaths(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	tests := []struct {
+		name  string
+		drive string
+		valid bool
+	}{
+		{"patterns", `Ignore = [".DS_Store", "*.tmp"]`, true},
+		{"invalid pattern", `Ignore = ["[a-"]`, false},
+		{"empty pattern", `Ignore = [""]`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadTestConfig(t, "[[Drive]]\nName = \"d\"\nPath = \""+dir+"\"\n"+test.drive+"\n")
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "a.tmp"), nil, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Drives()["d"].Stat("a.tmp"); !os.IsNotExist(err) {
+				t.Fatalf("got %v, want a not exist error", err)
+			}
+		})
+	}
+}
+
+func TestConfigMetricsAddress(t *testing.T) {
+	for _, addr := range []string{"", "127.0.0.1:9100"} {
+		s, err := loadTestConfig(t, "MetricsAddr = \""+addr+"\"")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.MetricsAddress() != addr {
+			t.Errorf("metrics address %q, want %q", s.MetricsAddress(), addr)
+		}
+	}
+}
+
+func TestConfigLogFormat(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, format := range []string{"", "text", "JSON"} {
+		path := dir + "/" + format + ".log"
+		s, err := loadTestConfig(t, `
+[Logging]
+File = "`+path+`"
+Format = "`+format+`"
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.info.Println("entry")
+		s.logFile.Close()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isJSON := strings.HasPrefix(string(data), "{"); isJSON != (format == "JSON") {
+			t.Errorf("format %q wrote %q", format, data)
+		}
+	}
+
+	// Unknown formats are rejected.
+	if _, err := loadTestConfig(t, "[Logging]\nFormat = \"xml\""); err == nil || !strings.Contains(err.Error(), "invalid log format") {
+		t.Fatalf("got %v, want an invalid log format error", err)
+	}
+}
+
+func TestConfigBandwidth(t *testing.T) {
+	for _, bps := range []string{"0", "1048576"} {
+		s, err := loadTestConfig(t, "Bandwidth = "+bps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strconv.FormatInt(s.BandwidthLimit(), 10); got != bps {
+			t.Errorf("bandwidth %s, want %s", got, bps)
+		}
+	}
+
+	// Negative limits are rejected.
+	if _, err := loadTestConfig(t, "Bandwidth = -1"); err == nil || !strings.Contains(err.Error(), "invalid bandwidth") {
+		t.Fatalf("got %v, want an invalid bandwidth error", err)
+	}
+}
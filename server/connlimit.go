@@ -0,0 +1,90 @@
+// server/connlimit.go
+// Global connection limits.
+
+package server
+
+import (
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Admit a connection, taking one of the connection slots. If every slot is
+// taken, the connection waits in the queue for up to the queue timeout for
+// another connection to close, and is then rejected. The queue holds as many
+// connections as there are slots, and connections over it are closed
+// immediately. Returns false if the connection wasn't admitted immediately.
+func (s *server) admit(r *request) bool {
+	select {
+	case s.connSlots <- struct{}{}:
+		r.slot = true
+		return true
+	default:
+	}
+
+	// Take a place in the queue, or close the connection if it is full.
+	select {
+	case s.connQueue <- struct{}{}:
+	default:
+		s.info.Println("connection queue full, closing connection:", r.conn.RemoteAddr().String())
+		r.writer.Close()
+		return false
+	}
+
+	// Wait for a slot in the queue.
+	go func() {
+		defer func() { <-s.connQueue }()
+		timer := time.NewTimer(s.connQueueTimeout)
+		defer timer.Stop()
+		select {
+		case s.connSlots <- struct{}{}:
+			r.slot = true
+			s.jobs <- r
+		case <-timer.C:
+			s.info.Println("server at capacity, rejecting connection:", r.conn.RemoteAddr().String())
+			if err := s.reject(r, "server at capacity"); err != nil {
+				s.err.Println("failed to reject connection: ", err.Error())
+			}
+		}
+	}()
+	return false
+}
+
+// Release the connection slot of a request, if it has one.
+func (s *server) release(r *request) {
+	if r.slot {
+		r.slot = false
+		<-s.connSlots
+	}
+}
+
+// Reject a request with an error, reading the request first so the client
+// receives the error.
+func (s *server) reject(r *request, message string) error {
+	defer r.writer.Close()
+	if err := s.handshake(r); err != nil {
+		return err
+	}
+
+	// Read the request.
+	header, err := r.getString()
+	if err != nil {
+		return err
+	}
+	if header != protocol.Header {
+		return nil
+	}
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+	if _, err := r.getString(); err != nil {
+		return err
+	}
+	if err := r.consume(); err != nil {
+		return err
+	}
+	if err := r.consume(); err != nil {
+		return err
+	}
+	return r.sendError(message)
+}
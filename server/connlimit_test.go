@@ -0,0 +1,126 @@
+// server/connlimit_test.go
+// Tests for global connection limits.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestConnectionQueueFull(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetConnectionLimit(1, 5*time.Second)
+	})
+
+	// The first connection takes the only slot and the second waits in the
+	// queue. Neither sends anything, so both stay open.
+	conns := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", s.ActualAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// The third connection is over the queue, so it is closed immediately.
+	conns[2].SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conns[2].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection over the queue not closed: %v", err)
+	}
+
+	// The queued connection is still open.
+	conns[1].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conns[1].Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("queued connection closed: %v", err)
+	}
+}
+
+func TestConnectionQueueTimeout(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetConnectionLimit(1, 100*time.Millisecond)
+	})
+
+	// Hold the only slot.
+	conn, err := net.Dial("tcp", s.ActualAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Queued clients are rejected once the queue timeout passes, which frees
+	// their places in the queue for the next clients.
+	for i := 0; i < 3; i++ {
+		c := newTestClient(t, s, testAdminKey)
+		if err := c.Ping(); err == nil || !strings.Contains(err.Error(), "server at capacity") {
+			t.Fatalf("client not rejected over the connection limit: %v", err)
+		}
+	}
+}
+
+func TestConnectionQueueAdmitted(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetConnectionLimit(1, 5*time.Second)
+	})
+
+	// Hold the only slot.
+	conn, err := net.Dial("tcp", s.ActualAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A client waits in the queue while the slot is held.
+	done := make(chan error, 1)
+	go func() {
+		done <- newTestClient(t, s, testAdminKey).Ping()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("client admitted over the connection limit: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Closing the connection admits the queued client.
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("queued client failed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("queued client not admitted")
+	}
+}
+
+func TestSetMaxConnections(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetConnectionLimit(5, 100*time.Millisecond)
+		s.SetMaxConnections(1)
+	})
+
+	// Setting the maximum keeps the queue timeout.
+	if max, timeout := s.ConnectionLimit(); max != 1 || timeout != 100*time.Millisecond {
+		t.Fatalf("limit %d, %v", max, timeout)
+	}
+
+	// Clients over the new limit are rejected with a FAILED response.
+	conn, err := net.Dial("tcp", s.ActualAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := newTestClient(t, s, testAdminKey).Ping(); err == nil || !strings.Contains(err.Error(), "server at capacity") {
+		t.Fatalf("client not rejected over the connection limit: %v", err)
+	}
+}
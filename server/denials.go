@@ -0,0 +1,30 @@
+// server/denials.go
+// Logging of requests denied for lack of permissions.
+
+package server
+
+// The tag of denial log entries, so they can be found and alerted on.
+const denialTag = "DENIED"
+
+// Log a request denied for lack of permissions to the error log, with the
+// hash of its key, its IP, its command, and the drive and path it tried to
+// access. Denials are logged so probing and misconfigured clients can be
+// detected.
+func (r *request) logDenial(s Server, reason, drive, path string) {
+	_, logger := s.Logger()
+	if logger == nil {
+		return
+	}
+	key, ip := r.keyID(), r.remoteIP()
+	if logJSON(logger, map[string]any{"tag": denialTag, "key": key, "ip": ip, "command": r.command, "drive": drive, "path": path, "reason": reason}) {
+		return
+	}
+	logger.Printf("%s key=%s ip=%s command=%q drive=%q path=%q reason=%q", denialTag, key, ip, r.command, drive, path, reason)
+}
+
+// Log a request denied for lack of permissions, and send the reason to the
+// client.
+func (r *request) sendDenied(s Server, reason, drive, path string) error {
+	r.logDenial(s, reason, drive, path)
+	return r.sendError(reason)
+}
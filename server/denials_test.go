@@ -0,0 +1,82 @@
+// server/denials_test.go
+// Tests for logging requests denied for lack of permissions.
+
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestDenialLogs(t *testing.T) {
+	logs := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(log.New(&syncBuffer{}, "", 0), log.New(logs, "", 0))
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	reader := auth.HashKey("reader")[:16]
+
+	// Each denial is logged with the hashed key, the IP, the command, the
+	// drive, the path, and the reason.
+	tests := []struct {
+		name    string
+		key     string
+		command string
+		args    string
+		entry   string
+	}{
+		{"no write permissions", "reader", "mkdir", "d1\ndir\n", `DENIED key=` + reader + ` ip=127.0.0.1 command="mkdir" drive="d1" path="dir" reason="no write permissions"`},
+		{"drive not allowed", "reader", "stat", "d2\nfile\n", `DENIED key=` + reader + ` ip=127.0.0.1 command="stat" drive="d2" path="" reason="drive not allowed"`},
+		{"no admin permissions", "reader", "dropcache", "d1\n", `DENIED key=` + reader + ` ip=127.0.0.1 command="dropcache" drive="d1" path="" reason="no admin permissions"`},
+		{"invalid key", "wrong", "ping", "", `DENIED key=` + auth.HashKey("wrong")[:16] + ` ip=127.0.0.1 command="ping" drive="" path="" reason="invalid authentication key"`},
+		{"invalid command", "reader", "probe", "", `DENIED key=` + reader + ` ip=127.0.0.1 command="probe" drive="" path="" reason="invalid command"`},
+	}
+	for _, test := range tests {
+		if response := rawRequest(t, s, test.key, test.command, test.args, nil); !strings.HasPrefix(response, "FAILED\n") {
+			t.Errorf("%s: got %q, want a failure", test.name, response)
+			continue
+		}
+		if !strings.Contains(logs.String(), test.entry+"\n") {
+			t.Errorf("%s: no entry %s in the logs:\n%s", test.name, test.entry, logs.String())
+		}
+	}
+
+	// Keys aren't logged, and allowed requests aren't denials.
+	if strings.Contains(logs.String(), "reader ") || strings.Contains(logs.String(), "wrong") {
+		t.Fatalf("logs contain a key:\n%s", logs.String())
+	}
+	before := strings.Count(logs.String(), denialTag)
+	if response := rawRequest(t, s, "reader", "stat", "d1\n\n", nil); !strings.HasPrefix(response, "SUCCESS\n") {
+		t.Fatalf("got %q", response)
+	}
+	if after := strings.Count(logs.String(), denialTag); after != before {
+		t.Fatalf("logged %d denials for an allowed request", after-before)
+	}
+}
+
+func TestDenialLogsJSON(t *testing.T) {
+	logs := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(newJSONLogger(&syncBuffer{}, "info"), newJSONLogger(logs, "error"))
+		a.AddKey("reader", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+	if response := rawRequest(t, s, "reader", "mkdir", "d1\ndir\n", nil); !strings.HasPrefix(response, "FAILED\n") {
+		t.Fatalf("got %q", response)
+	}
+
+	// Denials are entries with their own tag and fields.
+	entry := map[string]any{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry); err != nil {
+		t.Fatalf("invalid JSON log entry %q: %v", logs.String(), err)
+	}
+	want := map[string]any{"tag": denialTag, "key": auth.HashKey("reader")[:16], "ip": "127.0.0.1", "command": "mkdir", "drive": "d1", "path": "dir", "reason": "no write permissions", "level": "error"}
+	for field, value := range want {
+		if entry[field] != value {
+			t.Errorf("field %s is %v, want %v", field, entry[field], value)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// server/encoding.go
+// Transcoding text between character encodings.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// The maximum size of a file transcoded in a single request.
+const maxTranscodeSize = 64 << 20
+
+// Get an encoding by name. Files are stored as UTF-8, so a nil encoding is
+// returned for UTF-8 and raw bytes, which need no transcoding.
+func getEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "raw" || name == "utf-8" || name == "utf8" {
+		return nil, nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unknown encoding: %s", name))
+	}
+	return enc, nil
+}
@@ -0,0 +1,97 @@
+// server/handshake_test.go
+// Tests for the handshake timeout.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+// Wait for the server to close a connection. Fails if it is still open after
+// the wait.
+func expectClosed(t *testing.T, c net.Conn, wait time.Duration) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 256)
+	for {
+		_, err := c.Read(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatalf("connection still open after %v", wait)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetHandshakeTimeout(200 * time.Millisecond)
+	})
+
+	t.Run("stalled TLS handshake", func(t *testing.T) {
+		c, err := net.Dial("tcp", s.ActualAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		start := time.Now()
+		expectClosed(t, c, 2*time.Second)
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("connection closed before the handshake timeout: %v", elapsed)
+		}
+	})
+
+	t.Run("trickled preamble", func(t *testing.T) {
+		c, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// Each byte of the preamble arrives well within the operation
+		// timeout, but the preamble as a whole takes longer than the
+		// handshake timeout.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 20; i++ {
+				if _, err := c.Write([]byte{'D'}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		expectClosed(t, c, 900*time.Millisecond)
+		c.Close()
+		<-done
+	})
+
+	t.Run("prompt client", func(t *testing.T) {
+		if err := newTestClient(t, s, testAdminKey).Ping(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestHandshakeTimeoutFallback(t *testing.T) {
+	// Without a handshake timeout, stalled clients are dropped after the
+	// operation timeout.
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetTimeout(200 * time.Millisecond)
+		s.SetHandshakeTimeout(0)
+	})
+	c, err := net.Dial("tcp", s.ActualAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expectClosed(t, c, 2*time.Second)
+}
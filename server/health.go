@@ -0,0 +1,97 @@
+// server/health.go
+// Health checking of the drives' backing stores.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// The default interval the drives are checked on.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// Get if a drive is healthy. Drives are unhealthy while their backing store
+// is unavailable.
+func (s *server) DriveHealthy(name string) bool {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+	return !s.unhealthyDrives[name]
+}
+
+// Get the interval the drives are checked on.
+func (s *server) HealthCheckInterval() time.Duration {
+	return s.healthInterval
+}
+
+// Set the interval the drives are checked on. Zero uses
+// DefaultHealthCheckInterval, and a negative interval disables checks.
+func (s *server) SetHealthCheckInterval(interval time.Duration) {
+	s.healthInterval = interval
+}
+
+// Check the drives on an interval, marking drives unhealthy when their
+// backing store can't be reached and healthy again once it can.
+func (s *server) monitorHealth(stop chan struct{}) {
+	interval := s.healthInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for name, d := range s.drives {
+			s.setDriveHealth(name, probeDrive(d, interval))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe the backing store of a drive by stating its root. A probe which
+// takes longer than the timeout fails, since a dropped network mount may
+// hang rather than fail.
+func probeDrive(d drive.Drive, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		stat, err := d.Stat("")
+		if err == nil && !stat.IsDir() {
+			err = errors.New("root is not a directory")
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New(fmt.Sprintf("health check timed out after %s", timeout))
+	}
+}
+
+// Record the result of a probe of a drive, logging changes in its health.
+func (s *server) setDriveHealth(name string, err error) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	unhealthy := s.unhealthyDrives[name]
+	if err != nil {
+		if !unhealthy {
+			s.err.Println("drive unavailable:", name, err.Error())
+		}
+		if s.unhealthyDrives == nil {
+			s.unhealthyDrives = map[string]bool{}
+		}
+		s.unhealthyDrives[name] = true
+	} else if unhealthy {
+		s.info.Println("drive recovered:", name)
+		delete(s.unhealthyDrives, name)
+	}
+}
@@ -0,0 +1,116 @@
+// server/health_test.go
+// Tests for health checking of the drives' backing stores.
+
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// Wait for the health of a drive of a server to change.
+func waitDriveHealthy(t *testing.T, s *server, name string, healthy bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.DriveHealthy(name) != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("drive %s healthy: %v, want %v", name, !healthy, healthy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDriveHealth(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetHealthCheckInterval(20 * time.Millisecond)
+	})
+	c := newTestClient(t, s, testAdminKey)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the backing store becoming unavailable.
+	if err := os.Rename(filepath.Join(dir, "d1"), filepath.Join(dir, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	waitDriveHealthy(t, s, "d1", false)
+
+	// Commands fail with a clear error, and the drive is left out of the
+	// drives or flagged.
+	if _, err := c.Stat("d1", "file"); err == nil || !strings.Contains(err.Error(), "drive unavailable: d1") {
+		t.Fatalf("got %v, want a drive unavailable error", err)
+	}
+	if drives, err := c.Drives(); err != nil || strings.Join(drives, ",") != "d2" {
+		t.Fatalf("listed %v: %v", drives, err)
+	}
+	info, err := c.DrivesInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range info {
+		if d.Available != (d.Name == "d2") {
+			t.Errorf("drive %s reported available: %v", d.Name, d.Available)
+		}
+	}
+
+	// The drive recovers once the backing store returns.
+	if err := os.Rename(filepath.Join(dir, "gone"), filepath.Join(dir, "d1")); err != nil {
+		t.Fatal(err)
+	}
+	waitDriveHealthy(t, s, "d1", true)
+	if stat, err := c.Stat("d1", "file"); err != nil || stat.Size != 4 {
+		t.Fatalf("stat %+v: %v", stat, err)
+	}
+	if drives, err := c.Drives(); err != nil || strings.Join(drives, ",") != "d1,d2" {
+		t.Fatalf("listed %v: %v", drives, err)
+	}
+}
+
+func TestDriveHealthHTTP(t *testing.T) {
+	s, _ := newHTTPTestServer(t, HTTPOptions{})
+	s.setDriveHealth("web", os.ErrNotExist)
+	if w := httpRequest(s.HTTPHandler(), "GET", "/web/file.txt", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	s.setDriveHealth("web", nil)
+	if w := httpRequest(s.HTTPHandler(), "GET", "/web/file.txt", nil); w.Code != http.StatusOK {
+		t.Fatalf("status %d after recovering", w.Code)
+	}
+}
+
+// A drive whose root can't be stated until released, like a dropped network
+// mount.
+type hangingDrive struct {
+	drive.Drive
+	release chan struct{}
+}
+
+// Stat a path once released.
+func (d *hangingDrive) Stat(path string) (os.FileInfo, error) {
+	<-d.release
+	return d.Drive.Stat(path)
+}
+
+func TestProbeDrive(t *testing.T) {
+	dir := t.TempDir()
+	if err := probeDrive(drive.NewDrive(dir), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := probeDrive(drive.NewDrive(filepath.Join(dir, "missing")), time.Second); err == nil {
+		t.Error("probed a missing backing store")
+	}
+
+	// Probes which hang time out.
+	hanging := &hangingDrive{Drive: drive.NewDrive(dir), release: make(chan struct{})}
+	defer close(hanging.release)
+	if err := probeDrive(hanging, 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,103 @@
+// server/hmac.go
+// Signing connections with an HMAC.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+
+	"github.com/cubeflix/deepwell/conn"
+)
+
+// A connection whose reads drain the data already buffered by a request
+// before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// Get the secret requests must be signed with, unless their key has its own
+// secret.
+func (s *server) HMACSecret() []byte {
+	return s.hmacSecret
+}
+
+// Set the secret requests must be signed with, unless their key has its own
+// secret. Nil stops requiring signing.
+func (s *server) SetHMACSecret(secret []byte) {
+	s.hmacSecret = secret
+}
+
+// Get the secret requests with a key must be signed with, if any.
+func (s *server) keyHMACSecret(key string) []byte {
+	if secret := s.authentication.HMACSecret(key); secret != nil {
+		return secret
+	}
+	return s.hmacSecret
+}
+
+// Check if the connection of a request is signed with a secret. Any
+// connection satisfies a nil secret.
+func (r *request) signedWith(secret []byte) bool {
+	if secret == nil {
+		return true
+	}
+	return r.hmacSecret != nil && hmac.Equal(secret, r.hmacSecret)
+}
+
+// Sign the rest of a connection. The key and the client's nonce are read, and
+// the server's nonce is sent, from which the key of the connection is derived
+// with the secret of the key. The connection is then handled as a new
+// request, reading and writing signed frames.
+func (s *server) serveHMAC(r *request) error {
+	key, err := r.getString()
+	if err != nil {
+		return err
+	}
+	r.key = key
+	nonceStr, err := r.getString()
+	if err != nil {
+		return err
+	}
+	clientNonce, err := hex.DecodeString(nonceStr)
+	if err != nil || len(clientNonce) != conn.HMACNonceSize {
+		// Close the connection, we got an invalid nonce.
+		return nil
+	}
+
+	// Get the secret of the key.
+	secret := s.keyHMACSecret(key)
+	if secret == nil {
+		s.info.Println("failed to sign connection, no secret for key:", r.keyID())
+		return r.sendString("FAILED")
+	}
+
+	// Send our nonce.
+	serverNonce := make([]byte, conn.HMACNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	if err := r.sendString(hex.EncodeToString(serverNonce)); err != nil {
+		return err
+	}
+
+	// Handle the signed connection as a new request.
+	buffered, err := r.reader.Peek(r.reader.Buffered())
+	if err != nil {
+		return err
+	}
+	c := &bufferedConn{Conn: r.conn, reader: io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), r.conn)}
+	signed := newRequest(conn.NewHMACConn(c, conn.HMACSessionKey(secret, clientNonce, serverNonce), false), s.timeout)
+	signed.hmacSecret = secret
+	signed.slot, r.slot, r.detached = r.slot, false, true
+	return s.handleRequest(signed)
+}
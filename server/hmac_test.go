@@ -0,0 +1,170 @@
+// server/hmac_test.go
+// Tests for signing connections with an HMAC.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/conn"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// A connection which flips a bit of the byte at an offset of the data
+// written.
+type tamperingConn struct {
+	net.Conn
+	offset int
+}
+
+func (c *tamperingConn) Write(p []byte) (int, error) {
+	if c.offset >= 0 && c.offset < len(p) {
+		p = append([]byte{}, p...)
+		p[c.offset] ^= 1
+	}
+	c.offset -= len(p)
+	return c.Conn.Write(p)
+}
+
+// Send a raw request to a test server over a connection signed with a secret,
+// flipping a bit of the signed frames at an offset if it isn't negative.
+// Returns the response after the protocol header, or the error reading it.
+func signedRawRequest(t *testing.T, s *server, key string, secret []byte, command, args string, offset int) (string, error) {
+	t.Helper()
+	c, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Exchange nonces.
+	clientNonce := make([]byte, conn.HMACNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte(protocol.HMACHeader + "\n" + key + "\n" + hex.EncodeToString(clientNonce) + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNonce, err := hex.DecodeString(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		t.Fatalf("invalid nonce %q", line)
+	}
+
+	// Send the request in signed frames.
+	signed := conn.NewHMACConn(&tamperingConn{Conn: c, offset: offset}, conn.HMACSessionKey(secret, clientNonce, serverNonce), true)
+	request := strings.Join([]string{protocol.Header, key, command, strconv.Itoa(len(args))}, "\n") + "\n" + args + "0\n"
+	if _, err := signed.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(signed)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(string(response), protocol.Header+"\n"), nil
+}
+
+func TestHMACSigning(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetHMACSecret([]byte("global"))
+		a.AddKey("keyed", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+		a.SetHMACSecret("keyed", []byte("own"))
+	})
+
+	// Connections signed with the wrong secret are dropped by the server.
+	tests := []struct {
+		name   string
+		key    string
+		secret []byte
+		valid  bool
+		err    string
+	}{
+		{"unsigned", testAdminKey, nil, false, "message signing required"},
+		{"global secret", testAdminKey, []byte("global"), true, ""},
+		{"wrong secret", testAdminKey, []byte("wrong"), false, ""},
+		{"key secret", "keyed", []byte("own"), true, ""},
+		{"global secret for a key with its own", "keyed", []byte("global"), false, ""},
+	}
+	for _, test := range tests {
+		c := newTestClient(t, s, test.key)
+		c.SetHMACSecret(test.secret)
+		err := c.Ping()
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.valid && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestHMACStreaming(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.SetHMACSecret(testAdminKey, []byte("secret"))
+	})
+	c := newTestClient(t, s, testAdminKey)
+	c.SetHMACSecret([]byte("secret"))
+
+	// Data spanning many frames is written and read back intact.
+	data := make([]byte, 5*conn.MaxHMACFrameSize+123)
+	rand.Read(data)
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("d1", "file", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := os.ReadFile(filepath.Join(dir, "d1", "file")); err != nil || !bytes.Equal(written, data) {
+		t.Fatalf("wrote %d bytes: %v", len(written), err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := c.Read("d1", "file", buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("read %d bytes: %v", buf.Len(), err)
+	}
+}
+
+func TestHMACTamperedRequest(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.SetHMACSecret(testAdminKey, []byte("secret"))
+	})
+
+	// Untampered requests are served.
+	response, err := signedRawRequest(t, s, testAdminKey, []byte("secret"), "mkdir", "d1\nsigned\n", -1)
+	if err != nil || !strings.HasPrefix(response, "SUCCESS\n") {
+		t.Fatalf("got %q: %v", response, err)
+	}
+
+	// Tampering with the length, the data, or the MAC of the frame drops the
+	// connection without serving the request. The request is sent in one
+	// frame: its length, the request, and a SHA-256 MAC.
+	args := "d1\ntampered\n"
+	frameSize := 4 + len(strings.Join([]string{protocol.Header, testAdminKey, "mkdir", strconv.Itoa(len(args))}, "\n")+"\n"+args+"0\n") + 32
+	for _, offset := range []int{0, 20, frameSize - 1} {
+		response, err := signedRawRequest(t, s, testAdminKey, []byte("secret"), "mkdir", args, offset)
+		if err == nil && response != "" {
+			t.Errorf("tampered at %d: got %q", offset, response)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "signed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "tampered")); !os.IsNotExist(err) {
+		t.Fatalf("tampered request served: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+// server/http.go
+// Serving drives over HTTP.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// HTTP serving options for a drive. Drives are only served over HTTP if they
+// have options set.
+type HTTPOptions struct {
+	// The index files to serve for a directory, tried in order.
+	IndexFiles []string
+
+	// If directories without an index file are listed. If not, they are
+	// forbidden.
+	Listing bool
+
+	// The content types to serve files with, keyed by lowercase extension
+	// including the leading dot (e.g. ".wasm"). Files with other extensions
+	// have their content type detected.
+	ContentTypes map[string]string
+
+	// Headers to add to every response (e.g. Cache-Control).
+	Headers map[string]string
+}
+
+// The HTTP handler, serving drives at /<drive>/<path>.
+type httpHandler struct {
+	s *server
+}
+
+// A read-only, seekable view of a file on a drive, for serving content.
+type driveFile struct {
+	drive  drive.Drive
+	path   string
+	size   int64
+	offset int64
+}
+
+// A writer into a fixed buffer.
+type bufferWriter struct {
+	buf []byte
+	n   int
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	n := copy(b.buf[b.n:], p)
+	b.n += n
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (f *driveFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	writer := &bufferWriter{buf: p}
+	err := f.drive.ReadRange(f.path, writer, f.offset, int64(len(p)))
+	f.offset += int64(writer.n)
+	if err != nil {
+		return writer.n, err
+	}
+	if writer.n == 0 {
+		return 0, io.EOF
+	}
+	return writer.n, nil
+}
+
+func (f *driveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid whence: %d", whence))
+	}
+	if offset < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid offset: %d", offset))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Get the HTTP handler.
+func (s *server) HTTPHandler() http.Handler {
+	return &httpHandler{s: s}
+}
+
+// Start serving drives over HTTPS, if an HTTP address is set. The listener is
+// bound before returning.
+func (s *server) serveHTTP() error {
+	if s.httpAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.httpAddr)
+	if err != nil {
+		return err
+	}
+	s.httpServer = &http.Server{Handler: s.HTTPHandler()}
+	go func() {
+		err := s.httpServer.Serve(tls.NewListener(listener, s.tlsConfig))
+		if err != nil && err != http.ErrServerClosed {
+			s.err.Println("failed to serve http: ", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Serve a file over HTTP, using the configured content type for its extension
+// if there is one.
+func serveFile(w http.ResponseWriter, r *http.Request, d drive.Drive, filePath string, stat os.FileInfo, options HTTPOptions) {
+	if contentType, ok := options.ContentTypes[strings.ToLower(path.Ext(filePath))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	file := &driveFile{drive: d, path: filePath, size: stat.Size()}
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// Handle an HTTP request.
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get the drive and the path within it.
+	urlPath := path.Clean("/" + r.URL.Path)
+	driveName, filePath, _ := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	options, ok := h.s.httpDrives[driveName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	d, ok := h.s.drives[driveName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.s.DriveHealthy(driveName) {
+		http.Error(w, "drive unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Log the access.
+	if logger := h.s.AccessLog(driveName); logger != nil {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		logger.Println(ip, "http", driveName, "allowed")
+	}
+
+	// Add the configured headers.
+	for key, value := range options.Headers {
+		w.Header().Set(key, value)
+	}
+
+	stat, err := d.Stat(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !stat.IsDir() {
+		h.s.info.Println("http", driveName, filePath)
+		serveFile(w, r, d, filePath, stat, options)
+		return
+	}
+
+	// Redirect directories to their canonical path with a trailing slash.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, urlPath+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	// Serve the first index file present.
+	for _, index := range options.IndexFiles {
+		indexPath := path.Join(filePath, index)
+		indexStat, err := d.Stat(indexPath)
+		if err != nil || indexStat.IsDir() {
+			continue
+		}
+		h.s.info.Println("http", driveName, indexPath)
+		serveFile(w, r, d, indexPath, indexStat, options)
+		return
+	}
+
+	if !options.Listing {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// List the directory.
+	items, err := d.ReadDir(filePath)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.s.info.Println("http", driveName, filePath)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for i := range items {
+		name := items[i].Name()
+		if items[i].IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
@@ -0,0 +1,212 @@
+// server/http_test.go
+// Tests for serving drives over HTTP.
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// Create a server serving a drive over HTTP with options. Returns the server
+// and the directory of the drive.
+func newHTTPTestServer(t *testing.T, options HTTPOptions) (*server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"file.txt":        "hello",
+		"site/index.html": "<p>index</p>",
+		"list/a":          "a",
+		"list/sub/b":      "b",
+		"list/<odd> name": "odd",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer().(*server)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	s.SetDrives(map[string]drive.Drive{"web": drive.NewDrive(dir), "private": drive.NewDrive(dir)})
+	s.SetHTTPDrives(map[string]HTTPOptions{"web": options})
+	return s, dir
+}
+
+// Make an HTTP request to a handler.
+func httpRequest(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPServing(t *testing.T) {
+	s, _ := newHTTPTestServer(t, HTTPOptions{IndexFiles: []string{"missing.html", "index.html"}})
+	h := s.HTTPHandler()
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		body   string
+	}{
+		{"file", "GET", "/web/file.txt", http.StatusOK, "hello"},
+		{"head", "HEAD", "/web/file.txt", http.StatusOK, ""},
+		{"index file", "GET", "/web/site/", http.StatusOK, "<p>index</p>"},
+		{"directory without a slash", "GET", "/web/site", http.StatusMovedPermanently, ""},
+		{"directory without an index", "GET", "/web/list/", http.StatusForbidden, ""},
+		{"missing file", "GET", "/web/missing", http.StatusNotFound, ""},
+		{"escaping the drive", "GET", "/web/../private/file.txt", http.StatusNotFound, ""},
+		{"drive not served", "GET", "/private/file.txt", http.StatusNotFound, ""},
+		{"write", "PUT", "/web/file.txt", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httpRequest(h, test.method, test.target, nil)
+			if w.Code != test.status {
+				t.Fatalf("status %d, expected %d", w.Code, test.status)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Fatalf("body %q, expected %q", w.Body.String(), test.body)
+			}
+		})
+	}
+
+	if location := httpRequest(h, "GET", "/web/site", nil).Header().Get("Location"); location != "/web/site/" {
+		t.Errorf("redirected to %q", location)
+	}
+	w := httpRequest(h, "GET", "/web/file.txt", http.Header{"Range": {"bytes=1-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "ell" {
+		t.Errorf("range request returned %d %q", w.Code, w.Body.String())
+	}
+
+	// Unhealthy drives aren't served.
+	s.unhealthyDrives = map[string]bool{"web": true}
+	if w := httpRequest(h, "GET", "/web/file.txt", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unhealthy drive returned %d", w.Code)
+	}
+}
+
+func TestHTTPListing(t *testing.T) {
+	s, _ := newHTTPTestServer(t, HTTPOptions{Listing: true})
+	w := httpRequest(s.HTTPHandler(), "GET", "/web/list/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, entry := range []string{`<a href="a">a</a>`, `<a href="sub/">sub/</a>`, "&lt;odd&gt; name"} {
+		if !strings.Contains(body, entry) {
+			t.Errorf("listing missing %s: %s", entry, body)
+		}
+	}
+	if strings.Contains(body, "<odd>") {
+		t.Errorf("listing not escaped: %s", body)
+	}
+}
+
+func TestHTTPAccessLog(t *testing.T) {
+	s, _ := newHTTPTestServer(t, HTTPOptions{})
+	var logs strings.Builder
+	s.SetAccessLog("web", log.New(&logs, "", 0))
+	httpRequest(s.HTTPHandler(), "GET", "/web/file.txt", nil)
+	if got, want := logs.String(), "192.0.2.1 http web allowed\n"; got != want {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+}
+
+func TestConfigHTTP(t *testing.T) {
+	dir := t.TempDir()
+	s, err := loadTestConfig(t, `
+HTTPAddress = "127.0.0.1:0"
+
+[[Drive]]
+Name = "web"
+Path = "`+filepath.ToSlash(dir)+`"
+HTTP = true
+IndexFiles = ["index.html"]
+Listing = true
+
+[[Drive]]
+Name = "private"
+Path = "`+filepath.ToSlash(dir)+`"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HTTPAddress() != "127.0.0.1:0" {
+		t.Errorf("HTTP address %q", s.HTTPAddress())
+	}
+	options, ok := s.HTTPDrives()["web"]
+	if !ok || !options.Listing || len(options.IndexFiles) != 1 || options.IndexFiles[0] != "index.html" {
+		t.Errorf("HTTP options %+v", options)
+	}
+	if _, ok := s.HTTPDrives()["private"]; ok {
+		t.Error("drive without HTTP served")
+	}
+}
+
+func TestHTTPContentTypesAndHeaders(t *testing.T) {
+	s, _ := newHTTPTestServer(t, HTTPOptions{
+		IndexFiles:   []string{"index.html"},
+		ContentTypes: map[string]string{".txt": "text/x-custom"},
+		Headers:      map[string]string{"Cache-Control": "no-store"},
+	})
+	h := s.HTTPHandler()
+	tests := []struct {
+		target      string
+		status      int
+		contentType string
+	}{
+		{"/web/file.txt", http.StatusOK, "text/x-custom"},
+		{"/web/site/", http.StatusOK, "text/html; charset=utf-8"},
+		{"/web/missing", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := httpRequest(h, "GET", test.target, nil)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, expected %d", test.target, w.Code, test.status)
+		}
+		if test.contentType != "" && w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s: content type %q, expected %q", test.target, w.Header().Get("Content-Type"), test.contentType)
+		}
+		if w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: headers not added: %v", test.target, w.Header())
+		}
+	}
+}
+
+func TestConfigHTTPContentTypes(t *testing.T) {
+	s, err := loadTestConfig(t, `
+[[Drive]]
+Name = "web"
+Path = "`+filepath.ToSlash(t.TempDir())+`"
+HTTP = true
+ContentTypes = { TXT = "text/plain", ".Wasm" = "application/wasm" }
+Headers = { Cache-Control = "no-store" }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := s.HTTPDrives()["web"]
+	if options.ContentTypes[".txt"] != "text/plain" || options.ContentTypes[".wasm"] != "application/wasm" || len(options.ContentTypes) != 2 {
+		t.Errorf("content types not normalized: %v", options.ContentTypes)
+	}
+	if options.Headers["Cache-Control"] != "no-store" {
+		t.Errorf("headers %v", options.Headers)
+	}
+}
@@ -0,0 +1,191 @@
+// server/idempotency.go
+// Idempotency keys, which make retries of mutating requests safe.
+
+package server
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// The flag requests carry their idempotency key in.
+const IdempotencyFlag = "idempotency"
+
+// The default time the outcomes of requests with idempotency keys are kept
+// for, and the default maximum number of outcomes kept.
+const (
+	DefaultIdempotencyWindow  = 10 * time.Minute
+	DefaultMaxIdempotencyKeys = 10000
+)
+
+// The commands which may be sent with idempotency keys. Their responses are
+// small, so they can be kept and replayed.
+var idempotentCommands = map[string]bool{
+	"create":         true,
+	"createsized":    true,
+	"createtemp":     true,
+	"mkdir":          true,
+	"write":          true,
+	"writeat":        true,
+	"append":         true,
+	"appendrecord":   true,
+	"cas":            true,
+	"remove":         true,
+	"move":           true,
+	"movecrossdrive": true,
+	"copy":           true,
+	"chown":          true,
+	"restoreversion": true,
+	"commit":         true,
+	"batch":          true,
+}
+
+// The outcome of a request with an idempotency key.
+type idempotencyEntry struct {
+	key     string
+	command string
+	created time.Time
+
+	// Closed once the request has finished. The response is nil if the
+	// request failed before responding, in which case it may be retried.
+	done     chan struct{}
+	response []byte
+}
+
+// The outcomes of recent requests with idempotency keys, keyed by the
+// authentication key and the idempotency key.
+type idempotencyStore struct {
+	lock    sync.Mutex
+	entries map[string]*idempotencyEntry
+	order   []*idempotencyEntry
+}
+
+// Begin a request with an idempotency key. Returns the existing entry and
+// false if the key has been seen, otherwise a new entry and true.
+func (store *idempotencyStore) begin(key, command string, window time.Duration, max int) (*idempotencyEntry, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.entries == nil {
+		store.entries = map[string]*idempotencyEntry{}
+	}
+	store.prune(window, max)
+	if entry, ok := store.entries[key]; ok {
+		return entry, false
+	}
+	entry := &idempotencyEntry{key: key, command: command, created: time.Now(), done: make(chan struct{})}
+	store.entries[key] = entry
+	store.order = append(store.order, entry)
+	return entry, true
+}
+
+// Remove the oldest entries which have expired or are over the limit. Entries
+// of requests still running are kept. The lock must be held.
+func (store *idempotencyStore) prune(window time.Duration, max int) {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	if max <= 0 {
+		max = DefaultMaxIdempotencyKeys
+	}
+	cutoff := time.Now().Add(-window)
+	kept := store.order[:0]
+	excess := len(store.order) - max + 1
+	for _, entry := range store.order {
+		if store.entries[entry.key] != entry {
+			// Already released.
+			continue
+		}
+		select {
+		case <-entry.done:
+			if excess > 0 || entry.created.Before(cutoff) {
+				delete(store.entries, entry.key)
+				excess--
+				continue
+			}
+		default:
+		}
+		kept = append(kept, entry)
+	}
+	for i := len(kept); i < len(store.order); i++ {
+		store.order[i] = nil
+	}
+	store.order = kept
+}
+
+// Finish a request, keeping its response. A nil response releases the key, so
+// the request may be retried.
+func (store *idempotencyStore) finish(entry *idempotencyEntry, response []byte) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entry.response = response
+	if response == nil && store.entries[entry.key] == entry {
+		delete(store.entries, entry.key)
+	}
+	close(entry.done)
+}
+
+// Get the limits of idempotency keys.
+func (s *server) IdempotencyLimits() (time.Duration, int) {
+	return s.idempotencyWindow, s.maxIdempotencyKeys
+}
+
+// Set the limits of idempotency keys.
+func (s *server) SetIdempotencyLimits(window time.Duration, maxKeys int) {
+	s.idempotencyWindow = window
+	s.maxIdempotencyKeys = maxKeys
+}
+
+// Handle a request with an idempotency key. The first request with the key is
+// executed and its response kept. Retries wait for it to finish, then are
+// sent the same response without being executed.
+func (s *server) handleIdempotent(r *request, function func(*request) error, id string) error {
+	key := r.key + "\n" + id
+	for {
+		entry, first := s.idempotency.begin(key, r.command, s.idempotencyWindow, s.maxIdempotencyKeys)
+		if first {
+			// Execute the request, holding its response until it is kept.
+			r.response = &bytes.Buffer{}
+			err := function(r)
+			response := r.response.Bytes()
+			r.response = nil
+			if len(response) == 0 {
+				s.idempotency.finish(entry, nil)
+				return err
+			}
+			s.idempotency.finish(entry, response)
+			if err != nil {
+				return err
+			}
+			_, err = r.writer.Write(response)
+			return err
+		}
+
+		// Wait for the first request to finish.
+		select {
+		case <-entry.done:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+		if entry.response == nil {
+			// It failed before responding, so try again.
+			continue
+		}
+
+		// Replay its response.
+		if err := r.consume(); err != nil {
+			return err
+		}
+		if err := r.consume(); err != nil {
+			return err
+		}
+		if entry.command != r.command {
+			return r.sendError("idempotency key already used for another command")
+		}
+		s.info.Println("replayed", r.command, id)
+		_, err := r.writer.Write(entry.response)
+		return err
+	}
+}
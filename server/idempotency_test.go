@@ -0,0 +1,115 @@
+// server/idempotency_test.go
+// Tests for idempotency keys.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+)
+
+func TestIdempotencyReplay(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("other", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	c := newTestClient(t, s, testAdminKey)
+	appendOnce := func(c client.Client, key string) error {
+		return c.WithIdempotencyKey(key).Append("d1", "log", 2, strings.NewReader("x\n"))
+	}
+
+	// Retries with the same key aren't executed again, and are sent the
+	// outcome of the first request.
+	key := client.NewIdempotencyKey()
+	for i := 0; i < 3; i++ {
+		if err := appendOnce(c, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.WithIdempotencyKey(key).Mkdir("d1", "log", false); err == nil || !strings.Contains(err.Error(), "idempotency key already used for another command") {
+		t.Fatalf("got %v, want an idempotency key already used error", err)
+	}
+	mkdirKey := client.NewIdempotencyKey()
+	for i := 0; i < 2; i++ {
+		if err := c.WithIdempotencyKey(mkdirKey).Mkdir("d1", "dir", false); err != nil {
+			t.Fatalf("retry %d: %v", i, err)
+		}
+	}
+
+	// Other keys and other authentication keys are executed.
+	if err := appendOnce(c, client.NewIdempotencyKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendOnce(newTestClient(t, s, "other"), key); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d1", "log")); err != nil || string(data) != "x\nx\nx\n" {
+		t.Fatalf("appended %q: %v", data, err)
+	}
+
+	// Requests without a key are executed each time.
+	if err := c.Mkdir("d1", "dir", false); err == nil {
+		t.Fatal("created an existing directory")
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey).WithIdempotencyKey(client.NewIdempotencyKey())
+
+	// Concurrent retries wait for the first request, then share its outcome.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Append("d1", "log", 2, strings.NewReader("x\n")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if data, err := os.ReadFile(filepath.Join(dir, "d1", "log")); err != nil || string(data) != "x\n" {
+		t.Fatalf("appended %q: %v", data, err)
+	}
+}
+
+func TestIdempotencyStorePrune(t *testing.T) {
+	store := &idempotencyStore{}
+	finished := func(key string) {
+		entry, first := store.begin(key, "mkdir", time.Hour, 2)
+		if !first {
+			t.Fatalf("%s already seen", key)
+		}
+		store.finish(entry, []byte("response"))
+	}
+
+	// Only the newest outcomes are kept.
+	finished("a")
+	finished("b")
+	finished("c")
+	if _, first := store.begin("a", "mkdir", time.Hour, 2); !first {
+		t.Fatal("oldest outcome kept over the limit")
+	}
+
+	// Requests which failed before responding may be retried.
+	entry, _ := store.begin("failed", "mkdir", time.Hour, 10)
+	store.finish(entry, nil)
+	if _, first := store.begin("failed", "mkdir", time.Hour, 10); !first {
+		t.Fatal("failed request not released")
+	}
+
+	// Outcomes older than the window are removed.
+	store = &idempotencyStore{}
+	finished("old")
+	time.Sleep(20 * time.Millisecond)
+	if _, first := store.begin("old", "mkdir", 10*time.Millisecond, 10); !first {
+		t.Fatal("expired outcome kept")
+	}
+}
@@ -0,0 +1,51 @@
+// server/keepalive_test.go
+// Tests for connections kept alive between requests.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestKeepAliveReleasesWorker(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		secret := []byte(nil)
+		if signed {
+			secret = []byte("secret")
+		}
+		s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+			s.SetNumWorkers(1)
+			a.SetHMACSecret(testAdminKey, secret)
+		})
+
+		// Leave an idle connection in the pool of a client.
+		pooled := newTestClient(t, s, testAdminKey)
+		pooled.SetHMACSecret(secret)
+		pooled.SetMaxIdleConns(2)
+		if err := pooled.Ping(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The idle connection doesn't hold the only worker, so other clients
+		// are served before it times out.
+		other := newTestClient(t, s, testAdminKey)
+		other.SetHMACSecret(secret)
+		start := time.Now()
+		if err := other.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("client waited %v for the worker (signed: %v)", elapsed, signed)
+		}
+
+		// The idle connection is still served.
+		for i := 0; i < 3; i++ {
+			if err := pooled.Ping(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// server/keyquota.go
+// Per-key storage quotas, tracking the bytes stored by each key.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// The files stored by keys with quotas, and the bytes they use. Keys are
+// identified by their hash, so the usage file doesn't hold them.
+type keyUsageStore struct {
+	lock sync.Mutex
+
+	// The file the usage is persisted to. Empty keeps it in memory only.
+	path string
+
+	// The files stored by each key, by drive and path, and the total size
+	// stored by each key.
+	files  map[string]map[string]keyFile
+	totals map[string]int64
+}
+
+// A file stored by a key.
+type keyFile struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Load the usage from a file. A missing file starts with no usage.
+func (store *keyUsageStore) load(path string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.path = path
+	store.files = map[string]map[string]keyFile{}
+	store.totals = map[string]int64{}
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &store.files); err != nil {
+		return err
+	}
+	for _, files := range store.files {
+		for _, file := range files {
+			store.totals[file.Key] += file.Size
+		}
+	}
+	return nil
+}
+
+// Save the usage to its file. The lock must be held.
+func (store *keyUsageStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(store.files)
+	if err != nil {
+		return err
+	}
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
+
+// Clean a path, so each file has one key.
+func cleanKeyPath(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+}
+
+// Get the bytes stored by a key.
+func (store *keyUsageStore) usage(key string) int64 {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.totals[key]
+}
+
+// Check that storing files of given sizes, keyed by path, would keep a key
+// within its quota. The current sizes of the files, if the key stored them,
+// are not counted.
+func (store *keyUsageStore) check(key, driveName string, sizes map[string]int64, quota int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	usage := store.totals[key]
+	for path, size := range sizes {
+		if file, ok := store.files[driveName][cleanKeyPath(path)]; ok && file.Key == key {
+			usage -= file.Size
+		}
+		usage += size
+	}
+	if usage > quota {
+		return errors.New("key quota exceeded")
+	}
+	return nil
+}
+
+// Record the size of a file stored by a key. An empty key leaves the file
+// unattributed.
+func (store *keyUsageStore) record(key, driveName, path string, size int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.files == nil {
+		store.files = map[string]map[string]keyFile{}
+		store.totals = map[string]int64{}
+	}
+	path = cleanKeyPath(path)
+	files := store.files[driveName]
+	if file, ok := files[path]; ok {
+		store.totals[file.Key] -= file.Size
+		delete(files, path)
+	} else if key == "" {
+		return nil
+	}
+	if key != "" {
+		if files == nil {
+			files = map[string]keyFile{}
+			store.files[driveName] = files
+		}
+		files[path] = keyFile{Key: key, Size: size}
+		store.totals[key] += size
+	}
+	return store.save()
+}
+
+// Forget the files at or under a path, once they have been removed.
+func (store *keyUsageStore) forget(driveName, path string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.take(driveName, cleanKeyPath(path)) == nil {
+		return nil
+	}
+	return store.save()
+}
+
+// Move the files at or under a path to another path.
+func (store *keyUsageStore) move(driveName, src, dest string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	src, dest = cleanKeyPath(src), cleanKeyPath(dest)
+	moved := store.take(driveName, src)
+	replaced := store.take(driveName, dest)
+	if moved == nil && replaced == nil {
+		return nil
+	}
+	for path, file := range moved {
+		if store.files[driveName] == nil {
+			store.files[driveName] = map[string]keyFile{}
+		}
+		store.files[driveName][dest+strings.TrimPrefix(path, src)] = file
+		store.totals[file.Key] += file.Size
+	}
+	return store.save()
+}
+
+// Remove the files at or under a path, returning them. The lock must be held.
+func (store *keyUsageStore) take(driveName, path string) map[string]keyFile {
+	var taken map[string]keyFile
+	for filePath, file := range store.files[driveName] {
+		if filePath == path || path == "" || strings.HasPrefix(filePath, path+"/") {
+			if taken == nil {
+				taken = map[string]keyFile{}
+			}
+			taken[filePath] = file
+			store.totals[file.Key] -= file.Size
+			delete(store.files[driveName], filePath)
+		}
+	}
+	return taken
+}
+
+// Get the file the usage of keys with quotas is persisted to.
+func (s *server) KeyUsageFile() string {
+	s.keyUsage.lock.Lock()
+	defer s.keyUsage.lock.Unlock()
+	return s.keyUsage.path
+}
+
+// Set the file the usage of keys with quotas is persisted to, loading it.
+func (s *server) SetKeyUsageFile(path string) error {
+	return s.keyUsage.load(path)
+}
+
+// Check that storing a file of a given size would keep the key of a request
+// within its quota.
+func (s *server) checkKeyQuota(r *request, driveName, path string, size int64) error {
+	return s.checkKeyQuotaFiles(r, driveName, map[string]int64{path: size})
+}
+
+// Check that storing files of given sizes, keyed by path, would keep the key
+// of a request within its quota.
+func (s *server) checkKeyQuotaFiles(r *request, driveName string, sizes map[string]int64) error {
+	if r.permissions.QuotaBytes <= 0 {
+		return nil
+	}
+	return s.keyUsage.check(auth.HashKey(r.key), driveName, sizes, r.permissions.QuotaBytes)
+}
+
+// Record a file stored by the key of a request. Files stored by keys without
+// quotas are left unattributed.
+func (s *server) recordKeyUsage(r *request, d drive.Drive, driveName, path string) {
+	size := int64(0)
+	if r.permissions.QuotaBytes > 0 {
+		stat, err := d.Stat(path)
+		if err != nil {
+			return
+		}
+		size = stat.Size()
+	}
+	s.recordKeyUsageSize(r, driveName, path, size)
+}
+
+// Record a file of a known size stored by the key of a request.
+func (s *server) recordKeyUsageSize(r *request, driveName, path string, size int64) {
+	key := ""
+	if r.permissions.QuotaBytes > 0 {
+		key = auth.HashKey(r.key)
+	} else {
+		size = 0
+	}
+	if err := s.keyUsage.record(key, driveName, path, size); err != nil {
+		s.err.Println("failed to save key usage:", err)
+	}
+}
+
+// Forget the files at or under a path, once they have been removed.
+func (s *server) forgetKeyUsage(driveName, path string) {
+	if err := s.keyUsage.forget(driveName, path); err != nil {
+		s.err.Println("failed to save key usage:", err)
+	}
+}
+
+// Move the usage of the files at or under a path to another path.
+func (s *server) moveKeyUsage(driveName, src, dest string) {
+	if err := s.keyUsage.move(driveName, src, dest); err != nil {
+		s.err.Println("failed to save key usage:", err)
+	}
+}
+
+// Key quota command. Replies with the bytes stored by the key of the request
+// and its quota, which is zero if it is unlimited.
+func (s *server) keyQuotaCommand(r *request) error {
+	// Consume.
+	if err := r.consume(); err != nil {
+		return err
+	}
+	if err := r.consume(); err != nil {
+		return err
+	}
+
+	usage := int64(0)
+	if r.permissions.QuotaBytes > 0 {
+		usage = s.keyUsage.usage(auth.HashKey(r.key))
+	}
+	return r.sendSuccess(strconv.FormatInt(usage, 10) + "\n" + strconv.FormatInt(r.permissions.QuotaBytes, 10) + "\n")
+}
@@ -0,0 +1,225 @@
+// server/keyquota_test.go
+// Tests for per-key storage quotas.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// Create a file on a drive and write data to it.
+func writeKeyFile(c client.Client, drive, path, data string) error {
+	if err := c.Create(drive, path); err != nil {
+		return err
+	}
+	_, err := c.Write(drive, path, int64(len(data)), strings.NewReader(data))
+	return err
+}
+
+// Check the usage and quota of a key.
+func checkKeyQuota(t *testing.T, c client.Client, used, quota int64) {
+	t.Helper()
+	gotUsed, gotQuota, err := c.KeyQuota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotUsed != used || gotQuota != quota {
+		t.Fatalf("used %d of %d bytes, want %d of %d", gotUsed, gotQuota, used, quota)
+	}
+}
+
+func TestKeyQuota(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("limited", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "d2"}, CanWrite: true, QuotaBytes: 10})
+	})
+	c := newTestClient(t, s, "limited")
+
+	// The quota is shared across drives.
+	if err := writeKeyFile(c, "d1", "a", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(c, "d2", "b", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 10, 10)
+	if err := c.Append("d2", "b", 1, strings.NewReader("5")); err == nil || !strings.Contains(err.Error(), "key quota exceeded") {
+		t.Fatalf("got %v, want a key quota exceeded error", err)
+	}
+	if err := c.Copy("d1", "a", "c"); err == nil || !strings.Contains(err.Error(), "key quota exceeded") {
+		t.Fatalf("got %v, want a key quota exceeded error", err)
+	}
+
+	// Overwriting a file only counts its new size.
+	if _, err := c.Write("d1", "a", 2, strings.NewReader("12")); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 6, 10)
+
+	// Moving keeps the usage, and removing frees it.
+	if err := c.Move("d2", "b", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 6, 10)
+	if err := c.Remove("d2", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 2, 10)
+	if err := writeKeyFile(c, "d2", "c", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files written by other keys aren't counted, and keys without quotas are
+	// unlimited.
+	admin := newTestClient(t, s, testAdminKey)
+	if err := writeKeyFile(admin, "d1", "big", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 10, 10)
+	checkKeyQuota(t, admin, 0, 0)
+}
+
+func TestKeyUsageFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	// The usage is persisted, and loaded again.
+	store := &keyUsageStore{}
+	if err := store.load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"dir/a", "dir/b", "c"} {
+		if err := store.record("key", "d1", file, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.forget("d1", "/dir/../c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.move("d1", "dir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	store = &keyUsageStore{}
+	if err := store.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if usage := store.usage("key"); usage != 10 {
+		t.Fatalf("loaded usage %d, want 10", usage)
+	}
+
+	// Removing a directory forgets the files under it.
+	if err := store.forget("d1", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if usage := store.usage("key"); usage != 0 {
+		t.Fatalf("usage %d after removing, want 0", usage)
+	}
+}
+
+// Check that an error is a key quota exceeded error.
+func checkQuotaExceeded(t *testing.T, err error) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), "key quota exceeded") {
+		t.Fatalf("got %v, want a key quota exceeded error", err)
+	}
+}
+
+func TestKeyQuotaWritePaths(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.drives["d2"] = drive.NewVersionedDrive(s.drives["d2"], 10, time.Hour)
+		a.AddKey("limited", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "d2"}, CanWrite: true, QuotaBytes: 10})
+	})
+	c := newTestClient(t, s, "limited")
+
+	// Sized files and swapped contents count.
+	checkQuotaExceeded(t, c.CreateSized("d1", "a", 11))
+	if err := c.CreateSized("d1", "a", 4); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 4, 10)
+	_, err := c.CompareAndSwap("d1", "a", make([]byte, 4), []byte("12345678901"))
+	checkQuotaExceeded(t, err)
+	if _, err := c.CompareAndSwap("d1", "a", make([]byte, 4), []byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 6, 10)
+
+	// Records count with their framing.
+	checkQuotaExceeded(t, c.AppendRecord("d1", "r", []byte("xx")))
+	if err := c.Remove("d1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AppendRecord("d1", "r", []byte("xx")); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 6, 10)
+
+	// Transactions are checked on commit, and their removes and moves are
+	// applied to the usage.
+	txn, err := c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"t1", "t2"} {
+		if err := txn.Write(path, 3, strings.NewReader("abc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkQuotaExceeded(t, txn.Commit())
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "t1")); err == nil {
+		t.Fatal("transaction over the quota was committed")
+	}
+	txn, err = c.Begin("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Remove("r"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Write("t1", 3, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Move("t1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 3, 10)
+	if err := c.Remove("d1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 0, 10)
+
+	// Restored versions count at their size.
+	if err := writeKeyFile(c, "d2", "v", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write("d2", "v", 2, strings.NewReader("12")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(c, "d1", "big", "12345"); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := c.ListVersions("d2", "v")
+	if err != nil || len(versions) == 0 {
+		t.Fatalf("got %d versions: %v", len(versions), err)
+	}
+	checkQuotaExceeded(t, c.RestoreVersion("d2", "v", versions[0].ID))
+	if err := c.Remove("d1", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestoreVersion("d2", "v", versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyQuota(t, c, 8, 10)
+}
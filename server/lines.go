@@ -0,0 +1,96 @@
+// server/lines.go
+// Reading ranges of lines from files.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// The maximum number of lines, and the maximum total size of the lines, read
+// by a single readlines command.
+const (
+	maxReadLines     = 10000
+	maxReadLinesSize = 16 << 20
+)
+
+// The error the reader is closed with once enough lines have been read.
+var errEnoughLines = errors.New("enough lines read")
+
+// Read a range of lines from a file, starting at the line at index start.
+// The file is streamed, skipping the lines before the range, and reading
+// stops once the range has been read. Lines past the end of the file are not
+// returned. A final line without a trailing newline counts as a line.
+func readLines(d drive.Drive, path string, start, count int) ([]string, error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := d.Read(path, writer)
+		writer.CloseWithError(err)
+		done <- err
+	}()
+
+	lines := []string{}
+	err := func() error {
+		buffered := bufio.NewReader(reader)
+		size := 0
+		for i := 0; len(lines) < count; i++ {
+			line, err := readLine(buffered, i >= start, maxReadLinesSize-size)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if i >= start {
+				lines = append(lines, line)
+				size += len(line)
+			}
+		}
+		return nil
+	}()
+
+	// Stop reading the file.
+	reader.CloseWithError(errEnoughLines)
+	if readErr := <-done; readErr != nil && err == nil && !errors.Is(readErr, errEnoughLines) {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Read a line, without its trailing newline. If the line isn't kept, it is
+// skipped without being buffered. Kept lines may be at most max bytes.
+// Returns io.EOF once there are no more lines.
+func readLine(r *bufio.Reader, keep bool, max int) (string, error) {
+	line := []byte{}
+	read := false
+	for {
+		slice, err := r.ReadSlice('\n')
+		read = read || len(slice) > 0
+		if keep {
+			if len(line)+len(slice) > max {
+				return "", errors.New(fmt.Sprintf("lines too large, the maximum is %d bytes", maxReadLinesSize))
+			}
+			line = append(line, slice...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF {
+			if !read {
+				return "", io.EOF
+			}
+			return string(line), nil
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(line), "\n"), nil
+	}
+}
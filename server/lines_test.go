@@ -0,0 +1,83 @@
+// server/lines_test.go
+// Tests for reading ranges of lines from files.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+func TestReadLines(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 10000)
+	files := map[string]string{
+		"lines":    "zero\none\ntwo\nthree\nfour\n",
+		"partial":  "zero\none\ntwo",
+		"blank":    "\n\nlast\n",
+		"long":     long + "\nshort\n" + long + "\n",
+		"empty":    "",
+		"manyLong": strings.Repeat(long+"\n", 100),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := drive.NewDrive(dir)
+
+	tests := []struct {
+		path  string
+		start int
+		count int
+		want  string
+	}{
+		{"lines", 0, 5, "zero,one,two,three,four"},
+		{"lines", 1, 2, "one,two"},
+		{"lines", 3, 10, "three,four"},
+		{"lines", 5, 1, ""},
+		{"lines", 100, 1, ""},
+		{"lines", 0, 0, ""},
+		{"partial", 1, 5, "one,two"},
+		{"blank", 0, 3, ",,last"},
+		{"long", 1, 1, "short"},
+		{"long", 2, 1, long},
+		{"empty", 0, 1, ""},
+		{"manyLong", 99, 5, long},
+	}
+	for _, test := range tests {
+		lines, err := readLines(d, test.path, test.start, test.count)
+		if err != nil {
+			t.Errorf("%s %d %d: %v", test.path, test.start, test.count, err)
+			continue
+		}
+		if got := strings.Join(lines, ","); got != test.want {
+			t.Errorf("%s %d %d: read %.40q, want %.40q", test.path, test.start, test.count, got, test.want)
+		}
+	}
+
+	if _, err := readLines(d, "missing", 0, 1); err == nil {
+		t.Error("read lines from a missing file")
+	}
+}
+
+func TestReadLinesTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	line := strings.Repeat("x", maxReadLinesSize/2)
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte(line+"\n"+line+"\n"+line+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	d := drive.NewDrive(dir)
+
+	// Skipped lines don't count towards the maximum size.
+	if lines, err := readLines(d, "file", 1, 1); err != nil || len(lines) != 1 {
+		t.Fatalf("read %d lines: %v", len(lines), err)
+	}
+	if _, err := readLines(d, "file", 0, 3); err == nil || !strings.Contains(err.Error(), "lines too large") {
+		t.Fatalf("got %v, want a lines too large error", err)
+	}
+}
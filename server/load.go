@@ -0,0 +1,84 @@
+// server/load.go
+// Tracking server load.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of seconds the request rate is averaged over.
+const loadWindow = 60
+
+// The minimum backoff suggested to clients of an overloaded server.
+const minBackoff = 100 * time.Millisecond
+
+// Load statistics: the number of busy workers and the number of requests
+// accepted in each second of the window.
+type loadStats struct {
+	active int32
+
+	lock    sync.Mutex
+	seconds [loadWindow]int64
+	counts  [loadWindow]int64
+}
+
+// Record an accepted request.
+func (l *loadStats) record(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	second := now.Unix()
+	i := second % loadWindow
+	if l.seconds[i] != second {
+		l.seconds[i] = second
+		l.counts[i] = 0
+	}
+	l.counts[i]++
+}
+
+// Get the average number of requests per second over the window.
+func (l *loadStats) rate(now time.Time) float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	second := now.Unix()
+	total := int64(0)
+	for i := range l.counts {
+		if second-l.seconds[i] < loadWindow {
+			total += l.counts[i]
+		}
+	}
+	return float64(total) / loadWindow
+}
+
+// Mark a worker as busy or idle.
+func (l *loadStats) setBusy(busy bool) {
+	if busy {
+		atomic.AddInt32(&l.active, 1)
+	} else {
+		atomic.AddInt32(&l.active, -1)
+	}
+}
+
+// Get the number of busy workers.
+func (l *loadStats) busy() int {
+	return int(atomic.LoadInt32(&l.active))
+}
+
+// Get the backoff to suggest to clients. Clients are only asked to back off
+// when every worker is busy and requests are queued, for longer the deeper
+// the queue.
+func (s *server) backoff(queued, busy int) time.Duration {
+	workers := s.workerCount()
+	if queued == 0 || busy < workers || workers == 0 {
+		return 0
+	}
+	backoff := s.timeout * time.Duration(queued) / time.Duration(workers)
+	if backoff < minBackoff {
+		backoff = minBackoff
+	}
+	return backoff
+}
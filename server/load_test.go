@@ -0,0 +1,79 @@
+// server/load_test.go
+// Tests for tracking server load.
+
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadRate(t *testing.T) {
+	l := &loadStats{}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 120; i++ {
+		l.record(start)
+	}
+	l.record(start.Add(30 * time.Second))
+	if rate := l.rate(start.Add(30 * time.Second)); rate != 121.0/loadWindow {
+		t.Fatalf("rate %v", rate)
+	}
+
+	// Requests older than the window aren't counted, even once their slot
+	// is reused.
+	if rate := l.rate(start.Add(loadWindow * time.Second)); rate != 1.0/loadWindow {
+		t.Fatalf("rate %v after the window", rate)
+	}
+	l.record(start.Add(loadWindow * time.Second))
+	if rate := l.rate(start.Add(loadWindow * time.Second)); rate != 2.0/loadWindow {
+		t.Fatalf("rate %v with a reused slot", rate)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &server{timeout: 10 * time.Second}
+	atomic.StoreInt32(&s.liveWorkers, 4)
+	tests := []struct {
+		queued, busy int
+		backoff      time.Duration
+	}{
+		{0, 4, 0},
+		{5, 3, 0},
+		{2, 4, 5 * time.Second},
+		{8, 4, 20 * time.Second},
+	}
+	for _, test := range tests {
+		if backoff := s.backoff(test.queued, test.busy); backoff != test.backoff {
+			t.Errorf("%d queued, %d busy: backoff %v, want %v", test.queued, test.busy, backoff, test.backoff)
+		}
+	}
+
+	// The backoff is never shorter than the minimum.
+	s.timeout = time.Millisecond
+	if backoff := s.backoff(1, 4); backoff != minBackoff {
+		t.Errorf("backoff %v, want %v", backoff, minBackoff)
+	}
+}
+
+func TestLoadCommand(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	for i := 0; i < 3; i++ {
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The load request itself is busy and counted.
+	if info.Queued != 0 || info.QueueSize != 10 || info.Busy != 1 || info.Workers != 5 || info.Backoff != 0 {
+		t.Fatalf("load %+v", info)
+	}
+	if info.RequestRate < 4.0/loadWindow {
+		t.Fatalf("request rate %v", info.RequestRate)
+	}
+}
@@ -0,0 +1,120 @@
+// server/logging.go
+// Structured logging in text or JSON.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+// The log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// A writer for loggers which writes each entry as a JSON object on its own
+// line, with its level and time. Messages logged through the logger are
+// written with a message field, and structured entries with their own fields.
+type jsonLogWriter struct {
+	level string
+	out   io.Writer
+}
+
+// Create a logger which writes JSON entries of a level.
+func newJSONLogger(out io.Writer, level string) *log.Logger {
+	return log.New(&jsonLogWriter{level: level, out: out}, "", 0)
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.writeEntry(map[string]any{"message": strings.TrimSuffix(string(p), "\n")}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write an entry with fields, adding the level and time.
+func (w *jsonLogWriter) writeEntry(fields map[string]any) error {
+	fields["level"] = w.level
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(append(line, '\n'))
+	return err
+}
+
+// Write a structured entry to a logger if it writes JSON, with the fields
+// given as alternating keys and values. Returns false if the logger doesn't
+// write JSON, in which case the entry should be logged as text.
+func logJSON(logger *log.Logger, fields map[string]any, keyvals ...any) bool {
+	writer, ok := logger.Writer().(*jsonLogWriter)
+	if !ok {
+		return false
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	writer.writeEntry(fields)
+	return true
+}
+
+// Log a command handled for a request, with the path it operated on, and any
+// other values as alternating keys and values. Entries carry the IP of the
+// client and the ID of its key, never the key itself. JSON logs carry each as
+// a distinct field. Text logs list the IP and key ID, then the command, the
+// path, and the values.
+func (s *server) logCommand(r *request, path string, keyvals ...any) {
+	s.logRequest(s.info, r, path, keyvals...)
+}
+
+// Log an error of a command handled for a request, with any other values as
+// alternating keys and values, to the error log.
+func (s *server) logCommandError(r *request, err error, keyvals ...any) {
+	s.logRequest(s.err, r, "", append(keyvals, "error", err.Error())...)
+}
+
+// Log an entry for a request to a logger. Must be called by logCommand or
+// logCommandError, so text logs report the file and line of their caller.
+func (s *server) logRequest(logger *log.Logger, r *request, path string, keyvals ...any) {
+	fields := map[string]any{"command": r.command, "ip": r.remoteIP(), "key": r.keyID()}
+	if path != "" {
+		fields["path"] = path
+	}
+	if logJSON(logger, fields, keyvals...) {
+		return
+	}
+
+	values := []any{"ip=" + r.remoteIP(), "key=" + r.keyID(), r.command}
+	if path != "" {
+		values = append(values, path)
+	}
+	for i := 1; i < len(keyvals); i += 2 {
+		values = append(values, keyvals[i])
+	}
+	logger.Output(3, fmt.Sprintln(values...))
+}
+
+// Get the ID of the key of a request, the start of the hash of the key, so
+// requests can be attributed to a key without logging it.
+func (r *request) keyID() string {
+	return auth.HashKey(r.key)[:16]
+}
+
+// Get the IP of the client of a request.
+func (r *request) remoteIP() string {
+	ip, _, err := net.SplitHostPort(r.conn.RemoteAddr().String())
+	if err != nil {
+		return r.conn.RemoteAddr().String()
+	}
+	return ip
+}
@@ -0,0 +1,253 @@
+// server/logging_test.go
+// Tests for logging.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+// A buffer which may be written to by multiple goroutines.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+const testSecretKey = "very-secret-key"
+
+func TestCommandLogs(t *testing.T) {
+	info := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(log.New(info, "", 0), log.New(info, "", 0))
+		a.AddKey(testSecretKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	c := newTestClient(t, s, testSecretKey)
+	if err := c.Create("d1", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("d2", "file"); err == nil {
+		t.Fatal("created a file on a drive which isn't allowed")
+	}
+
+	logs := info.String()
+	keyID := auth.HashKey(testSecretKey)[:16]
+	if strings.Contains(logs, testSecretKey) {
+		t.Fatalf("logs contain the key:\n%s", logs)
+	}
+	if !strings.Contains(logs, "ip=127.0.0.1 key="+keyID+" create file") {
+		t.Fatalf("logs don't attribute the command to the IP and key:\n%s", logs)
+	}
+	if !strings.Contains(logs, "DENIED key="+keyID+" ip=127.0.0.1") {
+		t.Fatalf("logs don't attribute the denial to the IP and key:\n%s", logs)
+	}
+}
+
+func TestCommandLogsJSON(t *testing.T) {
+	info := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(newJSONLogger(info, "info"), newJSONLogger(info, "error"))
+		a.AddKey(testSecretKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	c := newTestClient(t, s, testSecretKey)
+	if err := c.Mkdir("d1", "dir", false); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := info.String()
+	if strings.Contains(logs, testSecretKey) {
+		t.Fatalf("logs contain the key:\n%s", logs)
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		entry := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log entry %q: %v", line, err)
+		}
+		if entry["command"] == "mkdir" {
+			found = true
+			if entry["ip"] != "127.0.0.1" || entry["key"] != auth.HashKey(testSecretKey)[:16] || entry["path"] != "dir" || entry["level"] != "info" {
+				t.Fatalf("wrong fields of the entry: %v", entry)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("no entry for the command:\n%s", logs)
+	}
+}
+
+// A connection with a fixed remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestCommandErrorLogs(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	r := &request{conn: addrConn{addr: addr}, command: "commit", key: testSecretKey}
+	keyID := auth.HashKey(testSecretKey)[:16]
+
+	// Errors are attributed to the IP and key in both formats.
+	text := &syncBuffer{}
+	s := &server{err: log.New(text, "", 0)}
+	s.logCommandError(r, errors.New("disk failure"), "transaction", "t1")
+	if want := "ip=10.0.0.1 key=" + keyID + " commit t1 disk failure\n"; text.String() != want {
+		t.Fatalf("logged %q, want %q", text.String(), want)
+	}
+
+	out := &syncBuffer{}
+	s.err = newJSONLogger(out, "error")
+	s.logCommandError(r, errors.New("disk failure"), "transaction", "t1")
+	entry := map[string]any{}
+	if err := json.Unmarshal([]byte(out.String()), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["ip"] != "10.0.0.1" || entry["key"] != keyID || entry["command"] != "commit" || entry["transaction"] != "t1" || entry["error"] != "disk failure" || entry["level"] != "error" {
+		t.Fatalf("wrong fields of the entry: %v", entry)
+	}
+}
+
+func TestSigningFailureLogsKeyID(t *testing.T) {
+	info := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(log.New(info, "", 0), log.New(info, "", 0))
+		a.AddKey(testSecretKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+	})
+
+	// The key has no secret, so the server can't sign the connection.
+	c := newTestClient(t, s, testSecretKey)
+	c.SetHMACSecret([]byte("secret"))
+	if err := c.Ping(); err == nil {
+		t.Fatal("signed a connection without a secret")
+	}
+
+	logs := info.String()
+	if strings.Contains(logs, testSecretKey) {
+		t.Fatalf("logs contain the key:\n%s", logs)
+	}
+	if !strings.Contains(logs, "no secret for key: "+auth.HashKey(testSecretKey)[:16]) {
+		t.Fatalf("logs don't contain the ID of the key:\n%s", logs)
+	}
+}
+
+func TestSessionsHideKeys(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	sessions, err := c.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Key != auth.HashKey(testAdminKey)[:16] || sessions[0].IP != "127.0.0.1" {
+		t.Fatalf("wrong sessions: %+v", sessions)
+	}
+}
+
+func TestAccessLogs(t *testing.T) {
+	sensitive := &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetAccessLog("d1", log.New(sensitive, "", 0))
+		a.AddKey("d2only", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d2"}})
+	})
+	admin := newTestClient(t, s, testAdminKey)
+	if _, err := admin.List("d1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.List("d2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestClient(t, s, "d2only").List("d1", ""); err == nil {
+		t.Fatal("listed a drive which isn't allowed")
+	}
+
+	// Only accesses to the drive with an access log are logged, including
+	// denied ones.
+	want := "127.0.0.1 list d1 allowed\n127.0.0.1 list d1 denied\n"
+	if got := sensitive.String(); got != want {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+
+	// Removing the logger disables the access log.
+	s.SetAccessLog("d1", nil)
+	if s.AccessLog("d1") != nil {
+		t.Fatal("access log not removed")
+	}
+}
+
+func TestDrivesInfoLogging(t *testing.T) {
+	info, access := &syncBuffer{}, &syncBuffer{}
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetLogger(log.New(info, "", 0), log.New(info, "", 0))
+		s.SetAccessLog("d1", log.New(access, "", 0))
+		s.SetAccessLog("d2", log.New(access, "", 0))
+	})
+	if _, err := newTestClient(t, s, testAdminKey).DrivesInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Describing the drives is logged once, not as an access to each drive.
+	if logs := access.String(); logs != "" {
+		t.Fatalf("logged accesses %q", logs)
+	}
+	if count := strings.Count(info.String(), " drivesinfo "); count != 1 {
+		t.Fatalf("logged the request %d times:\n%s", count, info.String())
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	out := &syncBuffer{}
+	logger := newJSONLogger(out, "error")
+
+	// Plain messages are logged with a message field, and structured entries
+	// with their own fields.
+	logger.Println("plain", "message")
+	if !logJSON(logger, map[string]any{"command": "write"}, "path", "file", "size", 4) {
+		t.Fatal("structured entry not logged as JSON")
+	}
+	if logJSON(log.New(out, "", 0), map[string]any{}) {
+		t.Fatal("text logger logged a JSON entry")
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d entries, want 2:\n%s", len(lines), out.String())
+	}
+	entries := make([]map[string]any, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			t.Fatalf("invalid JSON log entry %q: %v", line, err)
+		}
+		if entries[i]["level"] != "error" || entries[i]["time"] == nil {
+			t.Fatalf("entry without a level and time: %v", entries[i])
+		}
+	}
+	if entries[0]["message"] != "plain message" {
+		t.Fatalf("wrong message: %v", entries[0])
+	}
+	if entries[1]["command"] != "write" || entries[1]["path"] != "file" || entries[1]["size"] != float64(4) {
+		t.Fatalf("wrong fields of the entry: %v", entries[1])
+	}
+}
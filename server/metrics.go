@@ -0,0 +1,143 @@
+// server/metrics.go
+// Exporting metrics to Prometheus.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The command label of requests with unknown commands, so clients can't
+// create arbitrary labels.
+const invalidCommandLabel = "invalid"
+
+// The metrics of the server. Each server has its own registry, so multiple
+// servers can run in one process.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	// The number of requests, failed requests, and their latency, by
+	// command.
+	requests *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+
+	// The number of bytes read from and written to clients.
+	bytesRead    prometheus.Counter
+	bytesWritten prometheus.Counter
+
+	// The number of workers handling a request.
+	busyWorkers prometheus.Gauge
+}
+
+// Create the metrics of a server.
+func newServerMetrics(s *server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "deepwell_requests_total",
+			Help: "The number of requests handled, by command.",
+		}, []string{"command"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "deepwell_request_errors_total",
+			Help: "The number of requests which failed, by command.",
+		}, []string{"command"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "deepwell_request_duration_seconds",
+			Help:    "The time taken to handle requests, by command.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"command"}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "deepwell_read_bytes_total",
+			Help: "The number of bytes read from clients.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "deepwell_written_bytes_total",
+			Help: "The number of bytes written to clients.",
+		}),
+		busyWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "deepwell_busy_workers",
+			Help: "The number of workers handling a request.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.failures, m.latency, m.bytesRead, m.bytesWritten, m.busyWorkers,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "deepwell_workers",
+			Help: "The number of running workers.",
+		}, func() float64 { return float64(s.workerCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "deepwell_queued_requests",
+			Help: "The number of requests waiting for a worker.",
+		}, func() float64 { return float64(len(s.jobs)) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Record a handled request, with the number of bytes read from and written
+// to its connection before it was handled.
+func (m *serverMetrics) recordRequest(command string, r *request, start time.Time, read, written int64) {
+	m.requests.WithLabelValues(command).Inc()
+	if r.failed {
+		m.failures.WithLabelValues(command).Inc()
+	}
+	m.latency.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	m.bytesRead.Add(float64(r.writer.BytesRead() - read))
+	m.bytesWritten.Add(float64(r.writer.BytesWritten() - written))
+}
+
+// Get the label of a command, grouping unknown commands.
+func (s *server) commandLabel(command string) string {
+	if _, ok := s.commands[command]; !ok {
+		return invalidCommandLabel
+	}
+	return command
+}
+
+// Get the address to serve metrics on. Empty if disabled.
+func (s *server) MetricsAddress() string {
+	return s.metricsAddr
+}
+
+// Set the address to serve metrics on. Empty to disable.
+func (s *server) SetMetricsAddress(addr string) {
+	s.metricsAddr = addr
+}
+
+// Get the HTTP handler serving the metrics in the Prometheus format.
+func (s *server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// Start serving metrics over HTTP at /metrics, if a metrics address is set.
+// The listener is bound before returning.
+func (s *server) serveMetrics() error {
+	if s.metricsAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.metricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	s.metricsServer = &http.Server{Handler: mux}
+	go func() {
+		err := s.metricsServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.err.Println("failed to serve metrics: ", err.Error())
+		}
+	}()
+
+	return nil
+}
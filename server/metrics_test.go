@@ -0,0 +1,91 @@
+// server/metrics_test.go
+// Tests for exporting metrics to Prometheus.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+// Wait for the metrics of a server to contain some lines. Requests are
+// recorded after their responses are sent, so they are counted shortly after.
+func waitMetrics(t *testing.T, s *server, lines ...string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := httpRequest(s.MetricsHandler(), "GET", "/metrics", nil).Body.String()
+		missing := ""
+		for _, line := range lines {
+			if !strings.Contains(body, "\n"+line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics don't contain %s:\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	c := newTestClient(t, s, testAdminKey)
+	for i := 0; i < 2; i++ {
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Requests are counted by command, with unknown commands grouped under
+	// one label, so clients can't create labels.
+	for _, command := range []string{"probe1", "probe2"} {
+		rawRequest(t, s, testAdminKey, command, "", nil)
+	}
+	body := waitMetrics(t, s,
+		`deepwell_requests_total{command="ping"} 2`,
+		`deepwell_requests_total{command="invalid"} 2`,
+		`deepwell_request_duration_seconds_count{command="ping"} 2`,
+		"deepwell_workers 5",
+		"deepwell_queued_requests 0",
+	)
+	if strings.Contains(body, "probe") {
+		t.Fatalf("metrics contain an unknown command:\n%s", body)
+	}
+	for _, name := range []string{"deepwell_read_bytes_total", "deepwell_written_bytes_total"} {
+		if !strings.Contains(body, "\n"+name+" ") || strings.Contains(body, "\n"+name+" 0\n") {
+			t.Errorf("%s not counted", name)
+		}
+	}
+}
+
+func TestMetricsAddress(t *testing.T) {
+	addr := freeAddress(t)
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetMetricsAddress(addr)
+	})
+	if err := newTestClient(t, s, testAdminKey).Ping(); err != nil {
+		t.Fatal(err)
+	}
+	waitMetrics(t, s, `deepwell_requests_total{command="ping"} 1`)
+
+	// The metrics are served over HTTP.
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `deepwell_requests_total{command="ping"} 1`) {
+		t.Fatalf("got %d %s: %v", resp.StatusCode, body, err)
+	}
+}
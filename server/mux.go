@@ -0,0 +1,96 @@
+// server/mux.go
+// Multiplexed sessions.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// The maximum number of streams of a multiplexed session handled at once.
+// Further streams wait until one of them is handled.
+const MaxSessionStreams = 16
+
+// A multiplexed session connection. Reads drain any data already buffered by
+// the request before reading from the connection.
+type muxConn struct {
+	io.Reader
+	r *request
+}
+
+func (m *muxConn) Write(p []byte) (int, error) {
+	return m.r.conn.Write(p)
+}
+
+func (m *muxConn) Close() error {
+	return m.r.conn.Close()
+}
+
+// The session uses these to report the addresses of its streams.
+func (m *muxConn) LocalAddr() net.Addr {
+	return m.r.conn.LocalAddr()
+}
+
+func (m *muxConn) RemoteAddr() net.Addr {
+	return m.r.conn.RemoteAddr()
+}
+
+// Serve a multiplexed session, handling each stream as a separate request.
+// The session occupies the worker until the client closes it, and handles
+// up to MaxSessionStreams streams at once, which share the bandwidth limit of
+// the session.
+func (s *server) serveMux(r *request) error {
+	// The session manages its own keepalives, so we read from the underlying
+	// connection directly, without the operation timeout.
+	buffered, err := r.reader.Peek(r.reader.Buffered())
+	if err != nil {
+		return err
+	}
+	c := &muxConn{
+		Reader: io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), r.conn),
+		r:      r,
+	}
+
+	config := yamux.DefaultConfig()
+	config.LogOutput = s.err.Writer()
+	session, err := yamux.Server(c, config)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	s.info.Println("starting multiplexed session")
+
+	// Accept and handle streams, waiting for a free slot before accepting
+	// each.
+	slots := make(chan struct{}, MaxSessionStreams)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-session.CloseChan():
+			return nil
+		}
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if session.IsClosed() {
+				return nil
+			}
+			return err
+		}
+
+		req := newRequest(stream, s.timeout)
+		req.stream = true
+		req.hmacSecret = r.hmacSecret
+		req.writer.ShareBandwidthLimit(r.writer)
+		go func() {
+			defer func() { <-slots }()
+			if err := s.handleRequest(req); err != nil {
+				s.err.Println("failed to handle request: ", err.Error())
+			}
+		}()
+	}
+}
@@ -0,0 +1,169 @@
+// server/mux_test.go
+// Tests for multiplexed sessions.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestMultiplexedRequests(t *testing.T) {
+	for _, secret := range [][]byte{nil, []byte("secret")} {
+		// With a single connection allowed, concurrent requests only succeed
+		// if they share the session.
+		s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+			s.SetConnectionLimit(1, 0)
+			a.SetHMACSecret(testAdminKey, secret)
+		})
+		c := newTestClient(t, s, testAdminKey)
+		c.SetHMACSecret(secret)
+		c.SetMultiplexing(true)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := "file" + strconv.Itoa(i)
+				data := bytes.Repeat([]byte{byte(i)}, 10000*i)
+				if err := c.Create("d1", name); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := c.Write("d1", name, int64(len(data)), bytes.NewReader(data)); err != nil {
+					errs <- err
+					return
+				}
+				var buf bytes.Buffer
+				if _, err := c.Read("d1", name, &buf); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf.Bytes(), data) {
+					errs <- errors.New("read the wrong data from " + name + " " + strconv.Itoa(buf.Len()) + " " + strconv.Itoa(len(data)))
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("signed: %v: %v", secret != nil, err)
+		}
+	}
+}
+
+func TestSessionStreamLimit(t *testing.T) {
+	var active, peak atomic.Int64
+	release := make(chan struct{})
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		// Replace ping with a command which blocks until released.
+		s.RegisterCommand("ping", func(r *Request) error {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			<-release
+			return r.SendSuccess("PONG\n")
+		})
+	})
+	c := newTestClient(t, s, testAdminKey)
+	c.SetMultiplexing(true)
+
+	// Open more streams than the limit.
+	streams := MaxSessionStreams * 2
+	errs := make(chan error, streams)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Ping()
+		}()
+	}
+
+	// Only the limit are handled at once.
+	deadline := time.Now().Add(3 * time.Second)
+	for active.Load() < MaxSessionStreams && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := peak.Load(); got != MaxSessionStreams {
+		t.Errorf("handled %d streams at once, want %d", got, MaxSessionStreams)
+	}
+
+	// The rest are handled once the first are done.
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("stream failed: %v", err)
+		}
+	}
+}
+
+func TestSessionSharesBandwidthLimit(t *testing.T) {
+	const limit = 20000
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetBandwidthLimit(limit)
+	})
+	data := bytes.Repeat([]byte("0123456789"), limit/10)
+	if err := os.WriteFile(filepath.Join(dir, "d1", "file"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s, testAdminKey)
+	c.SetMultiplexing(true)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two streams each read a second of data. The first second is allowed
+	// at once, so if the streams share the limit, reading both takes about
+	// another second.
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			_, err := c.ReadRange("d1", "file", 0, int64(len(data)), &buf)
+			if err == nil && !bytes.Equal(buf.Bytes(), data) {
+				t.Error("read the wrong data")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("streams read %d bytes in %v, over the limit of %d bytes per second", 2*len(data), elapsed, limit)
+	}
+}
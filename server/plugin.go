@@ -0,0 +1,111 @@
+// server/plugin.go
+// Custom commands.
+
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// A request passed to a custom command handler. It exposes the authenticated
+// permissions, the request arguments, and helpers for sending responses,
+// without exposing the internals of the connection.
+//
+// A handler must read the request in order: first the arguments with Args,
+// then the data chunk with Consume (or by reading it from Reader), and
+// finally send exactly one response.
+type Request struct {
+	r *request
+	s *server
+}
+
+// Get the name of the command.
+func (r *Request) Command() string {
+	return r.r.command
+}
+
+// Get the context of the request, which is cancelled once the client
+// disconnects or times out, or the request has been handled. Long-running
+// handlers should check it and stop early. Disconnects are noticed when
+// reading or writing fails, or while watching for them with WatchDisconnect.
+func (r *Request) Context() context.Context {
+	return r.r.ctx
+}
+
+// Watch for the client disconnecting while the handler isn't reading from the
+// connection, cancelling the context if it does. Returns the function to stop
+// watching, which must be called before reading again.
+func (r *Request) WatchDisconnect() func() {
+	return r.r.watchDisconnect()
+}
+
+// Get the flags sent with the request. Handlers should ignore flags they
+// don't support.
+func (r *Request) Flags() map[string]string {
+	return r.r.flags
+}
+
+// Get the permissions of the authenticated key.
+func (r *Request) Permissions() auth.Permissions {
+	return r.r.permissions
+}
+
+// Get the arguments of the request.
+func (r *Request) Args() ([]string, error) {
+	return r.r.getArgs()
+}
+
+// Consume the data chunk of the request.
+func (r *Request) Consume() error {
+	return r.r.consume()
+}
+
+// Get the reader for the remaining request data.
+func (r *Request) Reader() io.Reader {
+	return r.r.reader
+}
+
+// Get the writer for streaming response data.
+func (r *Request) Writer() io.Writer {
+	return r.r.writer
+}
+
+// Get a drive, ensuring the authenticated key may access it.
+func (r *Request) Drive(name string) (drive.Drive, error) {
+	return r.r.getDrive(name, r.s)
+}
+
+// Send a success response with a body.
+func (r *Request) SendSuccess(body string) error {
+	return r.r.sendSuccess(body)
+}
+
+// Send an error response.
+func (r *Request) SendError(msg string) error {
+	return r.r.sendError(msg)
+}
+
+// Register a custom command, replacing any existing command with the same
+// name. Commands should be registered before the server starts serving. For
+// example, a command which echoes its arguments:
+//
+//	s.RegisterCommand("echo", func(r *server.Request) error {
+//		args, err := r.Args()
+//		if err != nil {
+//			return err
+//		}
+//		if err := r.Consume(); err != nil {
+//			return err
+//		}
+//		return r.SendSuccess(strings.Join(args, "\n") + "\n")
+//	})
+func (s *server) RegisterCommand(name string, handler func(*Request) error) {
+	s.commands[strings.ToLower(name)] = func(r *request) error {
+		return handler(&Request{r: r, s: s})
+	}
+}
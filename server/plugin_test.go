@@ -0,0 +1,116 @@
+// server/plugin_test.go
+// Tests for custom commands.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("user", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+		s.RegisterCommand("Echo", func(r *Request) error {
+			args, err := r.Args()
+			if err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			return r.SendSuccess(r.Command() + ":" + strings.Join(args, ",") + ":" + r.Flags()["x"] + "\n")
+		})
+		s.RegisterCommand("whoami", func(r *Request) error {
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			return r.SendSuccess(strconv.FormatBool(r.Permissions().IsAdmin) + "\n")
+		})
+		s.RegisterCommand("opendrive", func(r *Request) error {
+			args, err := r.Args()
+			if err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			if _, err := r.Drive(args[0]); err != nil {
+				return r.SendError(err.Error())
+			}
+			return r.SendSuccess("")
+		})
+	})
+
+	tests := []struct {
+		name     string
+		key      string
+		command  string
+		args     string
+		response string
+	}{
+		{"arguments and flags", testAdminKey, "echo x=1", "a\nb\n", "SUCCESS\necho:a,b:1\n0\n"},
+		{"case insensitive", testAdminKey, "ECHO", "a\n", "SUCCESS\necho:a:\n0\n"},
+		{"admin permissions", testAdminKey, "whoami", "", "SUCCESS\ntrue\n0\n"},
+		{"user permissions", "user", "whoami", "", "SUCCESS\nfalse\n0\n"},
+		{"allowed drive", "user", "opendrive", "d1\n", "SUCCESS\n0\n"},
+		{"disallowed drive", "user", "opendrive", "d2\n", "FAILED\ndrive not allowed: d2\n0\n"},
+		{"invalid key", "nobody", "whoami", "", "FAILED\ninvalid authentication key: nobody\n0\n"},
+		{"unknown command", testAdminKey, "missing", "", "FAILED\ninvalid command missing\n0\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rawRequest(t, s, test.key, test.command, test.args, nil); got != test.response {
+				t.Fatalf("got %q, want %q", got, test.response)
+			}
+		})
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	done := make(chan error, 1)
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.RegisterCommand("wait", func(r *Request) error {
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			defer r.WatchDisconnect()()
+			select {
+			case <-r.Context().Done():
+				done <- nil
+			case <-time.After(5 * time.Second):
+				done <- errors.New("context not cancelled")
+			}
+			return nil
+		})
+	})
+
+	// The context is cancelled once the client disconnects, though the
+	// handler isn't reading from the connection.
+	c, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := strings.Join([]string{protocol.Header, testAdminKey, "wait", "0", "0"}, "\n") + "\n"
+	if _, err := c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+// server/privileges_linux.go
+// Dropping privileges on Linux.
+
+//go:build linux
+
+package server
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Drop the privileges of the server process to the configured user and
+// group. This is called once the listener has been bound, so the server may
+// bind to a privileged port first.
+func (s *server) dropPrivileges() error {
+	if s.runAsUser == "" && s.runAsGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	// Look up the user.
+	if s.runAsUser != "" {
+		u, err := user.Lookup(s.runAsUser)
+		if err != nil {
+			return err
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return err
+		}
+		gid, err = strconv.Atoi(u.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Look up the group. This overrides the user's primary group.
+	if s.runAsGroup != "" {
+		g, err := user.LookupGroup(s.runAsGroup)
+		if err != nil {
+			return err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The group must be set before the user, since we will no longer have
+	// permission to change it afterwards.
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+
+	s.info.Println("dropped privileges to", s.runAsUser, s.runAsGroup)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// server/privileges_linux_test.go
+// Tests for dropping privileges on Linux.
+
+//go:build linux
+
+package server
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestDropPrivilegesChangesIDs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	// Privileges can't be regained once dropped, so they are dropped in a
+	// child process running this test.
+	if os.Getenv("DEEPWELL_TEST_DROP_PRIVILEGES") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesChangesIDs$")
+		cmd.Env = append(os.Environ(), "DEEPWELL_TEST_DROP_PRIVILEGES=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("child failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	s := NewServer().(*server)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	s.SetRunAs("nobody", "")
+	if err := s.dropPrivileges(); err != nil {
+		t.Fatal(err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+	if syscall.Getuid() != uid || syscall.Geteuid() != uid {
+		t.Fatalf("uid %d, euid %d, want %d", syscall.Getuid(), syscall.Geteuid(), uid)
+	}
+	if syscall.Getgid() != gid || syscall.Getegid() != gid {
+		t.Fatalf("gid %d, egid %d, want %d", syscall.Getgid(), syscall.Getegid(), gid)
+	}
+	groups, err := syscall.Getgroups()
+	if err != nil || len(groups) != 1 || groups[0] != gid {
+		t.Fatalf("groups %v, want only %d: %v", groups, gid, err)
+	}
+}
@@ -0,0 +1,16 @@
+// server/privileges_other.go
+// Dropping privileges on unsupported platforms.
+
+//go:build !linux
+
+package server
+
+import "errors"
+
+// Drop the privileges of the server process. Only supported on Linux.
+func (s *server) dropPrivileges() error {
+	if s.runAsUser == "" && s.runAsGroup == "" {
+		return nil
+	}
+	return errors.New("running as a different user or group is only supported on linux")
+}
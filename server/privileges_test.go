@@ -0,0 +1,52 @@
+// server/privileges_test.go
+// Tests for dropping privileges.
+
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestDropPrivilegesUnset(t *testing.T) {
+	s := NewServer().(*server)
+	if err := s.dropPrivileges(); err != nil {
+		t.Fatalf("failed without a user or group: %v", err)
+	}
+}
+
+func TestDropPrivilegesUnknownUser(t *testing.T) {
+	// The listener is closed if privileges can't be dropped, so the server
+	// never serves with more privileges than configured.
+	s := NewServer().(*server)
+	s.SetAddress("127.0.0.1:0")
+	s.SetHTTPAddress("")
+	s.SetTLSConfig(testTLSConfig(t))
+	s.SetHealthCheckInterval(-1)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	s.SetRunAs("deepwell-no-such-user", "deepwell-no-such-group")
+	if err := s.Serve(); err == nil {
+		t.Fatal("served as an unknown user")
+	}
+	if addr := s.ActualAddress(); addr != "" {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Fatal("listener left open")
+		}
+	}
+}
+
+func TestConfigRunAs(t *testing.T) {
+	s, err := loadTestConfig(t, `
+RunAsUser = "deepwell"
+RunAsGroup = "daemon"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, group := s.RunAs(); user != "deepwell" || group != "daemon" {
+		t.Fatalf("run as %s:%s", user, group)
+	}
+}
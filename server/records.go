@@ -0,0 +1,49 @@
+// server/records.go
+// Reading ranges of records from record files.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// The maximum number of records, and the maximum total size of the records,
+// read by a single readrecords command.
+const (
+	maxReadRecords     = 10000
+	maxReadRecordsSize = 16 << 20
+)
+
+// The error reading is stopped with once enough records have been read.
+var errEnoughRecords = errors.New("enough records read")
+
+// Read a range of records from a record file, starting at the record at index
+// start. Reading stops once the range has been read, or once the next record
+// would exceed the maximum total size, so fewer records than requested may be
+// returned before the end of the file. At least one record is returned if
+// any are in the range.
+func readRecords(d drive.Drive, path string, start, count int) ([][]byte, error) {
+	records := [][]byte{}
+	size := 0
+	i := 0
+	err := drive.ReadRecords(d, path, func(record []byte) error {
+		if len(records) == count {
+			return errEnoughRecords
+		}
+		if i >= start {
+			if len(records) > 0 && size+len(record) > maxReadRecordsSize {
+				return errEnoughRecords
+			}
+			records = append(records, record)
+			size += len(record)
+		}
+		i++
+		return nil
+	})
+	if err != nil && err != errEnoughRecords {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,78 @@
+// server/records_test.go
+// Tests for reading ranges of records from record files.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+func TestReadRecords(t *testing.T) {
+	d := drive.NewDrive(t.TempDir())
+	for _, record := range []string{"zero", "one", "", "three"} {
+		if err := d.AppendRecord("log", []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		start int
+		count int
+		want  []string
+	}{
+		{0, 4, []string{"zero", "one", "", "three"}},
+		{1, 2, []string{"one", ""}},
+		{3, 10, []string{"three"}},
+		{4, 1, []string{}},
+		{0, 0, []string{}},
+	}
+	for _, test := range tests {
+		records, err := readRecords(d, "log", test.start, test.count)
+		if err != nil {
+			t.Errorf("%d %d: %v", test.start, test.count, err)
+			continue
+		}
+		got := []string{}
+		for _, record := range records {
+			got = append(got, string(record))
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%d %d: read %q, want %q", test.start, test.count, got, test.want)
+		}
+	}
+
+	if _, err := readRecords(d, "missing", 0, 1); err == nil {
+		t.Error("read records from a missing file")
+	}
+}
+
+func TestReadRecordsTooLarge(t *testing.T) {
+	d := drive.NewDrive(t.TempDir())
+	records := maxReadRecordsSize/drive.MaxRecordSize + 2
+	for i := 0; i < records; i++ {
+		if err := d.AppendRecord("log", []byte(fmt.Sprintf("%d%s", i%10, strings.Repeat("x", drive.MaxRecordSize-1)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading stops before the maximum total size, and continues from the
+	// next record.
+	first, err := readRecords(d, "log", 0, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != maxReadRecordsSize/drive.MaxRecordSize {
+		t.Fatalf("read %d records, want %d", len(first), maxReadRecordsSize/drive.MaxRecordSize)
+	}
+	rest, err := readRecords(d, "log", len(first), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != records-len(first) || rest[0][0] != byte('0'+len(first)%10) {
+		t.Fatalf("read %d more records", len(rest))
+	}
+}
@@ -5,10 +5,14 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -19,80 +23,217 @@ import (
 	"github.com/cubeflix/deepwell/protocol"
 )
 
+// The maximum size of the arguments of a request.
+const maxArgsSize = 1 << 20
+
+// The error returned when the data of a request is larger than allowed.
+var errDataTooLarge = errors.New("data too large")
+
 // The request struct.
 type request struct {
 	// The underlying connection. The reader and writer should be used in all
 	// cases.
-	conn   *tls.Conn
+	conn   net.Conn
 	writer *conn.Conn
 	reader *bufio.Reader
 
+	// If the request is a stream within a multiplexed session.
+	stream bool
+
+	// If the request holds one of the connection slots.
+	slot bool
+
+	// If the connection was kept alive after an earlier request, so the
+	// handshake is already complete.
+	keptAlive bool
+
+	// If the connection was handed to another request, which closes it.
+	detached bool
+
+	// The secret the connection of the request is signed with, if it is.
+	hmacSecret []byte
+
+	// The context of the request, cancelled once an operation on the
+	// connection fails (e.g. the client disconnected or timed out) or the
+	// request has been handled. Long-running commands should check it and
+	// stop early, watching for disconnects while they don't read or write.
+	ctx context.Context
+
 	// Authentication information.
 	key         string
 	permissions auth.Permissions
 
 	// The request information.
 	command string
+
+	// The flags sent after the command, as key=value options. Commands
+	// interpret the flags they support and ignore any others.
+	flags map[string]string
+
+	// If set, responses are written here instead of to the connection, so
+	// they can be kept for requests with idempotency keys.
+	response *bytes.Buffer
+
+	// If the request failed.
+	failed bool
 }
 
 // Create a new request.
-func newRequest(c *tls.Conn, timeout time.Duration) *request {
+func newRequest(c net.Conn, timeout time.Duration) *request {
 	conn := conn.NewConn(c, timeout)
 	return &request{
 		conn:   c,
 		writer: conn,
 		reader: bufio.NewReader(conn),
+		ctx:    conn.Context(),
 	}
 }
 
-// Handle a single request.
+// Watch for the client disconnecting while the request isn't reading from the
+// connection, cancelling the context of the request if it does. Returns the
+// function to stop watching, which must be called before reading again.
+func (r *request) watchDisconnect() func() {
+	return r.writer.WatchClose()
+}
+
+// Handle a single request. If the request asks to keep the connection alive,
+// the connection waits for the next request without holding the worker, and
+// is then queued again.
 func (s *server) handleRequest(r *request) error {
-	defer r.conn.Close()
+	keepAlive := false
+	defer func() {
+		if !keepAlive && !r.detached {
+			r.writer.Close()
+			s.release(r)
+		}
+	}()
+
+	if !r.keptAlive {
+		if !r.stream {
+			// Streams share the limit of their session.
+			r.writer.SetBandwidthLimit(s.bandwidth)
+		}
+
+		// Complete the TLS handshake and read the request preamble within
+		// the handshake timeout, so stalled clients are dropped quickly.
+		if err := s.handshake(r); err != nil {
+			return err
+		}
+	}
+
+	keepAlive, err := s.serveRequest(r)
+	if err != nil || !keepAlive {
+		return err
+	}
+	r.key, r.permissions, r.command, r.flags, r.failed = "", auth.Permissions{}, "", nil, false
+	r.keptAlive = true
+	go s.awaitRequest(r)
+	return nil
+}
+
+// Wait for the next request on a connection kept alive, and queue it for the
+// workers. The connection is closed once it has been idle for the timeout.
+func (s *server) awaitRequest(r *request) {
+	if _, err := r.reader.Peek(1); err != nil {
+		r.writer.Close()
+		s.release(r)
+		return
+	}
+	select {
+	case s.jobs <- r:
+	case <-s.stopSignal:
+		r.writer.Close()
+		s.release(r)
+	}
+}
+
+// The commands which need no authentication.
+var unauthenticatedCommands = map[string]bool{
+	"status": true,
+}
+
+// Serve a request on a connection. Returns true if the request completed
+// and asked to keep the connection alive for another request.
+func (s *server) serveRequest(r *request) (bool, error) {
+	start := time.Now()
+	read, written := r.writer.BytesRead(), r.writer.BytesWritten()
 
 	// Read the DEEPWELL protocol header.
 	header, err := r.getString()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if header == protocol.HMACHeader && r.hmacSecret == nil && !r.stream {
+		// Sign the rest of the connection.
+		return false, s.serveHMAC(r)
+	}
+	if header == protocol.MuxHeader && !r.stream {
+		// Start a multiplexed session.
+		if err := r.writer.SetDeadline(time.Time{}); err != nil {
+			return false, err
+		}
+		return false, s.serveMux(r)
 	}
 	if header != protocol.Header {
 		// Close the connection, we got an invalid header.
-		return nil
+		return false, nil
 	}
 
 	// Read the authentication information.
 	key, err := r.getString()
 	if err != nil {
-		return err
+		return false, err
 	}
 	r.key = key
 
 	// Read the command.
 	command, err := r.getString()
 	if err != nil {
-		return err
+		return false, err
 	}
+	command, r.flags = protocol.ParseFlags(command)
 	command = strings.ToLower(command)
 	r.command = command
 
-	// Authenticate the user.
+	// Record the metrics of the request once it has been handled.
+	defer s.metrics.recordRequest(s.commandLabel(command), r, start, read, written)
+
+	// Register the session.
+	defer s.sessions.add(r)()
+
+	// Restore the regular operation timeout.
+	if err := r.writer.SetDeadline(time.Time{}); err != nil {
+		return false, err
+	}
+
+	// Authenticate the user. Keys with a secret must sign their requests.
+	// Commands which need no authentication don't check the key.
 	ip, _, err := net.SplitHostPort(r.conn.RemoteAddr().String())
 	if err != nil {
-		return err
+		return false, err
+	}
+	var permissions auth.Permissions
+	if !unauthenticatedCommands[command] {
+		permissions, err = s.authentication.Authenticate(key, ip)
+		if err != nil {
+			r.logDenial(s, "invalid authentication key", "", "")
+		} else if !r.signedWith(s.keyHMACSecret(key)) {
+			err = errors.New("message signing required")
+			r.logDenial(s, err.Error(), "", "")
+		}
 	}
-	permissions, err := s.authentication.Authenticate(key, ip)
 	if err != nil {
-		s.info.Println("failed to authenticate user:", key, ip)
 		// Failed to log in.
 		if err := r.consume(); err != nil {
-			return err
+			return false, err
 		}
 		if err := r.consume(); err != nil {
-			return err
+			return false, err
 		}
 		if err := r.sendError(err.Error()); err != nil {
-			return err
+			return false, err
 		}
-		return nil
+		return false, nil
 	}
 	r.permissions = permissions
 
@@ -100,29 +241,66 @@ func (s *server) handleRequest(r *request) error {
 	function, ok := s.commands[command]
 	if !ok {
 		// Invalid command.
+		r.logDenial(s, "invalid command", "", "")
 		if err := r.consume(); err != nil {
-			return err
+			return false, err
 		}
 		if err := r.consume(); err != nil {
-			return err
+			return false, err
 		}
 		if err := r.sendError(fmt.Sprintf("invalid command %s", command)); err != nil {
-			return err
+			return false, err
 		}
-		return nil
+		return false, nil
 	}
 
 	// Invoke the command. It is up to the command to handle responses/errors.
-	err = function(r)
-	return err
+	// Commands with idempotency keys are only executed once.
+	if id := r.flags[IdempotencyFlag]; id != "" && idempotentCommands[command] {
+		err = s.handleIdempotent(r, function, id)
+	} else {
+		err = function(r)
+	}
+	if err != nil {
+		r.failed = true
+		return false, err
+	}
+
+	// Keep the connection open if the client asked to.
+	keepAlive, _ := strconv.ParseBool(r.flags[protocol.KeepAliveFlag])
+	return keepAlive && !r.stream, nil
+}
+
+// Complete the TLS handshake, setting the deadline to the handshake timeout.
+// If no handshake timeout is set, fall back to the operation timeout.
+func (s *server) handshake(r *request) error {
+	handshakeTimeout := s.handshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = s.timeout
+	}
+	if err := r.writer.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	if tlsConn, ok := r.conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Get a drive, given a server.
 func (r *request) getDrive(drive string, s Server) (drive.Drive, error) {
+	if drive == "" {
+		return nil, errors.New("no drive specified")
+	}
+
 	// Check if the user can access the drive.
 	ok := r.permissions.DriveAllowed(drive)
+	r.logAccess(drive, ok, s)
 	if !ok {
 		// Not allowed.
+		r.logDenial(s, "drive not allowed", drive, "")
 		return nil, errors.New(fmt.Sprintf("drive not allowed: %s", drive))
 	}
 
@@ -132,12 +310,67 @@ func (r *request) getDrive(drive string, s Server) (drive.Drive, error) {
 		// Drive does not exist.
 		return nil, errors.New(fmt.Sprintf("drive not allowed: %s", drive))
 	}
+	if !s.DriveHealthy(drive) {
+		// The backing store of the drive is unavailable.
+		return nil, errors.New(fmt.Sprintf("drive unavailable: %s", drive))
+	}
+
+	return driveObj, nil
+}
+
+// Log an access to a drive to its access log, if it has one.
+func (r *request) logAccess(drive string, allowed bool, s Server) {
+	logger := s.AccessLog(drive)
+	if logger == nil {
+		return
+	}
+	ip, _, err := net.SplitHostPort(r.conn.RemoteAddr().String())
+	if err != nil {
+		ip = r.conn.RemoteAddr().String()
+	}
+	outcome := "allowed"
+	if !allowed {
+		outcome = "denied"
+	}
+	logger.Println(ip, r.command, drive, outcome)
+}
+
+// Get a drive which is about to be modified, ensuring it isn't read-only.
+// The paths to be modified are checked as well. An empty path refers to the
+// root of the drive, which commands that only read the drive (e.g. list and
+// stat) accept, but paths to be modified must not be empty or the root.
+func (r *request) getWritableDrive(drive string, s Server, paths ...string) (drive.Drive, error) {
+	driveObj, err := r.getDrive(drive, s)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if path == "" {
+			return nil, errors.New("no path specified")
+		}
+		if clean := filepath.Clean(path); clean == "." || clean == string(filepath.Separator) {
+			return nil, errors.New(fmt.Sprintf("cannot modify the root of a drive: %s", path))
+		}
+	}
+	if s.DriveReadOnly(drive) {
+		return nil, errors.New(fmt.Sprintf("drive is read-only: %s", drive))
+	}
 
 	return driveObj, nil
 }
 
+// Send the error of a failed write, discarding the rest of its data first so
+// the connection stays in sync. Fails if the data can't be read.
+func (r *request) sendWriteError(data io.Reader, writeErr error) error {
+	if _, err := io.Copy(io.Discard, data); err != nil {
+		return err
+	}
+	return r.sendError(writeErr.Error())
+}
+
 // Send an error response.
 func (r *request) sendError(s string) error {
+	r.failed = true
 	if err := r.sendString(protocol.Header); err != nil {
 		return err
 	}
@@ -161,7 +394,7 @@ func (r *request) sendSuccess(s string) error {
 	if err := r.sendString("SUCCESS"); err != nil {
 		return err
 	}
-	if _, err := r.writer.Write([]byte(s)); err != nil {
+	if err := r.write([]byte(s)); err != nil {
 		return err
 	}
 	if err := r.sendString("0"); err != nil {
@@ -170,6 +403,37 @@ func (r *request) sendSuccess(s string) error {
 	return nil
 }
 
+// Check if the client asked for progress events.
+func (r *request) wantsProgress() bool {
+	progress, _ := strconv.ParseBool(r.flags[protocol.ProgressFlag])
+	return progress
+}
+
+// Send a progress event, after the success response.
+func (r *request) sendProgress(p protocol.Progress) error {
+	return r.sendString(protocol.FormatProgress(p))
+}
+
+// End the progress events with the result.
+func (r *request) sendProgressResult(result string) error {
+	if err := r.sendString(protocol.ProgressResult); err != nil {
+		return err
+	}
+	if err := r.write([]byte(result)); err != nil {
+		return err
+	}
+	return r.sendString("0")
+}
+
+// End the progress events with an error.
+func (r *request) sendProgressError(message string) error {
+	r.failed = true
+	if err := r.sendString(protocol.ProgressError); err != nil {
+		return err
+	}
+	return r.sendString(message)
+}
+
 // Get a string from the connection. Terminates once it reaches a newline.
 func (r *request) getString() (string, error) {
 	// Scan the string.
@@ -180,38 +444,109 @@ func (r *request) getString() (string, error) {
 	return str[:len(str)-1], nil
 }
 
+// Get the arguments of a request. The arguments are a chunk of newline
+// terminated strings, prefixed with the length of the chunk.
+func (r *request) getArgs() ([]string, error) {
+	// Get the length of the arguments.
+	lenStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxArgsSize {
+		return nil, errors.New("invalid argument length")
+	}
+
+	// Read the arguments.
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return nil, err
+	}
+	args := strings.Split(string(buf), "\n")
+	return args[:len(args)-1], nil
+}
+
+// Get a chunk of data, prefixed with the length. If the data is larger than
+// the maximum size, it is discarded and errDataTooLarge is returned.
+func (r *request) getData(max int64) ([]byte, error) {
+	// Get the length of the data.
+	lenStr, err := r.getString()
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(lenStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, errors.New("invalid data length")
+	}
+	if size > max {
+		if _, err := io.CopyN(io.Discard, r.reader, size); err != nil {
+			return nil, err
+		}
+		return nil, errDataTooLarge
+	}
+
+	// Read the data.
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 // Send a string over the connection.
 func (r *request) sendString(s string) error {
 	// Send the string, along with a newline.
-	_, err := r.writer.Write([]byte(s + "\n"))
+	return r.write([]byte(s + "\n"))
+}
+
+// Write to the connection, or to the held response if there is one.
+func (r *request) write(b []byte) error {
+	if r.response != nil {
+		r.response.Write(b)
+		return nil
+	}
+	_, err := r.writer.Write(b)
 	return err
 }
 
-// Consume a chunk of data, prefixed with the length.
+// Consume a chunk of data, prefixed with the length. The length line may be
+// that of compressed data, whose compressed length is consumed.
 func (r *request) consume() error {
 	// Get the length of the data.
 	lenStr, err := r.getString()
 	if err != nil {
 		return err
 	}
-	len, err := strconv.ParseInt(lenStr, 10, 64)
+	len, _, _, err := protocol.ParseLength(lenStr)
 	if err != nil {
 		return err
 	}
+	if len < 0 {
+		return errors.New(fmt.Sprintf("invalid length: %d", len))
+	}
 
-	buf := make([]byte, protocol.ChunkSize)
+	chunk := protocol.GetChunk()
+	defer protocol.PutChunk(chunk)
+	buf := *chunk
 	n := int64(0)
 	for {
-		// Read the chunk.
+		// Read the chunk. Reads may return less than a full chunk, so read
+		// until the chunk is filled.
 		if len-n < int64(protocol.ChunkSize) {
-			smallBuf := make([]byte, len-n)
-			_, err := r.reader.Read(smallBuf)
+			smallBuf := buf[:len-n]
+			_, err := io.ReadFull(r.reader, smallBuf)
 			if err != nil {
 				return err
 			}
 			return nil
 		} else {
-			i, err := r.reader.Read(buf)
+			i, err := io.ReadFull(r.reader, buf)
 			if err != nil {
 				return err
 			}
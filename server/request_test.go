@@ -0,0 +1,88 @@
+// server/request_test.go
+// Tests for reading requests.
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Write data to a connection one byte at a time, as a fragmented TCP stream
+// would deliver it. Stops once the connection is closed.
+func writeFragmented(c net.Conn, data []byte) {
+	go func() {
+		for i := range data {
+			if _, err := c.Write(data[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestConsumeFragmented(t *testing.T) {
+	sizes := []int{0, 1, protocol.ChunkSize - 1, protocol.ChunkSize, protocol.ChunkSize + 1, 3*protocol.ChunkSize + 17}
+	for _, size := range sizes {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			// Send a chunk followed by a line, which must be read intact
+			// after the chunk is consumed.
+			var msg bytes.Buffer
+			msg.WriteString(strconv.Itoa(size) + "\n")
+			msg.Write(bytes.Repeat([]byte{'x'}, size))
+			msg.WriteString("next\n")
+			writeFragmented(client, msg.Bytes())
+
+			r := newRequest(server, 5*time.Second)
+			if err := r.consume(); err != nil {
+				t.Fatalf("failed to consume: %v", err)
+			}
+			next, err := r.getString()
+			if err != nil || next != "next" {
+				t.Fatalf("got %q, %v after the chunk, want \"next\"", next, err)
+			}
+		})
+	}
+}
+
+func TestConsumeCompressedLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The compressed length is consumed, not the uncompressed size.
+	var msg bytes.Buffer
+	msg.WriteString(protocol.FormatCompressedLength(10, 5000) + "\n")
+	msg.Write(bytes.Repeat([]byte{'x'}, 10))
+	msg.WriteString("next\n")
+	writeFragmented(client, msg.Bytes())
+
+	r := newRequest(server, 5*time.Second)
+	if err := r.consume(); err != nil {
+		t.Fatalf("failed to consume: %v", err)
+	}
+	if next, err := r.getString(); err != nil || next != "next" {
+		t.Fatalf("got %q, %v after the chunk, want \"next\"", next, err)
+	}
+}
+
+func TestConsumeInvalidLength(t *testing.T) {
+	for _, line := range []string{"-1", "abc", "gzip -1 10"} {
+		client, server := net.Pipe()
+		writeFragmented(client, []byte(line+"\n"))
+		r := newRequest(server, 5*time.Second)
+		if err := r.consume(); err == nil {
+			t.Errorf("consumed a chunk with length %q", line)
+		}
+		client.Close()
+		server.Close()
+	}
+}
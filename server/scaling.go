@@ -0,0 +1,117 @@
+// server/scaling.go
+// Dynamic scaling of the worker pool.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The default interval the supervisor checks the queue on.
+const DefaultScaleInterval = 100 * time.Millisecond
+
+// The default time the pool must be idle before a worker is retired.
+const DefaultWorkerIdleTimeout = 10 * time.Second
+
+// Worker scaling options. If Max is zero, the pool has a fixed number of
+// workers.
+type WorkerScaling struct {
+	// The minimum and maximum number of workers. The pool starts with the
+	// minimum.
+	Min int
+	Max int
+
+	// The number of queued requests at which the pool grows. Zero means any
+	// queued request.
+	QueueThreshold int
+
+	// How long the queue must be empty and a worker idle before a worker is
+	// retired. Zero uses DefaultWorkerIdleTimeout.
+	IdleTimeout time.Duration
+
+	// The interval the queue is checked on. Zero uses DefaultScaleInterval.
+	Interval time.Duration
+}
+
+// Start a worker.
+func (s *server) spawnWorker() {
+	atomic.AddInt32(&s.liveWorkers, 1)
+	go func() {
+		defer atomic.AddInt32(&s.liveWorkers, -1)
+		s.worker()
+	}()
+}
+
+// Get the number of running workers.
+func (s *server) workerCount() int {
+	return int(atomic.LoadInt32(&s.liveWorkers))
+}
+
+// Supervise the worker pool, growing it while requests are queued and
+// shrinking it once it is idle. The pool grows like a slow start, doubling
+// on each check while the queue stays backed up, and shrinks by one worker
+// for every idle timeout. Workers are only retired between requests, so no
+// request is lost.
+func (s *server) supervise(stop chan struct{}) {
+	interval := s.scaling.Interval
+	if interval == 0 {
+		interval = DefaultScaleInterval
+	}
+	idleTimeout := s.scaling.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultWorkerIdleTimeout
+	}
+	threshold := s.scaling.QueueThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			queued := len(s.jobs)
+			workers := s.workerCount()
+			busy := s.load.busy()
+
+			if queued >= threshold && workers < s.scaling.Max {
+				// Grow the pool.
+				grow := workers
+				if grow < 1 {
+					grow = 1
+				}
+				if grow > queued {
+					grow = queued
+				}
+				if grow > s.scaling.Max-workers {
+					grow = s.scaling.Max - workers
+				}
+				for i := 0; i < grow; i++ {
+					s.spawnWorker()
+				}
+				s.info.Println("scaled workers up to", workers+grow)
+				idleSince = now
+				continue
+			}
+
+			if queued > 0 || busy >= workers || workers <= s.scaling.Min {
+				idleSince = now
+				continue
+			}
+			if now.Sub(idleSince) >= idleTimeout {
+				// Retire an idle worker.
+				select {
+				case s.retire <- struct{}{}:
+					s.info.Println("scaled workers down to", workers-1)
+				default:
+				}
+				idleSince = now
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// server/scaling_test.go
+// Tests for dynamic scaling of the worker pool.
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Wait for the number of workers of a server to reach a count.
+func waitWorkers(t *testing.T, s *server, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.workerCount() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers, want %d", s.workerCount(), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorkerScaling(t *testing.T) {
+	release := make(chan struct{})
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetWorkerScaling(WorkerScaling{Min: 1, Max: 4, Interval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond})
+		s.RegisterCommand("block", func(r *Request) error {
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			<-release
+			return r.SendSuccess("")
+		})
+	})
+	waitWorkers(t, s, 1)
+
+	// Queue more blocking requests than the maximum number of workers.
+	responses := make(chan string, 6)
+	for i := 0; i < cap(responses); i++ {
+		go func() {
+			conn, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				responses <- err.Error()
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			request := strings.Join([]string{protocol.Header, testAdminKey, "block", "0", "0"}, "\n") + "\n"
+			if _, err := conn.Write([]byte(request)); err != nil {
+				responses <- err.Error()
+				return
+			}
+			response, err := io.ReadAll(conn)
+			if err != nil {
+				responses <- err.Error()
+				return
+			}
+			responses <- string(response)
+		}()
+	}
+
+	// The pool grows to the maximum under load.
+	waitWorkers(t, s, 4)
+	time.Sleep(50 * time.Millisecond)
+	if s.workerCount() != 4 {
+		t.Fatalf("%d workers, want at most 4", s.workerCount())
+	}
+
+	// Every request is handled, and the pool shrinks back once idle.
+	close(release)
+	for i := 0; i < cap(responses); i++ {
+		if response := <-responses; response != protocol.Header+"\nSUCCESS\n0\n" {
+			t.Errorf("got %q", response)
+		}
+	}
+	waitWorkers(t, s, 1)
+	if err := newTestClient(t, s, testAdminKey).Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFixedWorkers(t *testing.T) {
+	s, _ := startTestServer(t, nil)
+	waitWorkers(t, s, s.numWorkers)
+}
@@ -6,9 +6,14 @@ package server
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cubeflix/deepwell/auth"
@@ -23,18 +28,44 @@ type Server interface {
 	// Set the server address.
 	SetAddress(addr string)
 
+	// Get the address the server is bound to, such as the concrete port when
+	// the configured address uses port 0. Empty until the listener is bound.
+	ActualAddress() string
+
 	// Get the timeout duration.
 	Timeout() time.Duration
 
 	// Set the timeout duration.
 	SetTimeout(timeout time.Duration)
 
+	// Get the handshake timeout duration.
+	HandshakeTimeout() time.Duration
+
+	// Set the handshake timeout duration.
+	SetHandshakeTimeout(timeout time.Duration)
+
 	// TLS config.
 	TLSConfig() *tls.Config
 
 	// Set the TLS config.
 	SetTLSConfig(config *tls.Config)
 
+	// Get the ACME options.
+	ACME() ACMEOptions
+
+	// Set the ACME options. When domains are set, certificates for them are
+	// obtained and renewed over ACME when serving, in place of the
+	// certificates in the TLS config.
+	SetACME(options ACMEOptions)
+
+	// Get the interval the TLS session ticket keys are rotated on. Zero
+	// leaves ticket keys to the TLS library.
+	TicketKeyRotation() time.Duration
+
+	// Set the interval the TLS session ticket keys are rotated on. Zero
+	// leaves ticket keys to the TLS library.
+	SetTicketKeyRotation(interval time.Duration)
+
 	// Get the backlog size.
 	BacklogSize() int
 
@@ -47,24 +78,181 @@ type Server interface {
 	// Set the number of workers.
 	SetNumWorkers(workers int)
 
+	// Get the worker scaling options.
+	WorkerScaling() WorkerScaling
+
+	// Set the worker scaling options. If the maximum is non-zero, the pool
+	// starts with the minimum number of workers, grows up to the maximum
+	// while requests are queued, and shrinks back once it is idle, instead
+	// of running a fixed number of workers.
+	SetWorkerScaling(scaling WorkerScaling)
+
+	// Get the limits of the removetree command: the number of paths removed
+	// in each batch, and the maximum number of paths removed per second.
+	RemoveTreeLimits() (batchSize, rate int)
+
+	// Set the limits of the removetree command: the number of paths removed
+	// in each batch, and the maximum number of paths removed per second. A
+	// zero rate is unlimited.
+	SetRemoveTreeLimits(batchSize, rate int)
+
+	// Get the bandwidth limit of each connection in bytes per second. Zero
+	// means unlimited.
+	BandwidthLimit() int64
+
+	// Set the bandwidth limit of each connection in bytes per second, in
+	// each direction. Reads and writes on connections sleep as needed to
+	// honor the limit, including streams of multiplexed sessions. Zero means
+	// unlimited.
+	SetBandwidthLimit(bps int64)
+
+	// Get if the data of reads and writes is compressed.
+	Compression() bool
+
+	// Set if the data of reads and writes is compressed. When enabled, the
+	// data of reads is compressed with gzip if the client asks for it, and
+	// clients may send compressed writes. Small data is sent as is.
+	SetCompression(v bool)
+
+	// Get the file the usage of keys with quotas is persisted to.
+	KeyUsageFile() string
+
+	// Set the file the usage of keys with quotas is persisted to, loading
+	// the usage from it. The files stored by keys with quotas are tracked,
+	// so each key's writes can be limited. Empty keeps the usage in memory.
+	SetKeyUsageFile(path string) error
+
+	// Get the limits of idempotency keys: how long the outcomes of requests
+	// with idempotency keys are kept for, and the maximum number kept.
+	IdempotencyLimits() (window time.Duration, maxKeys int)
+
+	// Set the limits of idempotency keys. Mutating requests sent with an
+	// idempotency key are only executed once, and retries with the same key
+	// within the window are sent the outcome of the first. Zero uses
+	// DefaultIdempotencyWindow and DefaultMaxIdempotencyKeys.
+	SetIdempotencyLimits(window time.Duration, maxKeys int)
+
+	// Get the maximum number of open connections, and how long connections
+	// over the limit wait for another connection to close before being
+	// rejected. Zero is unlimited.
+	ConnectionLimit() (max int, queueTimeout time.Duration)
+
+	// Set the maximum number of open connections, and how long connections
+	// over the limit wait for another connection to close before being
+	// rejected. As many connections may wait as the limit, and connections
+	// over that are closed immediately. Unlike the backlog, which queues
+	// accepted connections for the workers, the limit counts every
+	// connection which is open. Zero is unlimited.
+	SetConnectionLimit(max int, queueTimeout time.Duration)
+
+	// Set the maximum number of open connections, keeping the queue timeout.
+	// Connections over the limit are sent a FAILED response. Zero is
+	// unlimited.
+	SetMaxConnections(max int)
+
 	// Get the map of drives.
 	Drives() map[string]drive.Drive
 
 	// Set the map of drives.
 	SetDrives(drives map[string]drive.Drive)
 
+	// Get if a drive has been made read-only at runtime.
+	DriveReadOnly(name string) bool
+
+	// Make a drive read-only at runtime, or writable again. Read-only drives
+	// reject every command which would modify them.
+	SetDriveReadOnly(name string, readOnly bool) error
+
+	// Drop the caches of a drive, flushing any written data not yet flushed,
+	// so it reflects changes made to its files outside the server.
+	DropCache(name string) error
+
+	// Get if a drive is healthy. Drives are unhealthy while their backing
+	// store is unavailable, and commands on them fail until it recovers.
+	DriveHealthy(name string) bool
+
+	// Get the interval the drives are checked on.
+	HealthCheckInterval() time.Duration
+
+	// Set the interval the drives are checked on. Zero uses
+	// DefaultHealthCheckInterval, and a negative interval disables checks.
+	SetHealthCheckInterval(interval time.Duration)
+
+	// Get the address to serve drives over HTTPS on. Empty if disabled.
+	HTTPAddress() string
+
+	// Set the address to serve drives over HTTPS on. Empty to disable.
+	SetHTTPAddress(addr string)
+
+	// Get the HTTP options of the drives served over HTTPS.
+	HTTPDrives() map[string]HTTPOptions
+
+	// Set the HTTP options of the drives served over HTTPS. Drives without
+	// options are not served.
+	SetHTTPDrives(drives map[string]HTTPOptions)
+
+	// Get the HTTP handler, serving drives at /<drive>/<path>.
+	HTTPHandler() http.Handler
+
+	// Get the address to serve metrics on over HTTP. Empty if disabled.
+	MetricsAddress() string
+
+	// Set the address to serve metrics on over HTTP, at /metrics. Empty to
+	// disable.
+	SetMetricsAddress(addr string)
+
+	// Get the HTTP handler serving the metrics of the server in the
+	// Prometheus format.
+	MetricsHandler() http.Handler
+
 	// Get the loggers.
 	Logger() (info, err *log.Logger)
 
 	// Set the loggers.
 	SetLogger(info, err *log.Logger)
 
+	// Get the access logger of a drive. Nil if the drive has no access log.
+	AccessLog(drive string) *log.Logger
+
+	// Set the access logger of a drive, which logs every access to the drive
+	// in addition to the server's own logging. Nil disables the access log.
+	// Drives may share a logger.
+	SetAccessLog(drive string, logger *log.Logger)
+
+	// Get the user and group the server runs as after binding.
+	RunAs() (user, group string)
+
+	// Set the user and group the server runs as after binding. Only supported
+	// on Linux.
+	SetRunAs(user, group string)
+
 	// Get the authentication manager.
 	Authentication() auth.Authentication
 
 	// Set the authentication manager.
 	SetAuthentication(auth auth.Authentication)
 
+	// Get the secret requests must be signed with, unless their key has its
+	// own secret. Nil if requests don't need to be signed.
+	HMACSecret() []byte
+
+	// Set the secret requests must be signed with, unless their key has its
+	// own secret. Signed connections carry each message in frames signed
+	// with an HMAC, so tampering is detected even without end-to-end TLS.
+	// Nil stops requiring signing.
+	SetHMACSecret(secret []byte)
+
+	// Register a custom command, replacing any existing command with the
+	// same name.
+	RegisterCommand(name string, handler func(*Request) error)
+
+	// Get the configuration profile.
+	Profile() string
+
+	// Set the configuration profile, which is applied over the base
+	// configuration when loading a configuration file.
+	SetProfile(profile string)
+
 	// Load a configuration file.
 	LoadConfig(path string) error
 
@@ -77,41 +265,143 @@ type Server interface {
 
 // The server implementation.
 type server struct {
-	addr           string
-	timeout        time.Duration
-	tlsConfig      *tls.Config
-	backlogSize    int
-	numWorkers     int
-	drives         map[string]drive.Drive
-	authentication auth.Authentication
+	addr              string
+	timeout           time.Duration
+	handshakeTimeout  time.Duration
+	tlsConfig         *tls.Config
+	acme              ACMEOptions
+	ticketKeyRotation time.Duration
+	backlogSize       int
+	numWorkers        int
+	scaling           WorkerScaling
+	removeBatchSize   int
+	removeRate        int
+	compression       bool
+	bandwidth         int64
+	maxConnections    int
+	connQueueTimeout  time.Duration
+	drives            map[string]drive.Drive
+	readOnlyDrives    map[string]bool
+	readOnlyLock      sync.RWMutex
+	unhealthyDrives   map[string]bool
+	healthLock        sync.RWMutex
+	healthInterval    time.Duration
+	authentication    auth.Authentication
+	hmacSecret        []byte
+	runAsUser         string
+	runAsGroup        string
+	profile           string
+	httpAddr          string
+	httpDrives        map[string]HTTPOptions
+	metricsAddr       string
 
 	info    *log.Logger
 	err     *log.Logger
 	logFile *os.File
 
+	// The access loggers of the drives, and the files they write to.
+	accessLogs     map[string]*log.Logger
+	accessLogFiles []*os.File
+
 	commands map[string]func(*request) error
 
-	running    bool
+	running    atomic.Bool
 	jobs       chan *request
+	connSlots  chan struct{}
+	connQueue  chan struct{}
 	stopSignal chan struct{}
+	retire     chan struct{}
+	stopTicket chan struct{}
 	listener   net.Listener
+	boundAddr  string
+	boundLock  sync.Mutex
+	httpServer *http.Server
+	load       loadStats
+	sessions   sessionRegistry
+
+	// The open transactions.
+	transactions transactionRegistry
+
+	// The usage of keys with quotas.
+	keyUsage keyUsageStore
+
+	// The outcomes of recent requests with idempotency keys.
+	idempotency        idempotencyStore
+	idempotencyWindow  time.Duration
+	maxIdempotencyKeys int
+
+	// The number of running workers.
+	liveWorkers int32
+
+	// The time the server started serving.
+	started time.Time
+
+	// The metrics of the server, and the server exporting them.
+	metrics       *serverMetrics
+	metricsServer *http.Server
+
+	// The server answering ACME HTTP-01 challenges.
+	challengeServer *http.Server
 }
 
 // Create a new server.
 func NewServer() Server {
 	s := &server{authentication: auth.NewAuthentication()}
 	s.commands = map[string]func(*request) error{
-		"ping":   s.pingCommand,
-		"drives": s.drivesCommand,
-		"create": s.createCommand,
-		"mkdir":  s.mkdirCommand,
-		"read":   s.readCommand,
-		"list":   s.listCommand,
-		"stat":   s.statCommand,
-		"write":  s.writeCommand,
-		"remove": s.removeCommand,
-		"move":   s.moveCommand,
+		"ping":             s.pingCommand,
+		"time":             s.timeCommand,
+		"drives":           s.drivesCommand,
+		"drivesinfo":       s.drivesInfoCommand,
+		"create":           s.createCommand,
+		"createsized":      s.createSizedCommand,
+		"createtemp":       s.createTempCommand,
+		"mkdir":            s.mkdirCommand,
+		"read":             s.readCommand,
+		"readchunks":       s.readChunksCommand,
+		"readmany":         s.readManyCommand,
+		"readlines":        s.readLinesCommand,
+		"readrecords":      s.readRecordsCommand,
+		"appendrecord":     s.appendRecordCommand,
+		"list":             s.listCommand,
+		"listjson":         s.listJSONCommand,
+		"load":             s.loadCommand,
+		"status":           s.statusCommand,
+		"stat":             s.statCommand,
+		"write":            s.writeCommand,
+		"writeat":          s.writeAtCommand,
+		"append":           s.appendCommand,
+		"cas":              s.casCommand,
+		"remove":           s.removeCommand,
+		"setdrivereadonly": s.setDriveReadOnlyCommand,
+		"dropcache":        s.dropCacheCommand,
+		"keyquota":         s.keyQuotaCommand,
+		"sessions":         s.sessionsCommand,
+		"kill":             s.killCommand,
+		"removetree":       s.removeTreeCommand,
+		"move":             s.moveCommand,
+		"movecrossdrive":   s.moveCrossDriveCommand,
+		"batch":            s.batchCommand,
+		"copy":             s.copyCommand,
+		"chown":            s.chownCommand,
+		"begin":            s.beginCommand,
+		"stage":            s.stageCommand,
+		"stagewrite":       s.stageWriteCommand,
+		"commit":           s.commitCommand,
+		"rollback":         s.rollbackCommand,
+		"versions":         s.versionsCommand,
+		"readversion":      s.readVersionCommand,
+		"restoreversion":   s.restoreVersionCommand,
+		"fsync":            s.fsyncCommand,
+		"checksum":         s.checksumCommand,
+		"compare":          s.compareCommand,
+		"quotacheck":       s.quotaCheckCommand,
+		"usage":            s.usageCommand,
+		"dirsize":          s.dirSizeCommand,
+		"count":            s.countCommand,
+		"verify":           s.verifyCommand,
+		"manifest":         s.manifestCommand,
 	}
+	s.metrics = newServerMetrics(s)
 	return s
 }
 
@@ -125,6 +415,13 @@ func (s *server) SetAddress(addr string) {
 	s.addr = addr
 }
 
+// Get the address the server is bound to. Empty until the listener is bound.
+func (s *server) ActualAddress() string {
+	s.boundLock.Lock()
+	defer s.boundLock.Unlock()
+	return s.boundAddr
+}
+
 // Get the timeout duration.
 func (s *server) Timeout() time.Duration {
 	return s.timeout
@@ -135,6 +432,16 @@ func (s *server) SetTimeout(timeout time.Duration) {
 	s.timeout = timeout
 }
 
+// Get the handshake timeout duration.
+func (s *server) HandshakeTimeout() time.Duration {
+	return s.handshakeTimeout
+}
+
+// Set the handshake timeout duration.
+func (s *server) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshakeTimeout = timeout
+}
+
 // Get the TLS config.
 func (s *server) TLSConfig() *tls.Config {
 	return s.tlsConfig
@@ -145,6 +452,26 @@ func (s *server) SetTLSConfig(config *tls.Config) {
 	s.tlsConfig = config
 }
 
+// Get the ACME options.
+func (s *server) ACME() ACMEOptions {
+	return s.acme
+}
+
+// Set the ACME options.
+func (s *server) SetACME(options ACMEOptions) {
+	s.acme = options
+}
+
+// Get the interval the TLS session ticket keys are rotated on.
+func (s *server) TicketKeyRotation() time.Duration {
+	return s.ticketKeyRotation
+}
+
+// Set the interval the TLS session ticket keys are rotated on.
+func (s *server) SetTicketKeyRotation(interval time.Duration) {
+	s.ticketKeyRotation = interval
+}
+
 // Get the backlog size.
 func (s *server) BacklogSize() int {
 	return s.backlogSize
@@ -165,6 +492,63 @@ func (s *server) SetNumWorkers(workers int) {
 	s.numWorkers = workers
 }
 
+// Get the worker scaling options.
+func (s *server) WorkerScaling() WorkerScaling {
+	return s.scaling
+}
+
+// Set the worker scaling options.
+func (s *server) SetWorkerScaling(scaling WorkerScaling) {
+	s.scaling = scaling
+}
+
+// Get the limits of the removetree command.
+func (s *server) RemoveTreeLimits() (int, int) {
+	return s.removeBatchSize, s.removeRate
+}
+
+// Set the limits of the removetree command.
+func (s *server) SetRemoveTreeLimits(batchSize, rate int) {
+	s.removeBatchSize = batchSize
+	s.removeRate = rate
+}
+
+// Get the bandwidth limit of each connection.
+func (s *server) BandwidthLimit() int64 {
+	return s.bandwidth
+}
+
+// Set the bandwidth limit of each connection.
+func (s *server) SetBandwidthLimit(bps int64) {
+	s.bandwidth = bps
+}
+
+// Get if the data of reads and writes is compressed.
+func (s *server) Compression() bool {
+	return s.compression
+}
+
+// Set if the data of reads and writes is compressed.
+func (s *server) SetCompression(v bool) {
+	s.compression = v
+}
+
+// Get the maximum number of open connections and the queue timeout.
+func (s *server) ConnectionLimit() (int, time.Duration) {
+	return s.maxConnections, s.connQueueTimeout
+}
+
+// Set the maximum number of open connections and the queue timeout.
+func (s *server) SetConnectionLimit(max int, queueTimeout time.Duration) {
+	s.maxConnections = max
+	s.connQueueTimeout = queueTimeout
+}
+
+// Set the maximum number of open connections, keeping the queue timeout.
+func (s *server) SetMaxConnections(max int) {
+	s.maxConnections = max
+}
+
 // Get the map of drives.
 func (s *server) Drives() map[string]drive.Drive {
 	return s.drives
@@ -175,6 +559,58 @@ func (s *server) SetDrives(drives map[string]drive.Drive) {
 	s.drives = drives
 }
 
+// Get if a drive has been made read-only at runtime.
+func (s *server) DriveReadOnly(name string) bool {
+	s.readOnlyLock.RLock()
+	defer s.readOnlyLock.RUnlock()
+	return s.readOnlyDrives[name]
+}
+
+// Make a drive read-only at runtime, or writable again.
+func (s *server) SetDriveReadOnly(name string, readOnly bool) error {
+	if _, ok := s.drives[name]; !ok {
+		return errors.New(fmt.Sprintf("unknown drive: %s", name))
+	}
+
+	s.readOnlyLock.Lock()
+	defer s.readOnlyLock.Unlock()
+	if s.readOnlyDrives == nil {
+		s.readOnlyDrives = map[string]bool{}
+	}
+	s.readOnlyDrives[name] = readOnly
+	return nil
+}
+
+// Drop the caches of a drive.
+func (s *server) DropCache(name string) error {
+	d, ok := s.drives[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown drive: %s", name))
+	}
+	return drive.DropCache(d)
+}
+
+// Get the address to serve drives over HTTPS on. Empty if disabled.
+func (s *server) HTTPAddress() string {
+	return s.httpAddr
+}
+
+// Set the address to serve drives over HTTPS on. Empty to disable.
+func (s *server) SetHTTPAddress(addr string) {
+	s.httpAddr = addr
+}
+
+// Get the HTTP options of the drives served over HTTPS.
+func (s *server) HTTPDrives() map[string]HTTPOptions {
+	return s.httpDrives
+}
+
+// Set the HTTP options of the drives served over HTTPS. Drives without options
+// are not served.
+func (s *server) SetHTTPDrives(drives map[string]HTTPOptions) {
+	s.httpDrives = drives
+}
+
 // Get the loggers.
 func (s *server) Logger() (info, err *log.Logger) {
 	return s.info, s.err
@@ -186,6 +622,35 @@ func (s *server) SetLogger(info, err *log.Logger) {
 	s.err = err
 }
 
+// Get the access logger of a drive.
+func (s *server) AccessLog(drive string) *log.Logger {
+	return s.accessLogs[drive]
+}
+
+// Set the access logger of a drive.
+func (s *server) SetAccessLog(drive string, logger *log.Logger) {
+	if s.accessLogs == nil {
+		s.accessLogs = map[string]*log.Logger{}
+	}
+	if logger == nil {
+		delete(s.accessLogs, drive)
+		return
+	}
+	s.accessLogs[drive] = logger
+}
+
+// Get the user and group the server runs as after binding.
+func (s *server) RunAs() (user, group string) {
+	return s.runAsUser, s.runAsGroup
+}
+
+// Set the user and group the server runs as after binding. Only supported on
+// Linux.
+func (s *server) SetRunAs(user, group string) {
+	s.runAsUser = user
+	s.runAsGroup = group
+}
+
 // Get the authentication manager.
 func (s *server) Authentication() auth.Authentication {
 	return s.authentication
@@ -196,21 +661,73 @@ func (s *server) SetAuthentication(a auth.Authentication) {
 	s.authentication = a
 }
 
+// Get the configuration profile.
+func (s *server) Profile() string {
+	return s.profile
+}
+
+// Set the configuration profile, which is applied over the base
+// configuration when loading a configuration file.
+func (s *server) SetProfile(profile string) {
+	s.profile = profile
+}
+
 // Serve.
 func (s *server) Serve() error {
-	s.running = true
+	s.running.Store(true)
+	s.started = time.Now()
 
 	// Initialize the channels.
 	s.jobs = make(chan *request, s.backlogSize)
-	s.stopSignal = make(chan struct{}, s.numWorkers)
+	s.stopSignal = make(chan struct{})
+	s.retire = make(chan struct{})
+	if s.maxConnections > 0 {
+		s.connSlots = make(chan struct{}, s.maxConnections)
+		s.connQueue = make(chan struct{}, s.maxConnections)
+	}
 
 	// Start the workers.
-	for i := 0; i < s.numWorkers; i++ {
-		go s.worker()
+	if s.scaling.Max > 0 {
+		for i := 0; i < s.scaling.Min; i++ {
+			s.spawnWorker()
+		}
+		go s.supervise(s.stopSignal)
+	} else {
+		for i := 0; i < s.numWorkers; i++ {
+			s.spawnWorker()
+		}
+	}
+
+	// Start checking the health of the drives.
+	if s.healthInterval >= 0 {
+		go s.monitorHealth(s.stopSignal)
 	}
 
 	s.info.Println("starting server")
 
+	// Start rotating the session ticket keys.
+	if s.ticketKeyRotation > 0 {
+		s.stopTicket = make(chan struct{})
+		if err := s.rotateTicketKeys(s.stopTicket); err != nil {
+			return err
+		}
+	}
+
+	// Start obtaining certificates over ACME.
+	if err := s.startACME(); err != nil {
+		return err
+	}
+
+	// Start serving over HTTPS.
+	if err := s.serveHTTP(); err != nil {
+		return err
+	}
+
+	// Start serving metrics.
+	if err := s.serveMetrics(); err != nil {
+		return err
+	}
+
 	// Start listening.
 	return s.listen()
 }
@@ -218,13 +735,23 @@ func (s *server) Serve() error {
 // Stop serving.
 func (s *server) Stop() {
 	// Stop listening.
-	s.running = false
+	s.running.Store(false)
 	s.listener.Close()
-
-	// Stop the workers.
-	for i := 0; i < s.numWorkers; i++ {
-		s.stopSignal <- struct{}{}
+	if s.httpServer != nil {
+		s.httpServer.Close()
 	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.challengeServer != nil {
+		s.challengeServer.Close()
+	}
+	if s.stopTicket != nil {
+		close(s.stopTicket)
+	}
+
+	// Stop the workers, the supervisor, and the health checks.
+	close(s.stopSignal)
 
 	s.info.Println("stopping server")
 
@@ -232,6 +759,9 @@ func (s *server) Stop() {
 	if s.logFile != nil {
 		s.logFile.Close()
 	}
+	for _, file := range s.accessLogFiles {
+		file.Close()
+	}
 }
 
 // The connection handling routine.
@@ -243,11 +773,23 @@ func (s *server) listen() error {
 		return err
 	}
 
+	// Record the address the listener is bound to.
+	s.boundLock.Lock()
+	s.boundAddr = listener.Addr().String()
+	s.boundLock.Unlock()
+	s.info.Println("listening on", s.boundAddr)
+
+	// Drop privileges now that the listener is bound.
+	if err := s.dropPrivileges(); err != nil {
+		listener.Close()
+		return err
+	}
+
 	// Accept connections.
-	for s.running {
+	for s.running.Load() {
 		conn, err := listener.Accept()
 		if err != nil {
-			if !s.running {
+			if !s.running.Load() {
 				// If we are not running (i.e. shutting down), then ignore this
 				// and exit.
 				return nil
@@ -255,7 +797,12 @@ func (s *server) listen() error {
 			s.err.Println("failed to accept connection: ", err.Error())
 			continue
 		}
-		req := newRequest(conn.(*tls.Conn), s.timeout)
+		req := newRequest(conn, s.timeout)
+		s.load.record(time.Now())
+		if s.connSlots != nil && !s.admit(req) {
+			// The connection is queued until a slot frees up.
+			continue
+		}
 		s.jobs <- req
 	}
 
@@ -265,17 +812,24 @@ func (s *server) listen() error {
 // The worker routine.
 func (s *server) worker() error {
 	// Continually handle new requests.
-	for s.running {
+	for s.running.Load() {
 		select {
 		case <-s.stopSignal:
 			// Stop signal. NOTE: Never put any code here since we can't be
 			// sure we'll ever get the stop signal, we may just exit the loop.
 			return nil
+		case <-s.retire:
+			// Retired by the supervisor while idle.
+			return nil
 		case req := <-s.jobs:
 			// Got a request.
+			s.load.setBusy(true)
+			s.metrics.busyWorkers.Inc()
 			if err := s.handleRequest(req); err != nil {
 				s.err.Println("failed to handle request: ", err.Error())
 			}
+			s.metrics.busyWorkers.Dec()
+			s.load.setBusy(false)
 		}
 	}
 
@@ -0,0 +1,154 @@
+// server/server_test.go
+// Helpers for testing the server over real connections, and tests for
+// serving.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/client"
+	"github.com/cubeflix/deepwell/drive"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// The key of test servers which may use every drive.
+const testAdminKey = "admin"
+
+// Create a self-signed TLS config for localhost.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Start a server on a free port with two drives, d1 and d2, in a temporary
+// directory, and an admin key. The server may be configured before it starts
+// serving. Returns the server and the directory of the drives. The server is
+// stopped when the test finishes.
+func startTestServer(t *testing.T, configure func(s *server, a auth.Authentication)) (*server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	drives := map[string]drive.Drive{}
+	for _, name := range []string{"d1", "d2"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		drives[name] = drive.NewDrive(filepath.Join(dir, name))
+	}
+
+	s := NewServer().(*server)
+	s.SetAddress("127.0.0.1:0")
+	s.SetHTTPAddress("")
+	s.SetTimeout(5 * time.Second)
+	s.SetHandshakeTimeout(5 * time.Second)
+	s.SetBacklogSize(10)
+	s.SetNumWorkers(5)
+	s.SetIdempotencyLimits(0, 0)
+	s.SetTLSConfig(testTLSConfig(t))
+	s.SetDrives(drives)
+	s.SetHealthCheckInterval(-1)
+	s.SetLogger(log.New(io.Discard, "", 0), log.New(io.Discard, "", 0))
+	a := auth.NewAuthentication()
+	a.AddKey(testAdminKey, []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1", "d2"}, CanWrite: true, IsAdmin: true})
+	s.SetAuthentication(a)
+	if configure != nil {
+		configure(s, a)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActualAddress() == "" {
+		select {
+		case err := <-served:
+			t.Fatalf("failed to serve: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(s.Stop)
+	return s, dir
+}
+
+// Create a client of a test server with a key.
+func newTestClient(t *testing.T, s *server, key string) client.Client {
+	t.Helper()
+	c := client.NewClient(5 * time.Second)
+	c.Connect(s.ActualAddress(), key)
+	c.SetInsecureSkipVerify(true)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Send a raw request to a test server, for commands the client doesn't
+// support. Returns the response after the protocol header.
+func rawRequest(t *testing.T, s *server, key, command, args string, data []byte) string {
+	t.Helper()
+	c, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	request := strings.Join([]string{protocol.Header, key, command, strconv.Itoa(len(args))}, "\n") + "\n" + args + strconv.Itoa(len(data)) + "\n" + string(data)
+	if _, err := c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rest, _ := strings.Cut(string(response), "\n")
+	if header != protocol.Header {
+		t.Fatalf("invalid response: %q", response)
+	}
+	return rest
+}
+
+func TestActualAddress(t *testing.T) {
+	if addr := NewServer().ActualAddress(); addr != "" {
+		t.Fatalf("address %q before serving", addr)
+	}
+	s, _ := startTestServer(t, nil)
+	host, port, err := net.SplitHostPort(s.ActualAddress())
+	if err != nil || host != "127.0.0.1" || port == "0" {
+		t.Fatalf("bound to %q: %v", s.ActualAddress(), err)
+	}
+	if err := newTestClient(t, s, testAdminKey).Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+// server/sessions.go
+// Tracking and managing active sessions.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// An active session: a request being handled.
+type session struct {
+	id      uint64
+	ip      string
+	key     string
+	command string
+	start   time.Time
+	r       *request
+}
+
+// The registry of active sessions, keyed by session ID.
+type sessionRegistry struct {
+	lock     sync.Mutex
+	next     uint64
+	sessions map[uint64]*session
+}
+
+// Register a request as an active session. Returns a function which removes
+// the session once the request has been handled.
+func (reg *sessionRegistry) add(r *request) func() {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.sessions == nil {
+		reg.sessions = map[uint64]*session{}
+	}
+	reg.next++
+	id := reg.next
+	reg.sessions[id] = &session{
+		id:      id,
+		ip:      r.remoteIP(),
+		key:     r.keyID(),
+		command: r.command,
+		start:   time.Now(),
+		r:       r,
+	}
+
+	return func() {
+		reg.lock.Lock()
+		defer reg.lock.Unlock()
+		delete(reg.sessions, id)
+	}
+}
+
+// Get the active sessions, ordered by ID.
+func (reg *sessionRegistry) list() []*session {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	sessions := make([]*session, 0, len(reg.sessions))
+	for _, sess := range reg.sessions {
+		sessions = append(sessions, sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].id < sessions[j].id
+	})
+	return sessions
+}
+
+// Forcibly close the connection of a session. Returns if the session
+// exists.
+func (reg *sessionRegistry) kill(id uint64) bool {
+	reg.lock.Lock()
+	sess, ok := reg.sessions[id]
+	reg.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	sess.r.writer.Close()
+	return true
+}
@@ -0,0 +1,79 @@
+// server/sessions_test.go
+// Tests for tracking and managing active sessions.
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+func TestSessionsAndKill(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("user", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}})
+		s.RegisterCommand("block", func(r *Request) error {
+			if _, err := r.Args(); err != nil {
+				return err
+			}
+			if err := r.Consume(); err != nil {
+				return err
+			}
+			<-release
+			return nil
+		})
+	})
+	admin := newTestClient(t, s, testAdminKey)
+
+	// Start a request which stays active.
+	conn, err := tls.Dial("tcp", s.ActualAddress(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := strings.Join([]string{protocol.Header, "user", "block", "0", "0"}, "\n") + "\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The blocked request and the sessions request itself are active.
+	sessions, err := admin.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Command != "block" || sessions[1].Command != "sessions" {
+		t.Fatalf("wrong sessions: %+v", sessions)
+	}
+	if sessions[0].IP != "127.0.0.1" || sessions[0].Key != auth.HashKey("user")[:16] || sessions[0].BytesRead < int64(len(request)) || sessions[0].Duration < 50*time.Millisecond {
+		t.Fatalf("wrong session: %+v", sessions[0])
+	}
+
+	// Only admin keys may manage sessions.
+	user := newTestClient(t, s, "user")
+	if _, err := user.Sessions(); err == nil {
+		t.Error("listed sessions without an admin key")
+	}
+	if err := user.Kill(sessions[0].ID); err == nil {
+		t.Error("killed a session without an admin key")
+	}
+
+	// Killing the session closes its connection.
+	if err := admin.Kill(sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	if err := admin.Kill(sessions[0].ID + 100); err == nil {
+		t.Error("killed a missing session")
+	}
+}
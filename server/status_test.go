@@ -0,0 +1,49 @@
+// server/status_test.go
+// Tests for the status command.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestStatusCommand(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetHealthCheckInterval(20 * time.Millisecond)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// The status needs no valid key.
+	status, err := newTestClient(t, s, "unknown").Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Uptime < 50*time.Millisecond || status.Uptime > time.Minute {
+		t.Errorf("uptime %v", status.Uptime)
+	}
+	if status.Workers != 5 || status.Busy < 1 || status.Busy > status.Workers || status.Queued != 0 {
+		t.Errorf("%d of %d workers busy with %d queued", status.Busy, status.Workers, status.Queued)
+	}
+	if status.Drives != 2 || status.UnhealthyDrives != 0 {
+		t.Errorf("%d drives, %d unhealthy", status.Drives, status.UnhealthyDrives)
+	}
+
+	// Unhealthy drives are counted.
+	if err := os.Rename(filepath.Join(dir, "d1"), filepath.Join(dir, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	waitDriveHealthy(t, s, "d1", false)
+	if status, err := newTestClient(t, s, testAdminKey).Status(); err != nil || status.Drives != 2 || status.UnhealthyDrives != 1 {
+		t.Fatalf("status %+v: %v", status, err)
+	}
+
+	// Other commands still need a valid key.
+	if err := newTestClient(t, s, "unknown").Ping(); err == nil {
+		t.Fatal("pinged with an unknown key")
+	}
+}
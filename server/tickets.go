@@ -0,0 +1,58 @@
+// server/tickets.go
+// TLS session ticket key rotation.
+
+package server
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// The number of ticket keys kept, including the current one. Tickets issued
+// under older keys can still be resumed until they are rotated out.
+const numTicketKeys = 3
+
+// Generate a new session ticket key.
+func newTicketKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+// Rotate the session ticket keys of the TLS config on an interval, until the
+// stop channel is closed. The newest key encrypts new tickets; the previous
+// keys are kept so existing tickets can still be resumed.
+func (s *server) rotateTicketKeys(stop chan struct{}) error {
+	key, err := newTicketKey()
+	if err != nil {
+		return err
+	}
+	keys := [][32]byte{key}
+	s.tlsConfig.SetSessionTicketKeys(keys)
+
+	go func() {
+		ticker := time.NewTicker(s.ticketKeyRotation)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			// Add a new key and drop the oldest.
+			key, err := newTicketKey()
+			if err != nil {
+				s.err.Println("failed to rotate session ticket keys: ", err.Error())
+				continue
+			}
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > numTicketKeys {
+				keys = keys[:numTicketKeys]
+			}
+			s.tlsConfig.SetSessionTicketKeys(keys)
+		}
+	}()
+
+	return nil
+}
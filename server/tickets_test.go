@@ -0,0 +1,89 @@
+// server/tickets_test.go
+// Tests for TLS session ticket key rotation.
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+	"github.com/cubeflix/deepwell/protocol"
+)
+
+// Ping a test server over a new connection. Returns if the TLS session was
+// resumed.
+func pingResumed(t *testing.T, s *server, config *tls.Config) bool {
+	t.Helper()
+	c, err := tls.Dial("tcp", s.ActualAddress(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Read the whole response, so the session ticket is received.
+	request := strings.Join([]string{protocol.Header, testAdminKey, "ping", "0", "0"}, "\n") + "\n"
+	if _, err := c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	return c.ConnectionState().DidResume
+}
+
+func TestTicketKeyRotation(t *testing.T) {
+	interval := 100 * time.Millisecond
+	s, _ := startTestServer(t, func(s *server, a auth.Authentication) {
+		s.SetTicketKeyRotation(interval)
+	})
+	config := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+
+	if pingResumed(t, s, config) {
+		t.Fatal("first connection resumed a session")
+	}
+	if !pingResumed(t, s, config) {
+		t.Fatal("session not resumed")
+	}
+
+	// Once the key of the cached ticket is rotated out, the session can't be
+	// resumed.
+	time.Sleep(time.Duration(numTicketKeys+1) * interval)
+	if pingResumed(t, s, config) {
+		t.Fatal("session resumed with a rotated out ticket key")
+	}
+}
+
+func TestConfigTicketKeyRotation(t *testing.T) {
+	tests := []struct {
+		cfg      string
+		interval time.Duration
+		valid    bool
+	}{
+		{``, 0, true},
+		{`TicketKeyRotation = "12h"`, 12 * time.Hour, true},
+		{`TicketKeyRotation = "daily"`, 0, false},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			s, err := loadTestConfig(t, test.cfg)
+			if !test.valid {
+				if err == nil {
+					t.Fatal("invalid configuration loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.TicketKeyRotation() != test.interval {
+				t.Fatalf("rotation interval %v, expected %v", s.TicketKeyRotation(), test.interval)
+			}
+		})
+	}
+}
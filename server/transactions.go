@@ -0,0 +1,261 @@
+// server/transactions.go
+// Transactions of staged operations, committed all at once.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cubeflix/deepwell/drive"
+)
+
+// The time after which an uncommitted transaction is discarded.
+const DefaultTransactionTimeout = time.Hour
+
+// The prefix of the staging directories of transactions, at the root of their
+// drives.
+const stagingPrefix = ".txn-"
+
+// A staged operation of a transaction.
+type stagedOp struct {
+	// The kind of operation: write, mkdir, remove, or move.
+	kind string
+	path string
+
+	// The destination of a move, and the staged file of a write and its
+	// size.
+	dest   string
+	staged string
+	size   int64
+}
+
+// A transaction. Operations are staged until the transaction is committed,
+// and writes are staged in a directory within the drive.
+type transaction struct {
+	lock    sync.Mutex
+	id      string
+	drive   string
+	key     string
+	staging string
+	ops     []stagedOp
+	created time.Time
+	done    bool
+}
+
+// The registry of open transactions, keyed by ID.
+type transactionRegistry struct {
+	lock sync.Mutex
+	txns map[string]*transaction
+}
+
+// Begin a transaction on a drive, creating its staging directory.
+func (reg *transactionRegistry) begin(d drive.Drive, driveName, key string) (*transaction, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	txn := &transaction{id: id, drive: driveName, key: key, staging: stagingPrefix + id, created: time.Now()}
+	if err := d.CreateDirectory(txn.staging); err != nil {
+		return nil, err
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.txns == nil {
+		reg.txns = map[string]*transaction{}
+	}
+	reg.txns[id] = txn
+	return txn, nil
+}
+
+// Get an open transaction. Transactions may only be used by the key which
+// began them.
+func (reg *transactionRegistry) get(id, key string) (*transaction, error) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	txn, ok := reg.txns[id]
+	if !ok || txn.key != key {
+		return nil, errors.New(fmt.Sprintf("unknown transaction: %s", id))
+	}
+	return txn, nil
+}
+
+// Remove a transaction once it has been committed or rolled back.
+func (reg *transactionRegistry) remove(id string) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	delete(reg.txns, id)
+}
+
+// Remove the transactions which have been open for too long, returning them.
+func (reg *transactionRegistry) removeExpired() []*transaction {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	expired := []*transaction{}
+	for id, txn := range reg.txns {
+		if time.Since(txn.created) > DefaultTransactionTimeout {
+			delete(reg.txns, id)
+			expired = append(expired, txn)
+		}
+	}
+	return expired
+}
+
+// Discard the transactions which have been open for too long, removing their
+// staging directories.
+func (s *server) discardExpiredTransactions() {
+	for _, txn := range s.transactions.removeExpired() {
+		txn.lock.Lock()
+		if !txn.done {
+			txn.done = true
+			if d, ok := s.drives[txn.drive]; ok {
+				txn.discard(d)
+			}
+		}
+		txn.lock.Unlock()
+	}
+}
+
+// Get an open transaction and its drive for a request, ensuring the paths to
+// be modified are writable.
+func (r *request) getTransaction(id string, s *server, paths ...string) (*transaction, drive.Drive, error) {
+	txn, err := s.transactions.get(id, r.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !r.permissions.CanWriteDrive(txn.drive) {
+		r.logDenial(s, "no write permissions", txn.drive, "")
+		return nil, nil, errors.New("no write permissions")
+	}
+	d, err := r.getWritableDrive(txn.drive, s, paths...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return txn, d, nil
+}
+
+// Stage an operation. Fails if the transaction has already been committed,
+// rolled back, or discarded. The lock of the transaction must be held.
+func (txn *transaction) stage(op stagedOp) error {
+	if txn.done {
+		return errors.New(fmt.Sprintf("transaction is closed: %s", txn.id))
+	}
+	txn.ops = append(txn.ops, op)
+	return nil
+}
+
+// Get the path of a new staged file of the transaction.
+func (txn *transaction) stagedPath(kind string) string {
+	return filepath.Join(txn.staging, kind+strconv.Itoa(len(txn.ops)))
+}
+
+// Commit the staged operations in order. If any operation fails, the
+// operations already applied are undone in reverse order, restoring the
+// drive. The commit is not atomic across crashes.
+func (txn *transaction) commit(d drive.Drive) error {
+	undo := []func() error{}
+	for i, op := range txn.ops {
+		op := op
+		backup := filepath.Join(txn.staging, "b"+strconv.Itoa(i))
+		var err error
+		switch op.kind {
+		case "write":
+			// Keep any existing file, so it can be restored.
+			_, statErr := d.Stat(op.path)
+			existed := statErr == nil
+			if existed {
+				if err = d.Move(op.path, backup); err != nil {
+					break
+				}
+			}
+			if err = d.Move(op.staged, op.path); err != nil {
+				if existed {
+					d.Move(backup, op.path)
+				}
+				break
+			}
+			undo = append(undo, func() error {
+				if err := d.Remove(op.path); err != nil {
+					return err
+				}
+				if existed {
+					return d.Move(backup, op.path)
+				}
+				return nil
+			})
+		case "mkdir":
+			if err = d.CreateDirectory(op.path); err != nil {
+				break
+			}
+			undo = append(undo, func() error {
+				return d.Remove(op.path)
+			})
+		case "remove":
+			// Removed paths are kept until the commit succeeds.
+			if err = d.Move(op.path, backup); err != nil {
+				break
+			}
+			undo = append(undo, func() error {
+				return d.Move(backup, op.path)
+			})
+		case "move":
+			// Keep any existing destination, so it can be restored.
+			_, statErr := d.Stat(op.dest)
+			existed := statErr == nil
+			if existed {
+				if err = d.Move(op.dest, backup); err != nil {
+					break
+				}
+			}
+			if err = d.Move(op.path, op.dest); err != nil {
+				if existed {
+					d.Move(backup, op.dest)
+				}
+				break
+			}
+			undo = append(undo, func() error {
+				if err := d.Move(op.dest, op.path); err != nil {
+					return err
+				}
+				if existed {
+					return d.Move(backup, op.dest)
+				}
+				return nil
+			})
+		default:
+			err = errors.New(fmt.Sprintf("unknown operation: %s", op.kind))
+		}
+
+		if err != nil {
+			// Undo the applied operations.
+			for j := len(undo) - 1; j >= 0; j-- {
+				undo[j]()
+			}
+			return errors.New(fmt.Sprintf("%s %s: %s", op.kind, op.path, err.Error()))
+		}
+	}
+	return nil
+}
+
+// Remove the staging directory of a transaction, along with its contents.
+func (txn *transaction) discard(d drive.Drive) error {
+	paths, err := collectTree(context.Background(), d, txn.staging)
+	if err != nil {
+		return err
+	}
+	for i := range paths {
+		if err := d.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// server/transactions_test.go
+// Tests for transactions of staged operations.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cubeflix/deepwell/auth"
+)
+
+func TestTransactionOwnership(t *testing.T) {
+	s, dir := startTestServer(t, func(s *server, a auth.Authentication) {
+		a.AddKey("other", []string{"127.0.0.1"}, auth.Permissions{AllowedDrives: []string{"d1"}, CanWrite: true})
+	})
+	lines := strings.Split(rawRequest(t, s, testAdminKey, "begin", "d1\n", nil), "\n")
+	if lines[0] != "SUCCESS" {
+		t.Fatalf("got %q", lines)
+	}
+	id := lines[1]
+
+	// Other keys can't use the transaction.
+	for _, command := range []string{"stage", "commit", "rollback"} {
+		args := id + "\n"
+		if command == "stage" {
+			args += "mkdir\nstolen\n"
+		}
+		if response := rawRequest(t, s, "other", command, args, nil); !strings.Contains(response, "unknown transaction: "+id) {
+			t.Errorf("%s: got %q", command, response)
+		}
+	}
+
+	// The key which began it can.
+	if response := rawRequest(t, s, testAdminKey, "stage", id+"\nmkdir\nmine\n", nil); !strings.HasPrefix(response, "SUCCESS") {
+		t.Fatalf("got %q", response)
+	}
+	if response := rawRequest(t, s, testAdminKey, "commit", id+"\n", nil); !strings.HasPrefix(response, "SUCCESS") {
+		t.Fatalf("got %q", response)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d1", "mine")); err != nil {
+		t.Fatal(err)
+	}
+	if response := rawRequest(t, s, testAdminKey, "stage", id+"\nmkdir\nlate\n", nil); !strings.Contains(response, "unknown transaction") {
+		t.Fatalf("staged into a committed transaction: %q", response)
+	}
+}
+
+func TestExpiredTransactions(t *testing.T) {
+	s, dir := startTestServer(t, nil)
+	lines := strings.Split(rawRequest(t, s, testAdminKey, "begin", "d1\n", nil), "\n")
+	if lines[0] != "SUCCESS" {
+		t.Fatalf("got %q", lines)
+	}
+	id := lines[1]
+	if response := rawRequest(t, s, testAdminKey, "stagewrite", id+"\nfile\n", []byte("data")); !strings.HasPrefix(response, "SUCCESS") {
+		t.Fatalf("got %q", response)
+	}
+	staging := filepath.Join(dir, "d1", stagingPrefix+id)
+	if _, err := os.Stat(staging); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions are kept until they expire.
+	s.discardExpiredTransactions()
+	txn, err := s.transactions.get(id, testAdminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.lock.Lock()
+	txn.created = time.Now().Add(-DefaultTransactionTimeout - time.Minute)
+	txn.lock.Unlock()
+
+	// Expired transactions are discarded along with their staged files.
+	s.discardExpiredTransactions()
+	if _, err := s.transactions.get(id, testAdminKey); err == nil {
+		t.Fatal("expired transaction kept")
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Fatalf("staging directory kept: %v", err)
+	}
+	if response := rawRequest(t, s, testAdminKey, "commit", id+"\n", nil); !strings.Contains(response, "unknown transaction") {
+		t.Fatalf("committed an expired transaction: %q", response)
+	}
+}